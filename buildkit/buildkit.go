@@ -2,12 +2,14 @@ package buildkit
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +26,7 @@ import (
 	"github.com/containerd/containerd/metadata"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/overlay"
 	"github.com/containerd/containerd/sys"
@@ -37,29 +40,28 @@ import (
 	registryremotecache "github.com/moby/buildkit/cache/remotecache/registry"
 	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/client/llb"
-	"github.com/moby/buildkit/cmd/buildkitd/config"
 	"github.com/moby/buildkit/control"
 	"github.com/moby/buildkit/executor"
-	"github.com/moby/buildkit/executor/oci"
 	"github.com/moby/buildkit/exporter"
 	"github.com/moby/buildkit/frontend"
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
-	"github.com/moby/buildkit/session/auth/authprovider"
 	"github.com/moby/buildkit/session/sshforward/sshprovider"
 	"github.com/moby/buildkit/snapshot"
 	bkSnapshot "github.com/moby/buildkit/snapshot/containerd"
 	"github.com/moby/buildkit/solver/bboltcachestorage"
+	"github.com/moby/buildkit/source/git"
+	"github.com/moby/buildkit/util/entitlements"
 	"github.com/moby/buildkit/util/leaseutil"
-	"github.com/moby/buildkit/util/progress/progressui"
-	"github.com/moby/buildkit/util/resolver"
 	"github.com/moby/buildkit/util/winlayers"
 	"github.com/moby/buildkit/worker"
 	"github.com/moby/buildkit/worker/base"
 	"github.com/moby/buildkit/worker/runc"
+	"github.com/opencontainers/go-digest"
 	imageSpec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sipsma/bincastle/ctr"
+	"github.com/sipsma/bincastle/graph"
 	"github.com/sipsma/bincastle/util"
 	"go.etcd.io/bbolt"
 	"golang.org/x/sync/errgroup"
@@ -67,8 +69,6 @@ import (
 )
 
 const (
-	gcKeepStorage int64 = 20e9 // ~20GB
-
 	etcHostsContent = `127.0.0.1 localhost
 ::1 localhost ip6-localhost ip6-loopback
 ff02::1 ip6-allnodes
@@ -76,19 +76,13 @@ ff02::2 ip6-allrouters
 `
 )
 
+// Paths of the daemon's state and socket inside the system container, where
+// they are backed by dirs in the configurable state root on the host.
 const (
-	// TODO don't hardcode
-	Root   = "/var/lib/buildkitd"
-	socket = "/var/bincastle.sock"
-)
-
-var (
-	insecure   = true
-	resolverFn = resolver.NewRegistryConfig(map[string]config.RegistryConfig{
-		"docker.io": {
-			Insecure: &insecure, // TODO getting unknown CA errors without this, need better fix
-		},
-	})
+	Root     = "/var/lib/buildkitd"
+	SockPath = "/var/bincastle.sock"
+	// LockPath is held by the daemon while it's running
+	LockPath = Root + "/buildkitd.lock"
 )
 
 type BincastleArgs struct {
@@ -97,7 +91,13 @@ type BincastleArgs struct {
 	SourceLocalDir string
 	SourceSubdir   string
 	SourcerName    string
-	LocalOverrides []string
+	Overrides      []graph.NamedOverride
+	// SysrootImage is the ref of the image definitions are bootstrapped
+	// from, graph.DefaultSysrootImage if empty
+	SysrootImage string
+	// UpdateLock re-resolves every source of the definition, rewriting its
+	// lock file first if the definition is in a local dir
+	UpdateLock bool
 
 	LLB *llb.Definition
 
@@ -106,48 +106,142 @@ type BincastleArgs struct {
 	ExportLocalDir   string
 	ExportImageRef   string
 	SSHAgentSockPath string
+	// Registries are used for the credentials of registries with an auth
+	// config, others use the docker config
+	Registries RegistryConfigs
 
 	BincastleSockPath string
+	ExecName          string
 	Verbose           bool
+	// Progress is how build progress is shown, one of ProgressAuto,
+	// ProgressPlain or ProgressJSON
+	Progress string
+	// EventLog is a file that BuildEvents are appended to as json lines
+	EventLog string
+	// NoTTY runs the exec with plain pipes for stdio instead of a tty
+	NoTTY bool
+	// Mounts are host mounts for the exec in addition to those of the
+	// system's definition, HostMountPaths is where each host path is
+	// available to the daemon
+	Mounts         []graph.HostMount
+	HostMountPaths map[string]string
+	// WritableRunMounts lets the RunMounts of the system's definition be
+	// writable when they ask to be, they're always read-only otherwise
+	WritableRunMounts bool
+	// ExecArgs, ExecWorkdir and ExecEnv override the args, working dir and
+	// env the system runs with by default
+	ExecArgs    []string
+	ExecWorkdir string
+	ExecEnv     []string
+	// ExecChain is the exec chain of the system the client is running in,
+	// if any, ClientIODir is a dir of fifos in the daemon's filesystem the
+	// exec should use for its stdio instead of the daemon's
+	ExecChain   string
+	ClientIODir string
 }
 
-func BincastleBuild(ctx context.Context, args BincastleArgs) error {
-	c, err := client.New(ctx, fmt.Sprintf(`unix://%s`, args.BincastleSockPath))
-	if err != nil {
-		return errors.Wrapf(err, "failed to create client")
+// MissingMountsError is returned when the system's definition mounts host
+// paths that aren't available to the daemon.
+type MissingMountsError struct {
+	Mounts []graph.HostMount
+}
+
+func (e *MissingMountsError) Error() string {
+	var sources []string
+	for _, m := range e.Mounts {
+		sources = append(sources, m.Source)
 	}
+	return fmt.Sprintf("host paths are not mounted into the system: %s",
+		strings.Join(sources, ", "))
+}
 
-	attachable := []session.Attachable{authprovider.NewDockerAuthProvider(os.Stderr)}
+// BuildSummary lists the names of the layers solved during a build, split by
+// whether they were actually built or loaded from cache.
+type BuildSummary struct {
+	Built  []string
+	Cached []string
+
+	// completed are the vertices that completed, in the order they first did.
+	// Vertices solved again (i.e. as deps of later layers) report completing
+	// again, but only the first time reflects whether they were built.
+	completed []*client.Vertex
+	seen      map[digest.Digest]struct{}
+}
 
-	if args.SSHAgentSockPath != "" {
-		sshProvider, err := sshprovider.NewSSHAgentProvider([]sshprovider.AgentConfig{{
-			ID:    "git",
-			Paths: []string{args.SSHAgentSockPath},
-		}})
-		if err != nil {
-			return errors.Wrap(err, "failed to create ssh provider")
+func (s *BuildSummary) record(status *client.SolveStatus) {
+	if s.seen == nil {
+		s.seen = make(map[digest.Digest]struct{})
+	}
+	for _, v := range status.Vertexes {
+		if v.Completed == nil || v.Error != "" {
+			continue
 		}
-		attachable = append(attachable, sshProvider)
+		if _, ok := s.seen[v.Digest]; ok {
+			continue
+		}
+		s.seen[v.Digest] = struct{}{}
+		s.completed = append(s.completed, v)
 	}
+}
 
-	localDirs := make(map[string]string)
-	if args.SourceLocalDir != "" {
-		localDirs[args.SourceLocalDir] = args.SourceLocalDir
+// summarize fills in Built and Cached with the completed vertices that are
+// layers, given the names of layers by the digest of their vertex.
+func (s *BuildSummary) summarize(layerNames map[digest.Digest]string) {
+	for _, v := range s.completed {
+		name, ok := layerNames[v.Digest]
+		if !ok {
+			continue
+		}
+		if v.Cached {
+			s.Cached = append(s.Cached, name)
+		} else {
+			s.Built = append(s.Built, name)
+		}
+	}
+}
+
+func BincastleBuild(ctx context.Context, args BincastleArgs) error {
+	return bincastleBuild(ctx, args, nil)
+}
+
+// BincastleBuildOnly solves every layer of the system's definition without
+// running it.
+func BincastleBuildOnly(ctx context.Context, args BincastleArgs) (*BuildSummary, error) {
+	summary := &BuildSummary{}
+	if err := bincastleBuild(ctx, args, summary); err != nil {
+		return summary, err
 	}
-	for _, kv := range args.LocalOverrides {
-		path := strings.SplitN(kv, "=", 2)[1]
-		localDirs[path] = path
+	return summary, nil
+}
+
+// bincastleBuild builds and runs the system unless summary is non-nil, in
+// which case the system is only built and the summary filled in.
+func bincastleBuild(ctx context.Context, args BincastleArgs, summary *BuildSummary) error {
+	// only the lock of a definition in a local dir can be rewritten, ones
+	// from a git url are evaluated without their lock instead
+	if args.UpdateLock && args.SourceLocalDir != "" {
+		if _, _, err := WriteLock(ctx, args, true); err != nil {
+			return err
+		}
 	}
 
-	var cacheImport []client.CacheOptionsEntry
-	if args.ImportCacheRef != "" {
-		cacheImport = []client.CacheOptionsEntry{{
-			Type: "registry",
-			Attrs: map[string]string{
-				"ref": args.ImportCacheRef,
-			},
-		}}
+	c, err := client.New(ctx, fmt.Sprintf(`unix://%s`, args.BincastleSockPath))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create client")
+	}
+
+	attachable, err := sessionAttachables(args)
+	if err != nil {
+		return err
+	}
+	localDirs := sourceLocalDirs(args)
+
+	eventLog, closeEventLog, err := openEventLog(args)
+	if err != nil {
+		return fmt.Errorf("failed to open event log: %w", err)
 	}
+	defer closeEventLog()
+	cacheImport := cacheImports(args)
 
 	runType := Exec
 
@@ -187,6 +281,10 @@ func BincastleBuild(ctx context.Context, args BincastleArgs) error {
 		})
 	}
 
+	if summary != nil && runType == Exec {
+		runType = BuildOnly
+	}
+
 	var frontend string
 	frontendAttrs := make(map[string]string)
 	buildID := identity.NewID()
@@ -196,76 +294,319 @@ func BincastleBuild(ctx context.Context, args BincastleArgs) error {
 		if realRunType == Exec {
 			realRunType = PreBuild
 		}
-		frontendAttrs = map[string]string{
-			KeyGitURL:         args.SourceGitURL,
-			KeyGitRef:         args.SourceGitRef,
-			KeyLocalDir:       args.SourceLocalDir,
-			KeySubdir:         args.SourceSubdir,
-			KeySourcerName:    args.SourcerName,
-			KeyRunType:        string(realRunType),
-			KeyLocalOverrides: strings.Join(args.LocalOverrides, ":"),
-			KeyImageRef:       args.ExportImageRef,
-			KeyBuildID:        buildID,
+		frontendAttrs, err = sourceAttrs(args)
+		if err != nil {
+			return err
+		}
+		frontendAttrs[KeyRunType] = string(realRunType)
+		frontendAttrs[KeyImageRef] = args.ExportImageRef
+		frontendAttrs[KeyBuildID] = buildID
+		frontendAttrs[KeyExecName] = args.ExecName
+		if args.NoTTY {
+			frontendAttrs[KeyNoTTY] = "true"
+		}
+		if args.ExecChain != "" {
+			frontendAttrs[KeyExecChain] = args.ExecChain
+		}
+		if args.ClientIODir != "" {
+			frontendAttrs[KeyClientIODir] = args.ClientIODir
+		}
+		if len(args.ExecArgs) > 0 {
+			execArgs, err := json.Marshal(args.ExecArgs)
+			if err != nil {
+				return fmt.Errorf("failed to marshal exec args: %w", err)
+			}
+			frontendAttrs[KeyExecArgs] = string(execArgs)
+		}
+		if args.ExecWorkdir != "" {
+			frontendAttrs[KeyExecWorkdir] = args.ExecWorkdir
+		}
+		if len(args.ExecEnv) > 0 {
+			execEnv, err := json.Marshal(args.ExecEnv)
+			if err != nil {
+				return fmt.Errorf("failed to marshal exec env: %w", err)
+			}
+			frontendAttrs[KeyExecEnv] = string(execEnv)
+		}
+		if len(args.Mounts) > 0 {
+			mounts, err := json.Marshal(args.Mounts)
+			if err != nil {
+				return fmt.Errorf("failed to marshal mounts: %w", err)
+			}
+			frontendAttrs[KeyMounts] = string(mounts)
+		}
+		if len(args.HostMountPaths) > 0 {
+			hostMountPaths, err := json.Marshal(args.HostMountPaths)
+			if err != nil {
+				return fmt.Errorf("failed to marshal host mount paths: %w", err)
+			}
+			frontendAttrs[KeyHostMountPaths] = string(hostMountPaths)
+		}
+		if args.WritableRunMounts {
+			frontendAttrs[KeyWritableMounts] = "true"
 		}
 	}
 
 	solveOpt := client.SolveOpt{
-		Frontend:      frontend,
-		FrontendAttrs: frontendAttrs,
-		Exports:       exports,
-		CacheExports:  cacheExport,
-		CacheImports:  cacheImport,
-		Session:       attachable,
-		LocalDirs:     localDirs,
+		Frontend:            frontend,
+		FrontendAttrs:       frontendAttrs,
+		Exports:             exports,
+		CacheExports:        cacheExport,
+		CacheImports:        cacheImport,
+		Session:             attachable,
+		LocalDirs:           localDirs,
+		AllowedEntitlements: allowedEntitlements,
 	}
 
+	statusCh := make(chan *client.SolveStatus)
 	displayCh := make(chan *client.SolveStatus)
 	eg, egctx := errgroup.WithContext(ctx)
 	displayCtx, displayCancel := context.WithCancel(context.Background())
 
+	var mounts []graph.HostMount
+	var layerNames map[digest.Digest]string
 	eg.Go(func() error {
 		defer displayCancel()
-		_, err := c.Solve(egctx, args.LLB, solveOpt, displayCh)
-		return err
+		resp, err := solveSharingLocalRepos(egctx, c, args.LLB, &solveOpt, statusCh)
+		if err != nil {
+			return err
+		}
+		if v, ok := resp.ExporterResponse[mountsResponseKey]; ok {
+			if err := json.Unmarshal([]byte(v), &mounts); err != nil {
+				return fmt.Errorf("invalid mounts %q: %w", v, err)
+			}
+		}
+		if v, ok := resp.ExporterResponse[layersResponseKey]; ok {
+			if err := json.Unmarshal([]byte(v), &layerNames); err != nil {
+				return fmt.Errorf("invalid layer names %q: %w", v, err)
+			}
+		}
+		return nil
+	})
+
+	eg.Go(func() error {
+		defer close(displayCh)
+		for status := range statusCh {
+			if summary != nil {
+				summary.record(status)
+			}
+			select {
+			case displayCh <- status:
+			case <-displayCtx.Done():
+			}
+		}
+		return nil
 	})
 
 	eg.Go(func() error {
 		var cons console.Console
 		if !args.Verbose {
-			var err error
-			cons, err = console.ConsoleFromFile(os.Stdin)
-			if err != nil {
-				return err
-			}
+			// fallback to plain output when there's no tty (i.e. in CI)
+			cons, _ = console.ConsoleFromFile(os.Stdin)
 		}
-		return progressui.DisplaySolveStatus(displayCtx, "", cons, os.Stderr, displayCh)
+		return displayProgress(displayCtx, args, cons, eventLog, displayCh)
 	})
 
-	if err := eg.Wait(); err != nil && err != context.Canceled {
+	err = eg.Wait()
+	if summary != nil {
+		summary.summarize(layerNames)
+	}
+	if err != nil && err != context.Canceled {
 		return err
 	}
 
 	if runType != Exec {
 		return nil
 	}
+
+	var missingMounts []graph.HostMount
+	for _, m := range mounts {
+		if _, ok := args.HostMountPaths[m.Source]; !ok {
+			missingMounts = append(missingMounts, m)
+		}
+	}
+	if len(missingMounts) > 0 {
+		return &MissingMountsError{Mounts: missingMounts}
+	}
 	solveOpt.FrontendAttrs[KeyRunType] = string(runType)
 
 	displayCh = make(chan *client.SolveStatus)
 	eg, egctx = errgroup.WithContext(ctx)
 
+	var exitCode int
 	eg.Go(func() error {
-		_, err := c.Solve(egctx, args.LLB, solveOpt, displayCh)
+		resp, err := c.Solve(egctx, args.LLB, solveOpt, displayCh)
+		if err != nil {
+			return err
+		}
+		if v, ok := resp.ExporterResponse[exitCodeResponseKey]; ok {
+			if exitCode, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("invalid exit code %q: %w", v, err)
+			}
+		}
+		return nil
+	})
+
+	eg.Go(func() error {
+		return displayProgress(egctx, args, nil, eventLog, displayCh)
+	})
+
+	if err := eg.Wait(); err != nil {
 		return err
+	}
+	if exitCode != 0 {
+		return ctr.ExitError{ExitCode: exitCode}
+	}
+	return nil
+}
+
+// DescribeGraph evaluates the system's definition and returns a description
+// of its graph without building any of it.
+func DescribeGraph(ctx context.Context, args BincastleArgs) (*graph.Description, error) {
+	out, err := evaluateDefinition(ctx, args, Describe, nil, describeResponseKey)
+	if err != nil {
+		return nil, err
+	}
+	var desc graph.Description
+	if err := json.Unmarshal(out, &desc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal graph description: %w", err)
+	}
+	return &desc, nil
+}
+
+// evaluateDefinition solves a RunType that only evaluates the system's
+// definition, returning the response the frontend sets at responseKey.
+func evaluateDefinition(
+	ctx context.Context, args BincastleArgs, runType RunType, attrs map[string]string, responseKey string,
+) ([]byte, error) {
+	c, err := client.New(ctx, fmt.Sprintf(`unix://%s`, args.BincastleSockPath))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create client")
+	}
+	defer c.Close()
+
+	attachable, err := sessionAttachables(args)
+	if err != nil {
+		return nil, err
+	}
+
+	eventLog, closeEventLog, err := openEventLog(args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %w", err)
+	}
+	defer closeEventLog()
+
+	frontendAttrs, err := sourceAttrs(args)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range attrs {
+		frontendAttrs[k] = v
+	}
+	frontendAttrs[KeyRunType] = string(runType)
+
+	solveOpt := client.SolveOpt{
+		Frontend:            "bincastle",
+		FrontendAttrs:       frontendAttrs,
+		CacheImports:        cacheImports(args),
+		Session:             attachable,
+		LocalDirs:           sourceLocalDirs(args),
+		AllowedEntitlements: allowedEntitlements,
+	}
+
+	statusCh := make(chan *client.SolveStatus)
+	eg, egctx := errgroup.WithContext(ctx)
+
+	var out []byte
+	eg.Go(func() error {
+		resp, err := solveSharingLocalRepos(egctx, c, nil, &solveOpt, statusCh)
+		if err != nil {
+			return err
+		}
+		out = []byte(resp.ExporterResponse[responseKey])
+		return nil
 	})
 
 	eg.Go(func() error {
-		return progressui.DisplaySolveStatus(egctx, "", nil, os.Stderr, displayCh)
+		return displayProgress(egctx, args, nil, eventLog, statusCh)
 	})
 
-	return eg.Wait()
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func sessionAttachables(args BincastleArgs) ([]session.Attachable, error) {
+	attachable := []session.Attachable{newRegistryAuthProvider(args.Registries)}
+
+	if args.SSHAgentSockPath != "" {
+		sshProvider, err := sshprovider.NewSSHAgentProvider([]sshprovider.AgentConfig{{
+			ID:    graph.SSHForwardID,
+			Paths: []string{args.SSHAgentSockPath},
+		}})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create ssh provider")
+		}
+		attachable = append(attachable, sshProvider)
+	}
+	return attachable, nil
+}
+
+// sourceAttrs returns the frontend attrs that say where the system's
+// definition comes from.
+func sourceAttrs(args BincastleArgs) (map[string]string, error) {
+	attrs := map[string]string{
+		KeyGitURL:      args.SourceGitURL,
+		KeyGitRef:      args.SourceGitRef,
+		KeyLocalDir:    args.SourceLocalDir,
+		KeySubdir:      args.SourceSubdir,
+		KeySourcerName: args.SourcerName,
+	}
+	if args.SysrootImage != "" {
+		attrs[KeySysrootImage] = args.SysrootImage
+	}
+	if args.UpdateLock && args.SourceLocalDir == "" {
+		attrs[KeyUpdateLock] = "true"
+	}
+	if len(args.Overrides) > 0 {
+		overrides, err := json.Marshal(args.Overrides)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal overrides: %w", err)
+		}
+		attrs[KeyOverrides] = string(overrides)
+	}
+	return attrs, nil
+}
+
+// sourceLocalDirs returns the local dirs the definition's source and local
+// overrides are read from.
+func sourceLocalDirs(args BincastleArgs) map[string]string {
+	localDirs := make(map[string]string)
+	if args.SourceLocalDir != "" {
+		localDirs[args.SourceLocalDir] = args.SourceLocalDir
+	}
+	for _, o := range args.Overrides {
+		localDirs[o.Path] = o.Path
+	}
+	return localDirs
+}
+
+func cacheImports(args BincastleArgs) []client.CacheOptionsEntry {
+	if args.ImportCacheRef == "" {
+		return nil
+	}
+	return []client.CacheOptionsEntry{{
+		Type: "registry",
+		Attrs: map[string]string{
+			"ref": args.ImportCacheRef,
+		},
+	}}
 }
 
-func Buildkitd(mountBackend ctr.MountBackend) (func(context.Context) error, error) {
+func Buildkitd(
+	mountBackend ctr.MountBackend, gcConfig GCConfig, registries RegistryConfigs, network NetworkConfig,
+) (func(context.Context) error, error) {
 	if err := os.MkdirAll(Root, 0700); err != nil {
 		return nil, err
 	}
@@ -281,7 +622,7 @@ func Buildkitd(mountBackend ctr.MountBackend) (func(context.Context) error, erro
 		return nil, err
 	}
 
-	lockPath := filepath.Join(Root, "buildkitd.lock")
+	lockPath := LockPath
 	lock := flock.New(lockPath)
 	locked, err := lock.TryLock()
 	if err != nil {
@@ -301,7 +642,7 @@ func Buildkitd(mountBackend ctr.MountBackend) (func(context.Context) error, erro
 
 	uid := 0
 	gid := 0
-	listener, err := sys.GetLocalListener(socket, uid, gid)
+	listener, err := sys.GetLocalListener(SockPath, uid, gid)
 	if err != nil {
 		err = errors.Wrap(err, "failed to create listener")
 		return nil, err
@@ -309,7 +650,7 @@ func Buildkitd(mountBackend ctr.MountBackend) (func(context.Context) error, erro
 
 	// TODO call cleanup in all error cases
 	// TODO get rid of workerBackend?
-	controller, cleanup, _, err := newController(mountBackend)
+	controller, cleanup, _, err := newController(mountBackend, gcConfig, registries, network)
 	if err != nil {
 		err = errors.Wrap(err, "failed to create controller")
 		return nil, err
@@ -334,29 +675,32 @@ func Buildkitd(mountBackend ctr.MountBackend) (func(context.Context) error, erro
 	}, nil
 }
 
-func newController(mountBackend ctr.MountBackend) (*control.Controller, func() error, *workerBackend, error) {
+func newController(
+	mountBackend ctr.MountBackend, gcConfig GCConfig, registries RegistryConfigs, network NetworkConfig,
+) (*control.Controller, func() error, *workerBackend, error) {
 	sessionManager, err := session.NewManager()
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	wc, cleanup, workerBackend, err := newWorkerController(mountBackend, sessionManager)
+	registryHosts := registries.hosts()
+	wc, cleanup, workerBackend, err := newWorkerController(mountBackend, gcConfig, registryHosts, network, sessionManager)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
 	frontends := map[string]frontend.Frontend{
-		"bincastle": newBincastleFrontend(workerBackend.CacheManager, workerBackend.MetadataStore, workerBackend.Applier, workerBackend.ImageExporter, workerBackend.LeaseManager),
+		"bincastle": newBincastleFrontend(workerBackend.CacheManager, workerBackend.MetadataStore, workerBackend.Applier, workerBackend.ImageExporter, workerBackend.LeaseManager, workerBackend.ContentStore, workerBackend.ImageStore),
 	}
 
 	remoteCacheExporterFuncs := map[string]remotecache.ResolveCacheExporterFunc{
-		"registry": registryremotecache.ResolveCacheExporterFunc(sessionManager, resolverFn),
+		"registry": registryremotecache.ResolveCacheExporterFunc(sessionManager, registryHosts),
 		"local":    localremotecache.ResolveCacheExporterFunc(sessionManager),
 		"inline":   inlineremotecache.ResolveCacheExporterFunc(),
 	}
 
 	remoteCacheImporterFuncs := map[string]remotecache.ResolveCacheImporterFunc{
-		"registry": registryremotecache.ResolveCacheImporterFunc(sessionManager, workerBackend.ContentStore, resolverFn),
+		"registry": registryremotecache.ResolveCacheImporterFunc(sessionManager, workerBackend.ContentStore, registryHosts),
 		"local":    localremotecache.ResolveCacheImporterFunc(sessionManager),
 	}
 
@@ -372,6 +716,7 @@ func newController(mountBackend ctr.MountBackend) (*control.Controller, func() e
 		ResolveCacheExporterFuncs: remoteCacheExporterFuncs,
 		ResolveCacheImporterFuncs: remoteCacheImporterFuncs,
 		CacheKeyStorage:           cacheStorage,
+		Entitlements:              []string{string(entitlements.EntitlementNetworkHost)},
 	})
 	if err != nil {
 		return nil, nil, nil, err
@@ -380,10 +725,13 @@ func newController(mountBackend ctr.MountBackend) (*control.Controller, func() e
 	return ctrler, cleanup, workerBackend, nil
 }
 
-func newWorkerController(mountBackend ctr.MountBackend, sm *session.Manager) (*worker.Controller, func() error, *workerBackend, error) {
+func newWorkerController(
+	mountBackend ctr.MountBackend, gcConfig GCConfig, registryHosts docker.RegistryHosts, network NetworkConfig,
+	sm *session.Manager,
+) (*worker.Controller, func() error, *workerBackend, error) {
 	wc := &worker.Controller{}
 
-	workers, cleanup, workerBackend, err := RuncWorkers(Root, gcKeepStorage, mountBackend, sm)
+	workers, cleanup, workerBackend, err := RuncWorkers(Root, gcConfig, mountBackend, registryHosts, network, sm)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -398,10 +746,17 @@ func newWorkerController(mountBackend ctr.MountBackend, sm *session.Manager) (*w
 	return wc, cleanup, workerBackend, nil
 }
 
+// ExecStateRoot is the dir under which the worker's executor keeps the
+// state dirs of the containers it runs.
+func ExecStateRoot() ctr.ContainerStateRoot {
+	return ctr.ContainerStateRoot(filepath.Join(Root, "runc-overlayfs", "execs"))
+}
+
 func RuncWorkers(
-	root string, gcKeepStorage int64, mountBackend ctr.MountBackend, sm *session.Manager,
+	root string, gcConfig GCConfig, mountBackend ctr.MountBackend, registryHosts docker.RegistryHosts,
+	network NetworkConfig, sm *session.Manager,
 ) ([]worker.Worker, func() error, *workerBackend, error) {
-	w, cleanup, workerBackend, err := runcWorker(root, gcKeepStorage, mountBackend, sm)
+	w, cleanup, workerBackend, err := runcWorker(root, gcConfig, mountBackend, registryHosts, network, sm)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -409,7 +764,8 @@ func RuncWorkers(
 }
 
 func runcWorker(
-	root string, gcKeepStorage int64, mountBackend ctr.MountBackend, sm *session.Manager,
+	root string, gcConfig GCConfig, mountBackend ctr.MountBackend, registryHosts docker.RegistryHosts,
+	network NetworkConfig, sm *session.Manager,
 ) (worker.Worker, func() error, *workerBackend, error) {
 	snapshotterName := "overlayfs"
 	name := fmt.Sprintf("runc-%s", snapshotterName)
@@ -472,13 +828,7 @@ func runcWorker(
 
 	leaseManager := leaseutil.WithNamespace(metadata.NewLeaseManager(metaDB), "buildkit")
 
-	dnsConfig := &oci.DNSConfig{
-		Nameservers:   []string{"1.1.1.1", "8.8.8.8"},
-		Options:       nil,
-		SearchDomains: []string{"localdomain"},
-	}
-
-	newExecutor, err := newRuncExecutor(root, dnsConfig, mountBackend)
+	newExecutor, err := newRuncExecutor(root, network, mountBackend)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -498,7 +848,7 @@ func runcWorker(
 		Platforms:       []imageSpec.Platform{platforms.Normalize(platforms.DefaultSpec())},
 		IdentityMapping: nil,
 		LeaseManager:    leaseManager,
-		RegistryHosts:   resolverFn,
+		RegistryHosts:   registryHosts,
 		GarbageCollect: func(ctx context.Context) (gc.Stats, error) {
 			l, err := leaseManager.Create(ctx)
 			if err != nil {
@@ -506,21 +856,24 @@ func runcWorker(
 			}
 			return nil, leaseManager.Delete(ctx, leases.Lease{ID: l.ID}, leases.SynchronousDelete)
 		},
+		GCPolicy: gcConfig.policy(root),
 	}
 
-	for _, rule := range config.DefaultGCPolicy(root, gcKeepStorage) {
-		opt.GCPolicy = append(opt.GCPolicy, client.PruneInfo{
-			Filter:       rule.Filters,
-			All:          rule.All,
-			KeepBytes:    rule.KeepBytes,
-			KeepDuration: time.Duration(rule.KeepDuration) * time.Second,
-		})
+	baseWorker, err := base.NewWorker(opt)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-
-	w, err := base.NewWorker(opt)
+	// git is exported to the system only after the daemon starts, so its
+	// source is registered even if git couldn't be found yet
+	gitSource, err := git.NewSource(git.Opt{
+		CacheAccessor: baseWorker.CacheMgr,
+		MetadataStore: bkMetaDB,
+	})
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	baseWorker.SourceManager.Register(gitSource)
+	w := &execProtectingWorker{Worker: baseWorker, metadataStore: bkMetaDB}
 
 	imageExporter, err := w.Exporter(client.ExporterImage, sm)
 	if err != nil {
@@ -564,6 +917,7 @@ type runcExecutor struct {
 	execCond     *sync.Cond
 	shutdown     bool
 	mountBackend ctr.MountBackend
+	network      NetworkConfig
 }
 
 func (e *runcExecutor) resolvConfPath() string {
@@ -585,7 +939,7 @@ type Executor interface {
 
 func newRuncExecutor(
 	stateRootDir string,
-	dnsConfig *oci.DNSConfig,
+	network NetworkConfig,
 	mountBackend ctr.MountBackend,
 ) (Executor, error) {
 	var execMu sync.Mutex
@@ -593,15 +947,15 @@ func newRuncExecutor(
 		stateRootDir: stateRootDir,
 		execCond:     sync.NewCond(&execMu),
 		mountBackend: mountBackend,
+		network:      network,
 	}
 
-	// TODO handle options
-	var resolvConfLines []string
-	for _, nameserver := range dnsConfig.Nameservers {
-		resolvConfLines = append(resolvConfLines, fmt.Sprintf("nameserver %s", nameserver))
+	resolvConf, err := network.resolvConf()
+	if err != nil {
+		return nil, err
 	}
 
-	err := os.MkdirAll(filepath.Dir(newExecutor.resolvConfPath()), 0700)
+	err = os.MkdirAll(filepath.Dir(newExecutor.resolvConfPath()), 0700)
 	if err != nil {
 		return nil, err
 	}
@@ -609,7 +963,7 @@ func newRuncExecutor(
 	// TODO handle cleanup?
 	err = ioutil.WriteFile(
 		newExecutor.resolvConfPath(),
-		[]byte(strings.Join(resolvConfLines, "\n")),
+		resolvConf,
 		0700)
 	if err != nil {
 		return nil, err
@@ -633,8 +987,79 @@ func (e *runcExecutor) Shutdown() {
 	return
 }
 
-func (e *runcExecutor) Exec(context.Context, string, executor.ProcessInfo) error {
-	panic("exec is not implemented yet")
+func (e *runcExecutor) Exec(ctx context.Context, id string, process executor.ProcessInfo) error {
+	meta := process.Meta
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	e.execCond.L.Lock()
+	if e.shutdown {
+		e.execCond.L.Unlock()
+		return fmt.Errorf("cannot exec after executor shutdown")
+	}
+	e.execCount++
+	e.execCond.L.Unlock()
+	defer func() {
+		e.execCond.L.Lock()
+		defer e.execCond.L.Unlock()
+		e.execCount--
+		e.execCond.Broadcast()
+	}()
+
+	container, err := ctr.ContainerStateRoot(e.execsDir()).ContainerState(id).Load()
+	if err != nil {
+		return err
+	}
+
+	proc, err := container.Exec(ctr.ContainerProc{
+		Args:         meta.Args,
+		Env:          meta.Env,
+		WorkingDir:   meta.Cwd,
+		Capabilities: &ctr.AllCaps, // TODO don't hardcode
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for winSize := range process.Resize {
+			if err := proc.Resize(console.WinSize{
+				Height: uint16(winSize.Rows),
+				Width:  uint16(winSize.Cols),
+			}); err != nil {
+				fmt.Printf("console resize failed: %v\n", err)
+			}
+		}
+	}()
+
+	ioctx, iocancel := context.WithCancel(context.Background())
+	goCount := 2
+	errCh := make(chan error, goCount)
+
+	go func() {
+		defer cancel()
+		defer iocancel()
+		errCh <- proc.Wait(ctx).Err
+	}()
+
+	go func() {
+		defer cancel()
+		attachErr := proc.Attach(ioctx, process.Stdin, process.Stdout)
+		if attachErr == context.Canceled {
+			attachErr = nil
+		}
+		if attachErr != nil {
+			attachErr = fmt.Errorf("error during exec io attach: %w", attachErr)
+		}
+		errCh <- attachErr
+	}()
+
+	var finalErr error
+	for i := 0; i < goCount; i++ {
+		finalErr = multierror.Append(finalErr, <-errCh).ErrorOrNil()
+	}
+	return finalErr
 }
 
 func ExecNameToID(execName string) string {
@@ -649,6 +1074,16 @@ func IDToExecName(id string) (string, error) {
 	return execName, nil
 }
 
+// hostMount is the source of an exec mount that binds a path from the system
+// container (where the host's paths are mounted) into a bincastle exec.
+type hostMount struct {
+	path string
+}
+
+func (m hostMount) Mount(ctx context.Context, readonly bool) (snapshot.Mountable, error) {
+	return nil, fmt.Errorf("host mount %s can only be used by bincastle execs", m.path)
+}
+
 func (e *runcExecutor) Run(
 	ctx context.Context,
 	id string,
@@ -730,6 +1165,17 @@ func (e *runcExecutor) Run(
 
 	ctrMounts := ctr.Mounts(nil)
 	for _, execMount := range execMounts {
+		if m, ok := execMount.Src.(hostMount); ok {
+			// read-only binds of paths that aren't on a read-only fs rely
+			// on the fuse-overlayfs workaround in the mount backend
+			ctrMounts = ctrMounts.With(ctr.BindMount{
+				Source:    m.path,
+				Dest:      execMount.Dest,
+				Recursive: true,
+				Readonly:  execMount.Readonly,
+			})
+			continue
+		}
 		snapshotMountable, err := execMount.Src.Mount(ctx, execMount.Readonly)
 		if err != nil {
 			return err
@@ -797,13 +1243,15 @@ func (e *runcExecutor) Run(
 		},
 		ctr.BindMount{
 			Dest:   "/bincastle.sock",
-			Source: socket,
+			Source: SockPath,
 		},
 	)
 
 	meta.Env = append(meta.Env, "BINCASTLE_SOCK=/bincastle.sock")
 
-	if sshAgentSock := os.Getenv("SSH_AUTH_SOCK"); sshAgentSock != "" {
+	// build steps only get an agent through the ssh forwarding of layers
+	// that ask for it, the agent of the daemon (if any) is just for execs
+	if sshAgentSock := os.Getenv("SSH_AUTH_SOCK"); sshAgentSock != "" && persist {
 		ctrMounts = ctrMounts.With(ctr.BindMount{
 			Dest:   "/run/ssh-agent.sock",
 			Source: sshAgentSock,
@@ -825,6 +1273,11 @@ func (e *runcExecutor) Run(
 		MountBackend: e.mountBackend,
 		UpperDir:     rootUpperDir,
 		Persist:      persist,
+		// build steps get a tty when the daemon has one to size it from,
+		// bincastle execs are sized by the clients attaching to them
+		NoTTY: !meta.Tty && (persist || !ctr.StdinIsTerminal()),
+		// bincastle execs always share the host's network
+		NetworkNamespace: !persist && e.network.isolateNetwork(meta.NetMode),
 	})
 	if err != nil {
 		return err
@@ -835,10 +1288,12 @@ func (e *runcExecutor) Run(
 
 	go func() {
 		for winSize := range process.Resize {
-			container.Resize(console.WinSize{
+			if err := container.Resize(console.WinSize{
 				Height: uint16(winSize.Rows),
 				Width:  uint16(winSize.Cols),
-			})
+			}); err != nil {
+				fmt.Printf("console resize failed: %v\n", err)
+			}
 		}
 	}()
 
@@ -861,7 +1316,7 @@ func (e *runcExecutor) Run(
 
 	go func() {
 		defer cancel()
-		attachErr := container.Attach(ioctx, stdin, stdout)
+		attachErr := container.AttachStreams(ioctx, stdin, stdout, process.Stderr)
 		if attachErr == context.Canceled {
 			attachErr = nil
 		}
@@ -875,5 +1330,8 @@ func (e *runcExecutor) Run(
 	for i := 0; i < goCount; i++ {
 		finalErr = multierror.Append(finalErr, <-errCh).ErrorOrNil()
 	}
+	if exitCode, ok := ctr.ExitCode(finalErr); ok {
+		return &executor.ExitError{ExitCode: uint32(exitCode), Err: finalErr}
+	}
 	return finalErr
 }
@@ -0,0 +1,208 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/progress/progressui"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// ProgressAuto shows progress on a tty if there is one, plain text
+	// otherwise
+	ProgressAuto = "auto"
+	// ProgressPlain shows the full output of every build as plain text
+	ProgressPlain = "plain"
+	// ProgressJSON writes a BuildEvent per line instead of showing progress
+	ProgressJSON = "json"
+)
+
+// BuildEvent is a change in the state of a vertex (a layer or one of the
+// steps needed to build it) or a line of its log.
+type BuildEvent struct {
+	Type      string        `json:"type"` // "vertex" or "log"
+	Time      time.Time     `json:"time"`
+	Digest    digest.Digest `json:"digest"`
+	Name      string        `json:"name"`
+	Cached    bool          `json:"cached,omitempty"`
+	Started   *time.Time    `json:"started,omitempty"`
+	Completed *time.Time    `json:"completed,omitempty"`
+	// Duration is the time between Started and Completed in seconds
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Log      string  `json:"log,omitempty"`
+	Stream   int     `json:"stream,omitempty"`
+}
+
+// vertexState is what has to change for a vertex to get a new event, as
+// buildkit resends vertexes whenever their progress updates.
+type vertexState struct {
+	started   bool
+	completed bool
+	cached    bool
+	err       string
+}
+
+type logKey struct {
+	vertex digest.Digest
+	stream int
+}
+
+// eventWriter writes the events of solve statuses as json lines. Logs are
+// split into lines, partial lines are held until the rest arrives or the
+// vertex completes.
+type eventWriter struct {
+	enc     *json.Encoder
+	names   map[digest.Digest]string
+	states  map[digest.Digest]vertexState
+	partial map[logKey]string
+}
+
+func newEventWriter(w io.Writer) *eventWriter {
+	return &eventWriter{
+		enc:     json.NewEncoder(w),
+		names:   make(map[digest.Digest]string),
+		states:  make(map[digest.Digest]vertexState),
+		partial: make(map[logKey]string),
+	}
+}
+
+func (ew *eventWriter) write(status *client.SolveStatus) error {
+	for _, v := range status.Vertexes {
+		ew.names[v.Digest] = v.Name
+	}
+
+	for _, l := range status.Logs {
+		key := logKey{vertex: l.Vertex, stream: l.Stream}
+		lines := strings.Split(ew.partial[key]+string(l.Data), "\n")
+		ew.partial[key] = lines[len(lines)-1]
+		for _, line := range lines[:len(lines)-1] {
+			if err := ew.writeLog(key, l.Timestamp, line); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, v := range status.Vertexes {
+		if v.Completed != nil {
+			for _, stream := range []int{1, 2} {
+				key := logKey{vertex: v.Digest, stream: stream}
+				if line := ew.partial[key]; line != "" {
+					if err := ew.writeLog(key, *v.Completed, line); err != nil {
+						return err
+					}
+				}
+				delete(ew.partial, key)
+			}
+		}
+
+		state := vertexState{
+			started:   v.Started != nil,
+			completed: v.Completed != nil,
+			cached:    v.Cached,
+			err:       v.Error,
+		}
+		if prev, ok := ew.states[v.Digest]; ok && prev == state {
+			continue
+		}
+		ew.states[v.Digest] = state
+
+		event := BuildEvent{
+			Type:      "vertex",
+			Time:      time.Now(),
+			Digest:    v.Digest,
+			Name:      v.Name,
+			Cached:    v.Cached,
+			Started:   v.Started,
+			Completed: v.Completed,
+			Error:     v.Error,
+		}
+		if v.Started != nil && v.Completed != nil {
+			event.Duration = v.Completed.Sub(*v.Started).Seconds()
+		}
+		if err := ew.enc.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ew *eventWriter) writeLog(key logKey, ts time.Time, line string) error {
+	return ew.enc.Encode(BuildEvent{
+		Type:   "log",
+		Time:   ts,
+		Digest: key.vertex,
+		Name:   ew.names[key.vertex],
+		Log:    line,
+		Stream: key.stream,
+	})
+}
+
+// displayProgress shows the statuses read from ch as configured by args,
+// also writing them to eventLog if it's non-nil. cons is the console to show
+// progress on, if any.
+func displayProgress(
+	ctx context.Context, args BincastleArgs, cons console.Console, eventLog *eventWriter, ch chan *client.SolveStatus,
+) error {
+	if args.Progress == ProgressPlain || args.Verbose {
+		cons = nil
+	}
+	if eventLog == nil && args.Progress != ProgressJSON {
+		return progressui.DisplaySolveStatus(ctx, "", cons, os.Stderr, ch)
+	}
+
+	var stderrEvents *eventWriter
+	var displayCh chan *client.SolveStatus
+	displayErrCh := make(chan error, 1)
+	if args.Progress == ProgressJSON {
+		stderrEvents = newEventWriter(os.Stderr)
+		displayErrCh <- nil
+	} else {
+		displayCh = make(chan *client.SolveStatus)
+		go func() {
+			displayErrCh <- progressui.DisplaySolveStatus(ctx, "", cons, os.Stderr, displayCh)
+		}()
+	}
+
+	var writeErr error
+	for status := range ch {
+		for _, ew := range []*eventWriter{eventLog, stderrEvents} {
+			if ew != nil && writeErr == nil {
+				writeErr = ew.write(status)
+			}
+		}
+		if displayCh != nil {
+			select {
+			case displayCh <- status:
+			case <-ctx.Done():
+			}
+		}
+	}
+	if displayCh != nil {
+		close(displayCh)
+	}
+	if err := <-displayErrCh; err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// openEventLog opens the event log set in args for appending, returning nil
+// if none is set.
+func openEventLog(args BincastleArgs) (*eventWriter, func() error, error) {
+	if args.EventLog == "" {
+		return nil, func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(args.EventLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newEventWriter(f), f.Close, nil
+}
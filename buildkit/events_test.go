@@ -0,0 +1,73 @@
+package buildkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func readEvents(t *testing.T, buf *bytes.Buffer) []BuildEvent {
+	var events []BuildEvent
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var event BuildEvent
+		require.NoError(t, dec.Decode(&event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestEventWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ew := newEventWriter(buf)
+	dgst := digest.FromString("vertex")
+	started := time.Now()
+	completed := started.Add(time.Second)
+
+	running := &client.Vertex{Digest: dgst, Name: "libc", Started: &started}
+	require.NoError(t, ew.write(&client.SolveStatus{
+		Vertexes: []*client.Vertex{running},
+		Logs: []*client.VertexLog{
+			{Vertex: dgst, Stream: 1, Data: []byte("one\ntw")},
+			{Vertex: dgst, Stream: 2, Data: []byte("err")},
+		},
+	}))
+	// an unchanged vertex is resent along with its logs
+	require.NoError(t, ew.write(&client.SolveStatus{
+		Vertexes: []*client.Vertex{running},
+		Logs: []*client.VertexLog{
+			{Vertex: dgst, Stream: 1, Data: []byte("o\nthr")},
+			{Vertex: dgst, Stream: 1, Data: []byte("ee")},
+		},
+	}))
+	done := &client.Vertex{Digest: dgst, Name: "libc", Started: &started, Completed: &completed}
+	require.NoError(t, ew.write(&client.SolveStatus{Vertexes: []*client.Vertex{done}}))
+	require.NoError(t, ew.write(&client.SolveStatus{Vertexes: []*client.Vertex{done}}))
+
+	type summary struct {
+		Type      string
+		Log       string
+		Stream    int
+		Completed bool
+	}
+	var got []summary
+	for _, event := range readEvents(t, buf) {
+		require.Equal(t, dgst, event.Digest)
+		require.Equal(t, "libc", event.Name)
+		got = append(got, summary{event.Type, event.Log, event.Stream, event.Completed != nil})
+	}
+	require.Equal(t, []summary{
+		{Type: "log", Log: "one", Stream: 1},
+		{Type: "vertex"},
+		{Type: "log", Log: "two", Stream: 1},
+		// partial lines are flushed when the vertex completes
+		{Type: "log", Log: "three", Stream: 1},
+		{Type: "log", Log: "err", Stream: 2},
+		{Type: "vertex", Completed: true},
+	}, got)
+}
@@ -0,0 +1,291 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/cache/metadata"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/frontend"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	execNameKey     = "bincastle.ExecName"
+	execIndexPrefix = "bincastle-exec:"
+
+	// frontend metadata keys are passed back to the client in the
+	// solve response's ExporterResponse
+	execsResponseKey    = "frontend.bincastle.execs"
+	exitCodeResponseKey = "frontend.bincastle.exitcode"
+	mountsResponseKey   = "frontend.bincastle.mounts"
+	describeResponseKey = "frontend.bincastle.describe"
+	lockResponseKey     = "frontend.bincastle.lock"
+	layersResponseKey   = "frontend.bincastle.layers"
+	// localReposResponseKey is set instead of a result when the client
+	// needs to share more local repos for the solve
+	localReposResponseKey = "frontend.bincastle.local-repos"
+)
+
+func execIndex(execName string) string {
+	return execIndexPrefix + execName
+}
+
+// ExecInfo describes the persistent state of a named exec.
+type ExecInfo struct {
+	Name       string     `json:"name"`
+	ID         string     `json:"id"`
+	Size       int64      `json:"size"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	Running    bool       `json:"running"`
+	// Console is set for running execs that use the system's own console,
+	// which is what attach connects to
+	Console bool `json:"console,omitempty"`
+}
+
+// ListExecs returns the persistent execs known to the bincastle daemon
+// listening at sockPath.
+func ListExecs(ctx context.Context, sockPath string) ([]ExecInfo, error) {
+	resp, err := execStateSolve(ctx, sockPath, ExecList, "")
+	if err != nil {
+		return nil, err
+	}
+	var execs []ExecInfo
+	if err := json.Unmarshal([]byte(resp.ExporterResponse[execsResponseKey]), &execs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal exec list: %w", err)
+	}
+	return execs, nil
+}
+
+// RemoveExec deletes all the persistent state of the exec with the given
+// name. It fails if the exec is currently running.
+func RemoveExec(ctx context.Context, sockPath string, execName string) error {
+	_, err := execStateSolve(ctx, sockPath, ExecRemove, execName)
+	return err
+}
+
+func execStateSolve(ctx context.Context, sockPath string, runType RunType, execName string) (*client.SolveResponse, error) {
+	c, err := client.New(ctx, fmt.Sprintf(`unix://%s`, sockPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	defer c.Close()
+
+	return c.Solve(ctx, nil, client.SolveOpt{
+		Frontend: "bincastle",
+		FrontendAttrs: map[string]string{
+			KeyRunType:  string(runType),
+			KeyExecName: execName,
+		},
+	}, nil)
+}
+
+// newExecRef creates the ref holding the persistent state of a new exec,
+// indexed by the exec's name so later execs of the same name reuse it.
+func (f *BincastleFrontend) newExecRef(ctx context.Context, execName string) (cache.MutableRef, error) {
+	ref, err := f.cacheManager.New(ctx, nil, cache.CachePolicyRetain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new ref for exec %s: %w", execName, err)
+	}
+
+	// TODO ensure that the ref gets deleted if there's an error before the bincastle-exec index is set?
+	v, err := metadata.NewValue(execName)
+	if err != nil {
+		ref.Release(context.TODO())
+		return nil, fmt.Errorf("failed to create new metadata value for exec %s: %w", execName, err)
+	}
+	v.Index = execIndex(execName)
+	si := ref.Metadata()
+	if err := si.Update(func(b *bolt.Bucket) error {
+		return si.SetValue(b, execNameKey, v)
+	}); err != nil {
+		ref.Release(context.TODO())
+		return nil, fmt.Errorf("failed to update ref with exec name index %s: %w", execName, err)
+	}
+
+	if immutable, err := ref.Commit(ctx); err != nil {
+		ref.Release(context.TODO())
+		return nil, fmt.Errorf("failed to commit new mutable ref for exec %s: %w", execName, err)
+	} else if err := immutable.Release(ctx); err != nil {
+		ref.Release(context.TODO())
+		return nil, fmt.Errorf("failed to release immutable ref for exec %s: %w", execName, err)
+	}
+	return ref, nil
+}
+
+// activeExec tracks the running execs of a name, which all have to be in the
+// same chain as they share the same upperdir.
+type activeExec struct {
+	chain string
+	count int
+}
+
+func (f *BincastleFrontend) setExecActive(execName string, chainID string, active bool) error {
+	f.activeExecsMu.Lock()
+	defer f.activeExecsMu.Unlock()
+	cur, ok := f.activeExecs[execName]
+	if active {
+		if _, removing := f.removingExecs[execName]; removing {
+			return fmt.Errorf("system %s is being removed", execName)
+		}
+		if ok && cur.chain != chainID {
+			return fmt.Errorf("system %s is already running for another client", execName)
+		}
+		f.activeExecs[execName] = activeExec{chain: chainID, count: cur.count + 1}
+		return nil
+	}
+	if !ok || cur.chain != chainID {
+		return fmt.Errorf("system %s is not running for this client", execName)
+	}
+	if cur.count--; cur.count <= 0 {
+		delete(f.activeExecs, execName)
+	} else {
+		f.activeExecs[execName] = cur
+	}
+	return nil
+}
+
+func (f *BincastleFrontend) isExecActive(execName string) bool {
+	f.activeExecsMu.Lock()
+	defer f.activeExecsMu.Unlock()
+	return f.activeExecs[execName].count > 0
+}
+
+// isConsoleExec returns whether the exec is running in the chain that uses
+// the daemon's own tty.
+func (f *BincastleFrontend) isConsoleExec(execName string) bool {
+	f.activeExecsMu.Lock()
+	cur := f.activeExecs[execName]
+	f.activeExecsMu.Unlock()
+	if cur.count == 0 {
+		return false
+	}
+
+	f.chainsMu.Lock()
+	defer f.chainsMu.Unlock()
+	return f.consoleChain != "" && cur.chain == f.consoleChain
+}
+
+func (f *BincastleFrontend) listExecs(ctx context.Context) (*frontend.Result, error) {
+	items, err := f.metadataStore.All()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata store: %w", err)
+	}
+
+	usage, err := f.cacheManager.DiskUsage(ctx, client.DiskUsageInfo{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get disk usage: %w", err)
+	}
+	usageByID := make(map[string]*client.UsageInfo)
+	for _, u := range usage {
+		usageByID[u.ID] = u
+	}
+
+	execs := []ExecInfo{}
+	for _, item := range items {
+		v := item.Get(execNameKey)
+		if v == nil {
+			continue
+		}
+		var execName string
+		if err := v.Unmarshal(&execName); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal exec name of %s: %w", item.ID(), err)
+		}
+		info := ExecInfo{
+			Name:    execName,
+			ID:      item.ID(),
+			Running: f.isExecActive(execName),
+			Console: f.isConsoleExec(execName),
+		}
+		if u, ok := usageByID[item.ID()]; ok {
+			info.Size = u.Size
+			info.CreatedAt = u.CreatedAt
+			info.LastUsedAt = u.LastUsedAt
+		}
+		execs = append(execs, info)
+	}
+
+	bytes, err := json.Marshal(execs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal exec list: %w", err)
+	}
+	return &frontend.Result{Metadata: map[string][]byte{
+		execsResponseKey: bytes,
+	}}, nil
+}
+
+// markExecRemoving fails if the exec is running and otherwise keeps it from
+// being started until the returned func is called.
+func (f *BincastleFrontend) markExecRemoving(execName string) (func(), error) {
+	f.activeExecsMu.Lock()
+	defer f.activeExecsMu.Unlock()
+	if f.activeExecs[execName].count > 0 {
+		return nil, fmt.Errorf("cannot remove exec %s while it is running", execName)
+	}
+	if _, ok := f.removingExecs[execName]; ok {
+		return nil, fmt.Errorf("exec %s is already being removed", execName)
+	}
+	f.removingExecs[execName] = struct{}{}
+	return func() {
+		f.activeExecsMu.Lock()
+		defer f.activeExecsMu.Unlock()
+		delete(f.removingExecs, execName)
+	}, nil
+}
+
+func (f *BincastleFrontend) removeExec(ctx context.Context, execName string) error {
+	done, err := f.markExecRemoving(execName)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	items, err := f.metadataStore.Search(execIndex(execName))
+	if err != nil {
+		return fmt.Errorf("error during search for exec %s: %w", execName, err)
+	}
+
+	ctrState := ExecStateRoot().ContainerState(ExecNameToID(execName))
+	if len(items) == 0 {
+		if _, err := os.Stat(string(ctrState)); os.IsNotExist(err) {
+			return fmt.Errorf("unknown exec %s", execName)
+		}
+	}
+
+	for _, item := range items {
+		pruneCh := make(chan client.UsageInfo)
+		go func() {
+			for range pruneCh {
+			}
+		}()
+		err := f.cacheManager.Prune(ctx, pruneCh, client.PruneInfo{
+			All:    true,
+			Filter: []string{"id==" + item.ID()},
+		})
+		close(pruneCh)
+		if err != nil {
+			return fmt.Errorf("failed to remove ref for exec %s: %w", execName, err)
+		}
+	}
+
+	// make sure the index is gone even if the ref was already missing
+	if items, err := f.metadataStore.Search(execIndex(execName)); err != nil {
+		return fmt.Errorf("error during search for exec %s: %w", execName, err)
+	} else {
+		for _, item := range items {
+			if err := f.metadataStore.Clear(item.ID()); err != nil {
+				return fmt.Errorf("failed to clear metadata for exec %s: %w", execName, err)
+			}
+		}
+	}
+
+	if err := ctrState.Remove(); err != nil {
+		return fmt.Errorf("failed to remove container state of exec %s: %w", execName, err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moby/buildkit/cache/metadata"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/worker"
+	"github.com/sipsma/bincastle/ctr"
+	"github.com/stretchr/testify/require"
+)
+
+func testFrontend(t *testing.T) *BincastleFrontend {
+	dir, err := ioutil.TempDir("", "bincastle-frontend")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := metadata.NewStore(filepath.Join(dir, "metadata.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return &BincastleFrontend{
+		metadataStore: store,
+		activeExecs:   make(map[string]activeExec),
+		removingExecs: make(map[string]struct{}),
+		chains:        make(map[string]*execChain),
+	}
+}
+
+// workerFrontend returns a frontend backed by a worker with its own cache in
+// a temp dir, skipping the test if the worker can't be created here.
+func workerFrontend(t *testing.T) (*BincastleFrontend, worker.Worker) {
+	dir, err := ioutil.TempDir("", "bincastle-worker")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sm, err := session.NewManager()
+	require.NoError(t, err)
+	w, cleanup, backend, err := runcWorker(dir, DefaultGCConfig, ctr.NoOverlayfsBackend{}, nil, NetworkConfig{}, sm)
+	if err != nil {
+		t.Skipf("can't create a worker here: %v", err)
+	}
+	t.Cleanup(func() { cleanup() })
+	f := newBincastleFrontend(backend.CacheManager, backend.MetadataStore, backend.Applier,
+		backend.ImageExporter, backend.LeaseManager, backend.ContentStore, backend.ImageStore)
+	return f, w
+}
+
+// addExec creates the persistent state of an exec like running it does.
+func addExec(t *testing.T, f *BincastleFrontend, execName string) {
+	ref, err := f.newExecRef(context.TODO(), execName)
+	require.NoError(t, err)
+	require.NoError(t, ref.Release(context.TODO()))
+}
+
+func listExecs(t *testing.T, f *BincastleFrontend) map[string]bool {
+	res, err := f.listExecs(context.TODO())
+	require.NoError(t, err)
+	var execs []ExecInfo
+	require.NoError(t, json.Unmarshal(res.Metadata[execsResponseKey], &execs))
+	running := make(map[string]bool)
+	for _, exec := range execs {
+		require.NotEmpty(t, exec.ID)
+		require.False(t, exec.CreatedAt.IsZero(), exec.Name)
+		running[exec.Name] = exec.Running
+	}
+	return running
+}
+
+func TestListAndRemoveExecs(t *testing.T) {
+	f, _ := workerFrontend(t)
+	require.Empty(t, listExecs(t, f))
+
+	addExec(t, f, "home")
+	addExec(t, f, "dev")
+	require.NoError(t, f.setExecActive("dev", "a", true))
+	require.Equal(t, map[string]bool{"home": false, "dev": true}, listExecs(t, f))
+
+	require.NoError(t, f.removeExec(context.TODO(), "home"))
+	require.Equal(t, map[string]bool{"dev": true}, listExecs(t, f))
+	items, err := f.metadataStore.Search(execIndex("home"))
+	require.NoError(t, err)
+	require.Empty(t, items)
+	// it's gone, so removing it again fails
+	require.Error(t, f.removeExec(context.TODO(), "home"))
+
+	require.Error(t, f.removeExec(context.TODO(), "dev"))
+	require.NoError(t, f.setExecActive("dev", "a", false))
+	require.NoError(t, f.removeExec(context.TODO(), "dev"))
+	require.Empty(t, listExecs(t, f))
+}
+
+func TestSetExecActive(t *testing.T) {
+	type call struct {
+		name   string
+		chain  string
+		active bool
+		err    bool
+	}
+	for _, tc := range []struct {
+		name    string
+		calls   []call
+		running map[string]int
+	}{{
+		name: "start and stop",
+		calls: []call{
+			{name: "home", chain: "a", active: true},
+			{name: "home", chain: "a", active: false},
+		},
+	}, {
+		name: "nested in the same chain",
+		calls: []call{
+			{name: "home", chain: "a", active: true},
+			{name: "home", chain: "a", active: true},
+			{name: "home", chain: "a", active: false},
+		},
+		running: map[string]int{"home": 1},
+	}, {
+		name: "other chain",
+		calls: []call{
+			{name: "home", chain: "a", active: true},
+			{name: "home", chain: "b", active: true, err: true},
+			{name: "other", chain: "b", active: true},
+		},
+		running: map[string]int{"home": 1, "other": 1},
+	}, {
+		name: "stop not running",
+		calls: []call{
+			{name: "home", chain: "a", active: false, err: true},
+		},
+	}, {
+		name: "stop from other chain",
+		calls: []call{
+			{name: "home", chain: "a", active: true},
+			{name: "home", chain: "b", active: false, err: true},
+		},
+		running: map[string]int{"home": 1},
+	}, {
+		name: "stop more than started",
+		calls: []call{
+			{name: "home", chain: "a", active: true},
+			{name: "home", chain: "a", active: false},
+			{name: "home", chain: "a", active: false, err: true},
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := testFrontend(t)
+			for i, c := range tc.calls {
+				err := f.setExecActive(c.name, c.chain, c.active)
+				if c.err {
+					require.Error(t, err, "call %d", i)
+				} else {
+					require.NoError(t, err, "call %d", i)
+				}
+			}
+			running := make(map[string]int)
+			for name, cur := range f.activeExecs {
+				running[name] = cur.count
+			}
+			if tc.running == nil {
+				tc.running = map[string]int{}
+			}
+			require.Equal(t, tc.running, running)
+		})
+	}
+}
+
+func TestMarkExecRemoving(t *testing.T) {
+	f := testFrontend(t)
+	require.NoError(t, f.setExecActive("running", "a", true))
+	_, err := f.markExecRemoving("running")
+	require.Error(t, err)
+
+	done, err := f.markExecRemoving("home")
+	require.NoError(t, err)
+	// it can't be removed twice or started while it's being removed
+	_, err = f.markExecRemoving("home")
+	require.Error(t, err)
+	require.Error(t, f.setExecActive("home", "a", true))
+
+	done()
+	require.NoError(t, f.setExecActive("home", "a", true))
+}
+
+func TestRemoveExecErrors(t *testing.T) {
+	f := testFrontend(t)
+	err := f.removeExec(context.TODO(), "missing")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown exec missing")
+
+	require.NoError(t, f.setExecActive("home", "a", true))
+	err = f.removeExec(context.TODO(), "home")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "while it is running")
+}
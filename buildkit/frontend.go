@@ -2,17 +2,25 @@ package buildkit
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/leases"
+	"github.com/containerd/fifo"
 	"github.com/moby/buildkit/cache"
 	"github.com/moby/buildkit/cache/metadata"
 	"github.com/moby/buildkit/client/llb"
@@ -24,7 +32,7 @@ import (
 	"github.com/moby/buildkit/util/compression"
 	"github.com/moby/buildkit/util/leaseutil"
 	"github.com/moby/buildkit/worker"
-	bolt "go.etcd.io/bbolt"
+	"github.com/opencontainers/go-digest"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/sipsma/bincastle/ctr"
@@ -41,29 +49,58 @@ const (
 	KeySubdir         = "subdir"
 	KeySourcerName    = "sourcer-name"
 	KeyRunType        = "runtype"
-	KeyLocalOverrides = "local-overrides"
+	KeyOverrides      = "overrides"
 	KeyImageRef       = "image-ref"
 	KeyBuildID        = "build-id"
+	KeyExecName       = "exec-name"
+	KeyFilters        = "filters"
+	KeyNoTTY          = "no-tty"
+	KeyExecArgs       = "exec-args"
+	KeyExecWorkdir    = "exec-workdir"
+	KeyExecEnv        = "exec-env"
+	KeyMounts         = "mounts"
+	KeyHostMountPaths = "host-mount-paths"
+	KeyWritableMounts = "writable-run-mounts"
+	KeyExecChain      = "exec-chain"
+	KeyClientIODir    = "client-io-dir"
+	KeySysrootImage   = "sysroot-image"
+	KeyImportFile     = "import-file"
+	KeyUpdateLock     = "update-lock"
+	KeyLocalDirs      = "local-dirs"
 )
 
+// ExecChainEnv is set in execs to the id of their chain, clients running
+// inside an exec pass it along so the execs they start join the same chain.
+const ExecChainEnv = "BINCASTLE_EXEC_CHAIN"
+
 const (
-	defaultGitRef = "master"
+	defaultGitRef   = "master"
+	defaultExecName = "home"
 )
 
+var execNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
 type DefinitionSourcer interface {
 	DefinitionSource(llbsrc AsSpec, cmdPath string) (*Graph, *executor.Meta, error)
 }
 
-var definitionSourcers = map[string]DefinitionSourcer{
+var definitionSourcers = map[string]func(a *args) DefinitionSourcer{
 	// only option right now is golang-based definitions
-	"": golangDefinitionSourcer{},
+	"": func(a *args) DefinitionSourcer {
+		return golangDefinitionSourcer{sysrootImage: a.SysrootImage}
+	},
 }
 
-type golangDefinitionSourcer struct{}
+// definitionLockPath is where the definition's lock file is when it's run.
+const definitionLockPath = "/" + graph.LockFileName
+
+type golangDefinitionSourcer struct {
+	sysrootImage string
+}
 
 func (s golangDefinitionSourcer) DefinitionSource(llbsrc AsSpec, cmdPath string) (*Graph, *executor.Meta, error) {
 	return Build(LayerSpec(
-			Dep(Wrap(Image{Ref: "docker.io/eriksipsma/bincastle-sysroot:latest"}, AppendOutputDir("/sysroot"))),
+			Dep(Wrap(Image{Ref: s.sysrootImage}, AppendOutputDir("/sysroot"))),
 			BuildDep(Wrap(llbsrc, MountDir("/llbsrc"))),
 			Env("PATH", "/tools/bin:/tools/sbin:/go/bin"),
 			Env("SSL_CERT_DIR", "/tools/etc/pki/tls/certs"),
@@ -72,10 +109,13 @@ func (s golangDefinitionSourcer) DefinitionSource(llbsrc AsSpec, cmdPath string)
 			BuildScratch(`/build`),
 			BuildScript(
 				fmt.Sprintf(`cd %s`, filepath.Join(`/llbsrc`, cmdPath)),
+				fmt.Sprintf(`if [ -f %s ]; then cp %s %s; fi`, LockFileName, LockFileName, definitionLockPath),
 				// TODO better way of getting static bin?
 				`go build -a -tags "netgo osusergo" -ldflags '-w -extldflags "-static"' -o /llbgen .`,
 			),
 			AlwaysRun(true),
+			// go build downloads the definition's modules
+			NetworkAccess(true),
 		)), &executor.Meta{
 			Args:           []string{"/llbgen"},
 			Cwd:            "/",
@@ -90,10 +130,27 @@ type args struct {
 	Subdir         string
 	Sourcer        DefinitionSourcer
 	RunType        RunType
-	LocalOverrides []string
+	Overrides      []graph.NamedOverride
 	CacheImports   []frontend.CacheOptionsEntry
 	ImageRef       string
 	BuildID        string
+	ExecName       string
+	Filters        []string
+	NoTTY          bool
+	ExecArgs       []string
+	ExecWorkdir    string
+	ExecEnv        []string
+	Mounts         []graph.HostMount
+	HostMountPaths map[string]string
+	// WritableMounts lets the definition's RunMounts be writable, they are
+	// read-only otherwise
+	WritableMounts bool
+	ExecChain      string
+	ClientIODir    string
+	SysrootImage   string
+	ImportFile     string
+	UpdateLock     bool
+	LocalDirs      []string
 }
 
 // TODO this is pretty dumb, it should be removed once there's an official merge-op (which
@@ -107,26 +164,110 @@ const (
 	LocalExport RunType = "local-export"
 	ImageExport RunType = "image-export"
 	CacheExport RunType = "cache-export"
+	BuildOnly   RunType = "build-only"
+	ExecList    RunType = "exec-list"
+	ExecRemove  RunType = "exec-remove"
+	// Describe only evaluates the definition and returns a description of
+	// its graph
+	Describe RunType = "describe"
+	// ImageImport loads the images in an archive shared by the client into
+	// the daemon's image store
+	ImageImport RunType = "image-import"
+	// LockSources evaluates the definition and returns the lock of the
+	// sources it uses
+	LockSources RunType = "lock"
+	// TODO DiskUsageList should just be a call to the controller's DiskUsage
+	// once layer names are stored somewhere buildkit knows about
+	DiskUsageList RunType = "disk-usage"
 )
 
 func getargs(opts map[string]string) (*args, error) {
 	a := args{
-		GitURL:   opts[KeyGitURL],
-		GitRef:   opts[KeyGitRef],
-		LocalDir: opts[KeyLocalDir],
-		Subdir:   opts[KeySubdir],
-		RunType:  RunType(opts[KeyRunType]),
-		ImageRef: opts[KeyImageRef],
-		BuildID:  opts[KeyBuildID],
-	}
-	if sourcer, ok := definitionSourcers[opts[KeySourcerName]]; !ok {
+		GitURL:       opts[KeyGitURL],
+		GitRef:       opts[KeyGitRef],
+		LocalDir:     opts[KeyLocalDir],
+		Subdir:       opts[KeySubdir],
+		RunType:      RunType(opts[KeyRunType]),
+		ImageRef:     opts[KeyImageRef],
+		BuildID:      opts[KeyBuildID],
+		ExecName:     opts[KeyExecName],
+		NoTTY:        opts[KeyNoTTY] == "true",
+		ExecWorkdir:  opts[KeyExecWorkdir],
+		ExecChain:    opts[KeyExecChain],
+		ClientIODir:  opts[KeyClientIODir],
+		SysrootImage: opts[KeySysrootImage],
+		ImportFile:   opts[KeyImportFile],
+		UpdateLock:   opts[KeyUpdateLock] == "true",
+	}
+	if a.SysrootImage == "" {
+		a.SysrootImage = graph.DefaultSysrootImage
+	}
+	if newSourcer, ok := definitionSourcers[opts[KeySourcerName]]; !ok {
 		return nil, fmt.Errorf("unknown definition sourcer %q", opts[KeySourcerName])
 	} else {
-		a.Sourcer = sourcer
+		a.Sourcer = newSourcer(&a)
 	}
 
-	if overrides := opts[KeyLocalOverrides]; overrides != "" {
-		a.LocalOverrides = strings.Split(overrides, ":")
+	if a.ExecName == "" {
+		a.ExecName = defaultExecName
+	}
+	if !execNameRegexp.MatchString(a.ExecName) {
+		return nil, fmt.Errorf("invalid exec name %q", a.ExecName)
+	}
+
+	if overrides := opts[KeyOverrides]; overrides != "" {
+		if err := json.Unmarshal([]byte(overrides), &a.Overrides); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", KeyOverrides, err)
+		}
+	}
+
+	if filters := opts[KeyFilters]; filters != "" {
+		if err := json.Unmarshal([]byte(filters), &a.Filters); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", KeyFilters, err)
+		}
+	}
+
+	if execArgs := opts[KeyExecArgs]; execArgs != "" {
+		if err := json.Unmarshal([]byte(execArgs), &a.ExecArgs); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", KeyExecArgs, err)
+		}
+	}
+
+	if execEnv := opts[KeyExecEnv]; execEnv != "" {
+		if err := json.Unmarshal([]byte(execEnv), &a.ExecEnv); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", KeyExecEnv, err)
+		}
+	}
+
+	if mounts := opts[KeyMounts]; mounts != "" {
+		if err := json.Unmarshal([]byte(mounts), &a.Mounts); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", KeyMounts, err)
+		}
+	}
+
+	a.WritableMounts = opts[KeyWritableMounts] == "true"
+
+	if localDirs := opts[KeyLocalDirs]; localDirs != "" {
+		if err := json.Unmarshal([]byte(localDirs), &a.LocalDirs); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", KeyLocalDirs, err)
+		}
+	}
+
+	if hostMountPaths := opts[KeyHostMountPaths]; hostMountPaths != "" {
+		if err := json.Unmarshal([]byte(hostMountPaths), &a.HostMountPaths); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", KeyHostMountPaths, err)
+		}
+	}
+
+	switch a.RunType {
+	case ExecList, ExecRemove, DiskUsageList:
+		// these only operate on existing state, no definition is needed
+		return &a, nil
+	case ImageImport:
+		if a.LocalDir == "" {
+			return nil, fmt.Errorf("missing %s to import from", KeyLocalDir)
+		}
+		return &a, nil
 	}
 
 	if a.GitURL != "" && a.LocalDir != "" {
@@ -139,6 +280,8 @@ func getargs(opts map[string]string) (*args, error) {
 			KeyGitURL, KeyLocalDir)
 	}
 
+	// the ref is resolved to a commit when the definition's source is
+	// solved, so it's only fetched again once the ref moves
 	if a.GitURL != "" && a.GitRef == "" {
 		a.GitRef = defaultGitRef
 	}
@@ -171,10 +314,22 @@ type BincastleFrontend struct {
 	applier       diff.Applier
 	imageExporter exporter.Exporter
 	leaseManager  leases.Manager
-
-	startOnce  sync.Once
-	newSolveCh chan *solveReq
-	builds     map[string]*solveReq
+	contentStore  content.Store
+	imageStore    images.Store
+
+	buildsMu sync.Mutex
+	builds   map[string]*solveReq
+	terminal *terminal
+
+	chainsMu sync.Mutex
+	chains   map[string]*execChain
+	// consoleChain is the id of the chain using the daemon's own tty, if any
+	consoleChain string
+
+	activeExecsMu sync.Mutex
+	activeExecs   map[string]activeExec
+	// removingExecs can't be started while their state is being removed
+	removingExecs map[string]struct{}
 }
 
 type solveReq struct {
@@ -200,12 +355,26 @@ type solveResult struct {
 	err error
 }
 
+// execResult turns the exit status of an exec into a successful result
+// whose metadata has the exit code, so clients can exit with it too.
+func execResult(err error) *solveResult {
+	var exitErr *executor.ExitError
+	if !errors.As(err, &exitErr) {
+		return &solveResult{Result: &frontend.Result{}, err: err}
+	}
+	return &solveResult{Result: &frontend.Result{Metadata: map[string][]byte{
+		exitCodeResponseKey: []byte(strconv.Itoa(int(exitErr.ExitCode))),
+	}}}
+}
+
 func newBincastleFrontend(
 	cacheManager cache.Manager,
 	metadataStore *metadata.Store,
 	applier diff.Applier,
 	imageExporter exporter.Exporter,
 	leaseManager leases.Manager,
+	contentStore content.Store,
+	imageStore images.Store,
 ) *BincastleFrontend {
 	return &BincastleFrontend{
 		cacheManager:  cacheManager,
@@ -213,70 +382,47 @@ func newBincastleFrontend(
 		applier:       applier,
 		imageExporter: imageExporter,
 		leaseManager:  leaseManager,
+		contentStore:  contentStore,
+		imageStore:    imageStore,
 		builds:        make(map[string]*solveReq),
+		terminal:      newTerminal(os.Stdin, os.Stdout),
+		chains:        make(map[string]*execChain),
+		activeExecs:   make(map[string]activeExec),
+		removingExecs: make(map[string]struct{}),
 	}
 }
 
 func (f *BincastleFrontend) Solve(ctx context.Context, llbBridge frontend.FrontendLLBBridge, opt map[string]string, inputs map[string]*pb.Definition, sid string) (*frontend.Result, error) {
-	f.startOnce.Do(func() {
-		f.newSolveCh = make(chan *solveReq, 1)
-		go func() {
-			var execReqs []*solveReq
-			// For now, the first call to Exec is expected to be the one from
-			// an "outside" client, subsequent are from inside execs. TODO this
-			// won't apply when multiple "outside" clients are supported in future.
-			var origCtx context.Context
-			for req := range f.newSolveCh {
-				if origCtx == nil {
-					origCtx = req.ctx
-				}
-				solveCtx, solveCancel := context.WithCancel(origCtx)
-				done := make(chan *solveResult)
-				started := make(chan struct{})
-
-				go func() {
-					defer close(done)
-					err := f.exec(solveCtx, llbBridge, req.args, sid, req.layers, req.mounts, started)
-					done <- &solveResult{Result: &frontend.Result{}, err: err}
-				}()
-
-				select {
-				case res := <-done:
-					solveCancel()
-					req.resultCh <- res
-					if len(execReqs) > 0 {
-						lastIndex := len(execReqs) - 1
-						prevExec := execReqs[lastIndex]
-						prevExec.resultCh = execReqs[0].resultCh
-						select {
-						case f.newSolveCh <- prevExec:
-							execReqs = execReqs[:lastIndex]
-						default:
-						}
-					}
-				case newReq := <-f.newSolveCh:
-					solveCancel()
-					res := <-done
-					execReqs = append(execReqs, req)
-					if len(execReqs) > 1 {
-						req.resultCh <- res
-					}
-					select {
-					case f.newSolveCh <- newReq:
-					default:
-						// another request came along in the meantime; go with that instead
-						newReq.resultCh <- &solveResult{err: context.Canceled} // TODO use custom error
-					}
-				}
-			}
-		}()
-	})
+	res, err := f.solve(ctx, llbBridge, opt, sid)
+	// the client solves again once it shares the repos
+	var missingRepos *missingLocalReposError
+	if errors.As(err, &missingRepos) {
+		return missingRepos.result()
+	}
+	return res, err
+}
 
+func (f *BincastleFrontend) solve(ctx context.Context, llbBridge frontend.FrontendLLBBridge, opt map[string]string, sid string) (*frontend.Result, error) {
 	a, err := getargs(opt)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse frontend args: %w", err)
 	}
 
+	switch a.RunType {
+	case ExecList:
+		return f.listExecs(ctx)
+	case ExecRemove:
+		return &frontend.Result{}, f.removeExec(ctx, a.ExecName)
+	case DiskUsageList:
+		return f.diskUsage(ctx, a.Filters)
+	case Describe:
+		return f.describe(ctx, llbBridge, a, sid)
+	case ImageImport:
+		return f.importImages(ctx, llbBridge, a, sid)
+	case LockSources:
+		return f.lock(ctx, llbBridge, a, sid)
+	}
+
 	var req *solveReq
 	if a.RunType != Exec {
 		layers, mounts, cleanup, err := f.getLayers(ctx, llbBridge, a, sid)
@@ -291,45 +437,477 @@ func (f *BincastleFrontend) Solve(ctx context.Context, llbBridge frontend.Fronte
 			resultCh:    make(chan *solveResult, 1),
 			id:          a.BuildID,
 		}
-	} else if req = f.builds[a.BuildID]; req == nil {
+	} else if req = f.build(a.BuildID); req == nil {
 		return nil, fmt.Errorf("unknown build id %s", a.BuildID)
 	}
 	req.ctx = ctx
 
 	if a.RunType == PreBuild {
-		f.builds[req.id] = req
+		f.setBuild(req.id, req)
 	} else {
 		defer req.cleanup()
-		defer delete(f.builds, req.id)
+		defer f.setBuild(req.id, nil)
 	}
 
 	switch a.RunType {
 	case LocalExport:
 		return f.topLayerSolve(req.ctx, llbBridge, a, sid, req.layers)
-	case CacheExport, PreBuild:
+	case CacheExport:
 		return f.allLayerSolve(req.ctx, llbBridge, a, sid, req.layers)
+	case PreBuild:
+		res, err := f.allLayerSolve(req.ctx, llbBridge, a, sid, req.layers)
+		if err != nil {
+			return nil, err
+		}
+		// the client needs to know which host paths the exec will mount
+		// before it's run, as they may not be available to the daemon yet
+		mounts, err := json.Marshal(execMounts(req.layers, a.Mounts, a.WritableMounts))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal exec mounts: %w", err)
+		}
+		if res.Metadata == nil {
+			res.Metadata = make(map[string][]byte)
+		}
+		res.Metadata[mountsResponseKey] = mounts
+		return res, nil
+	case BuildOnly:
+		// getLayers already solved every layer, the client only needs to know
+		// which of the vertices it saw were layers
+		names, err := layerVertexNames(req.layers)
+		if err != nil {
+			return nil, err
+		}
+		namesJSON, err := json.Marshal(names)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal layer names: %w", err)
+		}
+		return &frontend.Result{
+			Metadata: map[string][]byte{layersResponseKey: namesJSON},
+		}, nil
 	case ImageExport:
 		err := f.imageExport(req.ctx, llbBridge, a, sid, req.mounts)
 		return &frontend.Result{}, err
 	case Exec:
-		f.newSolveCh <- req
-		result := <-req.resultCh
-		return result.Result, result.err
+		chain, err := f.execChain(llbBridge, a, sid)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case chain.newSolveCh <- req:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		select {
+		case result := <-req.resultCh:
+			return result.Result, result.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	default:
 		return nil, fmt.Errorf("unknown run type %v", a.RunType)
 	}
 }
 
+func (f *BincastleFrontend) build(id string) *solveReq {
+	f.buildsMu.Lock()
+	defer f.buildsMu.Unlock()
+	return f.builds[id]
+}
+
+// setBuild stores the prebuilt request for the later exec request with the
+// same id, or deletes it if req is nil.
+func (f *BincastleFrontend) setBuild(id string, req *solveReq) {
+	f.buildsMu.Lock()
+	defer f.buildsMu.Unlock()
+	if req == nil {
+		delete(f.builds, id)
+		return
+	}
+	f.builds[id] = req
+}
+
+// execChain is the stack of execs started by one outside client, including
+// the ones started by clients running inside those execs. Chains are
+// independent of each other; each has its own tty and result.
+type execChain struct {
+	id         string
+	newSolveCh chan *solveReq
+	terminal   *terminal
+	stdio      execStdio
+	closeIO    func()
+}
+
+// execStdio is the IO of execs that run without a tty.
+type execStdio struct {
+	stdin  io.ReadCloser
+	stdout io.WriteCloser
+	stderr io.WriteCloser
+}
+
+// execChain returns the chain an exec request belongs to. Requests from
+// clients inside an exec name the chain of that exec, requests from outside
+// clients start a new one.
+func (f *BincastleFrontend) execChain(llbBridge frontend.FrontendLLBBridge, a *args, sid string) (*execChain, error) {
+	f.chainsMu.Lock()
+	defer f.chainsMu.Unlock()
+
+	if a.ExecChain != "" {
+		chain, ok := f.chains[a.ExecChain]
+		if !ok {
+			return nil, fmt.Errorf("unknown exec chain %s", a.ExecChain)
+		}
+		return chain, nil
+	}
+
+	chain := &execChain{
+		id:         a.BuildID,
+		newSolveCh: make(chan *solveReq, 1),
+		closeIO:    func() {},
+	}
+	switch {
+	case a.ClientIODir != "":
+		ioDir := ctr.IODir(filepath.Clean(a.ClientIODir))
+		if a.NoTTY {
+			stdio, closeIO, err := openClientStdio(ioDir)
+			if err != nil {
+				return nil, err
+			}
+			chain.stdio, chain.closeIO = stdio, closeIO
+		} else {
+			term, closeIO, err := newClientTerminal(ioDir)
+			if err != nil {
+				return nil, err
+			}
+			chain.terminal, chain.closeIO = term, closeIO
+		}
+	case f.consoleChain != "":
+		return nil, fmt.Errorf("the system's tty is already in use, clients need their own io dir")
+	default:
+		// the client that started the system uses the daemon's own stdio
+		f.consoleChain = chain.id
+		chain.terminal = f.terminal
+		chain.stdio = execStdio{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+		chain.closeIO = func() {
+			f.chainsMu.Lock()
+			defer f.chainsMu.Unlock()
+			f.consoleChain = ""
+		}
+	}
+
+	f.chains[chain.id] = chain
+	go f.scheduleExecs(llbBridge, sid, chain)
+	return chain, nil
+}
+
+// openClientStdio opens the stdio fifos an outside client running without a
+// tty is attached to.
+func openClientStdio(ioDir ctr.IODir) (execStdio, func(), error) {
+	var closers []io.ReadWriteCloser
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	for _, f := range []struct {
+		path string
+		flag int
+	}{
+		{ioDir.StdinFifo(), syscall.O_RDONLY},
+		{ioDir.StdoutFifo(), syscall.O_WRONLY},
+		{ioDir.StderrFifo(), syscall.O_WRONLY},
+	} {
+		// nonblock means this doesn't wait for the client to open the other end
+		rwc, err := fifo.OpenFifo(context.TODO(), f.path, f.flag|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			closeAll()
+			return execStdio{}, nil, fmt.Errorf("failed to open client fifo %s: %w", f.path, err)
+		}
+		closers = append(closers, rwc)
+	}
+	return execStdio{
+		stdin:  closers[0],
+		stdout: closers[1],
+		stderr: closers[2],
+	}, closeAll, nil
+}
+
+type execEntry struct {
+	req       *solveReq
+	cancel    func()
+	running   bool
+	preempted bool
+	session   *termSession
+}
+
+type execFinished struct {
+	entry  *execEntry
+	result *solveResult
+}
+
+// scheduleExecs runs the execs of a chain. The execs form a stack where the
+// top one is in the foreground of the chain's terminal. Starting an exec with
+// the same name as one already running stops the running one (they can't
+// share the same upperdir), but it's resumed once everything above it in the
+// stack exits. Execs with different names keep running in the background.
+// The chain ends once its stack is empty.
+func (f *BincastleFrontend) scheduleExecs(llbBridge frontend.FrontendLLBBridge, sid string, chain *execChain) {
+	var stack []*execEntry
+	finishedCh := make(chan execFinished)
+
+	// The first request is the one from the outside client that started
+	// the chain, subsequent ones are from inside its execs.
+	var origCtx context.Context
+	var origResultCh chan *solveResult
+
+	end := func(result *solveResult) {
+		f.chainsMu.Lock()
+		delete(f.chains, chain.id)
+		f.chainsMu.Unlock()
+		chain.closeIO()
+		origResultCh <- result
+	}
+
+	start := func(e *execEntry) {
+		solveCtx, solveCancel := context.WithCancel(origCtx)
+		e.cancel = solveCancel
+		e.running = true
+		e.preempted = false
+		var session *termSession
+		if !e.req.args.NoTTY {
+			var err error
+			session, err = chain.terminal.session()
+			if err != nil {
+				go func() {
+					finishedCh <- execFinished{entry: e, result: &solveResult{
+						err: fmt.Errorf("failed to setup terminal: %w", err),
+					}}
+				}()
+				return
+			}
+		}
+		e.session = session
+		go func() {
+			var started chan struct{}
+			if session != nil {
+				started = make(chan struct{})
+				go func() {
+					select {
+					case <-started:
+						session.setForeground()
+					case <-solveCtx.Done():
+					}
+				}()
+			}
+			err := f.exec(solveCtx, llbBridge, e.req.args, sid, e.req.layers, e.req.mounts, chain, session, started)
+			if session != nil {
+				session.close()
+			}
+			finishedCh <- execFinished{entry: e, result: execResult(err)}
+		}()
+	}
+
+	// returns false once the chain has ended
+	handleFinished := func(fin execFinished) bool {
+		e := fin.entry
+		e.running = false
+		e.cancel()
+		if e.preempted {
+			// it stays in the stack and will be restarted when it's on top again
+			return true
+		}
+
+		index := -1
+		for i, other := range stack {
+			if other == e {
+				index = i
+			}
+		}
+		wasTop := index == len(stack)-1
+		stack = append(stack[:index], stack[index+1:]...)
+		if err := f.setExecActive(e.req.args.ExecName, chain.id, false); err != nil && fin.result.err == nil {
+			fin.result = &solveResult{Result: fin.result.Result, err: err}
+		}
+
+		if e.req.resultCh != origResultCh {
+			select {
+			case e.req.resultCh <- fin.result:
+			default:
+			}
+		}
+
+		if len(stack) == 0 {
+			end(fin.result)
+			return false
+		}
+		if wasTop {
+			top := stack[len(stack)-1]
+			if !top.running {
+				start(top)
+			} else if top.session != nil {
+				top.session.setForeground()
+			}
+		}
+		return true
+	}
+
+	for {
+		select {
+		case req := <-chain.newSolveCh:
+			if origCtx == nil {
+				origCtx = req.ctx
+				origResultCh = req.resultCh
+			}
+
+			if err := f.setExecActive(req.args.ExecName, chain.id, true); err != nil {
+				if len(stack) == 0 {
+					end(&solveResult{err: err})
+					return
+				}
+				req.resultCh <- &solveResult{err: err}
+				continue
+			}
+
+			for _, prev := range stack {
+				if prev.running && prev.req.args.ExecName == req.args.ExecName {
+					prev.preempted = true
+					prev.cancel()
+					for prev.running {
+						handleFinished(<-finishedCh)
+					}
+				}
+			}
+
+			e := &execEntry{req: req}
+			stack = append(stack, e)
+			start(e)
+		case fin := <-finishedCh:
+			if !handleFinished(fin) {
+				return
+			}
+		}
+	}
+}
+
 func (f *BincastleFrontend) getLayers(
 	ctx context.Context, llbBridge frontend.FrontendLLBBridge, a *args, sid string,
 ) ([]graph.MarshalLayer, []*executor.Mount, func(), error) {
+	out, err := f.runDefinitionSource(ctx, llbBridge, a, sid)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	layers, err := graph.UnmarshalLayers(out)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to unmarshal definition source output: %w", err)
+	}
+
+	if a.RunType != PreBuild && a.RunType != ImageExport && a.RunType != BuildOnly {
+		return layers, nil, nil, nil
+	}
+
+	defs := make([]*pb.Definition, len(layers))
+	for i, layer := range layers {
+		defs[i] = &pb.Definition{}
+		if err := defs[i].Unmarshal(layer.LLB); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to unmarshal layer: %w", err)
+		}
+	}
+	if err := missingLocalRepos(a.LocalDirs, defs...); err != nil {
+		return nil, nil, nil, err
+	}
+
+	eg, egctx := errgroup.WithContext(ctx)
+	mounts := make([]*executor.Mount, len(layers))
+	results := make([]*frontend.Result, len(layers))
+	for _i, _layer := range layers {
+		// have to copy loop vars to avoid races
+		i := _i
+		layer := _layer
+		eg.Go(func() error {
+			def := defs[i]
+			result, err := llbBridge.Solve(egctx, frontend.SolveRequest{
+				Definition:   def,
+				CacheImports: a.CacheImports,
+			}, sid)
+			if err != nil {
+				return err
+			}
+			results[i] = result
+
+			if result.Ref == nil {
+				// the state must have been Scratch, so it was just used
+				// for runopts + deps, no mount to create.
+				return nil
+			}
+			r, err := result.Ref.Result(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get ref result: %w", err)
+			}
+			workerRef, ok := r.Sys().(*worker.WorkerRef)
+			if !ok {
+				return fmt.Errorf("invalid ref type: %T", r.Sys())
+			}
+
+			if name := layerName(def); name != "" {
+				if err := setLayerName(workerRef.ImmutableRef, name); err != nil {
+					return fmt.Errorf("failed to set name of layer %s: %w", name, err)
+				}
+			}
+
+			mounts[i] = &executor.Mount{
+				Src:      workerRef.ImmutableRef,
+				Selector: layer.OutputDir,
+				Dest: util.LowerDir{
+					Index: i,
+					Dest:  layer.MountDir,
+				}.String(),
+			}
+			return nil
+		})
+	}
+	cleanup := func() {
+		for _, result := range results {
+			if result != nil {
+				result.EachRef(func(ref solver.ResultProxy) error {
+					return ref.Release(context.TODO())
+				})
+			}
+		}
+	}
+
+	if err := eg.Wait(); err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	return layers, mounts, cleanup, nil
+}
+
+func (f *BincastleFrontend) describe(
+	ctx context.Context, llbBridge frontend.FrontendLLBBridge, a *args, sid string,
+) (*frontend.Result, error) {
+	out, err := f.runDefinitionSource(ctx, llbBridge, a, sid, "-describe")
+	if err != nil {
+		return nil, err
+	}
+	var desc graph.Description
+	if err := json.Unmarshal(out, &desc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal graph description: %w", err)
+	}
+	return &frontend.Result{
+		Metadata: map[string][]byte{describeResponseKey: out},
+	}, nil
+}
+
+// runDefinitionSource builds and runs the program that outputs the system's
+// definition, returning its output. extraArgs are appended to its args.
+func (f *BincastleFrontend) runDefinitionSource(
+	ctx context.Context, llbBridge frontend.FrontendLLBBridge, a *args, sid string, extraArgs ...string,
+) ([]byte, error) {
 	var llbsrc AsSpec
 	if a.GitURL != "" {
 		llbsrc = src.ViaGit{
-			URL:       a.GitURL,
-			Ref:       a.GitRef,
-			Name:      "llb",
-			AlwaysRun: true,
+			URL:  a.GitURL,
+			Ref:  a.GitRef,
+			Name: "llb",
 		}
 	}
 	if a.LocalDir != "" {
@@ -338,17 +916,20 @@ func (f *BincastleFrontend) getLayers(
 
 	definitionSourceGraph, meta, err := a.Sourcer.DefinitionSource(llbsrc, a.Subdir)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to get definition source graph: %w", err)
+		return nil, fmt.Errorf("failed to get definition source graph: %w", err)
 	}
 
 	// TODO this is really, really dumb
 	marshalLayers, err := definitionSourceGraph.MarshalLayers(ctx, llb.LinuxAmd64)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to marshal definition source graph: %w", err)
+		return nil, fmt.Errorf("failed to marshal definition source graph: %w", err)
 	}
 	var sourceDef pb.Definition
 	if err := (&sourceDef).Unmarshal(marshalLayers[len(marshalLayers)-1].LLB); err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to get definition source: %w", err)
+		return nil, fmt.Errorf("failed to get definition source: %w", err)
+	}
+	if err := missingLocalRepos(a.LocalDirs, &sourceDef); err != nil {
+		return nil, err
 	}
 
 	res, err := llbBridge.Solve(ctx, frontend.SolveRequest{
@@ -356,7 +937,7 @@ func (f *BincastleFrontend) getLayers(
 		CacheImports: a.CacheImports,
 	}, sid)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to solve definition source: %w", err)
+		return nil, fmt.Errorf("failed to solve definition source: %w", err)
 	}
 	// TODO release refs earlier?
 	defer func() {
@@ -366,17 +947,17 @@ func (f *BincastleFrontend) getLayers(
 	}()
 
 	if res.Ref == nil {
-		return nil, nil, nil, fmt.Errorf("definition source result is missing ref")
+		return nil, fmt.Errorf("definition source result is missing ref")
 	}
 	r, err := res.Ref.Result(ctx)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to get definition source ref result: %w", err)
+		return nil, fmt.Errorf("failed to get definition source ref result: %w", err)
 	}
 	// NOTE: if you want to support export in the future, it seems like you might
 	// be able to use r.CacheKeys()? Not sure though
 	workerRef, ok := r.Sys().(*worker.WorkerRef)
 	if !ok {
-		return nil, nil, nil, fmt.Errorf("definition source returned invalid ref type: %T", r.Sys())
+		return nil, fmt.Errorf("definition source returned invalid ref type: %T", r.Sys())
 	}
 
 	rootfs := workerRef.ImmutableRef // TODO ever need to support mutable rootfs in the future?
@@ -385,12 +966,21 @@ func (f *BincastleFrontend) getLayers(
 	if meta != nil {
 		process.Meta = *meta
 	} else {
-		return nil, nil, nil, fmt.Errorf("invalid empty meta for definition source")
+		return nil, fmt.Errorf("invalid empty meta for definition source")
 	}
 
-	for _, override := range a.LocalOverrides {
-		process.Meta.Env = append(process.Meta.Env, override)
+	if len(a.Overrides) > 0 {
+		overrides, err := json.Marshal(a.Overrides)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal overrides: %w", err)
+		}
+		process.Meta.Env = append(process.Meta.Env, graph.OverridesEnv+"="+string(overrides))
+	}
+	process.Meta.Env = append(process.Meta.Env, graph.SysrootImageEnv+"="+a.SysrootImage)
+	if !a.UpdateLock {
+		process.Meta.Env = append(process.Meta.Env, graph.LockFileEnv+"="+definitionLockPath)
 	}
+	process.Meta.Args = append(append([]string{}, process.Meta.Args...), extraArgs...)
 
 	type output struct {
 		bytes []byte
@@ -406,6 +996,16 @@ func (f *BincastleFrontend) getLayers(
 		close(outputCh)
 	}()
 
+	// stderr is only read for errors, i.e. an override of a missing layer
+	errRead, errWrite := io.Pipe()
+	process.Stderr = errWrite
+	errOutputCh := make(chan output, 1)
+	go func() {
+		bytes, err := ioutil.ReadAll(errRead)
+		errOutputCh <- output{bytes: bytes, err: err}
+	}()
+	defer errRead.Close()
+
 	id := "" // use a random unique id to obtain the definition
 	defSourceMounts := []executor.Mount{{
 		Src:      workerRef.ImmutableRef,
@@ -415,95 +1015,27 @@ func (f *BincastleFrontend) getLayers(
 	if err := llbBridge.Run(ctx, id, rootfs, defSourceMounts, process, nil); err != nil {
 		// TODO including output from process for debugging, could be massive amounts of text
 		outWrite.Close()
+		errWrite.Close()
 		out := <-outputCh
+		errOut := <-errOutputCh
 
-		return nil, nil, nil, fmt.Errorf("failed to run definition source: %w\n%s", err, string(out.bytes))
+		return nil, fmt.Errorf("failed to run definition source: %w\n%s%s", err, string(out.bytes), string(errOut.bytes))
 	}
 	outWrite.Close()
+	errWrite.Close()
 
-	var layers []graph.MarshalLayer
+	defer outRead.Close()
 	select {
 	case out := <-outputCh:
 		if out.err != nil {
-			return nil, nil, nil, fmt.Errorf("error reading definition from source's stdout: %w", err)
-		}
-		layers, err = graph.UnmarshalLayers(out.bytes)
-		if err != nil {
-			return nil, nil, nil, fmt.Errorf("failed to unmarshal definition source output: %w", err)
+			return nil, fmt.Errorf("error reading definition from source's stdout: %w", err)
 		}
+		return out.bytes, nil
 	case <-time.After(5 * time.Second):
 		// the process is already dead, so 5 seconds is the timeout waiting to read its
 		// output in full (extremely generous amount of time)
-		return nil, nil, nil, fmt.Errorf("timed out reading definition")
+		return nil, fmt.Errorf("timed out reading definition")
 	}
-	outRead.Close()
-
-	if a.RunType != PreBuild && a.RunType != ImageExport {
-		return layers, nil, nil, nil
-	}
-
-	eg, egctx := errgroup.WithContext(ctx)
-	mounts := make([]*executor.Mount, len(layers))
-	results := make([]*frontend.Result, len(layers))
-	for _i, _layer := range layers {
-		// have to copy loop vars to avoid races
-		i := _i
-		layer := _layer
-		eg.Go(func() error {
-			var def pb.Definition
-			if err := (&def).Unmarshal(layer.LLB); err != nil {
-				return err
-			}
-
-			result, err := llbBridge.Solve(egctx, frontend.SolveRequest{
-				Definition:   &def,
-				CacheImports: a.CacheImports,
-			}, sid)
-			if err != nil {
-				return err
-			}
-			results[i] = result
-
-			if result.Ref == nil {
-				// the state must have been Scratch, so it was just used
-				// for runopts + deps, no mount to create.
-				return nil
-			}
-			r, err := result.Ref.Result(ctx)
-			if err != nil {
-				return fmt.Errorf("failed to get ref result: %w", err)
-			}
-			workerRef, ok := r.Sys().(*worker.WorkerRef)
-			if !ok {
-				return fmt.Errorf("invalid ref type: %T", r.Sys())
-			}
-
-			mounts[i] = &executor.Mount{
-				Src:      workerRef.ImmutableRef,
-				Selector: layer.OutputDir,
-				Dest: util.LowerDir{
-					Index: i,
-					Dest:  layer.MountDir,
-				}.String(),
-			}
-			return nil
-		})
-	}
-	cleanup := func() {
-		for _, result := range results {
-			if result != nil {
-				result.EachRef(func(ref solver.ResultProxy) error {
-					return ref.Release(context.TODO())
-				})
-			}
-		}
-	}
-
-	if err := eg.Wait(); err != nil {
-		cleanup()
-		return nil, nil, nil, err
-	}
-	return layers, mounts, cleanup, nil
 }
 
 func (f *BincastleFrontend) topLayerSolve(
@@ -534,7 +1066,7 @@ func (f *BincastleFrontend) allLayerSolve(
 			util.LowerDir{
 				Dest: "/",
 			}.String(),
-			llb.Image("docker.io/eriksipsma/bincastle-sysroot:latest"),
+			llb.Image(a.SysrootImage),
 			llb.Readonly,
 			llb.SourcePath("/sysroot"),
 		),
@@ -564,6 +1096,34 @@ func (f *BincastleFrontend) allLayerSolve(
 	}, sid)
 }
 
+// layerVertexNames returns the names of the layers that were given one
+// (i.e. by an exec building them), keyed by the digest of their vertex.
+func layerVertexNames(layers []graph.MarshalLayer) (map[digest.Digest]string, error) {
+	names := make(map[digest.Digest]string)
+	for _, layer := range layers {
+		var def pb.Definition
+		if err := (&def).Unmarshal(layer.LLB); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal layer: %w", err)
+		}
+		if len(def.Def) == 0 {
+			continue
+		}
+		// the last op only points at the layer's vertex
+		var lastOp pb.Op
+		if err := (&lastOp).Unmarshal(def.Def[len(def.Def)-1]); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal layer op: %w", err)
+		}
+		if len(lastOp.Inputs) == 0 {
+			continue
+		}
+		dgst := lastOp.Inputs[0].Digest
+		if name, ok := def.Metadata[dgst].Description["llb.customname"]; ok {
+			names[dgst] = name
+		}
+	}
+	return names, nil
+}
+
 func (f *BincastleFrontend) imageExport(
 	ctx context.Context, llbBridge frontend.FrontendLLBBridge, a *args, sid string,
 	refMounts []*executor.Mount,
@@ -635,9 +1195,58 @@ func (f *BincastleFrontend) imageExport(
 	return nil
 }
 
+// mergeEnv returns env with the vars in overrides added, replacing any
+// existing vars with the same key.
+func mergeEnv(env []string, overrides []string) []string {
+	merged := make([]string, 0, len(env)+len(overrides))
+	for _, kv := range env {
+		key := strings.SplitN(kv, "=", 2)[0]
+		overridden := false
+		for _, override := range overrides {
+			if strings.SplitN(override, "=", 2)[0] == key {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			merged = append(merged, kv)
+		}
+	}
+	return append(merged, overrides...)
+}
+
+// execMounts returns the host mounts of the exec, which are the mounts of
+// every layer plus the ones passed by the client. Later mounts replace earlier
+// ones with the same dest. The mounts of layers are read-only unless
+// writableLayerMounts is set.
+func execMounts(layers []graph.MarshalLayer, clientMounts []graph.HostMount, writableLayerMounts bool) []graph.HostMount {
+	var mounts []graph.HostMount
+	add := func(m graph.HostMount) {
+		for i, existing := range mounts {
+			if filepath.Clean(existing.Dest) == filepath.Clean(m.Dest) {
+				mounts[i] = m
+				return
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	for _, layer := range layers {
+		for _, m := range layer.Mounts {
+			if !writableLayerMounts {
+				m.Readonly = true
+			}
+			add(m)
+		}
+	}
+	for _, m := range clientMounts {
+		add(m)
+	}
+	return mounts
+}
+
 func (f *BincastleFrontend) exec(
 	ctx context.Context, llbBridge frontend.FrontendLLBBridge, a *args, sid string,
-	layers []graph.MarshalLayer, mounts []*executor.Mount, started chan<- struct{},
+	layers []graph.MarshalLayer, mounts []*executor.Mount, chain *execChain, session *termSession, started chan<- struct{},
 ) error {
 	// TODO this is very silly, just find the first layer with runtime args and assume that's
 	// the one you are supposed to run
@@ -650,11 +1259,17 @@ func (f *BincastleFrontend) exec(
 			break
 		}
 	}
+	if len(a.ExecArgs) > 0 {
+		meta.Args = a.ExecArgs
+	}
+	if a.ExecWorkdir != "" {
+		meta.Cwd = a.ExecWorkdir
+	}
+	meta.Env = mergeEnv(meta.Env, a.ExecEnv)
+	meta.Env = mergeEnv(meta.Env, []string{ExecChainEnv + "=" + chain.id})
 
-	// TODO don't hardcode
-	execName := "home"
-	const execKey = "bincastle.ExecName"
-	index := "bincastle-exec:" + execName
+	execName := a.ExecName
+	index := execIndex(execName)
 	items, err := f.metadataStore.Search(index)
 	if err != nil {
 		return fmt.Errorf("error during search for exec %s: %w", execName, err)
@@ -669,53 +1284,27 @@ func (f *BincastleFrontend) exec(
 		defer ref.Release(context.TODO())
 		execRef = ref
 	} else {
-		ref, err := f.cacheManager.New(ctx, nil, cache.CachePolicyRetain)
+		ref, err := f.newExecRef(ctx, execName)
 		if err != nil {
-			return fmt.Errorf("failed to create new ref for exec %s: %w", execName, err)
+			return err
 		}
 		defer ref.Release(context.TODO())
-
-		// TODO ensure that the ref gets deleted if there's an error before the bincastle-exec index is set?
-		v, err := metadata.NewValue(execName)
-		if err != nil {
-			return fmt.Errorf("failed to create new metadata value for exec %s: %w", execName, err)
-		}
-		v.Index = index
-		si := ref.Metadata()
-		if err := si.Update(func(b *bolt.Bucket) error {
-			return si.SetValue(b, execKey, v)
-		}); err != nil {
-			return fmt.Errorf("failed to update ref with exec name index %s: %w", execName, err)
-		}
-
-		if immutable, err := ref.Commit(ctx); err != nil {
-			return fmt.Errorf("failed to commit new mutable ref for exec %s: %w", execName, err)
-		} else if err := immutable.Release(ctx); err != nil {
-			return fmt.Errorf("failed to release immutable ref for exec %s: %w", execName, err)
-		}
 		execRef = ref
 	}
 
-	resizeCh, consoleCleanup, err := ctr.SetupSelfConsole(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to setup console for exec %s: %w", execName, err)
-	}
-	defer consoleCleanup()
-	execResizeCh := make(chan executor.WinSize)
-	go func() {
-		for winSize := range resizeCh {
-			execResizeCh <- executor.WinSize{
-				Rows: uint32(winSize.Height),
-				Cols: uint32(winSize.Width),
-			}
+	meta.Tty = session != nil
+	var execProcess executor.ProcessInfo
+	if session != nil {
+		execProcess = session.processInfo(meta)
+	} else {
+		// without a tty there's nothing to share, so the exec just gets
+		// the stdio of the chain
+		execProcess = executor.ProcessInfo{
+			Meta:   meta,
+			Stdin:  chain.stdio.stdin,
+			Stdout: chain.stdio.stdout,
+			Stderr: chain.stdio.stderr,
 		}
-	}()
-
-	execProcess := executor.ProcessInfo{
-		Stdin:  os.Stdin,
-		Stdout: os.Stdout,
-		Resize: execResizeCh,
-		Meta:   meta,
 	}
 
 	var finalMounts []executor.Mount
@@ -725,6 +1314,17 @@ func (f *BincastleFrontend) exec(
 		}
 		finalMounts = append(finalMounts, *m)
 	}
+	for _, m := range execMounts(layers, a.Mounts, a.WritableMounts) {
+		path, ok := a.HostMountPaths[m.Source]
+		if !ok {
+			return fmt.Errorf("host path %s is not mounted into the system", m.Source)
+		}
+		finalMounts = append(finalMounts, executor.Mount{
+			Src:      hostMount{path: path},
+			Dest:     m.Dest,
+			Readonly: m.Readonly,
+		})
+	}
 
 	if err := llbBridge.Run(ctx, ExecNameToID(execName), execRef, finalMounts, execProcess, started); err != nil {
 		// TODO include output from process for debugging?
@@ -0,0 +1,265 @@
+package buildkit
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/sipsma/bincastle/ctr"
+	"github.com/sipsma/bincastle/graph"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		env       []string
+		overrides []string
+		merged    []string
+	}{
+		{name: "no overrides", env: []string{"A=1", "B=2"}, merged: []string{"A=1", "B=2"}},
+		{name: "no env", overrides: []string{"A=1"}, merged: []string{"A=1"}},
+		{name: "added", env: []string{"A=1"}, overrides: []string{"B=2"}, merged: []string{"A=1", "B=2"}},
+		{name: "replaced", env: []string{"A=1", "B=2"}, overrides: []string{"A=3"}, merged: []string{"B=2", "A=3"}},
+		{name: "empty value", env: []string{"A=1"}, overrides: []string{"A="}, merged: []string{"A="}},
+		// keys match exactly, not by prefix
+		{name: "prefix", env: []string{"PATH=/bin"}, overrides: []string{"PAT=x"}, merged: []string{"PATH=/bin", "PAT=x"}},
+		{name: "value with =", env: []string{"A=1"}, overrides: []string{"A=b=c"}, merged: []string{"A=b=c"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.merged, mergeEnv(tc.env, tc.overrides))
+		})
+	}
+}
+
+func TestExecMounts(t *testing.T) {
+	layers := []graph.MarshalLayer{
+		{Mounts: []graph.HostMount{{Source: "/host/a", Dest: "/a"}}},
+		{Mounts: []graph.HostMount{{Source: "/host/b", Dest: "/b/"}, {Source: "/host/c", Dest: "/c", Readonly: true}}},
+		{},
+	}
+	for _, tc := range []struct {
+		name     string
+		client   []graph.HostMount
+		writable bool
+		mounts   []graph.HostMount
+	}{{
+		name: "layer mounts are read-only",
+		mounts: []graph.HostMount{
+			{Source: "/host/a", Dest: "/a", Readonly: true},
+			{Source: "/host/b", Dest: "/b/", Readonly: true},
+			{Source: "/host/c", Dest: "/c", Readonly: true},
+		},
+	}, {
+		name:     "writable layer mounts",
+		writable: true,
+		mounts: []graph.HostMount{
+			{Source: "/host/a", Dest: "/a"},
+			{Source: "/host/b", Dest: "/b/"},
+			{Source: "/host/c", Dest: "/c", Readonly: true},
+		},
+	}, {
+		name:   "client mounts replace layer mounts at the same dest",
+		client: []graph.HostMount{{Source: "/other", Dest: "/b"}, {Source: "/d", Dest: "/d", Readonly: true}},
+		mounts: []graph.HostMount{
+			{Source: "/host/a", Dest: "/a", Readonly: true},
+			{Source: "/other", Dest: "/b"},
+			{Source: "/host/c", Dest: "/c", Readonly: true},
+			{Source: "/d", Dest: "/d", Readonly: true},
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.mounts, execMounts(layers, tc.client, tc.writable))
+		})
+	}
+}
+
+func TestGetargsExecOverrides(t *testing.T) {
+	base := func(extra map[string]string) map[string]string {
+		opts := map[string]string{
+			KeyLocalDir: "/src",
+			KeyBuildID:  "build",
+		}
+		for k, v := range extra {
+			opts[k] = v
+		}
+		return opts
+	}
+
+	a, err := getargs(base(map[string]string{
+		KeyExecArgs:    `["make","test"]`,
+		KeyExecEnv:     `["A=1"]`,
+		KeyExecWorkdir: "/src/repo",
+		KeyExecChain:   "chain",
+		KeyClientIODir: "/var/clients/a",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"make", "test"}, a.ExecArgs)
+	require.Equal(t, []string{"A=1"}, a.ExecEnv)
+	require.Equal(t, "/src/repo", a.ExecWorkdir)
+	require.Equal(t, defaultExecName, a.ExecName)
+	require.Equal(t, "chain", a.ExecChain)
+	require.Equal(t, "/var/clients/a", a.ClientIODir)
+
+	for _, tc := range []struct {
+		name string
+		opts map[string]string
+	}{
+		{name: "malformed args", opts: base(map[string]string{KeyExecArgs: `make test`})},
+		{name: "malformed env", opts: base(map[string]string{KeyExecEnv: `{"A":"1"}`})},
+		{name: "malformed mounts", opts: base(map[string]string{KeyMounts: `/a:/b`})},
+		{name: "missing build id", opts: map[string]string{KeyLocalDir: "/src"}},
+		{name: "no source", opts: map[string]string{KeyBuildID: "build"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getargs(tc.opts)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestExecNames(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  bool
+	}{
+		{name: "home"},
+		{name: "dev-env.2"},
+		{name: "A_b"},
+		{name: "../home", err: true},
+		{name: "-home", err: true},
+		{name: ".home", err: true},
+		{name: "a/b", err: true},
+		{name: "a b", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := getargs(map[string]string{KeyRunType: string(ExecRemove), KeyExecName: tc.name})
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.name, a.ExecName)
+
+			// the exec's container id maps back to its name
+			execName, err := IDToExecName(ExecNameToID(tc.name))
+			require.NoError(t, err)
+			require.Equal(t, tc.name, execName)
+		})
+	}
+}
+
+// clientIODir creates the fifos an outside client attaches to, like
+// bincastle run does when a daemon is already running.
+func clientIODir(t *testing.T, noTTY bool) ctr.IODir {
+	dir, err := ioutil.TempDir("", "bincastle-client")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ioDir := ctr.IODir(dir)
+	fifoPaths := []string{ioDir.TTYInFifo(), ioDir.TTYOutFifo(), ioDir.ResizeFifo()}
+	if noTTY {
+		fifoPaths = []string{ioDir.StdinFifo(), ioDir.StdoutFifo(), ioDir.StderrFifo()}
+	}
+	for _, path := range fifoPaths {
+		require.NoError(t, syscall.Mkfifo(path, 0600))
+	}
+	return ioDir
+}
+
+func TestExecChain(t *testing.T) {
+	f := testFrontend(t)
+	f.terminal, _, _, _ = testTerminal(t)
+
+	// the client that started the system gets the daemon's terminal
+	first, err := f.execChain(nil, &args{BuildID: "a"}, "")
+	require.NoError(t, err)
+	require.Equal(t, f.terminal, first.terminal)
+	_, err = f.execChain(nil, &args{BuildID: "b"}, "")
+	require.Error(t, err)
+
+	// clients inside its execs join its chain
+	chain, err := f.execChain(nil, &args{BuildID: "c", ExecChain: "a"}, "")
+	require.NoError(t, err)
+	require.Equal(t, first, chain)
+	_, err = f.execChain(nil, &args{BuildID: "d", ExecChain: "missing"}, "")
+	require.Error(t, err)
+
+	// other outside clients get their own io
+	tty, err := f.execChain(nil, &args{BuildID: "e", ClientIODir: string(clientIODir(t, false))}, "")
+	require.NoError(t, err)
+	require.NotEqual(t, f.terminal, tty.terminal)
+	defer tty.closeIO()
+	stdio, err := f.execChain(nil, &args{BuildID: "f", ClientIODir: string(clientIODir(t, true)), NoTTY: true}, "")
+	require.NoError(t, err)
+	require.Nil(t, stdio.terminal)
+	defer stdio.closeIO()
+	require.Len(t, f.chains, 3)
+
+	// the daemon's terminal is free again once its chain's io is closed
+	first.closeIO()
+	_, err = f.execChain(nil, &args{BuildID: "b"}, "")
+	require.NoError(t, err)
+}
+
+func TestClientStdio(t *testing.T) {
+	f := testFrontend(t)
+	ioDir := clientIODir(t, true)
+	chain, err := f.execChain(nil, &args{BuildID: "a", ClientIODir: string(ioDir), NoTTY: true}, "")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var stdout, stderr syncBuffer
+	attachCh := make(chan error, 1)
+	go func() {
+		attachCh <- ioDir.AttachStreams(ctx, strings.NewReader("in"), &stdout, &stderr)
+	}()
+
+	in := make([]byte, 2)
+	_, err = io.ReadFull(chain.stdio.stdin, in)
+	require.NoError(t, err)
+	require.Equal(t, "in", string(in))
+	_, err = chain.stdio.stdout.Write([]byte("out"))
+	require.NoError(t, err)
+	_, err = chain.stdio.stderr.Write([]byte("err"))
+	require.NoError(t, err)
+
+	// the client's attach ends once the chain closes its io
+	chain.closeIO()
+	require.NoError(t, <-attachCh)
+	require.Equal(t, "out", stdout.String())
+	require.Equal(t, "err", stderr.String())
+}
+
+func TestClientTerminalResize(t *testing.T) {
+	ioDir := clientIODir(t, false)
+	term, closeIO, err := newClientTerminal(ioDir)
+	require.NoError(t, err)
+	defer closeIO()
+
+	// the client holds the resize fifo open for as long as it's attached
+	resizeFifo, err := os.OpenFile(ioDir.ResizeFifo(), os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer resizeFifo.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resizeCh, cleanup, err := term.setupConsole(ctx)
+	require.NoError(t, err)
+	defer cleanup()
+	for _, size := range []console.WinSize{{Height: 24, Width: 80}, {Height: 50, Width: 100}} {
+		require.NoError(t, ioDir.Resize(size))
+		select {
+		case got := <-resizeCh:
+			require.Equal(t, size, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for resize")
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package buildkit
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/leaseutil"
+	"github.com/moby/buildkit/worker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const importResponseKey = "frontend.bincastle.import"
+
+// ImportImages loads the images in an OCI layout dir, or a tarball of one (or
+// of docker save output), at path into the image store of the bincastle
+// daemon listening at sockPath. Images in the store are used when their refs
+// can't be pulled, so systems can be bootstrapped without a registry. If ref
+// is set, the archive must hold a single image, which is stored as ref.
+// Returns the refs of the imported images.
+func ImportImages(ctx context.Context, sockPath string, path string, ref string) ([]string, error) {
+	c, err := client.New(ctx, fmt.Sprintf(`unix://%s`, sockPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	defer c.Close()
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	localDir := path
+	var importFile string
+	if !fi.IsDir() {
+		localDir, importFile = filepath.Split(path)
+	}
+
+	resp, err := c.Solve(ctx, nil, client.SolveOpt{
+		Frontend: "bincastle",
+		FrontendAttrs: map[string]string{
+			KeyRunType:    string(ImageImport),
+			KeyLocalDir:   localDir,
+			KeyImportFile: importFile,
+			KeyImageRef:   ref,
+		},
+		LocalDirs: map[string]string{localDir: localDir},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	if err := json.Unmarshal([]byte(resp.ExporterResponse[importResponseKey]), &refs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal imported images: %w", err)
+	}
+	return refs, nil
+}
+
+func (f *BincastleFrontend) importImages(
+	ctx context.Context, llbBridge frontend.FrontendLLBBridge, a *args, sid string,
+) (*frontend.Result, error) {
+	var localOpts []llb.LocalOption
+	if a.ImportFile != "" {
+		localOpts = append(localOpts, llb.IncludePatterns([]string{a.ImportFile}))
+	}
+	def, err := llb.Local(a.LocalDir, localOpts...).Marshal(ctx, llb.LinuxAmd64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal import source: %w", err)
+	}
+	res, err := llbBridge.Solve(ctx, frontend.SolveRequest{Definition: def.ToPB()}, sid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to solve import source: %w", err)
+	}
+	defer func() {
+		res.EachRef(func(ref solver.ResultProxy) error {
+			return ref.Release(context.TODO())
+		})
+	}()
+	if res.Ref == nil {
+		return nil, fmt.Errorf("import source result is missing ref")
+	}
+	r, err := res.Ref.Result(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import source ref result: %w", err)
+	}
+	workerRef, ok := r.Sys().(*worker.WorkerRef)
+	if !ok {
+		return nil, fmt.Errorf("import source returned invalid ref type: %T", r.Sys())
+	}
+	mountable, err := workerRef.ImmutableRef.Mount(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	mounts, cleanup, err := mountable.Mount()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	// the images are only kept from being garbage collected once they're in
+	// the image store, so hold a lease on their content until then
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+	ctx, done, err := leaseutil.WithLease(ctx, f.leaseManager, leaseutil.MakeTemporary)
+	if err != nil {
+		return nil, err
+	}
+	defer done(ctx)
+
+	var index ocispec.Descriptor
+	err = mount.WithTempMount(ctx, mounts, func(root string) error {
+		var archiveReader io.Reader
+		if a.ImportFile != "" {
+			archiveFile, err := os.Open(filepath.Join(root, a.ImportFile))
+			if err != nil {
+				return err
+			}
+			defer archiveFile.Close()
+			archiveReader = archiveFile
+		} else {
+			pr, pw := io.Pipe()
+			go func() {
+				pw.CloseWithError(tarDir(pw, root))
+			}()
+			defer pr.Close()
+			archiveReader = pr
+		}
+		index, err = archive.ImportIndex(ctx, f.contentStore, archiveReader)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to import archive: %w", err)
+	}
+
+	refs, err := f.storeImages(ctx, index, a.ImageRef)
+	if err != nil {
+		return nil, err
+	}
+	refsJSON, err := json.Marshal(refs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal imported images: %w", err)
+	}
+	return &frontend.Result{
+		Metadata: map[string][]byte{importResponseKey: refsJSON},
+	}, nil
+}
+
+// storeImages creates an image in the image store for each manifest in the
+// imported index, named by its annotations or by ref if set.
+func (f *BincastleFrontend) storeImages(ctx context.Context, index ocispec.Descriptor, ref string) ([]string, error) {
+	indexBytes, err := content.ReadBlob(ctx, f.contentStore, index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read imported index: %w", err)
+	}
+	var idx ocispec.Index
+	if err := json.Unmarshal(indexBytes, &idx); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal imported index: %w", err)
+	}
+	if ref != "" && len(idx.Manifests) != 1 {
+		return nil, fmt.Errorf("archive has %d images, a ref can only be given for one", len(idx.Manifests))
+	}
+
+	var refs []string
+	for _, desc := range idx.Manifests {
+		name := ref
+		if name == "" {
+			name = desc.Annotations[images.AnnotationImageName]
+		}
+		// OCI ref names are often only a tag, which isn't enough to match
+		// the refs used in definitions
+		if refName := desc.Annotations[ocispec.AnnotationRefName]; name == "" && strings.Contains(refName, "/") {
+			name = refName
+		}
+		if name == "" {
+			return nil, fmt.Errorf("image %s in the archive has no ref, one must be given", desc.Digest)
+		}
+		named, err := docker.ParseDockerRef(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image ref %q: %w", name, err)
+		}
+
+		img := images.Image{Name: named.String(), Target: desc}
+		if _, err := f.imageStore.Create(ctx, img); errdefs.IsAlreadyExists(err) {
+			_, err = f.imageStore.Update(ctx, img)
+			if err != nil {
+				return nil, fmt.Errorf("failed to update image %s: %w", img.Name, err)
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to create image %s: %w", img.Name, err)
+		}
+		refs = append(refs, img.Name)
+	}
+	return refs, nil
+}
+
+// tarDir writes the regular files and dirs under dir to w as a tarball.
+func tarDir(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
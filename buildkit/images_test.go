@@ -0,0 +1,216 @@
+package buildkit
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bincastle-tar")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte("{}"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", "abc"), []byte("blob"), 0644))
+	// only regular files and dirs are archived
+	require.NoError(t, os.Symlink("index.json", filepath.Join(dir, "link")))
+
+	var b bytes.Buffer
+	require.NoError(t, tarDir(&b, dir))
+	entries := make(map[string]string)
+	tr := tar.NewReader(&b)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		dt, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeDir {
+			dt = []byte("dir")
+		}
+		entries[hdr.Name] = string(dt)
+	}
+	require.Equal(t, map[string]string{
+		"blobs":            "dir",
+		"blobs/sha256":     "dir",
+		"blobs/sha256/abc": "blob",
+		"index.json":       "{}",
+	}, entries)
+}
+
+// writeOCILayout writes an OCI layout with an image for each of the given
+// manifest annotations to dir, returning the digests of the manifests.
+func writeOCILayout(t *testing.T, dir string, annotations ...map[string]string) []digest.Digest {
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	require.NoError(t, os.MkdirAll(blobsDir, 0755))
+	writeBlob := func(mediaType string, v interface{}) ocispec.Descriptor {
+		dt, err := json.Marshal(v)
+		require.NoError(t, err)
+		dgst := digest.FromBytes(dt)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(blobsDir, dgst.Hex()), dt, 0644))
+		return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(dt))}
+	}
+
+	idx := ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}}
+	var dgsts []digest.Digest
+	for i, annotations := range annotations {
+		config := writeBlob(ocispec.MediaTypeImageConfig, ocispec.Image{
+			Architecture: "amd64",
+			OS:           "linux",
+			Config:       ocispec.ImageConfig{Env: []string{"IMAGE=" + string(rune('a'+i))}},
+		})
+		manifest := writeBlob(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Config:    config,
+		})
+		manifest.Annotations = annotations
+		idx.Manifests = append(idx.Manifests, manifest)
+		dgsts = append(dgsts, manifest.Digest)
+	}
+
+	dt, err := json.Marshal(idx)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), dt, 0644))
+	dt, err = json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), dt, 0644))
+	return dgsts
+}
+
+func TestImportOCILayoutDir(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+	f, _ := workerFrontend(t)
+	dir, err := ioutil.TempDir("", "bincastle-oci-layout")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dgsts := writeOCILayout(t, dir,
+		map[string]string{images.AnnotationImageName: "docker.io/eriksipsma/bincastle-sysroot:latest"},
+		// ref names that are more than a tag are used as the image's name
+		map[string]string{ocispec.AnnotationRefName: "example.com/fuse-overlayfs:1"},
+	)
+
+	// dirs are imported like a tarball of them
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarDir(pw, dir))
+	}()
+	index, err := archive.ImportIndex(ctx, f.contentStore, pr)
+	require.NoError(t, err)
+	refs, err := f.storeImages(ctx, index, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"docker.io/eriksipsma/bincastle-sysroot:latest",
+		"example.com/fuse-overlayfs:1",
+	}, refs)
+	for i, ref := range refs {
+		img, err := f.imageStore.Get(ctx, ref)
+		require.NoError(t, err)
+		require.Equal(t, dgsts[i], img.Target.Digest)
+		// the image's content was imported too
+		_, err = content.ReadBlob(ctx, f.contentStore, img.Target)
+		require.NoError(t, err)
+	}
+}
+
+func TestStoreImages(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+	f, _ := workerFrontend(t)
+
+	writeIndex := func(annotations ...map[string]string) ocispec.Descriptor {
+		idx := ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}}
+		for i, annotations := range annotations {
+			idx.Manifests = append(idx.Manifests, ocispec.Descriptor{
+				MediaType:   ocispec.MediaTypeImageManifest,
+				Digest:      digest.FromString(string(rune('a' + i))),
+				Size:        1,
+				Annotations: annotations,
+			})
+		}
+		dt, err := json.Marshal(idx)
+		require.NoError(t, err)
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageIndex,
+			Digest:    digest.FromBytes(dt),
+			Size:      int64(len(dt)),
+		}
+		require.NoError(t, content.WriteBlob(ctx, f.contentStore, "test-"+desc.Digest.String(), bytes.NewReader(dt), desc))
+		return desc
+	}
+
+	for _, tc := range []struct {
+		name        string
+		annotations []map[string]string
+		ref         string
+		refs        []string
+		err         bool
+	}{{
+		name:        "image name is normalized",
+		annotations: []map[string]string{{images.AnnotationImageName: "busybox"}},
+		refs:        []string{"docker.io/library/busybox:latest"},
+	}, {
+		name:        "ref overrides annotations",
+		annotations: []map[string]string{{images.AnnotationImageName: "busybox"}},
+		ref:         "example.com/sysroot:v1",
+		refs:        []string{"example.com/sysroot:v1"},
+	}, {
+		name:        "no annotations",
+		annotations: []map[string]string{nil},
+		ref:         "example.com/sysroot:v1",
+		refs:        []string{"example.com/sysroot:v1"},
+	}, {
+		name:        "only a tag",
+		annotations: []map[string]string{{ocispec.AnnotationRefName: "latest"}},
+		err:         true,
+	}, {
+		name: "ref for several images",
+		annotations: []map[string]string{
+			{images.AnnotationImageName: "busybox"},
+			{images.AnnotationImageName: "alpine"},
+		},
+		ref: "example.com/sysroot:v1",
+		err: true,
+	}, {
+		name:        "invalid ref",
+		annotations: []map[string]string{nil},
+		ref:         "Example.com/Sysroot",
+		err:         true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			refs, err := f.storeImages(ctx, writeIndex(tc.annotations...), tc.ref)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.refs, refs)
+		})
+	}
+
+	// importing an image again replaces the one in the store
+	name := map[string]string{images.AnnotationImageName: "example.com/a"}
+	_, err := f.storeImages(ctx, writeIndex(name), "")
+	require.NoError(t, err)
+	_, err = f.storeImages(ctx, writeIndex(map[string]string{images.AnnotationImageName: "example.com/b"}, name), "")
+	require.NoError(t, err)
+	img, err := f.imageStore.Get(ctx, "example.com/a:latest")
+	require.NoError(t, err)
+	require.Equal(t, digest.FromString("b"), img.Target.Digest)
+}
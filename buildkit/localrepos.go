@@ -0,0 +1,161 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/sipsma/bincastle/examples/distro/src"
+)
+
+// missingLocalReposError is returned by the frontend when the definition
+// reads repos on the client's host that the client doesn't share yet.
+type missingLocalReposError struct {
+	names []string
+}
+
+func (e *missingLocalReposError) Error() string {
+	return fmt.Sprintf("local repos are not shared by the client: %s", strings.Join(e.names, ", "))
+}
+
+// result asks the client to share the missing repos and solve again.
+func (e *missingLocalReposError) result() (*frontend.Result, error) {
+	names, err := json.Marshal(e.names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal local repos: %w", err)
+	}
+	return &frontend.Result{
+		Metadata: map[string][]byte{localReposResponseKey: names},
+	}, nil
+}
+
+// missingLocalRepos returns a missingLocalReposError if defs read local repos
+// that aren't in shared, the local dirs the client shares.
+func missingLocalRepos(shared []string, defs ...*pb.Definition) error {
+	seen := make(map[string]bool)
+	for _, name := range shared {
+		seen[name] = true
+	}
+	var missing []string
+	for _, def := range defs {
+		for _, dt := range def.Def {
+			var op pb.Op
+			if err := op.Unmarshal(dt); err != nil {
+				return fmt.Errorf("failed to unmarshal op: %w", err)
+			}
+			source := op.GetSource()
+			if source == nil {
+				continue
+			}
+			name := strings.TrimPrefix(source.Identifier, "local://")
+			if !strings.HasPrefix(name, src.LocalRepoPrefix) || seen[name] {
+				continue
+			}
+			seen[name] = true
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return &missingLocalReposError{names: missing}
+}
+
+// shareLocalRepo adds the repo of a local dir name the frontend asked for
+// to the local dirs of opt.
+func shareLocalRepo(opt *client.SolveOpt, name string) error {
+	path := strings.TrimPrefix(name, src.LocalRepoPrefix)
+	if path == name || !filepath.IsAbs(path) {
+		return fmt.Errorf("invalid local repo %q", name)
+	}
+	// only repos are shared, not arbitrary dirs the definition names
+	isRepo := false
+	for _, head := range []string{"HEAD", ".git"} {
+		if _, err := os.Stat(filepath.Join(path, head)); err == nil {
+			isRepo = true
+		}
+	}
+	if !isRepo {
+		return fmt.Errorf("%s is not a git repo", path)
+	}
+	if opt.LocalDirs == nil {
+		opt.LocalDirs = make(map[string]string)
+	}
+	opt.LocalDirs[name] = path
+	return nil
+}
+
+// solveSharingLocalRepos solves like c.Solve, solving again with the repos on
+// the client's host that the frontend asks for until it has all of them. opt
+// is updated with the local dirs it ends up sharing.
+func solveSharingLocalRepos(
+	ctx context.Context, c *client.Client, def *llb.Definition, opt *client.SolveOpt, statusCh chan *client.SolveStatus,
+) (*client.SolveResponse, error) {
+	if opt.FrontendAttrs == nil {
+		return c.Solve(ctx, def, *opt, statusCh)
+	}
+	defer close(statusCh)
+	for {
+		var shared []string
+		for name := range opt.LocalDirs {
+			shared = append(shared, name)
+		}
+		sort.Strings(shared)
+		sharedJSON, err := json.Marshal(shared)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal local dirs: %w", err)
+		}
+		opt.FrontendAttrs[KeyLocalDirs] = string(sharedJSON)
+
+		// c.Solve closes the channel it's given, statusCh stays open for
+		// the next attempt
+		attemptCh := make(chan *client.SolveStatus)
+		forwarded := make(chan struct{})
+		go func() {
+			defer close(forwarded)
+			for status := range attemptCh {
+				select {
+				case statusCh <- status:
+				case <-ctx.Done():
+				}
+			}
+		}()
+		resp, err := c.Solve(ctx, def, *opt, attemptCh)
+		<-forwarded
+		if err != nil {
+			return nil, err
+		}
+
+		v, ok := resp.ExporterResponse[localReposResponseKey]
+		if !ok {
+			return resp, nil
+		}
+		var names []string
+		if err := json.Unmarshal([]byte(v), &names); err != nil {
+			return nil, fmt.Errorf("invalid local repos %q: %w", v, err)
+		}
+		added := false
+		for _, name := range names {
+			if _, ok := opt.LocalDirs[name]; ok {
+				continue
+			}
+			if err := shareLocalRepo(opt, name); err != nil {
+				return nil, err
+			}
+			added = true
+		}
+		if !added {
+			return nil, fmt.Errorf("local repos are still missing after sharing them: %s",
+				strings.Join(names, ", "))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/sipsma/bincastle/examples/distro/src"
+	"github.com/sipsma/bincastle/graph"
+	"github.com/stretchr/testify/require"
+)
+
+func layerDefs(t *testing.T, spec graph.AsSpec) []*pb.Definition {
+	layers, err := graph.Build(spec).MarshalLayers(context.TODO(), llb.LinuxAmd64)
+	require.NoError(t, err)
+	var defs []*pb.Definition
+	for _, layer := range layers {
+		def := &pb.Definition{}
+		require.NoError(t, def.Unmarshal(layer.LLB))
+		defs = append(defs, def)
+	}
+	return defs
+}
+
+func TestMissingLocalRepos(t *testing.T) {
+	const repoName = src.LocalRepoPrefix + "/repos/foo.git"
+	spec := graph.LayerSpec(
+		graph.Dep(src.ViaGit{URL: "file:///repos/foo.git", Ref: "main", Name: "foo-src"}),
+		graph.Dep(src.ViaGit{URL: "https://example.com/bar.git", Ref: "main", Name: "bar-src", NoSubmodules: true}),
+		// local dirs that aren't repos are shared by the client up front
+		graph.Dep(graph.Local{Path: "/definition"}),
+	)
+	defs := layerDefs(t, spec)
+
+	for _, tc := range []struct {
+		name    string
+		shared  []string
+		missing []string
+	}{
+		{name: "none shared", missing: []string{repoName}},
+		{name: "other dirs shared", shared: []string{"/definition"}, missing: []string{repoName}},
+		{name: "repo shared", shared: []string{repoName}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := missingLocalRepos(tc.shared, defs...)
+			if tc.missing == nil {
+				require.NoError(t, err)
+				return
+			}
+			missing, ok := err.(*missingLocalReposError)
+			require.True(t, ok, "%v", err)
+			require.Equal(t, tc.missing, missing.names)
+
+			// the client is asked to share them instead of failing
+			res, err := missing.result()
+			require.NoError(t, err)
+			var names []string
+			require.NoError(t, json.Unmarshal(res.Metadata[localReposResponseKey], &names))
+			require.Equal(t, tc.missing, names)
+		})
+	}
+}
+
+func TestShareLocalRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bincastle-local-repo")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bare := filepath.Join(dir, "bare.git")
+	work := filepath.Join(dir, "work")
+	notRepo := filepath.Join(dir, "other")
+	for _, d := range []string{bare, filepath.Join(work, ".git"), notRepo} {
+		require.NoError(t, os.MkdirAll(d, 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bare, "HEAD"), []byte("ref: refs/heads/main\n"), 0644))
+
+	for _, tc := range []struct {
+		name string
+		dir  string
+		err  bool
+	}{
+		{name: "bare repo", dir: src.LocalRepoPrefix + bare},
+		{name: "work tree", dir: src.LocalRepoPrefix + work},
+		{name: "not a repo", dir: src.LocalRepoPrefix + notRepo, err: true},
+		{name: "relative path", dir: src.LocalRepoPrefix + "work", err: true},
+		{name: "not a local repo", dir: bare, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opt := &client.SolveOpt{}
+			err := shareLocalRepo(opt, tc.dir)
+			if tc.err {
+				require.Error(t, err)
+				require.Empty(t, opt.LocalDirs)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{
+				tc.dir: tc.dir[len(src.LocalRepoPrefix):],
+			}, opt.LocalDirs)
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/worker"
+	"github.com/opencontainers/go-digest"
+	"github.com/sipsma/bincastle/examples/distro/src"
+	"github.com/sipsma/bincastle/graph"
+)
+
+// LockFilePath returns the path of the lock file of the system's definition,
+// which is only known for definitions in a local dir.
+func LockFilePath(args BincastleArgs) (string, error) {
+	if args.SourceLocalDir == "" {
+		return "", fmt.Errorf("only definitions in a local dir can be locked, "+
+			"commit the %s of a git definition to its repo instead", graph.LockFileName)
+	}
+	return filepath.Join(args.SourceLocalDir, args.SourceSubdir, graph.LockFileName), nil
+}
+
+// WriteLock evaluates the system's definition and writes the lock of the
+// sources it uses next to it, returning how it differs from the previous
+// lock. Sources already in the lock keep their versions unless update is
+// set.
+func WriteLock(ctx context.Context, args BincastleArgs, update bool) (*graph.Lock, graph.LockDiff, error) {
+	path, err := LockFilePath(args)
+	if err != nil {
+		return nil, graph.LockDiff{}, err
+	}
+	oldLock, err := graph.ReadLock(path)
+	if err != nil {
+		return nil, graph.LockDiff{}, err
+	}
+	attrs := map[string]string{}
+	if update {
+		attrs[KeyUpdateLock] = "true"
+	}
+	out, err := evaluateDefinition(ctx, args, LockSources, attrs, lockResponseKey)
+	if err != nil {
+		return nil, graph.LockDiff{}, err
+	}
+	lock := graph.NewLock()
+	if err := json.Unmarshal(out, lock); err != nil {
+		return nil, graph.LockDiff{}, fmt.Errorf("failed to unmarshal lock: %w", err)
+	}
+	if err := lock.Write(path); err != nil {
+		return nil, graph.LockDiff{}, err
+	}
+	return lock, graph.DiffLocks(oldLock, lock), nil
+}
+
+// lock evaluates the definition to find the sources it uses and resolves
+// the images, git refs and downloads that aren't pinned yet, which the
+// definition can't do itself.
+func (f *BincastleFrontend) lock(
+	ctx context.Context, llbBridge frontend.FrontendLLBBridge, a *args, sid string,
+) (*frontend.Result, error) {
+	out, err := f.runDefinitionSource(ctx, llbBridge, a, sid, "-lock")
+	if err != nil {
+		return nil, err
+	}
+	lock := graph.NewLock()
+	if err := json.Unmarshal(out, lock); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lock: %w", err)
+	}
+
+	for ref, dgst := range lock.Images {
+		if dgst != "" {
+			continue
+		}
+		dgst, _, err := llbBridge.ResolveImageConfig(ctx, ref, llb.ResolveImageConfigOpt{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve image %s: %w", ref, err)
+		}
+		lock.Images[ref] = dgst
+	}
+	for key, commit := range lock.Git {
+		if commit != "" {
+			continue
+		}
+		split := strings.LastIndex(key, "#")
+		if split < 0 {
+			return nil, fmt.Errorf("invalid git source %q", key)
+		}
+		commit, err := f.gitCommit(ctx, llbBridge, a, key[:split], key[split+1:], sid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve git ref %s: %w", key, err)
+		}
+		lock.Git[key] = commit
+	}
+	for url, dgst := range lock.Downloads {
+		if dgst != "" {
+			continue
+		}
+		dgst, err := f.downloadChecksum(ctx, llbBridge, url, sid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get checksum of %s: %w", url, err)
+		}
+		lock.Downloads[url] = dgst
+	}
+
+	lockJSON, err := json.Marshal(lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal lock: %w", err)
+	}
+	return &frontend.Result{
+		Metadata: map[string][]byte{lockResponseKey: lockJSON},
+	}, nil
+}
+
+// downloadChecksum downloads url with buildkit's http source and returns the
+// digest of its contents.
+func (f *BincastleFrontend) downloadChecksum(
+	ctx context.Context, llbBridge frontend.FrontendLLBBridge, url string, sid string,
+) (digest.Digest, error) {
+	const filename = "download"
+	def, err := llb.HTTP(url, llb.Filename(filename)).Marshal(ctx, llb.LinuxAmd64)
+	if err != nil {
+		return "", err
+	}
+	var dgst digest.Digest
+	err = f.withSolvedFile(ctx, llbBridge, def.ToPB(), filename, sid, func(downloadFile *os.File) error {
+		dgst, err = digest.FromReader(downloadFile)
+		return err
+	})
+	return dgst, err
+}
+
+// gitCommit resolves ref of the git repo at url to the commit it points to.
+func (f *BincastleFrontend) gitCommit(
+	ctx context.Context, llbBridge frontend.FrontendLLBBridge, a *args, url string, ref string, sid string,
+) (string, error) {
+	layers, err := graph.Build(src.GitCommit{URL: url, Ref: ref}).MarshalLayers(ctx, llb.LinuxAmd64)
+	if err != nil {
+		return "", err
+	}
+	var def pb.Definition
+	if err := (&def).Unmarshal(layers[len(layers)-1].LLB); err != nil {
+		return "", err
+	}
+	if err := missingLocalRepos(a.LocalDirs, &def); err != nil {
+		return "", err
+	}
+	var commit string
+	err = f.withSolvedFile(ctx, llbBridge, &def, src.GitCommitFile, sid, func(commitFile *os.File) error {
+		bytes, err := ioutil.ReadAll(commitFile)
+		commit = string(bytes)
+		return err
+	})
+	if err == nil && !graph.IsCommitSHA(commit) {
+		err = fmt.Errorf("resolved to invalid commit %q", commit)
+	}
+	return commit, err
+}
+
+// withSolvedFile solves def and calls fn with the file at path in its result.
+func (f *BincastleFrontend) withSolvedFile(
+	ctx context.Context, llbBridge frontend.FrontendLLBBridge, def *pb.Definition, path string, sid string,
+	fn func(*os.File) error,
+) error {
+	res, err := llbBridge.Solve(ctx, frontend.SolveRequest{Definition: def}, sid)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		res.EachRef(func(ref solver.ResultProxy) error {
+			return ref.Release(context.TODO())
+		})
+	}()
+	if res.Ref == nil {
+		return fmt.Errorf("result is missing ref")
+	}
+	r, err := res.Ref.Result(ctx)
+	if err != nil {
+		return err
+	}
+	workerRef, ok := r.Sys().(*worker.WorkerRef)
+	if !ok {
+		return fmt.Errorf("solve returned invalid ref type: %T", r.Sys())
+	}
+	mountable, err := workerRef.ImmutableRef.Mount(ctx, true)
+	if err != nil {
+		return err
+	}
+	mounts, cleanup, err := mountable.Mount()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	return mount.WithTempMount(ctx, mounts, func(root string) error {
+		file, err := os.Open(filepath.Join(root, path))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return fn(file)
+	})
+}
@@ -0,0 +1,88 @@
+package buildkit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/entitlements"
+)
+
+// hostResolvConfPath is where the system container has the host's
+// resolv.conf mounted.
+const hostResolvConfPath = "/etc/resolv.conf"
+
+// allowedEntitlements are requested by every build so that layers with
+// graph.NetworkAccess can use the network in hermetic mode.
+var allowedEntitlements = []entitlements.Entitlement{entitlements.EntitlementNetworkHost}
+
+// NetworkConfig configures the network of build steps.
+type NetworkConfig struct {
+	// DNS, if set, is used for the resolv.conf of build steps instead of the
+	// host's.
+	DNS *DNSConfig `json:"dns,omitempty"`
+	// Hermetic runs each build step in its own network namespace that only
+	// has loopback, unless its layer has graph.NetworkAccess. Execs of a
+	// system always share the host's network.
+	Hermetic bool `json:"hermetic,omitempty"`
+}
+
+// DNSConfig is the contents of the resolv.conf given to build steps.
+type DNSConfig struct {
+	Nameservers   []string `json:"nameservers"`
+	SearchDomains []string `json:"searchDomains,omitempty"`
+	Options       []string `json:"options,omitempty"`
+}
+
+// Validate checks that a DNS config, if any, has valid nameservers.
+func (c NetworkConfig) Validate() error {
+	if c.DNS == nil {
+		return nil
+	}
+	if len(c.DNS.Nameservers) == 0 {
+		return fmt.Errorf("dns config must have at least one nameserver")
+	}
+	for _, nameserver := range c.DNS.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return fmt.Errorf("invalid nameserver %q", nameserver)
+		}
+	}
+	return nil
+}
+
+func (c NetworkConfig) resolvConf() ([]byte, error) {
+	if c.DNS == nil {
+		resolvConf, err := ioutil.ReadFile(hostResolvConfPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read host resolv.conf: %w", err)
+		}
+		return resolvConf, nil
+	}
+
+	var lines []string
+	for _, nameserver := range c.DNS.Nameservers {
+		lines = append(lines, fmt.Sprintf("nameserver %s", nameserver))
+	}
+	if len(c.DNS.SearchDomains) > 0 {
+		lines = append(lines, fmt.Sprintf("search %s", strings.Join(c.DNS.SearchDomains, " ")))
+	}
+	if len(c.DNS.Options) > 0 {
+		lines = append(lines, fmt.Sprintf("options %s", strings.Join(c.DNS.Options, " ")))
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+// isolateNetwork returns whether a build step with the given network mode
+// runs in its own network namespace rather than sharing the host's.
+func (c NetworkConfig) isolateNetwork(netMode pb.NetMode) bool {
+	switch netMode {
+	case pb.NetMode_NONE:
+		return true
+	case pb.NetMode_HOST:
+		return false
+	default:
+		return c.Hermetic
+	}
+}
@@ -0,0 +1,105 @@
+package buildkit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/sipsma/bincastle/ctr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config NetworkConfig
+		err    bool
+	}{
+		{name: "host dns"},
+		{name: "hermetic", config: NetworkConfig{Hermetic: true}},
+		{name: "ipv4 and ipv6", config: NetworkConfig{DNS: &DNSConfig{Nameservers: []string{"10.0.0.2", "fd00::2"}}}},
+		{name: "no nameservers", config: NetworkConfig{DNS: &DNSConfig{SearchDomains: []string{"internal"}}}, err: true},
+		{name: "hostname", config: NetworkConfig{DNS: &DNSConfig{Nameservers: []string{"dns.internal"}}}, err: true},
+		{name: "with port", config: NetworkConfig{DNS: &DNSConfig{Nameservers: []string{"10.0.0.2:53"}}}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if tc.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestResolvConf(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		dns        DNSConfig
+		resolvConf string
+	}{{
+		name:       "nameservers",
+		dns:        DNSConfig{Nameservers: []string{"10.0.0.2", "10.0.0.3"}},
+		resolvConf: "nameserver 10.0.0.2\nnameserver 10.0.0.3\n",
+	}, {
+		name: "search and options",
+		dns: DNSConfig{
+			Nameservers:   []string{"10.0.0.2"},
+			SearchDomains: []string{"corp.internal", "internal"},
+			Options:       []string{"ndots:2", "timeout:1"},
+		},
+		resolvConf: "nameserver 10.0.0.2\nsearch corp.internal internal\noptions ndots:2 timeout:1\n",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			dns := tc.dns
+			resolvConf, err := NetworkConfig{DNS: &dns}.resolvConf()
+			require.NoError(t, err)
+			require.Equal(t, tc.resolvConf, string(resolvConf))
+		})
+	}
+
+	// without a dns config, the host's is inherited
+	hostResolvConf, err := ioutil.ReadFile(hostResolvConfPath)
+	if err != nil {
+		t.Skipf("no host resolv.conf: %v", err)
+	}
+	resolvConf, err := NetworkConfig{}.resolvConf()
+	require.NoError(t, err)
+	require.Equal(t, hostResolvConf, resolvConf)
+}
+
+func TestIsolateNetwork(t *testing.T) {
+	for _, tc := range []struct {
+		netMode  pb.NetMode
+		hermetic bool
+		isolate  bool
+	}{
+		{netMode: pb.NetMode_UNSET, isolate: false},
+		{netMode: pb.NetMode_UNSET, hermetic: true, isolate: true},
+		// layers with graph.NetworkAccess
+		{netMode: pb.NetMode_HOST, isolate: false},
+		{netMode: pb.NetMode_HOST, hermetic: true, isolate: false},
+		{netMode: pb.NetMode_NONE, isolate: true},
+		{netMode: pb.NetMode_NONE, hermetic: true, isolate: true},
+	} {
+		require.Equal(t, tc.isolate, NetworkConfig{Hermetic: tc.hermetic}.isolateNetwork(tc.netMode),
+			"%s hermetic=%v", tc.netMode, tc.hermetic)
+	}
+}
+
+func TestExecutorResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bincastle-executor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = newRuncExecutor(filepath.Join(dir, "state"), NetworkConfig{
+		DNS: &DNSConfig{Nameservers: []string{"10.0.0.2"}},
+	}, ctr.NoOverlayfsBackend{})
+	require.NoError(t, err)
+	resolvConf, err := ioutil.ReadFile(filepath.Join(dir, "state", "resolv.conf"))
+	require.NoError(t, err)
+	require.Equal(t, "nameserver 10.0.0.2\n", string(resolvConf))
+}
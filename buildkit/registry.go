@@ -0,0 +1,148 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/moby/buildkit/cmd/buildkitd/config"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/util/resolver"
+	"google.golang.org/grpc"
+)
+
+// RegistryConfig configures how the daemon connects to a registry host.
+// Paths are of files in the daemon's filesystem, except for those in Auth
+// which are read by the client.
+type RegistryConfig struct {
+	// Mirrors are hosts that images are pulled from before trying this one.
+	Mirrors []string `json:"mirrors,omitempty"`
+	// PlainHTTP connects to the host with http instead of https.
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+	// Insecure skips verifying the host's certificate.
+	Insecure bool `json:"insecure,omitempty"`
+	// CAs are files of PEM certificates the host's certificate is verified
+	// with in addition to the system's.
+	CAs []string `json:"ca,omitempty"`
+	// ClientCert and ClientKey are files of a keypair to authenticate to the
+	// host with.
+	ClientCert string `json:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty"`
+	// Auth, if set, is used instead of the credentials in the docker config.
+	Auth *RegistryAuth `json:"auth,omitempty"`
+}
+
+// RegistryAuth is the credentials used for a registry host.
+type RegistryAuth struct {
+	Username string `json:"username"`
+	// PasswordFile holds the password (or token) so it doesn't need to be in
+	// the config itself.
+	PasswordFile string `json:"passwordFile"`
+}
+
+// RegistryConfigs are the configs of registry hosts, keyed by host (i.e.
+// "docker.io" or "registry.example.com:5000"). Hosts without a config use
+// https with the system's certificates, except for localhost which uses http.
+type RegistryConfigs map[string]RegistryConfig
+
+func (c RegistryConfigs) hosts() docker.RegistryHosts {
+	bkConfigs := make(map[string]config.RegistryConfig)
+	for host, rc := range c {
+		plainHTTP := rc.PlainHTTP
+		insecure := rc.Insecure
+		bkConfig := config.RegistryConfig{
+			Mirrors:  rc.Mirrors,
+			Insecure: &insecure,
+			RootCAs:  rc.CAs,
+		}
+		// leaving PlainHTTP unset keeps the default of http for localhost
+		if plainHTTP {
+			bkConfig.PlainHTTP = &plainHTTP
+		}
+		if rc.ClientCert != "" || rc.ClientKey != "" {
+			bkConfig.KeyPairs = []config.TLSKeyPair{{
+				Certificate: rc.ClientCert,
+				Key:         rc.ClientKey,
+			}}
+		}
+		bkConfigs[host] = bkConfig
+	}
+	return resolver.NewRegistryConfig(bkConfigs)
+}
+
+// Validate checks that the files each config refers to can be read.
+func (c RegistryConfigs) Validate() error {
+	for host, rc := range c {
+		if (rc.ClientCert == "") != (rc.ClientKey == "") {
+			return fmt.Errorf("registry %s: clientCert and clientKey must be set together", host)
+		}
+		if rc.Auth != nil {
+			if rc.Auth.Username == "" {
+				return fmt.Errorf("registry %s: auth is missing a username", host)
+			}
+			if _, err := os.Stat(rc.Auth.PasswordFile); err != nil {
+				return fmt.Errorf("registry %s: %w", host, err)
+			}
+		}
+		for _, path := range rc.Files() {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("registry %s: %w", host, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Files returns the paths of every file the daemon reads for the config.
+func (rc RegistryConfig) Files() []string {
+	files := append([]string{}, rc.CAs...)
+	if rc.ClientCert != "" {
+		files = append(files, rc.ClientCert)
+	}
+	if rc.ClientKey != "" {
+		files = append(files, rc.ClientKey)
+	}
+	return files
+}
+
+// registryAuthProvider gives the credentials of registries with an Auth
+// config, falling back to the docker config for others.
+type registryAuthProvider struct {
+	registries RegistryConfigs
+	docker     auth.AuthServer
+}
+
+func newRegistryAuthProvider(registries RegistryConfigs) session.Attachable {
+	return &registryAuthProvider{
+		registries: registries,
+		docker:     authprovider.NewDockerAuthProvider(os.Stderr).(auth.AuthServer),
+	}
+}
+
+func (ap *registryAuthProvider) Register(server *grpc.Server) {
+	auth.RegisterAuthServer(server, ap)
+}
+
+func (ap *registryAuthProvider) Credentials(ctx context.Context, req *auth.CredentialsRequest) (*auth.CredentialsResponse, error) {
+	host := req.Host
+	if host == "registry-1.docker.io" {
+		host = "docker.io"
+	}
+	rc, ok := ap.registries[host]
+	if !ok || rc.Auth == nil {
+		return ap.docker.Credentials(ctx, req)
+	}
+	password, err := ioutil.ReadFile(rc.Auth.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password of registry %s: %w", host, err)
+	}
+	return &auth.CredentialsResponse{
+		Username: rc.Auth.Username,
+		Secret:   strings.TrimSpace(string(password)),
+	}, nil
+}
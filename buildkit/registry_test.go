@@ -0,0 +1,202 @@
+package buildkit
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/moby/buildkit/session/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKeyPair writes a self-signed certificate and its key to dir.
+func writeKeyPair(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "registry.internal"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644))
+	require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600))
+	return certPath, keyPath
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bincastle-registry")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestRegistryConfigsValidate(t *testing.T) {
+	dir := tempDir(t)
+	cert, key := writeKeyPair(t, dir)
+	password := filepath.Join(dir, "password")
+	require.NoError(t, ioutil.WriteFile(password, []byte("secret\n"), 0600))
+	missing := filepath.Join(dir, "missing")
+
+	for _, tc := range []struct {
+		name   string
+		config RegistryConfig
+		err    bool
+	}{
+		{name: "empty"},
+		{name: "files", config: RegistryConfig{CAs: []string{cert}, ClientCert: cert, ClientKey: key}},
+		{name: "auth", config: RegistryConfig{Auth: &RegistryAuth{Username: "ci", PasswordFile: password}}},
+		{name: "missing ca", config: RegistryConfig{CAs: []string{cert, missing}}, err: true},
+		{name: "cert without key", config: RegistryConfig{ClientCert: cert}, err: true},
+		{name: "key without cert", config: RegistryConfig{ClientKey: key}, err: true},
+		{name: "missing key", config: RegistryConfig{ClientCert: cert, ClientKey: missing}, err: true},
+		{name: "auth without username", config: RegistryConfig{Auth: &RegistryAuth{PasswordFile: password}}, err: true},
+		{name: "missing password", config: RegistryConfig{Auth: &RegistryAuth{Username: "ci", PasswordFile: missing}}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := RegistryConfigs{"registry.internal": tc.config}.Validate()
+			if tc.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRegistryHosts(t *testing.T) {
+	dir := tempDir(t)
+	cert, key := writeKeyPair(t, dir)
+
+	type host struct {
+		scheme, host string
+	}
+	for _, tc := range []struct {
+		name    string
+		configs RegistryConfigs
+		lookup  string
+		hosts   []host
+		err     bool
+	}{{
+		name:   "unconfigured",
+		lookup: "registry.internal",
+		hosts:  []host{{"https", "registry.internal"}},
+	}, {
+		name:   "unconfigured localhost",
+		lookup: "localhost:5000",
+		hosts:  []host{{"http", "localhost:5000"}},
+	}, {
+		name:    "mirrors are tried first",
+		configs: RegistryConfigs{"docker.io": {Mirrors: []string{"mirror.internal"}}},
+		lookup:  "docker.io",
+		hosts:   []host{{"https", "mirror.internal"}, {"https", "registry-1.docker.io"}},
+	}, {
+		name:    "plain http",
+		configs: RegistryConfigs{"registry.internal:5000": {PlainHTTP: true}},
+		lookup:  "registry.internal:5000",
+		hosts:   []host{{"http", "registry.internal:5000"}},
+	}, {
+		name:    "insecure",
+		configs: RegistryConfigs{"registry.internal": {Insecure: true}},
+		lookup:  "registry.internal",
+		hosts:   []host{{"https", "registry.internal"}},
+	}, {
+		name:    "configured localhost",
+		configs: RegistryConfigs{"localhost:5000": {Mirrors: []string{"mirror.internal"}}},
+		lookup:  "localhost:5000",
+		hosts:   []host{{"https", "mirror.internal"}, {"http", "localhost:5000"}},
+	}, {
+		name:    "certs",
+		configs: RegistryConfigs{"registry.internal": {CAs: []string{cert}, ClientCert: cert, ClientKey: key}},
+		lookup:  "registry.internal",
+		hosts:   []host{{"https", "registry.internal"}},
+	}, {
+		name:    "missing ca",
+		configs: RegistryConfigs{"registry.internal": {CAs: []string{filepath.Join(dir, "missing")}}},
+		lookup:  "registry.internal",
+		err:     true,
+	}, {
+		name:    "invalid keypair",
+		configs: RegistryConfigs{"registry.internal": {ClientCert: key, ClientKey: cert}},
+		lookup:  "registry.internal",
+		err:     true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			registryHosts, err := tc.configs.hosts()(tc.lookup)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var hosts []host
+			for _, h := range registryHosts {
+				hosts = append(hosts, host{h.Scheme, h.Host})
+			}
+			require.Equal(t, tc.hosts, hosts)
+		})
+	}
+}
+
+func TestRegistryAuthProvider(t *testing.T) {
+	dir := tempDir(t)
+	password := filepath.Join(dir, "password")
+	require.NoError(t, ioutil.WriteFile(password, []byte("secret\n"), 0600))
+
+	// hosts without an auth config use the docker config
+	dockerConfig := `{"auths": {"other.internal": {"auth": "` +
+		base64.StdEncoding.EncodeToString([]byte("docker:dockersecret")) + `"}}}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(dockerConfig), 0600))
+	defer dockerconfig.SetDir(dockerconfig.Dir())
+	dockerconfig.SetDir(dir)
+
+	ap := newRegistryAuthProvider(RegistryConfigs{
+		"docker.io":         {Auth: &RegistryAuth{Username: "hub", PasswordFile: password}},
+		"registry.internal": {Auth: &RegistryAuth{Username: "ci", PasswordFile: password}},
+		"other.internal":    {Mirrors: []string{"mirror.internal"}},
+		"broken.internal":   {Auth: &RegistryAuth{Username: "ci", PasswordFile: filepath.Join(dir, "missing")}},
+	}).(*registryAuthProvider)
+
+	for _, tc := range []struct {
+		host     string
+		username string
+		secret   string
+		err      bool
+	}{
+		{host: "registry.internal", username: "ci", secret: "secret"},
+		{host: "registry-1.docker.io", username: "hub", secret: "secret"},
+		{host: "other.internal", username: "docker", secret: "dockersecret"},
+		{host: "unknown.internal"},
+		{host: "broken.internal", err: true},
+	} {
+		t.Run(tc.host, func(t *testing.T) {
+			resp, err := ap.Credentials(context.TODO(), &auth.CredentialsRequest{Host: tc.host})
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.username, resp.Username)
+			require.Equal(t, tc.secret, resp.Secret)
+		})
+	}
+}
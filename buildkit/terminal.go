@@ -0,0 +1,229 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/console"
+	"github.com/containerd/fifo"
+	"github.com/moby/buildkit/executor"
+
+	"github.com/sipsma/bincastle/ctr"
+)
+
+// terminal shares a single tty between all the execs of a chain. Only the
+// exec in the foreground receives input and has its output displayed; execs
+// in the background keep running but their output is discarded until they
+// are brought back to the foreground.
+type terminal struct {
+	in  io.Reader
+	out io.Writer
+	// setupConsole prepares the tty and returns its size changes
+	setupConsole func(context.Context) (<-chan console.WinSize, func(), error)
+
+	mu         sync.Mutex
+	foreground *termSession
+	size       *console.WinSize
+	sessions   int
+	cleanup    func()
+	cancel     func()
+	startOnce  sync.Once
+}
+
+// newTerminal returns a terminal for the tty of this process.
+func newTerminal(in io.Reader, out io.Writer) *terminal {
+	return &terminal{in: in, out: out, setupConsole: ctr.SetupSelfConsole}
+}
+
+// newClientTerminal returns a terminal for the tty of an outside client,
+// which is attached to the tty fifos in ioDir.
+func newClientTerminal(ioDir ctr.IODir) (*terminal, func(), error) {
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	for _, f := range []struct {
+		path string
+		flag int
+	}{
+		{ioDir.TTYInFifo(), syscall.O_RDONLY},
+		{ioDir.TTYOutFifo(), syscall.O_WRONLY},
+		{ioDir.ResizeFifo(), syscall.O_RDONLY},
+	} {
+		// nonblock means this doesn't wait for the client to open the other end
+		rwc, err := fifo.OpenFifo(context.TODO(), f.path, f.flag|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to open client fifo %s: %w", f.path, err)
+		}
+		closers = append(closers, rwc)
+	}
+	in, out, resize := closers[0].(io.Reader), closers[1].(io.Writer), closers[2].(io.Reader)
+
+	return &terminal{
+		in:  in,
+		out: out,
+		setupConsole: func(ctx context.Context) (<-chan console.WinSize, func(), error) {
+			resizeCh := make(chan console.WinSize)
+			go func() {
+				defer close(resizeCh)
+				dec := json.NewDecoder(resize)
+				for {
+					var winSize console.WinSize
+					if err := dec.Decode(&winSize); err != nil {
+						return
+					}
+					select {
+					case resizeCh <- winSize:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return resizeCh, func() {}, nil
+		},
+	}, closeAll, nil
+}
+
+type termSession struct {
+	term     *terminal
+	stdinR   *io.PipeReader
+	stdinW   *io.PipeWriter
+	resizeCh chan executor.WinSize
+}
+
+// session creates a new, initially backgrounded, set of IO for an exec.
+func (t *terminal) session() (*termSession, error) {
+	t.startOnce.Do(func() {
+		go t.copyInput()
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.sessions == 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		resizeCh, cleanup, err := t.setupConsole(ctx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		t.cleanup = cleanup
+		t.cancel = cancel
+		go func() {
+			for winSize := range resizeCh {
+				winSize := winSize
+				t.mu.Lock()
+				t.size = &winSize
+				if t.foreground != nil {
+					t.foreground.resize(winSize)
+				}
+				t.mu.Unlock()
+			}
+		}()
+	}
+	t.sessions++
+
+	stdinR, stdinW := io.Pipe()
+	return &termSession{
+		term:     t,
+		stdinR:   stdinR,
+		stdinW:   stdinW,
+		resizeCh: make(chan executor.WinSize, 1),
+	}, nil
+}
+
+func (t *terminal) copyInput() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.in.Read(buf)
+		if n > 0 {
+			t.mu.Lock()
+			fg := t.foreground
+			t.mu.Unlock()
+			if fg != nil {
+				// a closed session will return an error here, which just
+				// means the input is dropped
+				fg.stdinW.Write(buf[:n])
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *termSession) setForeground() {
+	s.term.mu.Lock()
+	defer s.term.mu.Unlock()
+	s.term.foreground = s
+	if s.term.size != nil {
+		s.resize(*s.term.size)
+	}
+}
+
+// resize must be called with the terminal's lock held
+func (s *termSession) resize(winSize console.WinSize) {
+	newSize := executor.WinSize{
+		Rows: uint32(winSize.Height),
+		Cols: uint32(winSize.Width),
+	}
+	// only the latest size matters, so replace any pending one
+	select {
+	case <-s.resizeCh:
+	default:
+	}
+	s.resizeCh <- newSize
+}
+
+func (s *termSession) isForeground() bool {
+	s.term.mu.Lock()
+	defer s.term.mu.Unlock()
+	return s.term.foreground == s
+}
+
+func (s *termSession) close() {
+	s.stdinW.Close()
+
+	s.term.mu.Lock()
+	defer s.term.mu.Unlock()
+	if s.term.foreground == s {
+		s.term.foreground = nil
+	}
+	close(s.resizeCh)
+	s.term.sessions--
+	if s.term.sessions == 0 {
+		s.term.cancel()
+		s.term.cleanup()
+	}
+}
+
+func (s *termSession) processInfo(meta executor.Meta) executor.ProcessInfo {
+	return executor.ProcessInfo{
+		Meta:   meta,
+		Stdin:  s.stdinR,
+		Stdout: termOutput{s},
+		Resize: s.resizeCh,
+	}
+}
+
+type termOutput struct {
+	session *termSession
+}
+
+func (o termOutput) Write(b []byte) (int, error) {
+	if !o.session.isForeground() {
+		return len(b), nil
+	}
+	return o.session.term.out.Write(b)
+}
+
+func (o termOutput) Close() error {
+	return nil
+}
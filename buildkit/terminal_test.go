@@ -0,0 +1,97 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/moby/buildkit/executor"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer that's safe to write from the terminal.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func testTerminal(t *testing.T) (*terminal, io.Writer, chan<- console.WinSize, *syncBuffer) {
+	inR, inW := io.Pipe()
+	t.Cleanup(func() { inW.Close() })
+	out := &syncBuffer{}
+	resizeCh := make(chan console.WinSize)
+	return &terminal{
+		in:  inR,
+		out: out,
+		setupConsole: func(context.Context) (<-chan console.WinSize, func(), error) {
+			return resizeCh, func() {}, nil
+		},
+	}, inW, resizeCh, out
+}
+
+func readSize(t *testing.T, s *termSession) executor.WinSize {
+	select {
+	case size := <-s.resizeCh:
+		return size
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for resize")
+		return executor.WinSize{}
+	}
+}
+
+func TestTerminalSessions(t *testing.T) {
+	term, in, resizeCh, out := testTerminal(t)
+	first, err := term.session()
+	require.NoError(t, err)
+	second, err := term.session()
+	require.NoError(t, err)
+
+	first.setForeground()
+	resizeCh <- console.WinSize{Height: 10, Width: 20}
+	require.Equal(t, executor.WinSize{Rows: 10, Cols: 20}, readSize(t, first))
+
+	// only the foreground session gets input and shows its output
+	_, err = in.Write([]byte("a"))
+	require.NoError(t, err)
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(first.stdinR, buf)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(buf))
+	termOutput{first}.Write([]byte("first"))
+	termOutput{second}.Write([]byte("second"))
+	require.Equal(t, "first", out.String())
+
+	// a session brought to the foreground gets the terminal's current size
+	second.setForeground()
+	require.Equal(t, executor.WinSize{Rows: 10, Cols: 20}, readSize(t, second))
+	require.False(t, first.isForeground())
+	termOutput{first}.Write([]byte("first"))
+	termOutput{second}.Write([]byte("second"))
+	require.Equal(t, "firstsecond", out.String())
+
+	// closing the foreground session leaves no session in the foreground
+	second.close()
+	_, err = ioutil.ReadAll(second.stdinR)
+	require.NoError(t, err)
+	require.Nil(t, term.foreground)
+	require.Equal(t, 1, term.sessions)
+	first.close()
+	require.Equal(t, 0, term.sessions)
+}
@@ -0,0 +1,294 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/cache"
+	cacheMetadata "github.com/moby/buildkit/cache/metadata"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/cmd/buildkitd/config"
+	"github.com/moby/buildkit/frontend"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/worker"
+	"github.com/moby/buildkit/worker/base"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	layerNameKey     = "bincastle.LayerName"
+	usageResponseKey = "frontend.bincastle.usage"
+
+	// the key llb.WithCustomName sets in the op's metadata description
+	customNameKey = "llb.customname"
+)
+
+// GCConfig configures the garbage collection of the daemon's build cache.
+// Persistent exec state is never garbage collected, it can only be removed
+// with RemoveExec.
+type GCConfig struct {
+	Disabled bool
+	// KeepStorage is the amount of bytes the cache may use before records are
+	// pruned. If 0, a default based on the size of the filesystem is used.
+	KeepStorage int64
+	// KeepDuration, if set, overrides how long unused records are kept before
+	// being eligible for pruning.
+	KeepDuration time.Duration
+}
+
+var DefaultGCConfig = GCConfig{
+	KeepStorage: 20e9, // ~20GB
+}
+
+func (c GCConfig) policy(root string) []client.PruneInfo {
+	if c.Disabled {
+		return nil
+	}
+	var policy []client.PruneInfo
+	for _, rule := range config.DefaultGCPolicy(root, c.KeepStorage) {
+		keepDuration := time.Duration(rule.KeepDuration) * time.Second
+		if c.KeepDuration != 0 && keepDuration != 0 {
+			keepDuration = c.KeepDuration
+		}
+		policy = append(policy, client.PruneInfo{
+			Filter:       rule.Filters,
+			All:          rule.All,
+			KeepBytes:    rule.KeepBytes,
+			KeepDuration: keepDuration,
+		})
+	}
+	return policy
+}
+
+// DiskUsageRecord is a record in the daemon's cache along with the name of
+// the layer or exec it belongs to, if known.
+type DiskUsageRecord struct {
+	*client.UsageInfo
+	LayerName string `json:"layerName,omitempty"`
+	ExecName  string `json:"execName,omitempty"`
+}
+
+// Name returns the most descriptive name available for the record.
+func (r DiskUsageRecord) Name() string {
+	switch {
+	case r.ExecName != "":
+		return "exec " + r.ExecName
+	case r.LayerName != "":
+		return r.LayerName
+	default:
+		return r.Description
+	}
+}
+
+// DiskUsage returns the records in the cache of the bincastle daemon
+// listening at sockPath that match any of the given filters.
+func DiskUsage(ctx context.Context, sockPath string, filters []string) ([]DiskUsageRecord, error) {
+	c, err := client.New(ctx, fmt.Sprintf(`unix://%s`, sockPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	defer c.Close()
+
+	filtersJSON, err := json.Marshal(filters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal filters: %w", err)
+	}
+	resp, err := c.Solve(ctx, nil, client.SolveOpt{
+		Frontend: "bincastle",
+		FrontendAttrs: map[string]string{
+			KeyRunType: string(DiskUsageList),
+			KeyFilters: string(filtersJSON),
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var records []DiskUsageRecord
+	if err := json.Unmarshal([]byte(resp.ExporterResponse[usageResponseKey]), &records); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal disk usage: %w", err)
+	}
+	return records, nil
+}
+
+// PruneOpts select which records Prune removes from the cache.
+type PruneOpts struct {
+	// Filters are buildkit cache filters (i.e. "type==regular"), records
+	// matching any of them are pruned.
+	Filters []string
+	// All includes internal and shared records.
+	All bool
+	// KeepStorage is the amount of bytes to keep in the cache.
+	KeepStorage int64
+	// UnusedFor only prunes records that haven't been used for this long.
+	UnusedFor time.Duration
+	// OlderThan only prunes records created at least this long ago.
+	OlderThan time.Duration
+}
+
+// Prune removes records from the cache of the bincastle daemon listening
+// at sockPath, returning the records that were removed. Persistent exec
+// state is never pruned.
+func Prune(ctx context.Context, sockPath string, opts PruneOpts) ([]client.UsageInfo, error) {
+	c, err := client.New(ctx, fmt.Sprintf(`unix://%s`, sockPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	defer c.Close()
+
+	filters := opts.Filters
+	if opts.OlderThan != 0 {
+		// buildkit doesn't support filtering on creation time, so find the
+		// matching records first and then prune them by id
+		usage, err := c.DiskUsage(ctx, client.WithFilter(opts.Filters))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get disk usage: %w", err)
+		}
+		filters = olderThanFilters(usage, time.Now().Add(-opts.OlderThan))
+		if len(filters) == 0 {
+			return nil, nil
+		}
+	}
+
+	pruneOpts := []client.PruneOption{
+		client.WithFilter(filters),
+		client.WithKeepOpt(opts.UnusedFor, opts.KeepStorage),
+	}
+	if opts.All {
+		pruneOpts = append(pruneOpts, client.PruneAll)
+	}
+
+	var pruned []client.UsageInfo
+	ch := make(chan client.UsageInfo)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for u := range ch {
+			pruned = append(pruned, u)
+		}
+	}()
+	err = c.Prune(ctx, ch, pruneOpts...)
+	close(ch)
+	<-doneCh
+	if err != nil {
+		return pruned, fmt.Errorf("failed to prune: %w", err)
+	}
+	return pruned, nil
+}
+
+// olderThanFilters returns filters matching the records in usage that were
+// created before cutoff by id.
+func olderThanFilters(usage []*client.UsageInfo, cutoff time.Time) []string {
+	var filters []string
+	for _, u := range usage {
+		if u.CreatedAt.Before(cutoff) {
+			filters = append(filters, "id=="+u.ID)
+		}
+	}
+	return filters
+}
+
+func (f *BincastleFrontend) diskUsage(ctx context.Context, filters []string) (*frontend.Result, error) {
+	usage, err := f.cacheManager.DiskUsage(ctx, client.DiskUsageInfo{Filter: filters})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get disk usage: %w", err)
+	}
+
+	records := []DiskUsageRecord{}
+	for _, u := range usage {
+		record := DiskUsageRecord{UsageInfo: u}
+		if si, ok := f.metadataStore.Get(u.ID); ok {
+			if v := si.Get(layerNameKey); v != nil {
+				if err := v.Unmarshal(&record.LayerName); err != nil {
+					return nil, fmt.Errorf("failed to unmarshal layer name of %s: %w", u.ID, err)
+				}
+			}
+			if v := si.Get(execNameKey); v != nil {
+				if err := v.Unmarshal(&record.ExecName); err != nil {
+					return nil, fmt.Errorf("failed to unmarshal exec name of %s: %w", u.ID, err)
+				}
+			}
+		}
+		records = append(records, record)
+	}
+
+	bytes, err := json.Marshal(records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal disk usage: %w", err)
+	}
+	return &frontend.Result{Metadata: map[string][]byte{
+		usageResponseKey: bytes,
+	}}, nil
+}
+
+// layerName returns the custom name set on the output vertex of the
+// definition, if any.
+func layerName(def *pb.Definition) string {
+	if len(def.Def) == 0 {
+		return ""
+	}
+	// the last op in a definition just points to the actual output
+	var op pb.Op
+	if err := (&op).Unmarshal(def.Def[len(def.Def)-1]); err != nil || len(op.Inputs) == 0 {
+		return ""
+	}
+	return def.Metadata[op.Inputs[0].Digest].Description[customNameKey]
+}
+
+func setLayerName(ref cache.ImmutableRef, name string) error {
+	v, err := cacheMetadata.NewValue(name)
+	if err != nil {
+		return fmt.Errorf("failed to create layer name value: %w", err)
+	}
+	si := ref.Metadata()
+	return si.Update(func(b *bolt.Bucket) error {
+		return si.SetValue(b, layerNameKey, v)
+	})
+}
+
+// execProtectingWorker makes sure the refs holding persistent exec state are
+// never pruned, whether by garbage collection or an explicit prune.
+type execProtectingWorker struct {
+	*base.Worker
+	metadataStore *cacheMetadata.Store
+}
+
+var _ worker.Worker = &execProtectingWorker{}
+
+func (w *execProtectingWorker) Prune(ctx context.Context, ch chan client.UsageInfo, opts ...client.PruneInfo) error {
+	items, err := w.metadataStore.All()
+	if err != nil {
+		return fmt.Errorf("failed to read metadata store: %w", err)
+	}
+	var exclusions []string
+	for _, item := range items {
+		if item.Get(execNameKey) != nil {
+			exclusions = append(exclusions, "id!="+item.ID())
+		}
+	}
+	if len(exclusions) == 0 {
+		return w.Worker.Prune(ctx, ch, opts...)
+	}
+
+	// filters in the same string are ANDed together, separate strings are ORed
+	exclude := strings.Join(exclusions, ",")
+	var protectedOpts []client.PruneInfo
+	for _, opt := range opts {
+		var filters []string
+		for _, filter := range opt.Filter {
+			if filter == "" {
+				filters = append(filters, exclude)
+			} else {
+				filters = append(filters, filter+","+exclude)
+			}
+		}
+		if len(filters) == 0 {
+			filters = []string{exclude}
+		}
+		opt.Filter = filters
+		protectedOpts = append(protectedOpts, opt)
+	}
+	return w.Worker.Prune(ctx, ch, protectedOpts...)
+}
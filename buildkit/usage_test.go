@@ -0,0 +1,165 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCConfigPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		config    GCConfig
+		durations []time.Duration
+		keepBytes int64
+	}{{
+		name:      "default",
+		config:    DefaultGCConfig,
+		durations: []time.Duration{48 * time.Hour, 60 * 24 * time.Hour, 0, 0},
+		keepBytes: DefaultGCConfig.KeepStorage,
+	}, {
+		// rules that keep records regardless of when they were used still do
+		name:      "keep duration",
+		config:    GCConfig{KeepStorage: 10e9, KeepDuration: time.Hour},
+		durations: []time.Duration{time.Hour, time.Hour, 0, 0},
+		keepBytes: 10e9,
+	}, {
+		name:   "disabled",
+		config: GCConfig{Disabled: true, KeepStorage: 10e9, KeepDuration: time.Hour},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := tc.config.policy("/")
+			if tc.durations == nil {
+				require.Nil(t, policy)
+				return
+			}
+			var durations []time.Duration
+			for _, rule := range policy {
+				durations = append(durations, rule.KeepDuration)
+			}
+			require.Equal(t, tc.durations, durations)
+			// the first rule only limits the most easily reproduced records
+			for _, rule := range policy[1:] {
+				require.Equal(t, tc.keepBytes, rule.KeepBytes)
+			}
+			// internal records are only pruned by the last rule
+			require.True(t, policy[len(policy)-1].All)
+		})
+	}
+}
+
+func TestOlderThanFilters(t *testing.T) {
+	now := time.Now()
+	usage := []*client.UsageInfo{
+		{ID: "old", CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "new", CreatedAt: now.Add(-time.Minute)},
+		{ID: "older", CreatedAt: now.Add(-48 * time.Hour)},
+	}
+	for _, tc := range []struct {
+		name    string
+		cutoff  time.Time
+		filters []string
+	}{
+		{name: "all", cutoff: now, filters: []string{"id==old", "id==new", "id==older"}},
+		{name: "some", cutoff: now.Add(-time.Hour), filters: []string{"id==old", "id==older"}},
+		{name: "none", cutoff: now.Add(-72 * time.Hour)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.filters, olderThanFilters(usage, tc.cutoff))
+		})
+	}
+}
+
+func TestDiskUsageRecordName(t *testing.T) {
+	info := &client.UsageInfo{Description: "mount / from exec /bin/sh"}
+	for _, tc := range []struct {
+		record DiskUsageRecord
+		name   string
+	}{
+		{record: DiskUsageRecord{UsageInfo: info}, name: "mount / from exec /bin/sh"},
+		{record: DiskUsageRecord{UsageInfo: info, LayerName: "gcc"}, name: "gcc"},
+		{record: DiskUsageRecord{UsageInfo: info, LayerName: "gcc", ExecName: "home"}, name: "exec home"},
+	} {
+		require.Equal(t, tc.name, tc.record.Name())
+	}
+}
+
+func TestLayerName(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		state llb.State
+	}{
+		{name: "gcc", state: llb.Scratch().File(llb.Mkdir("/a", 0755), llb.WithCustomName("gcc"))},
+		{name: "", state: llb.Scratch().File(llb.Mkdir("/a", 0755))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			def, err := tc.state.Marshal(context.TODO(), llb.LinuxAmd64)
+			require.NoError(t, err)
+			require.Equal(t, tc.name, layerName(def.ToPB()))
+		})
+	}
+	require.Empty(t, layerName(&pb.Definition{}))
+}
+
+func TestDiskUsageAndPrune(t *testing.T) {
+	ctx := context.TODO()
+	f, w := workerFrontend(t)
+
+	layerRef, err := f.cacheManager.New(ctx, nil, cache.CachePolicyRetain)
+	require.NoError(t, err)
+	layer, err := layerRef.Commit(ctx)
+	require.NoError(t, err)
+	// solved layers are finalized, separating them from the mutable ref
+	require.NoError(t, layer.Finalize(ctx, true))
+	require.NoError(t, setLayerName(layer, "gcc"))
+	require.NoError(t, layer.Release(ctx))
+	addExec(t, f, "home")
+
+	diskUsage := func() map[string]string {
+		res, err := f.diskUsage(ctx, nil)
+		require.NoError(t, err)
+		var records []DiskUsageRecord
+		require.NoError(t, json.Unmarshal(res.Metadata[usageResponseKey], &records))
+		names := make(map[string]string)
+		for _, record := range records {
+			names[record.ID] = record.Name()
+		}
+		return names
+	}
+	names := diskUsage()
+	require.Equal(t, "gcc", names[layer.ID()])
+	require.Equal(t, "exec home", names[execRecordID(t, f, "home")])
+
+	// exec state survives pruning everything
+	ch := make(chan client.UsageInfo)
+	pruned := make(map[string]bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for u := range ch {
+			pruned[u.ID] = true
+		}
+	}()
+	require.NoError(t, w.Prune(ctx, ch, client.PruneInfo{All: true}))
+	close(ch)
+	<-done
+	require.True(t, pruned[layer.ID()])
+	for id, name := range diskUsage() {
+		require.Equal(t, "exec home", name, id)
+	}
+	require.Len(t, listExecs(t, f), 1)
+}
+
+func execRecordID(t *testing.T, f *BincastleFrontend, execName string) string {
+	items, err := f.metadataStore.Search(execIndex(execName))
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	return items[0].ID()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/sipsma/bincastle/ctr"
+)
+
+// backgroundEnv is set for the copy of run that owns a system started with
+// --detach, which keeps running after the run that started it exits.
+const backgroundEnv = "BINCASTLE_BACKGROUND"
+
+func isBackground() bool {
+	return os.Getenv(backgroundEnv) != ""
+}
+
+// startBackground starts the system in a copy of this process in its own
+// session, so it outlives the terminal. Its output is logged to the state
+// root and the system's console is reached with attach.
+func startBackground(cfg *stateConfig, ctrState ctr.ContainerState, selfBin string) error {
+	if ctrState.ContainerExists() {
+		return ctr.ContainerExistsError{ID: ctrName}
+	}
+	// the system isn't running, so any socket still around is stale
+	if err := os.Remove(cfg.sockPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	logFile, err := os.OpenFile(cfg.logPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create log file: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(selfBin, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), backgroundEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start system in the background: %w", err)
+	}
+
+	exitCh := make(chan error, 1)
+	go func() {
+		exitCh <- cmd.Wait()
+	}()
+	readyCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second) // TODO don't hardcode
+		defer cancel()
+		readyCh <- waitToExist(ctx, cfg.sockPath())
+	}()
+
+	select {
+	case err := <-exitCh:
+		return fmt.Errorf("system exited during startup (see %s): %v", cfg.logPath(), err)
+	case err := <-readyCh:
+		if err != nil {
+			return fmt.Errorf("failed waiting for system to start (see %s): %w", cfg.logPath(), err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "system started in the background, logs are in %s\n", cfg.logPath())
+	return nil
+}
@@ -1,21 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/containerd/console"
 	"github.com/containerd/containerd/namespaces"
+	units "github.com/docker/go-units"
+	"github.com/gofrs/flock"
 	"github.com/hashicorp/go-multierror"
-	"github.com/moby/buildkit/client/llb"
 	"github.com/opencontainers/runc/libcontainer"
 	"github.com/sipsma/bincastle/buildkit"
 	"github.com/sipsma/bincastle/ctr"
@@ -30,8 +39,24 @@ import (
 const (
 	ctrName = "system"
 
-	runArg         = "run"
-	internalRunArg = "internalRun"
+	runArg          = "run"
+	internalRunArg  = "internalRun"
+	attachArg       = "attach"
+	daemonArg       = "daemon"
+	buildArg        = "build"
+	graphArg        = "graph"
+	diffArg         = "diff"
+	whyArg          = "why"
+	overrideArg     = "override"
+	execArg         = "exec"
+	internalExecArg = "internalExec"
+	lsArg           = "ls"
+	rmArg           = "rm"
+	duArg           = "du"
+	pruneArg        = "prune"
+	doctorArg       = "doctor"
+	bootstrapArg    = "bootstrap"
+	lockArg         = "lock"
 )
 
 var (
@@ -61,11 +86,122 @@ var (
 		},
 	}
 
+	execNameFlags = []cli.Flag{&cli.StringFlag{
+		Name:  "name",
+		Value: "home",
+		Usage: "name of the system, each name has its own persistent state",
+	}}
+
+	gcFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  "gc-keep-storage",
+			Value: units.HumanSize(float64(buildkit.DefaultGCConfig.KeepStorage)),
+			Usage: "amount of disk the build cache may use before it's garbage collected",
+		},
+		&cli.DurationFlag{
+			Name:  "gc-keep-duration",
+			Usage: "how long unused build cache is kept before it may be garbage collected",
+		},
+		&cli.BoolFlag{
+			Name:  "no-gc",
+			Usage: "disable garbage collection of the build cache",
+		},
+	}
+
+	cacheFilterFlags = []cli.Flag{&cli.StringSliceFlag{
+		Name:  "filter",
+		Usage: "only include cache records matching the buildkit filter (i.e. type==regular)",
+	}}
+
+	execOverrideFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  "workdir",
+			Usage: "working directory to run the command in, overriding the system's default",
+		},
+		&cli.StringSliceFlag{
+			Name:  "env",
+			Usage: "K=V env var to set for the command, can be repeated",
+		},
+	}
+
+	sshFlags = []cli.Flag{&cli.BoolFlag{
+		Name:    "ssh",
+		EnvVars: []string{"BINCASTLE_SSH"},
+		Usage:   "forward $SSH_AUTH_SOCK to the system and to the build steps that need it",
+	}}
+
+	mountFlags = []cli.Flag{&cli.StringSliceFlag{
+		Name:  "mount",
+		Usage: "host:ctr[:ro] bind mount of a host path into the system, can be repeated",
+	}}
+
+	runMountFlags = []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "allow-run-mounts",
+			Usage: "mount the host paths the system's definition asks for with RunMount without asking first",
+		},
+		&cli.BoolFlag{
+			Name:  "writable-run-mounts",
+			Usage: "let the definition's RunMounts be writable when they ask to be, they're read-only otherwise",
+		},
+	}
+
+	detachFlags = []cli.Flag{&cli.BoolFlag{
+		Name:    "detach",
+		Aliases: []string{"d"},
+		Usage:   "run the system in the background, attach connects to it",
+	}}
+
+	detachKeysFlags = []cli.Flag{&cli.StringFlag{
+		Name:  "detach-keys",
+		Value: ctr.DefaultDetachKeys,
+		Usage: "key sequence that detaches from the system without stopping it",
+	}}
+
+	noTTYFlags = []cli.Flag{&cli.BoolFlag{
+		Name:  "no-tty",
+		Usage: "use plain pipes for stdin, stdout and stderr instead of a tty (i.e. for scripts)",
+	}}
+
+	graphFormatFlags = []cli.Flag{&cli.StringFlag{
+		Name:  "format",
+		Value: "tree",
+		Usage: "output format of the graph, one of tree, dot or json",
+	}}
+
+	diffFormatFlags = []cli.Flag{&cli.StringFlag{
+		Name:  "format",
+		Value: "text",
+		Usage: "output format of the diff, one of text or json",
+	}}
+
+	rebuildFlags = []cli.Flag{&cli.BoolFlag{
+		Name:  "rebuild",
+		Usage: "list every layer that gets rebuilt when the given layer changes",
+	}}
+
 	verboseFlags = []cli.Flag{&cli.BoolFlag{
 		Name:    "verbose",
 		Aliases: []string{"v"},
 		Usage:   "show full output from every build",
 	}}
+
+	lockFlags = []cli.Flag{&cli.BoolFlag{
+		Name:  "update",
+		Usage: "re-resolve every source of the definition instead of using the versions in its lock file",
+	}}
+
+	progressFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  "progress",
+			Value: buildkit.ProgressAuto,
+			Usage: "how to show build progress, one of auto, plain or json (one build event per line on stderr)",
+		},
+		&cli.StringFlag{
+			Name:  "event-log",
+			Usage: "file to append build events to as json lines",
+		},
+	}
 )
 
 func joinflags(flagss ...[]cli.Flag) []cli.Flag {
@@ -97,212 +233,250 @@ func main() {
 	app := &cli.App{
 		Commands: []*cli.Command{
 			{
-				Name:  runArg,
-				Usage: "start the system in a rootless container",
-				Flags: joinflags(exportImportFlags, imageExportFlags, verboseFlags),
+				Name:      runArg,
+				Usage:     "start the system in a rootless container",
+				ArgsUsage: "<local dir> [subdir] | <git url> [ref] [subdir] [-- <cmd> [args...]]",
+				Flags:     joinflags(stateRootFlags, exportImportFlags, imageExportFlags, execNameFlags, execOverrideFlags, gcFlags, sshFlags, mountFlags, runMountFlags, detachFlags, noTTYFlags, verboseFlags, progressFlags, lockFlags),
 				Action: func(c *cli.Context) (err error) {
-					you, err := user.Current()
+					cfg, err := loadStateConfig(c)
 					if err != nil {
-						return fmt.Errorf("failed to get current user: %w", err)
-					}
-					homeDir := you.HomeDir
-					if homeDir == "" {
-						return fmt.Errorf("cannot find user's home dir (is the $HOME env var set?)")
+						return err
 					}
 
-					varDir := filepath.Join(homeDir, ".bincastle", "var")
-					err = os.MkdirAll(varDir, 0700)
+					ctrState, err := cfg.systemCtrState()
 					if err != nil {
 						return err
 					}
 
-					ctrsDir := filepath.Join(homeDir, ".bincastle", "ctrs")
-					err = os.MkdirAll(ctrsDir, 0700)
+					sshAgent, err := sshAgentFromFlags(c)
 					if err != nil {
 						return err
 					}
 
-					ctrStateDir, err := filepath.EvalSymlinks(ctrsDir)
+					noTTY := c.Bool("no-tty")
+					if noTTY && bincastleSock != "" {
+						// TODO the daemon's stdio is a tty in this case
+						return fmt.Errorf("--no-tty is not supported from inside a system yet")
+					}
+
+					mounts, err := parseMounts(c.StringSlice("mount"))
 					if err != nil {
-						return fmt.Errorf(
-							"failed to evaluate symlinks in container state root dir: %w", err)
+						return err
+					}
+					if len(mounts) > 0 && bincastleSock != "" {
+						return fmt.Errorf("--mount is not supported from inside a system yet")
 					}
-					ctrState := ctr.ContainerStateRoot(ctrStateDir).ContainerState(ctrName)
 
-					mounts := ctr.DefaultMounts().With(
-						ctr.BindMount{
-							Dest:   "/etc/resolv.conf",
-							Source: "/etc/resolv.conf",
-						},
-						ctr.BindMount{
-							Dest:   "/etc/hosts",
-							Source: "/etc/hosts",
-						},
-						ctr.BindMount{
-							Dest:   "/dev/fuse",
-							Source: "/dev/fuse",
-						},
-						ctr.BindMount{
-							Dest:   "/bincastle",
-							Source: selfBin,
-							// NOTE: not setting this readonly because doing so can fail with
-							// EPERM when selfBin is not already mounted read-only. Later
-							// in the inner container it can be set to a read-only bind mount
-							// due to the workarounds made possible via the other mount backends.
-						},
-						ctr.BindMount{
-							Dest:   "/var",
-							Source: varDir,
-						},
-					)
+					background := isBackground()
+					if c.Bool("detach") && !background {
+						if bincastleSock != "" {
+							return fmt.Errorf("--detach is not supported from inside a system yet")
+						}
+						if noTTY {
+							return fmt.Errorf("--detach can't be used with --no-tty")
+						}
+						return startBackground(cfg, ctrState, selfBin)
+					}
 
-					// TODO this should be optional and default to not happening (you are giving
-					// potentially untrusted code access to your ssh agent sock)
-					var env []string
-					if sshAgentSock != "" {
-						mounts = mounts.With(ctr.BindMount{
-							Dest:   "/run/ssh-agent.sock",
-							Source: sshAgentSock,
-						})
-						env = append(env, "SSH_AUTH_SOCK=/run/ssh-agent.sock")
+					progress, err := progressFromFlags(c)
+					if err != nil {
+						return err
 					}
 
 					bcArgs := buildkit.BincastleArgs{
 						ImportCacheRef:    c.String("import-cache"),
 						ExportCacheRef:    c.String("export-cache"),
 						ExportImageRef:    c.String("export-image"),
-						SSHAgentSockPath:  sshAgentSock,
+						SSHAgentSockPath:  sshAgent,
+						Registries:        cfg.Registries,
 						BincastleSockPath: bincastleSock,
+						SysrootImage:      cfg.Images.Sysroot,
+						ExecName:          c.String("name"),
 						Verbose:           c.Bool("verbose"),
+						Progress:          progress,
+						EventLog:          c.String("event-log"),
+						NoTTY:             noTTY,
+						ExecWorkdir:       c.String("workdir"),
+						Mounts:            mounts,
+						HostMountPaths:    hostMountPaths(mounts),
+						WritableRunMounts: c.Bool("writable-run-mounts"),
+						UpdateLock:        c.Bool("update"),
 					}
-					if !strings.HasPrefix(c.Args().Get(0), "https://") && !strings.HasPrefix(c.Args().Get(0), "ssh://") {
-						bcArgs.SourceLocalDir = c.Args().Get(0)
-						bcArgs.SourceSubdir = c.Args().Get(1)
-					} else {
-						bcArgs.SourceGitURL = c.Args().Get(0)
-						bcArgs.SourceGitRef = c.Args().Get(1)
-						bcArgs.SourceSubdir = c.Args().Get(2)
+					srcArgs, cmdArgs := splitCmdArgs(c.Args())
+					setSource(&bcArgs, srcArgs)
+					overrides, err := loadOverrides(cfg)
+					if err != nil {
+						return err
 					}
-
-					for _, kv := range os.Environ() {
-						if strings.HasPrefix(kv, graph.EnvOverridesPrefix) {
-							bcArgs.LocalOverrides = append(bcArgs.LocalOverrides, kv)
-						}
+					// stored overrides come after inherited ones so they win
+					bcArgs.Overrides = append(bcArgs.Overrides, overrides[bcArgs.ExecName]...)
+					bcArgs.ExecArgs = cmdArgs
+					if bcArgs.ExecEnv, err = parseEnv(c.StringSlice("env")); err != nil {
+						return err
 					}
+					// clients inside a system continue the exec chain of
+					// the system they're in
+					bcArgs.ExecChain = os.Getenv(buildkit.ExecChainEnv)
 
-					var needFuseOverlayfs bool
-					// TODO don't hardcode binary location, also /var is a weird place
-					if _, err := os.Stat(filepath.Join(homeDir, ".bincastle/var/fuse-overlayfs")); os.IsNotExist(err) {
-						needFuseOverlayfs = true
-					} else if err != nil {
-						return err
+					if bincastleSock == "" && !background && ctrState.ContainerExists() {
+						// a daemon is already running, connect to it
+						if len(mounts) > 0 {
+							return fmt.Errorf("--mount can't be used when the daemon is already running")
+						}
+						if c.Bool("detach") {
+							return fmt.Errorf("--detach can't be used when the daemon is already running")
+						}
+						return runClient(cfg, bcArgs)
 					}
 
-					ctx, cancel := context.WithCancel(
-						namespaces.WithNamespace(context.Background(), "buildkit"))
+					for retried := false; ; retried = true {
+						ctrDef, err := systemCtrDef(cfg, selfBin, sshAgent, bcArgs.HostMountPaths, os.Args[2:])
+						if err != nil {
+							return err
+						}
+						ctrDef.NoTTY = noTTY
 
-					sigchan := make(chan os.Signal, 1)
-					signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+						err = runSystem(cfg, ctrState, ctrDef, bcArgs, !background)
+						missing, ok := missingMounts(err)
+						if !ok || retried || bincastleSock != "" {
+							return err
+						}
+						if !c.Bool("allow-run-mounts") {
+							if err := confirmRunMounts(missing); err != nil {
+								return err
+							}
+						}
+						// the host paths mounted by the definition are only known
+						// once the system has evaluated it, so restart the system
+						// with them mounted too
+						bcArgs.HostMountPaths = hostMountPaths(append(mounts, missing...))
+						if err := os.Remove(cfg.sockPath()); err != nil && !os.IsNotExist(err) {
+							return err
+						}
+					}
+				},
+			},
+			{
+				Name:      attachArg,
+				Usage:     "attach to the console of a system running in the background",
+				ArgsUsage: "[name]",
+				Flags:     joinflags(stateRootFlags, detachKeysFlags),
+				Action: func(c *cli.Context) error {
+					if bincastleSock != "" {
+						return fmt.Errorf("attach is not supported from inside a system yet")
+					}
 
-					goCount := 3
-					errCh := make(chan error, goCount)
+					detachKeys, err := ctr.ParseDetachKeys(c.String("detach-keys"))
+					if err != nil {
+						return err
+					}
 
-					if bcArgs.BincastleSockPath == "" {
-						bcArgs.BincastleSockPath = filepath.Join(homeDir, ".bincastle/var/bincastle.sock")
-						go func() {
-							defer cancel()
-							errCh <- runCtr(ctx, ctrState, ctr.ContainerDef{
-								ContainerProc: ctr.ContainerProc{
-									// don't use /proc/self/exe directly because it ends up being a
-									// memfd created by runc, which wreaks havoc later when inner containers
-									// need to mount /proc/self/exe to /bincastle
-									Args:         append([]string{"/bincastle", internalRunArg}, os.Args[2:]...),
-									Env:          env,
-									WorkingDir:   "/var",
-									Uid:          uint32(unix.Geteuid()),
-									Gid:          uint32(unix.Getegid()),
-									Capabilities: &ctr.AllCaps,
-								},
-								Hostname:       "bincastle",
-								Mounts:         mounts,
-								MountBackend:   ctr.NoOverlayfsBackend{},
-								ReadOnlyRootfs: true,
-							})
-						}()
-					} else {
-						goCount--
-						needFuseOverlayfs = false
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					ctrState, err := cfg.systemCtrState()
+					if err != nil {
+						return err
+					}
+					container, err := ctrState.Load()
+					if err != nil {
+						return fmt.Errorf("failed to find running system: %w", err)
 					}
 
-					go func() {
-						defer cancel()
-						timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 10*time.Second)
-						defer timeoutCancel()
-						// TODO don't hardcode
-						if err := waitToExist(timeoutCtx, bcArgs.BincastleSockPath); err != nil {
-							errCh <- err
-							return
+					ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+					if name := c.Args().First(); name != "" {
+						execs, err := buildkit.ListExecs(ctx, cfg.sockPath())
+						if err != nil {
+							return err
 						}
-
-						if needFuseOverlayfs {
-							if fuseoverlayDef, err := llb.Image(
-								// TODO don't hardcode
-								"eriksipsma/bincastle-fuse-overlayfs",
-							).Marshal(ctx, llb.LinuxAmd64); err != nil {
-								errCh <- err
-								return
-							} else if err := buildkit.BincastleBuild(ctx, buildkit.BincastleArgs{
-								LLB:              fuseoverlayDef,
-								ExportLocalDir:   filepath.Join(homeDir, ".bincastle/var"), // TODO don't hardcode
-								ImportCacheRef:   bcArgs.ImportCacheRef,
-								SSHAgentSockPath: bcArgs.SSHAgentSockPath,
-								// TODO don't hardcode
-								BincastleSockPath: bcArgs.BincastleSockPath,
-								Verbose:           c.Bool("verbose"),
-							}); err != nil {
-								errCh <- err
-								return
+						var found *buildkit.ExecInfo
+						for i, exec := range execs {
+							if exec.Name == name && exec.Running {
+								found = &execs[i]
 							}
 						}
+						if found == nil {
+							return fmt.Errorf("system %s is not running", name)
+						}
+						// systems run from a terminal are stopped along with
+						// it, so only the one started with run -d can be
+						// attached to
+						if !found.Console {
+							return fmt.Errorf("system %s is attached to another terminal, "+
+								"only systems started with run -d can be attached to", name)
+						}
+					}
 
-						errCh <- buildkit.BincastleBuild(ctx, bcArgs)
-					}()
+					err = ctr.AttachSelfConsoleWithDetachKeys(ctx, container, detachKeys)
+					if err == ctr.ErrDetached {
+						fmt.Fprintf(os.Stderr, "\r\ndetached from system, it's still running\r\n")
+						return nil
+					}
+					return err
+				},
+			},
+			{
+				Name:  daemonArg,
+				Usage: "start the system container and serve clients until stopped",
+				Flags: joinflags(stateRootFlags, gcFlags, sshFlags),
+				Action: func(c *cli.Context) error {
+					if bincastleSock != "" {
+						return fmt.Errorf("daemon is not supported from inside a system")
+					}
 
-					go func() {
-						defer cancel()
-						select {
-						case sig := <-sigchan:
-							errCh <- fmt.Errorf("received signal %s", sig)
-						case <-ctx.Done():
-							errCh <- nil
-						}
-					}()
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					ctrState, err := cfg.systemCtrState()
+					if err != nil {
+						return err
+					}
+					sshAgent, err := sshAgentFromFlags(c)
+					if err != nil {
+						return err
+					}
 
-					var finalErr error
-					for i := 0; i < goCount; i++ {
-						finalErr = multierror.Append(finalErr, <-errCh).ErrorOrNil()
+					ctrDef, err := systemCtrDef(cfg, selfBin, sshAgent, nil, os.Args[2:])
+					if err != nil {
+						return err
 					}
-					return finalErr
+					return runDaemon(cfg, ctrState, ctrDef)
 				},
 			},
 			{
 				Name:   internalRunArg,
 				Hidden: true,
-				Flags:  joinflags(exportImportFlags, imageExportFlags, verboseFlags),
+				Flags:  joinflags(stateRootFlags, exportImportFlags, imageExportFlags, execNameFlags, execOverrideFlags, gcFlags, sshFlags, mountFlags, runMountFlags, detachFlags, noTTYFlags, verboseFlags, progressFlags, lockFlags),
 				Action: func(c *cli.Context) (err error) {
 					sigchan := make(chan os.Signal, 1)
 					signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-					// TODO don't hardcode
-					ctrStateRoot := ctr.ContainerStateRoot("/var/ctrs")
+					ctrStateRoot := ctr.ContainerStateRoot(ctrCtrsDir)
 					ctrState := ctrStateRoot.ContainerState(ctrName)
 					if ctrState.ContainerExists() {
 						return ctr.ContainerExistsError{ctrName}
 					}
 
+					gcConfig, err := gcConfigFromFlags(c)
+					if err != nil {
+						return err
+					}
+
+					registries, err := registriesFromEnv()
+					if err != nil {
+						return err
+					}
+
+					network, err := networkFromEnv()
+					if err != nil {
+						return err
+					}
+
 					serve, err := buildkit.Buildkitd(ctr.FuseOverlayfsBackend{
-						FuseOverlayfsBin: "/var/fuse-overlayfs",
-					})
+						FuseOverlayfsBin: ctrFuseOverlayfsBin,
+					}, gcConfig, registries, network)
 					if err != nil {
 						return err
 					}
@@ -335,15 +509,432 @@ func main() {
 					return finalErr
 				},
 			},
+			{
+				Name:      buildArg,
+				Usage:     "build the system without running it",
+				ArgsUsage: "<local dir> [subdir] | <git url> [ref] [subdir]",
+				Flags:     joinflags(stateRootFlags, exportImportFlags, gcFlags, sshFlags, verboseFlags, progressFlags, lockFlags),
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return fmt.Errorf("a source for the system's definition must be provided")
+					}
+
+					sshAgent, err := sshAgentFromFlags(c)
+					if err != nil {
+						return err
+					}
+					progress, err := progressFromFlags(c)
+					if err != nil {
+						return err
+					}
+
+					bcArgs := buildkit.BincastleArgs{
+						ImportCacheRef:   c.String("import-cache"),
+						ExportCacheRef:   c.String("export-cache"),
+						SSHAgentSockPath: sshAgent,
+						Verbose:          c.Bool("verbose"),
+						Progress:         progress,
+						EventLog:         c.String("event-log"),
+						UpdateLock:       c.Bool("update"),
+					}
+					setSource(&bcArgs, c.Args().Slice())
+
+					ctx, cancel := context.WithCancel(
+						namespaces.WithNamespace(context.Background(), "buildkit"))
+					defer cancel()
+					sigchan := make(chan os.Signal, 1)
+					signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+					go func() {
+						select {
+						case <-sigchan:
+							cancel()
+						case <-ctx.Done():
+						}
+					}()
+
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					bcArgs.SysrootImage = cfg.Images.Sysroot
+					bcArgs.Registries = cfg.Registries
+
+					return withSystem(ctx, cfg, selfBin, sshAgent, daemonFlagArgs(c), func(sockPath string) error {
+						bcArgs.BincastleSockPath = sockPath
+						if bincastleSock == "" {
+							needBins, err := needsDaemonBins(cfg)
+							if err != nil {
+								return err
+							}
+							if needBins {
+								if err := exportDaemonBins(ctx, cfg, bcArgs); err != nil {
+									return err
+								}
+							}
+						}
+
+						summary, err := buildkit.BincastleBuildOnly(ctx, bcArgs)
+						if summary != nil {
+							fmt.Printf("%d built, %d cached\n", len(summary.Built), len(summary.Cached))
+							for _, name := range summary.Built {
+								fmt.Printf("built: %s\n", name)
+							}
+						}
+						return err
+					})
+				},
+			},
+			{
+				Name:      graphArg,
+				Usage:     "print the layer graph of a system's definition without building it",
+				ArgsUsage: "<local dir> [subdir] | <git url> [ref] [subdir]",
+				Flags:     joinflags(stateRootFlags, sshFlags, graphFormatFlags),
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return fmt.Errorf("a source for the system's definition must be provided")
+					}
+
+					var write func(*graph.Description) error
+					switch format := c.String("format"); format {
+					case "tree":
+						write = func(desc *graph.Description) error {
+							return desc.WriteTree(os.Stdout)
+						}
+					case "dot":
+						write = func(desc *graph.Description) error {
+							return desc.WriteDot(os.Stdout)
+						}
+					case "json":
+						write = func(desc *graph.Description) error {
+							enc := json.NewEncoder(os.Stdout)
+							enc.SetIndent("", "  ")
+							return enc.Encode(desc)
+						}
+					default:
+						return fmt.Errorf("invalid format %q, must be one of tree, dot or json", format)
+					}
+
+					descs, err := describeGraphs(c, selfBin, c.Args().Slice())
+					if err != nil {
+						return err
+					}
+					return write(descs[0])
+				},
+			},
+			{
+				Name:      diffArg,
+				Usage:     "show which layers change between two system definitions",
+				ArgsUsage: "<source a> <source b> | <source a args...> -- <source b args...>",
+				Flags:     joinflags(stateRootFlags, sshFlags, diffFormatFlags),
+				Action: func(c *cli.Context) error {
+					srcA, srcB := splitCmdArgs(c.Args())
+					if srcB == nil && len(srcA) == 2 {
+						srcA, srcB = srcA[:1], srcA[1:]
+					}
+					if len(srcA) == 0 || len(srcB) == 0 {
+						return fmt.Errorf("two sources for system definitions must be provided")
+					}
+
+					format := c.String("format")
+					if format != "text" && format != "json" {
+						return fmt.Errorf("invalid format %q, must be one of text or json", format)
+					}
+
+					descs, err := describeGraphs(c, selfBin, srcA, srcB)
+					if err != nil {
+						return err
+					}
+					diff := graph.DiffDescriptions(descs[0], descs[1])
+					if format == "json" {
+						enc := json.NewEncoder(os.Stdout)
+						enc.SetIndent("", "  ")
+						return enc.Encode(diff)
+					}
+					if diff.Empty() {
+						fmt.Println("no changes")
+						return nil
+					}
+					return diff.Write(os.Stdout)
+				},
+			},
+			{
+				Name:      whyArg,
+				Usage:     "show the dependency paths between two layers of a system's definition",
+				ArgsUsage: "<source args...> -- <from layer> <to layer> | --rebuild <source args...> -- <layer>",
+				Flags:     joinflags(stateRootFlags, sshFlags, rebuildFlags),
+				Action: func(c *cli.Context) error {
+					srcArgs, layers := splitCmdArgs(c.Args())
+					if len(srcArgs) == 0 {
+						return fmt.Errorf("a source for the system's definition must be provided")
+					}
+					rebuild := c.Bool("rebuild")
+					if rebuild && len(layers) != 1 {
+						return fmt.Errorf("--rebuild takes exactly one layer after --")
+					}
+					if !rebuild && len(layers) != 2 {
+						return fmt.Errorf("a from and a to layer must be provided after --")
+					}
+
+					descs, err := describeGraphs(c, selfBin, srcArgs)
+					if err != nil {
+						return err
+					}
+					desc := descs[0]
+
+					if rebuild {
+						dependents, err := desc.Dependents(layers[0])
+						if err != nil {
+							return err
+						}
+						return graph.WriteLayers(os.Stdout, dependents)
+					}
+
+					paths, err := desc.DepPaths(layers[0], layers[1])
+					if err != nil {
+						return err
+					}
+					if len(paths) == 0 {
+						return fmt.Errorf("%s does not depend on %s", layers[0], layers[1])
+					}
+					for _, path := range paths {
+						fmt.Println(path)
+					}
+					return nil
+				},
+			},
+			overrideCommand(selfBin),
+			{
+				Name:      execArg,
+				Usage:     "start another process in a running system",
+				ArgsUsage: "[-- <cmd> [args...]]",
+				Flags:     joinflags(stateRootFlags, execNameFlags),
+				Action: func(c *cli.Context) error {
+					if bincastleSock != "" {
+						return fmt.Errorf("exec is not supported from inside a system yet")
+					}
+
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					ctrState, err := cfg.systemCtrState()
+					if err != nil {
+						return err
+					}
+					container, err := ctrState.Load()
+					if err != nil {
+						return fmt.Errorf("failed to find running system: %w", err)
+					}
+
+					// The persistent exec's runc state is only meaningful from within the
+					// system container (pids, mount namespaces, etc.), so exec an internal
+					// command in there that then joins the exec itself.
+					proc, err := container.Exec(ctr.ContainerProc{
+						Args: append([]string{
+							"/bincastle", internalExecArg, "--name", c.String("name"), "--",
+						}, c.Args().Slice()...),
+						Env:          []string{},
+						WorkingDir:   ctrVarDir,
+						Capabilities: &ctr.AllCaps,
+					})
+					if err != nil {
+						return err
+					}
+					return runProc(namespaces.WithNamespace(context.Background(), "buildkit"), proc)
+				},
+			},
+			{
+				Name:   internalExecArg,
+				Hidden: true,
+				Flags:  execNameFlags,
+				Action: func(c *cli.Context) error {
+					execName := c.String("name")
+					container, err := buildkit.ExecStateRoot().ContainerState(
+						buildkit.ExecNameToID(execName)).Load()
+					if err != nil {
+						return fmt.Errorf("failed to find running exec %s: %w", execName, err)
+					}
+
+					// leaving env and working dir empty means they are inherited from the exec
+					proc, err := container.Exec(ctr.ContainerProc{
+						Args:         c.Args().Slice(),
+						Capabilities: &ctr.AllCaps,
+					})
+					if err != nil {
+						return err
+					}
+					return runProc(context.Background(), proc)
+				},
+			},
+			{
+				Name:  lsArg,
+				Usage: "list the persistent state of each system",
+				Flags: stateRootFlags,
+				Action: func(c *cli.Context) error {
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+					return withSystem(ctx, cfg, selfBin, "", daemonFlagArgs(c), func(sockPath string) error {
+						execs, err := buildkit.ListExecs(ctx, sockPath)
+						if err != nil {
+							return err
+						}
+
+						tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+						fmt.Fprintln(tw, "NAME\tSIZE\tCREATED\tLAST USED\tRUNNING")
+						for _, exec := range execs {
+							lastUsed := "never"
+							if exec.LastUsedAt != nil {
+								lastUsed = units.HumanDuration(time.Since(*exec.LastUsedAt)) + " ago"
+							}
+							fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\n",
+								exec.Name,
+								units.HumanSize(float64(exec.Size)),
+								units.HumanDuration(time.Since(exec.CreatedAt))+" ago",
+								lastUsed,
+								exec.Running,
+							)
+						}
+						return tw.Flush()
+					})
+				},
+			},
+			{
+				Name:      rmArg,
+				Usage:     "delete the persistent state of systems that aren't running",
+				ArgsUsage: "<name> [name...]",
+				Flags:     stateRootFlags,
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return fmt.Errorf("at least one system name must be provided")
+					}
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+					return withSystem(ctx, cfg, selfBin, "", daemonFlagArgs(c), func(sockPath string) error {
+						var rmErr error
+						for _, execName := range c.Args().Slice() {
+							if err := buildkit.RemoveExec(ctx, sockPath, execName); err != nil {
+								rmErr = multierror.Append(rmErr, err)
+							}
+						}
+						return rmErr
+					})
+				},
+			},
+			{
+				Name:  duArg,
+				Usage: "show the disk usage of the build cache",
+				Flags: joinflags(stateRootFlags, cacheFilterFlags),
+				Action: func(c *cli.Context) error {
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+					return withSystem(ctx, cfg, selfBin, "", daemonFlagArgs(c), func(sockPath string) error {
+						records, err := buildkit.DiskUsage(ctx, sockPath, c.StringSlice("filter"))
+						if err != nil {
+							return err
+						}
+						sort.Slice(records, func(i, j int) bool {
+							return records[i].Size > records[j].Size
+						})
+
+						var total int64
+						tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+						fmt.Fprintln(tw, "ID\tSIZE\tLAST USED\tIN USE\tNAME")
+						for _, record := range records {
+							total += record.Size
+							lastUsed := "never"
+							if record.LastUsedAt != nil {
+								lastUsed = units.HumanDuration(time.Since(*record.LastUsedAt)) + " ago"
+							}
+							fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%s\n",
+								shortID(record.ID),
+								units.HumanSize(float64(record.Size)),
+								lastUsed,
+								record.InUse,
+								record.Name(),
+							)
+						}
+						fmt.Fprintf(tw, "Total:\t%s\n", units.HumanSize(float64(total)))
+						return tw.Flush()
+					})
+				},
+			},
+			{
+				Name:  pruneArg,
+				Usage: "remove records from the build cache (persistent system state is only removed by rm)",
+				Flags: joinflags(stateRootFlags, cacheFilterFlags, []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "include internal and shared records",
+					},
+					&cli.StringFlag{
+						Name:  "keep-storage",
+						Usage: "amount of disk to leave used by the build cache",
+					},
+					&cli.DurationFlag{
+						Name:  "unused-for",
+						Usage: "only remove records that haven't been used for this long",
+					},
+					&cli.DurationFlag{
+						Name:  "older-than",
+						Usage: "only remove records created at least this long ago",
+					},
+				}),
+				Action: func(c *cli.Context) error {
+					opts := buildkit.PruneOpts{
+						Filters:   c.StringSlice("filter"),
+						All:       c.Bool("all"),
+						UnusedFor: c.Duration("unused-for"),
+						OlderThan: c.Duration("older-than"),
+					}
+					if keepStorage := c.String("keep-storage"); keepStorage != "" {
+						bytes, err := units.FromHumanSize(keepStorage)
+						if err != nil {
+							return fmt.Errorf("invalid keep-storage %q: %w", keepStorage, err)
+						}
+						opts.KeepStorage = bytes
+					}
+
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+					return withSystem(ctx, cfg, selfBin, "", daemonFlagArgs(c), func(sockPath string) error {
+						pruned, err := buildkit.Prune(ctx, sockPath, opts)
+						var total int64
+						for _, record := range pruned {
+							total += record.Size
+						}
+						fmt.Printf("Removed %d records, reclaimed %s\n",
+							len(pruned), units.HumanSize(float64(total)))
+						return err
+					})
+				},
+			},
+			doctorCommand(),
+			bootstrapCommand(selfBin),
+			lockCommand(selfBin),
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
+		if exitCode, ok := ctr.ExitCode(err); ok {
+			os.Exit(exitCode)
+		}
 		panic(err)
 	}
 }
 
-func runCtr(ctx context.Context, ctrState ctr.ContainerState, def ctr.ContainerDef) error {
+func runCtr(ctx context.Context, ctrState ctr.ContainerState, def ctr.ContainerDef, attach bool) error {
 	container, err := ctrState.Start(def)
 	if err != nil {
 		return fmt.Errorf("failed to run container: %w", err)
@@ -352,6 +943,9 @@ func runCtr(ctx context.Context, ctrState ctr.ContainerState, def ctr.ContainerD
 	ctx, cancel := context.WithCancel(ctx)
 	ioctx, iocancel := context.WithCancel(context.Background())
 	goCount := 2
+	if !attach {
+		goCount--
+	}
 	errCh := make(chan error, goCount)
 
 	go func() {
@@ -365,9 +959,144 @@ func runCtr(ctx context.Context, ctrState ctr.ContainerState, def ctr.ContainerD
 		errCh <- multierror.Append(waitErr, destroyErr).ErrorOrNil()
 	}()
 
+	if attach {
+		go func() {
+			defer cancel()
+			var attachErr error
+			if def.NoTTY {
+				attachErr = container.AttachStreams(ioctx, os.Stdin, os.Stdout, os.Stderr)
+			} else {
+				attachErr = ctr.AttachSelfConsole(ioctx, container)
+			}
+			if attachErr == context.Canceled {
+				attachErr = nil
+			}
+			if attachErr != nil {
+				attachErr = fmt.Errorf("error during console attach: %w", attachErr)
+			}
+			errCh <- attachErr
+		}()
+	}
+
+	var finalErr error
+	for i := 0; i < goCount; i++ {
+		finalErr = multierror.Append(finalErr, <-errCh).ErrorOrNil()
+	}
+	return finalErr
+}
+
+// runSystem starts the system container (unless already inside one) and runs
+// the system in it, returning once the system exits. If attach is set, the
+// system's console is attached to this process's.
+func runSystem(
+	cfg *stateConfig, ctrState ctr.ContainerState, ctrDef ctr.ContainerDef, bcArgs buildkit.BincastleArgs, attach bool,
+) error {
+	needBins, err := needsDaemonBins(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(
+		namespaces.WithNamespace(context.Background(), "buildkit"))
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigchan)
+
+	goCount := 3
+	errCh := make(chan error, goCount)
+	// closed once the daemon in the system container is up
+	started := make(chan struct{})
+
+	ownsSystem := bcArgs.BincastleSockPath == ""
+	clientsLock := flock.New(cfg.clientsLockPath())
+	defer clientsLock.Unlock()
+	if ownsSystem {
+		bcArgs.BincastleSockPath = cfg.sockPath()
+		go func() {
+			defer cancel()
+			errCh <- runCtr(ctx, ctrState, ctrDef, attach)
+		}()
+	} else {
+		goCount--
+		needBins = false
+	}
+
 	go func() {
 		defer cancel()
-		attachErr := ctr.AttachSelfConsole(ioctx, container)
+		timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 10*time.Second)
+		defer timeoutCancel()
+		// TODO don't hardcode
+		if err := waitToExist(timeoutCtx, bcArgs.BincastleSockPath); err != nil {
+			errCh <- err
+			return
+		}
+		close(started)
+
+		if needBins {
+			if err := exportDaemonBins(ctx, cfg, bcArgs); err != nil {
+				errCh <- err
+				return
+			}
+		}
+
+		err := buildkit.BincastleBuild(ctx, bcArgs)
+		if ownsSystem {
+			// execs of other clients run in this system too, so it can only
+			// be stopped once they've exited
+			err = multierror.Append(err, waitForClients(ctx, clientsLock)).ErrorOrNil()
+		}
+		errCh <- err
+	}()
+
+	go func() {
+		defer cancel()
+		select {
+		case sig := <-sigchan:
+			errCh <- fmt.Errorf("received signal %s", sig)
+		case <-ctx.Done():
+			errCh <- nil
+		}
+	}()
+
+	var finalErr error
+	for i := 0; i < goCount; i++ {
+		finalErr = multierror.Append(finalErr, <-errCh).ErrorOrNil()
+	}
+	if finalErr != nil && !isClosed(started) {
+		reportStartupFailure(cfg)
+	}
+	return finalErr
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func runProc(ctx context.Context, proc ctr.Process) error {
+	ctx, cancel := context.WithCancel(ctx)
+	ioctx, iocancel := context.WithCancel(context.Background())
+	goCount := 2
+	errCh := make(chan error, goCount)
+
+	go func() {
+		defer cancel()
+		defer iocancel()
+		waitErr := proc.Wait(ctx).Err
+		if waitErr == context.Canceled {
+			waitErr = nil
+		}
+		errCh <- waitErr
+	}()
+
+	go func() {
+		defer cancel()
+		attachErr := ctr.AttachSelfConsole(ioctx, proc)
 		if attachErr == context.Canceled {
 			attachErr = nil
 		}
@@ -384,6 +1113,414 @@ func runCtr(ctx context.Context, ctrState ctr.ContainerState, def ctr.ContainerD
 	return finalErr
 }
 
+func homeDir() (string, error) {
+	you, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to get current user: %w", err)
+	}
+	if you.HomeDir == "" {
+		return "", fmt.Errorf("cannot find user's home dir (is the $HOME env var set?)")
+	}
+	return you.HomeDir, nil
+}
+
+// systemCtrDef returns the definition of the outer container that runs the
+// bincastle daemon. If sshAgent is set, the agent socket at that path is
+// available to the daemon's execs. hostMountPaths maps host paths to where
+// they are mounted in the container.
+func systemCtrDef(
+	cfg *stateConfig, selfBin string, sshAgent string, hostMountPaths map[string]string, args []string,
+) (ctr.ContainerDef, error) {
+	mounts := ctr.DefaultMounts().With(
+		ctr.BindMount{
+			Dest:   "/etc/resolv.conf",
+			Source: "/etc/resolv.conf",
+		},
+		ctr.BindMount{
+			Dest:   "/etc/hosts",
+			Source: "/etc/hosts",
+		},
+		ctr.BindMount{
+			Dest:   "/dev/fuse",
+			Source: "/dev/fuse",
+		},
+		ctr.BindMount{
+			Dest:   "/bincastle",
+			Source: selfBin,
+			// NOTE: not setting this readonly because doing so can fail with
+			// EPERM when selfBin is not already mounted read-only. Later
+			// in the inner container it can be set to a read-only bind mount
+			// due to the workarounds made possible via the other mount backends.
+		},
+		ctr.BindMount{
+			Dest:   ctrVarDir,
+			Source: cfg.VarDir,
+		},
+		ctr.BindMount{
+			Dest:   buildkit.Root,
+			Source: cfg.CacheDir,
+		},
+	)
+
+	// without the host's certificates, the daemon can't verify registries
+	if caBundle := hostCABundle(); caBundle != "" {
+		mounts = mounts.With(ctr.BindMount{
+			Dest:   ctrCABundle,
+			Source: caBundle,
+		})
+	}
+
+	registries, registryMounts := cfg.ctrRegistries()
+	for _, m := range registryMounts {
+		mounts = mounts.With(m)
+	}
+	registriesJSON, err := json.Marshal(registries)
+	if err != nil {
+		return ctr.ContainerDef{}, fmt.Errorf("failed to marshal registry configs: %w", err)
+	}
+	networkJSON, err := json.Marshal(cfg.Network)
+	if err != nil {
+		return ctr.ContainerDef{}, fmt.Errorf("failed to marshal network config: %w", err)
+	}
+	env := []string{
+		registriesEnv + "=" + string(registriesJSON),
+		networkEnv + "=" + string(networkJSON),
+		// git sources are fetched with the git exported from the sysroot
+		"PATH=" + filepath.Join(ctrGitDir, "bin"),
+	}
+	// mounted before git is exported, which only happens once the daemon is up
+	if err := os.MkdirAll(cfg.gitDir(), 0700); err != nil {
+		return ctr.ContainerDef{}, err
+	}
+	mounts = mounts.With(ctr.BindMount{
+		Dest:   ctrGitDir,
+		Source: cfg.gitDir(),
+	})
+
+	if sshAgent != "" {
+		mounts = mounts.With(ctr.BindMount{
+			Dest:   "/run/ssh-agent.sock",
+			Source: sshAgent,
+		})
+		env = append(env, "SSH_AUTH_SOCK=/run/ssh-agent.sock")
+	}
+
+	for source, dest := range hostMountPaths {
+		mounts = mounts.With(ctr.BindMount{
+			Dest:      dest,
+			Source:    source,
+			Recursive: true,
+			// NOTE: always read-write for the same reason as /bincastle,
+			// read-only mounts are made read-only in the inner container
+		})
+	}
+
+	return ctr.ContainerDef{
+		ContainerProc: ctr.ContainerProc{
+			// don't use /proc/self/exe directly because it ends up being a
+			// memfd created by runc, which wreaks havoc later when inner containers
+			// need to mount /proc/self/exe to /bincastle
+			Args:         append([]string{"/bincastle", internalRunArg}, args...),
+			Env:          env,
+			WorkingDir:   ctrVarDir,
+			Uid:          uint32(unix.Geteuid()),
+			Gid:          uint32(unix.Getegid()),
+			Capabilities: &ctr.AllCaps,
+		},
+		Hostname:       "bincastle",
+		Mounts:         mounts,
+		MountBackend:   ctr.NoOverlayfsBackend{},
+		ReadOnlyRootfs: true,
+	}, nil
+}
+
+// withSystem calls fn with the path of the socket of a bincastle daemon. If
+// the system isn't running yet, it's started in the background just for the
+// duration of fn, with sshAgent (if any) forwarded to it and its daemon
+// configured by daemonArgs (see daemonFlagArgs).
+func withSystem(
+	ctx context.Context, cfg *stateConfig, selfBin string, sshAgent string, daemonArgs []string,
+	fn func(sockPath string) error,
+) (rerr error) {
+	if bincastleSock != "" {
+		return fn(bincastleSock)
+	}
+
+	ctrState, err := cfg.systemCtrState()
+	if err != nil {
+		return err
+	}
+	sockPath := cfg.sockPath()
+	if ctrState.ContainerExists() {
+		return fn(sockPath)
+	}
+
+	ctrDef, err := systemCtrDef(cfg, selfBin, sshAgent, nil, daemonArgs)
+	if err != nil {
+		return err
+	}
+	// nothing attaches to the system's console, headless builds (i.e. in
+	// CI) don't have a terminal to size it from either
+	ctrDef.NoTTY = !ctr.StdinIsTerminal()
+	// the system isn't running, so any socket still around is stale
+	if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	container, err := ctrState.Start(ctrDef)
+	if err != nil {
+		return fmt.Errorf("failed to start system: %w", err)
+	}
+	defer func() {
+		rerr = multierror.Append(rerr, container.Destroy(15*time.Second)).ErrorOrNil() // TODO don't hardcode
+	}()
+
+	ioctx, iocancel := context.WithCancel(context.Background())
+	defer iocancel()
+	go container.Attach(ioctx, nil, ioutil.Discard)
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer timeoutCancel()
+	if err := waitToExist(timeoutCtx, sockPath); err != nil {
+		return fmt.Errorf("failed waiting for system to start: %w", err)
+	}
+	return fn(sockPath)
+}
+
+// setSource sets the source of the system's definition from cli args, which
+// are either <local dir> [subdir] or <git url> [ref] [subdir].
+func setSource(bcArgs *buildkit.BincastleArgs, args []string) {
+	get := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	if !strings.HasPrefix(get(0), "https://") && !strings.HasPrefix(get(0), "ssh://") {
+		bcArgs.SourceLocalDir = get(0)
+		bcArgs.SourceSubdir = get(1)
+	} else {
+		bcArgs.SourceGitURL = get(0)
+		bcArgs.SourceGitRef = get(1)
+		bcArgs.SourceSubdir = get(2)
+	}
+
+	bcArgs.Overrides = envOverrides()
+}
+
+// sshAgentFromFlags returns the path of the ssh agent socket to forward, or
+// "" if --ssh isn't set.
+func sshAgentFromFlags(c *cli.Context) (string, error) {
+	if !c.Bool("ssh") {
+		return "", nil
+	}
+	if sshAgentSock == "" {
+		return "", fmt.Errorf("--ssh requires $SSH_AUTH_SOCK to be set")
+	}
+	if _, err := os.Stat(sshAgentSock); err != nil {
+		return "", fmt.Errorf("--ssh requires a running ssh agent: %w", err)
+	}
+	return sshAgentSock, nil
+}
+
+// daemonFlagArgs returns the args the daemon of a system started for c is
+// run with, which are c's gc flags. Other flags of c aren't known to the
+// daemon.
+func daemonFlagArgs(c *cli.Context) []string {
+	var args []string
+	for _, flag := range gcFlags {
+		name := flag.Names()[0]
+		if c.IsSet(name) {
+			args = append(args, "--"+name+"="+c.String(name))
+		}
+	}
+	return args
+}
+
+func progressFromFlags(c *cli.Context) (string, error) {
+	switch progress := c.String("progress"); progress {
+	case buildkit.ProgressAuto, buildkit.ProgressPlain, buildkit.ProgressJSON:
+		return progress, nil
+	default:
+		return "", fmt.Errorf("invalid progress %q, must be one of auto, plain or json", progress)
+	}
+}
+
+// splitCmdArgs splits cli args of the form "<source args...> -- <cmd args...>".
+func splitCmdArgs(args cli.Args) (srcArgs []string, cmdArgs []string) {
+	all := args.Slice()
+	for i, arg := range all {
+		if arg == "--" {
+			return all[:i], all[i+1:]
+		}
+	}
+	return all, nil
+}
+
+// parseEnv validates a list of K=V env vars.
+func parseEnv(env []string) ([]string, error) {
+	for _, kv := range env {
+		if strings.IndexByte(kv, '=') <= 0 {
+			return nil, fmt.Errorf("invalid env var %q, must be of the form K=V", kv)
+		}
+	}
+	return env, nil
+}
+
+// parseMounts parses --mount values of the form host:ctr[:ro].
+func parseMounts(specs []string) ([]graph.HostMount, error) {
+	var mounts []graph.HostMount
+	for _, spec := range specs {
+		split := strings.Split(spec, ":")
+		if len(split) < 2 || len(split) > 3 || split[0] == "" || split[1] == "" {
+			return nil, fmt.Errorf("invalid mount %q, must be of the form host:ctr[:ro]", spec)
+		}
+		m := graph.HostMount{Dest: split[1]}
+		if len(split) == 3 {
+			if split[2] != "ro" {
+				return nil, fmt.Errorf("invalid mount option %q in %q, only ro is supported", split[2], spec)
+			}
+			m.Readonly = true
+		}
+		if !filepath.IsAbs(m.Dest) {
+			return nil, fmt.Errorf("invalid mount %q, the destination must be an absolute path", spec)
+		}
+		source, err := filepath.Abs(split[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount source %q: %w", split[0], err)
+		}
+		if _, err := os.Stat(source); err != nil {
+			return nil, fmt.Errorf("invalid mount source %q: %w", split[0], err)
+		}
+		m.Source = source
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// hostMountPaths returns where each host path in mounts is mounted in the
+// system container.
+func hostMountPaths(mounts []graph.HostMount) map[string]string {
+	var sources []string
+	for _, m := range mounts {
+		sources = append(sources, m.Source)
+	}
+	sort.Strings(sources)
+
+	paths := make(map[string]string)
+	for _, source := range sources {
+		if _, ok := paths[source]; !ok {
+			paths[source] = filepath.Join(ctrHostMountsDir, strconv.Itoa(len(paths)))
+		}
+	}
+	return paths
+}
+
+// missingMounts returns the mounts of a buildkit.MissingMountsError in err,
+// which may be one of the errors of a multierror.
+func missingMounts(err error) ([]graph.HostMount, bool) {
+	var missingErr *buildkit.MissingMountsError
+	if errors.As(err, &missingErr) {
+		return missingErr.Mounts, true
+	}
+	if merr, ok := err.(*multierror.Error); ok {
+		for _, err := range merr.Errors {
+			if mounts, ok := missingMounts(err); ok {
+				return mounts, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// confirmRunMounts asks whether the host paths the system's definition asks
+// for should be mounted into the system, failing unless they should be.
+func confirmRunMounts(mounts []graph.HostMount) error {
+	var lines []string
+	for _, m := range mounts {
+		mode := "read-only"
+		if !m.Readonly {
+			mode = "writable"
+		}
+		lines = append(lines, fmt.Sprintf("  %s at %s (%s)", m.Source, m.Dest, mode))
+	}
+	desc := strings.Join(lines, "\n")
+
+	if _, err := console.ConsoleFromFile(os.Stdin); err != nil {
+		return fmt.Errorf("the system's definition mounts host paths:\n%s\n"+
+			"pass --allow-run-mounts to mount them or --mount them yourself", desc)
+	}
+	fmt.Fprintf(os.Stderr, "The system's definition mounts host paths:\n%s\nMount them? [y/N] ", desc)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read answer: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("not mounting the host paths the system's definition asks for")
+}
+
+func needsFuseOverlayfs(cfg *stateConfig) (bool, error) {
+	if _, err := os.Stat(cfg.fuseOverlayfsBin()); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// needsDaemonBins returns whether any of the binaries the daemon runs still
+// have to be exported to the system's var dir.
+func needsDaemonBins(cfg *stateConfig) (bool, error) {
+	needFuseOverlayfs, err := needsFuseOverlayfs(cfg)
+	if err != nil || needFuseOverlayfs {
+		return needFuseOverlayfs, err
+	}
+	return needsGit(cfg)
+}
+
+// exportDaemonBins exports the binaries the daemon runs that are missing
+// from the system's var dir.
+func exportDaemonBins(ctx context.Context, cfg *stateConfig, bcArgs buildkit.BincastleArgs) error {
+	if needFuseOverlayfs, err := needsFuseOverlayfs(cfg); err != nil {
+		return err
+	} else if needFuseOverlayfs {
+		if err := exportFuseOverlayfs(ctx, cfg, bcArgs); err != nil {
+			return err
+		}
+	}
+	if needGit, err := needsGit(cfg); err != nil {
+		return err
+	} else if needGit {
+		if err := exportGit(ctx, cfg, bcArgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func gcConfigFromFlags(c *cli.Context) (buildkit.GCConfig, error) {
+	gcConfig := buildkit.DefaultGCConfig
+	if keepStorage := c.String("gc-keep-storage"); keepStorage != "" {
+		bytes, err := units.FromHumanSize(keepStorage)
+		if err != nil {
+			return gcConfig, fmt.Errorf("invalid gc-keep-storage %q: %w", keepStorage, err)
+		}
+		gcConfig.KeepStorage = bytes
+	}
+	gcConfig.KeepDuration = c.Duration("gc-keep-duration")
+	gcConfig.Disabled = c.Bool("no-gc")
+	return gcConfig, nil
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
 func waitToExist(ctx context.Context, path string) error {
 	for {
 		if _, err := os.Stat(path); err == nil {
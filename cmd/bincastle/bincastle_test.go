@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sipsma/bincastle/graph"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+// runFlags runs a command with flags on args and returns the context it got.
+func runFlags(t *testing.T, flags []cli.Flag, args ...string) *cli.Context {
+	var ctx *cli.Context
+	app := &cli.App{Commands: []*cli.Command{{
+		Name:  "test",
+		Flags: flags,
+		Action: func(c *cli.Context) error {
+			ctx = c
+			return nil
+		},
+	}}}
+	require.NoError(t, app.Run(append([]string{"bincastle", "test"}, args...)))
+	return ctx
+}
+
+func TestDaemonFlagArgs(t *testing.T) {
+	flags := joinflags(stateRootFlags, gcFlags, sshFlags)
+	require.Empty(t, daemonFlagArgs(runFlags(t, flags, "--ssh", "src")))
+	require.Equal(t, []string{
+		"--gc-keep-storage=10GB",
+		"--gc-keep-duration=1h0m0s",
+		"--no-gc=true",
+	}, daemonFlagArgs(runFlags(t, flags,
+		"--gc-keep-storage", "10GB", "--no-gc", "--gc-keep-duration", "1h", "src")))
+
+	// commands without gc flags start the daemon with its defaults
+	require.Empty(t, daemonFlagArgs(runFlags(t, stateRootFlags)))
+}
+
+func TestSSHAgentFromFlags(t *testing.T) {
+	origSock := sshAgentSock
+	defer func() { sshAgentSock = origSock }()
+	flags := joinflags(sshFlags)
+
+	sshAgentSock = ""
+	agent, err := sshAgentFromFlags(runFlags(t, flags))
+	require.NoError(t, err)
+	require.Empty(t, agent)
+	_, err = sshAgentFromFlags(runFlags(t, flags, "--ssh"))
+	require.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "bincastle-ssh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sshAgentSock = filepath.Join(dir, "agent.sock")
+	// the agent isn't running
+	_, err = sshAgentFromFlags(runFlags(t, flags, "--ssh"))
+	require.Error(t, err)
+
+	l, err := net.Listen("unix", sshAgentSock)
+	require.NoError(t, err)
+	defer l.Close()
+	agent, err = sshAgentFromFlags(runFlags(t, flags, "--ssh"))
+	require.NoError(t, err)
+	require.Equal(t, sshAgentSock, agent)
+}
+
+func TestSplitCmdArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		srcArgs []string
+		cmdArgs []string
+	}{
+		{name: "no cmd", args: []string{"src", "sub"}, srcArgs: []string{"src", "sub"}},
+		{name: "cmd", args: []string{"src", "--", "make", "test"}, srcArgs: []string{"src"}, cmdArgs: []string{"make", "test"}},
+		{name: "empty cmd", args: []string{"src", "--"}, srcArgs: []string{"src"}, cmdArgs: []string{}},
+		// only the first -- separates the cmd
+		{name: "-- in cmd", args: []string{"src", "--", "sh", "--", "x"}, srcArgs: []string{"src"}, cmdArgs: []string{"sh", "--", "x"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var srcArgs, cmdArgs []string
+			app := &cli.App{
+				Action: func(c *cli.Context) error {
+					srcArgs, cmdArgs = splitCmdArgs(c.Args())
+					return nil
+				},
+			}
+			require.NoError(t, app.Run(append([]string{"bincastle"}, tc.args...)))
+			require.Equal(t, tc.srcArgs, srcArgs)
+			require.Equal(t, tc.cmdArgs, cmdArgs)
+		})
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	for _, tc := range []struct {
+		env []string
+		err bool
+	}{
+		{env: nil},
+		{env: []string{"A=1", "B=", "C=a=b"}},
+		{env: []string{"A"}, err: true},
+		{env: []string{"=1"}, err: true},
+		{env: []string{"A=1", "B"}, err: true},
+	} {
+		env, err := parseEnv(tc.env)
+		if tc.err {
+			require.Error(t, err, "%v", tc.env)
+			continue
+		}
+		require.NoError(t, err, "%v", tc.env)
+		require.Equal(t, tc.env, env)
+	}
+}
+
+func TestParseMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bincastle-mounts")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	origWd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(origWd)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "data"), 0755))
+
+	for _, tc := range []struct {
+		spec  string
+		mount graph.HostMount
+		err   bool
+	}{
+		{spec: dir + ":/mnt", mount: graph.HostMount{Source: dir, Dest: "/mnt"}},
+		{spec: dir + ":/mnt:ro", mount: graph.HostMount{Source: dir, Dest: "/mnt", Readonly: true}},
+		// sources are relative to the working dir
+		{spec: "data:/data", mount: graph.HostMount{Source: filepath.Join(dir, "data"), Dest: "/data"}},
+		{spec: dir, err: true},
+		{spec: dir + ":", err: true},
+		{spec: ":/mnt", err: true},
+		{spec: dir + ":/mnt:rw", err: true},
+		{spec: dir + ":/mnt:ro:x", err: true},
+		{spec: dir + ":mnt", err: true},
+		{spec: "missing:/mnt", err: true},
+	} {
+		mounts, err := parseMounts([]string{tc.spec})
+		if tc.err {
+			require.Error(t, err, tc.spec)
+			continue
+		}
+		require.NoError(t, err, tc.spec)
+		require.Equal(t, []graph.HostMount{tc.mount}, mounts, tc.spec)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/sipsma/bincastle/buildkit"
+	"github.com/urfave/cli/v2"
+)
+
+func bootstrapCommand(selfBin string) *cli.Command {
+	return &cli.Command{
+		Name:  bootstrapArg,
+		Usage: "manage the images systems are bootstrapped from",
+		Subcommands: []*cli.Command{
+			{
+				Name: "import",
+				Usage: "load images from an OCI layout dir or image tarball, which are used " +
+					"in place of pulling them (i.e. on machines without internet access)",
+				ArgsUsage: "<oci layout dir | tarball>",
+				Flags: joinflags(stateRootFlags, []cli.Flag{&cli.StringFlag{
+					Name:  "ref",
+					Usage: "ref to store the image as, for archives of a single image that don't name it",
+				}}),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("a path to an OCI layout dir or image tarball must be provided")
+					}
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+					return withSystem(ctx, cfg, selfBin, "", daemonFlagArgs(c), func(sockPath string) error {
+						refs, err := buildkit.ImportImages(ctx, sockPath, c.Args().First(), c.String("ref"))
+						for _, ref := range refs {
+							fmt.Printf("imported %s\n", ref)
+						}
+						return err
+					})
+				},
+			},
+		},
+	}
+}
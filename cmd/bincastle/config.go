@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sipsma/bincastle/buildkit"
+	"github.com/sipsma/bincastle/ctr"
+	"github.com/sipsma/bincastle/graph"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	stateRootEnv   = "BINCASTLE_ROOT"
+	configFileName = "config.json"
+
+	// paths inside the system container, the host's var dir is mounted at
+	// ctrVarDir and the cache dir at buildkit.Root
+	ctrVarDir           = "/var"
+	ctrCtrsDir          = "/var/ctrs"
+	ctrFuseOverlayfsBin = "/var/fuse-overlayfs"
+	// git is mounted at the prefix it was built with in the sysroot image
+	ctrGitDir = "/tools"
+	// host paths mounted with --mount or by the system's definition are
+	// mounted under ctrHostMountsDir before being mounted into the exec
+	ctrHostMountsDir = "/run/bincastle/mounts"
+)
+
+var stateRootFlags = []cli.Flag{&cli.StringFlag{
+	Name:    "root",
+	EnvVars: []string{stateRootEnv},
+	Usage:   "dir bincastle keeps all its state in (default: $HOME/.bincastle)",
+}}
+
+// stateConfig is where bincastle keeps its state on the host. It's read from
+// config.json in the state root, paths that aren't set there default to dirs
+// under the root and relative paths are relative to the root.
+type stateConfig struct {
+	Root string `json:"-"`
+	// VarDir is mounted at /var in the system container, it holds the
+	// daemon's socket and the fuse-overlayfs binary.
+	VarDir string `json:"varDir,omitempty"`
+	// CacheDir holds the build cache and the persistent state of each exec.
+	CacheDir string `json:"cacheDir,omitempty"`
+	// CtrsDir holds the runtime state of the system container.
+	CtrsDir string `json:"ctrsDir,omitempty"`
+	// Images are the refs of the images bincastle bootstraps from, i.e. to
+	// use a mirror.
+	Images imageConfig `json:"images,omitempty"`
+	// Registries configures mirrors, certificates and credentials of
+	// registry hosts, keyed by host. Relative paths are relative to the root.
+	Registries buildkit.RegistryConfigs `json:"registries,omitempty"`
+	// Network configures the DNS of build steps and whether they run
+	// hermetically.
+	Network buildkit.NetworkConfig `json:"network,omitempty"`
+}
+
+type imageConfig struct {
+	// Sysroot is the image definitions are built and run with.
+	Sysroot string `json:"sysroot,omitempty"`
+	// FuseOverlayfs is the image the fuse-overlayfs binary is exported from
+	// when it isn't embedded in bincastle.
+	FuseOverlayfs string `json:"fuseOverlayfs,omitempty"`
+}
+
+func loadStateConfig(c *cli.Context) (*stateConfig, error) {
+	root := c.String("root")
+	if root == "" {
+		homeDir, err := homeDir()
+		if err != nil {
+			return nil, err
+		}
+		root = filepath.Join(homeDir, ".bincastle")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state root %q: %w", root, err)
+	}
+
+	cfg := &stateConfig{Root: root}
+	bytes, err := ioutil.ReadFile(filepath.Join(root, configFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(bytes, cfg); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %w", filepath.Join(root, configFileName), err)
+		}
+	}
+
+	for _, dir := range []struct {
+		path *string
+		def  string
+	}{
+		{&cfg.VarDir, "var"},
+		{&cfg.CacheDir, filepath.Join("var", "lib", "buildkitd")},
+		{&cfg.CtrsDir, "ctrs"},
+	} {
+		if *dir.path == "" {
+			*dir.path = dir.def
+		}
+		if !filepath.IsAbs(*dir.path) {
+			*dir.path = filepath.Join(root, *dir.path)
+		}
+		if err := os.MkdirAll(*dir.path, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Images.Sysroot == "" {
+		cfg.Images.Sysroot = graph.DefaultSysrootImage
+	}
+	if cfg.Images.FuseOverlayfs == "" {
+		cfg.Images.FuseOverlayfs = defaultFuseOverlayfsImage
+	}
+	if err := cfg.resolveRegistryPaths(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Network.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid network config: %w", err)
+	}
+	return cfg, nil
+}
+
+func (cfg *stateConfig) sockPath() string {
+	return filepath.Join(cfg.VarDir, filepath.Base(buildkit.SockPath))
+}
+
+// lockPath is the host path of the lock held by the daemon while it's running.
+func (cfg *stateConfig) lockPath() string {
+	return filepath.Join(cfg.CacheDir, filepath.Base(buildkit.LockPath))
+}
+
+// clientsLockPath is held shared by each client connected to a running
+// system from outside of it.
+func (cfg *stateConfig) clientsLockPath() string {
+	return filepath.Join(cfg.VarDir, clientsDir+".lock")
+}
+
+// logPath is where the output of a system running in the background goes.
+func (cfg *stateConfig) logPath() string {
+	return filepath.Join(cfg.Root, "system.log")
+}
+
+// overridesPath is where the local source overrides of each system are kept.
+func (cfg *stateConfig) overridesPath() string {
+	return filepath.Join(cfg.Root, "overrides.json")
+}
+
+func (cfg *stateConfig) fuseOverlayfsBin() string {
+	return filepath.Join(cfg.VarDir, filepath.Base(ctrFuseOverlayfsBin))
+}
+
+// gitDir is where git is exported to, it's mounted at ctrGitDir.
+func (cfg *stateConfig) gitDir() string {
+	return filepath.Join(cfg.VarDir, "git")
+}
+
+func (cfg *stateConfig) systemCtrState() (ctr.ContainerState, error) {
+	ctrStateDir, err := filepath.EvalSymlinks(cfg.CtrsDir)
+	if err != nil {
+		return "", fmt.Errorf(
+			"failed to evaluate symlinks in container state root dir: %w", err)
+	}
+	return ctr.ContainerStateRoot(ctrStateDir).ContainerState(ctrName), nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sipsma/bincastle/buildkit"
+	"github.com/sipsma/bincastle/graph"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+// testStateConfig loads the config of a temp state root with the given
+// config.json contents, if any.
+func testStateConfig(t *testing.T, configJSON string) (*stateConfig, error) {
+	root, err := ioutil.TempDir("", "bincastle-root")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+	if configJSON != "" {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, configFileName), []byte(configJSON), 0644))
+	}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("root", root, "")
+	return loadStateConfig(cli.NewContext(cli.NewApp(), set, nil))
+}
+
+func TestLoadStateConfigImages(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		config        string
+		sysroot       string
+		fuseOverlayfs string
+		err           bool
+	}{{
+		name:          "defaults",
+		sysroot:       graph.DefaultSysrootImage,
+		fuseOverlayfs: defaultFuseOverlayfsImage,
+	}, {
+		name:          "mirror",
+		config:        `{"images": {"sysroot": "registry.internal/sysroot:v1"}}`,
+		sysroot:       "registry.internal/sysroot:v1",
+		fuseOverlayfs: defaultFuseOverlayfsImage,
+	}, {
+		name:          "both",
+		config:        `{"images": {"sysroot": "registry.internal/sysroot:v1", "fuseOverlayfs": "registry.internal/fuse:v1"}}`,
+		sysroot:       "registry.internal/sysroot:v1",
+		fuseOverlayfs: "registry.internal/fuse:v1",
+	}, {
+		name:   "malformed",
+		config: `{"images": "sysroot"}`,
+		err:    true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := testStateConfig(t, tc.config)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.sysroot, cfg.Images.Sysroot)
+			require.Equal(t, tc.fuseOverlayfs, cfg.Images.FuseOverlayfs)
+		})
+	}
+}
+
+func TestLoadStateConfigDirs(t *testing.T) {
+	ctrsDir, err := ioutil.TempDir("", "bincastle-ctrs")
+	require.NoError(t, err)
+	defer os.RemoveAll(ctrsDir)
+	cfg, err := testStateConfig(t, `{"varDir": "state/var", "ctrsDir": "`+ctrsDir+`"}`)
+	require.NoError(t, err)
+	// relative dirs are under the root, the rest default to it
+	require.Equal(t, filepath.Join(cfg.Root, "state", "var"), cfg.VarDir)
+	require.Equal(t, ctrsDir, cfg.CtrsDir)
+	require.Equal(t, filepath.Join(cfg.Root, "var", "lib", "buildkitd"), cfg.CacheDir)
+	for _, dir := range []string{cfg.VarDir, cfg.CtrsDir, cfg.CacheDir} {
+		fi, err := os.Stat(dir)
+		require.NoError(t, err)
+		require.True(t, fi.IsDir())
+	}
+}
+
+func TestWriteEmbeddedFuseOverlayfs(t *testing.T) {
+	cfg, err := testStateConfig(t, "")
+	require.NoError(t, err)
+	need, err := needsFuseOverlayfs(cfg)
+	require.NoError(t, err)
+	require.True(t, need)
+
+	defer func(orig []byte) { embeddedFuseOverlayfs = orig }(embeddedFuseOverlayfs)
+	embeddedFuseOverlayfs = []byte("#!/bin/sh\n")
+	require.NoError(t, writeEmbeddedFuseOverlayfs(cfg))
+
+	dt, err := ioutil.ReadFile(cfg.fuseOverlayfsBin())
+	require.NoError(t, err)
+	require.Equal(t, embeddedFuseOverlayfs, dt)
+	fi, err := os.Stat(cfg.fuseOverlayfsBin())
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+	// the temp file it's written to is gone
+	tmpFiles, err := filepath.Glob(filepath.Join(cfg.VarDir, ".fuse-overlayfs*"))
+	require.NoError(t, err)
+	require.Empty(t, tmpFiles)
+
+	need, err = needsFuseOverlayfs(cfg)
+	require.NoError(t, err)
+	require.False(t, need)
+}
+
+func TestLoadStateConfigRegistries(t *testing.T) {
+	// the files the registry configs refer to are in the state root
+	cfg, err := testStateConfig(t, "")
+	require.NoError(t, err)
+	for _, name := range []string{"ca.pem", "cert.pem", "key.pem", "password"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Root, name), []byte(name), 0600))
+	}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("root", cfg.Root, "")
+	c := cli.NewContext(cli.NewApp(), set, nil)
+
+	for _, tc := range []struct {
+		name   string
+		config string
+		check  func(t *testing.T, cfg *stateConfig)
+		err    bool
+	}{{
+		name: "relative paths",
+		config: `{"registries": {"registry.internal": {
+			"ca": ["ca.pem"], "clientCert": "cert.pem", "clientKey": "` + filepath.Join(cfg.Root, "key.pem") + `",
+			"auth": {"username": "ci", "passwordFile": "password"}}}}`,
+		check: func(t *testing.T, loaded *stateConfig) {
+			rc := loaded.Registries["registry.internal"]
+			require.Equal(t, []string{filepath.Join(cfg.Root, "ca.pem")}, rc.CAs)
+			require.Equal(t, filepath.Join(cfg.Root, "cert.pem"), rc.ClientCert)
+			require.Equal(t, filepath.Join(cfg.Root, "key.pem"), rc.ClientKey)
+			require.Equal(t, filepath.Join(cfg.Root, "password"), rc.Auth.PasswordFile)
+		},
+	}, {
+		name:   "mirrors",
+		config: `{"registries": {"docker.io": {"mirrors": ["mirror.internal"]}, "mirror.internal": {"plainHTTP": true}}}`,
+		check: func(t *testing.T, loaded *stateConfig) {
+			require.Equal(t, []string{"mirror.internal"}, loaded.Registries["docker.io"].Mirrors)
+			require.True(t, loaded.Registries["mirror.internal"].PlainHTTP)
+		},
+	}, {
+		name:   "missing file",
+		config: `{"registries": {"registry.internal": {"ca": ["missing.pem"]}}}`,
+		err:    true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Root, configFileName), []byte(tc.config), 0644))
+			loaded, err := loadStateConfig(c)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			tc.check(t, loaded)
+		})
+	}
+}
+
+func TestCtrRegistries(t *testing.T) {
+	cfg := &stateConfig{Registries: buildkit.RegistryConfigs{
+		"registry.internal": {
+			Mirrors:    []string{"mirror.internal"},
+			Insecure:   true,
+			CAs:        []string{"/host/ca.pem"},
+			ClientCert: "/host/cert.pem",
+			ClientKey:  "/host/key.pem",
+			Auth:       &buildkit.RegistryAuth{Username: "ci", PasswordFile: "/host/password"},
+		},
+		"mirror.internal": {PlainHTTP: true},
+	}}
+	registries, mounts := cfg.ctrRegistries()
+
+	// the daemon reads the files from where they're mounted
+	sources := make(map[string]string)
+	for _, m := range mounts {
+		require.True(t, strings.HasPrefix(m.Dest, ctrRegistryDir+"/"), m.Dest)
+		require.Equal(t, filepath.Base(m.Source), filepath.Base(m.Dest))
+		sources[m.Dest] = m.Source
+	}
+	require.Len(t, sources, 3)
+	rc := registries["registry.internal"]
+	require.Equal(t, []string{"mirror.internal"}, rc.Mirrors)
+	require.True(t, rc.Insecure)
+	require.Len(t, rc.CAs, 1)
+	require.Equal(t, "/host/ca.pem", sources[rc.CAs[0]])
+	require.Equal(t, "/host/cert.pem", sources[rc.ClientCert])
+	require.Equal(t, "/host/key.pem", sources[rc.ClientKey])
+	// credentials are only read by clients
+	require.Nil(t, rc.Auth)
+	require.Equal(t, buildkit.RegistryConfig{PlainHTTP: true}, registries["mirror.internal"])
+
+	// the daemon gets them through its env
+	dt, err := json.Marshal(registries)
+	require.NoError(t, err)
+	defer os.Unsetenv(registriesEnv)
+	require.NoError(t, os.Setenv(registriesEnv, string(dt)))
+	fromEnv, err := registriesFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, registries, fromEnv)
+
+	require.NoError(t, os.Setenv(registriesEnv, "{"))
+	_, err = registriesFromEnv()
+	require.Error(t, err)
+	require.NoError(t, os.Unsetenv(registriesEnv))
+	fromEnv, err = registriesFromEnv()
+	require.NoError(t, err)
+	require.Empty(t, fromEnv)
+}
+
+func TestHostCABundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bincastle-certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "bundle.pem")
+	require.NoError(t, ioutil.WriteFile(bundle, nil, 0644))
+	link := filepath.Join(dir, "link.pem")
+	require.NoError(t, os.Symlink(bundle, link))
+
+	defer func(orig string, set bool) {
+		if set {
+			os.Setenv("SSL_CERT_FILE", orig)
+		} else {
+			os.Unsetenv("SSL_CERT_FILE")
+		}
+	}(os.LookupEnv("SSL_CERT_FILE"))
+	// the bundle is mounted, so symlinks are resolved
+	require.NoError(t, os.Setenv("SSL_CERT_FILE", link))
+	require.Equal(t, bundle, hostCABundle())
+
+	defer func(orig []string) { hostCABundles = orig }(hostCABundles)
+	hostCABundles = []string{filepath.Join(dir, "missing.pem")}
+	require.NoError(t, os.Setenv("SSL_CERT_FILE", filepath.Join(dir, "missing.pem")))
+	require.Empty(t, hostCABundle())
+}
+
+func TestLoadStateConfigNetwork(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  string
+		network buildkit.NetworkConfig
+		err     bool
+	}{{
+		name: "host dns",
+	}, {
+		name:   "dns and hermetic",
+		config: `{"network": {"hermetic": true, "dns": {"nameservers": ["10.0.0.2"], "searchDomains": ["internal"]}}}`,
+		network: buildkit.NetworkConfig{
+			Hermetic: true,
+			DNS:      &buildkit.DNSConfig{Nameservers: []string{"10.0.0.2"}, SearchDomains: []string{"internal"}},
+		},
+	}, {
+		name:   "invalid nameserver",
+		config: `{"network": {"dns": {"nameservers": ["dns.internal"]}}}`,
+		err:    true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := testStateConfig(t, tc.config)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.network, cfg.Network)
+
+			// the daemon gets it through its env
+			dt, err := json.Marshal(cfg.Network)
+			require.NoError(t, err)
+			defer os.Unsetenv(networkEnv)
+			require.NoError(t, os.Setenv(networkEnv, string(dt)))
+			network, err := networkFromEnv()
+			require.NoError(t, err)
+			require.Equal(t, tc.network, network)
+		})
+	}
+
+	defer os.Unsetenv(networkEnv)
+	require.NoError(t, os.Setenv(networkEnv, "{"))
+	_, err := networkFromEnv()
+	require.Error(t, err)
+}
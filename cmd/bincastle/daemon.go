@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/gofrs/flock"
+	"github.com/hashicorp/go-multierror"
+	"github.com/moby/buildkit/identity"
+	"github.com/sipsma/bincastle/buildkit"
+	"github.com/sipsma/bincastle/ctr"
+)
+
+// clientsDir is the dir under the var dir holding the stdio fifos of each
+// client connected to a running system from outside of it.
+const clientsDir = "clients"
+
+// runDaemon starts the system container without running a system in it and
+// serves clients on its socket until it receives a signal.
+func runDaemon(cfg *stateConfig, ctrState ctr.ContainerState, ctrDef ctr.ContainerDef) error {
+	if ctrState.ContainerExists() {
+		return ctr.ContainerExistsError{ID: ctrName}
+	}
+	// the system isn't running, so any socket still around is stale
+	if err := os.Remove(cfg.sockPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// nothing can still be attached to the fifos of old clients
+	if err := os.RemoveAll(filepath.Join(cfg.VarDir, clientsDir)); err != nil {
+		return err
+	}
+
+	needBins, err := needsDaemonBins(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(
+		namespaces.WithNamespace(context.Background(), "buildkit"))
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigchan)
+
+	goCount := 3
+	errCh := make(chan error, goCount)
+	started := make(chan struct{})
+
+	go func() {
+		defer cancel()
+		errCh <- runCtr(ctx, ctrState, ctrDef, false)
+	}()
+
+	go func() {
+		timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 10*time.Second)
+		defer timeoutCancel()
+		// TODO don't hardcode
+		if err := waitToExist(timeoutCtx, cfg.sockPath()); err != nil {
+			defer cancel()
+			errCh <- err
+			return
+		}
+		close(started)
+
+		if needBins {
+			if err := exportDaemonBins(ctx, cfg, buildkit.BincastleArgs{
+				BincastleSockPath: cfg.sockPath(),
+			}); err != nil {
+				defer cancel()
+				errCh <- err
+				return
+			}
+		}
+		fmt.Fprintf(os.Stderr, "daemon listening on %s\n", cfg.sockPath())
+		errCh <- nil
+	}()
+
+	go func() {
+		defer cancel()
+		select {
+		case sig := <-sigchan:
+			fmt.Fprintf(os.Stderr, "received signal %s, stopping daemon\n", sig)
+			errCh <- nil
+		case <-ctx.Done():
+			errCh <- nil
+		}
+	}()
+
+	var finalErr error
+	for i := 0; i < goCount; i++ {
+		finalErr = multierror.Append(finalErr, <-errCh).ErrorOrNil()
+	}
+	if finalErr != nil && !isClosed(started) {
+		reportStartupFailure(cfg)
+	}
+	return finalErr
+}
+
+// runClient runs the system as a client of the daemon already running in the
+// system container. The system's stdio is connected to this process through
+// fifos in the var dir, which is shared with the daemon.
+func runClient(cfg *stateConfig, bcArgs buildkit.BincastleArgs) (rerr error) {
+	id := identity.NewID()
+	hostDir := filepath.Join(cfg.VarDir, clientsDir, id)
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		return fmt.Errorf("failed to create client io dir: %w", err)
+	}
+	defer func() {
+		rerr = multierror.Append(rerr, os.RemoveAll(hostDir)).ErrorOrNil()
+	}()
+
+	ioDir := ctr.IODir(hostDir)
+	fifoPaths := []string{ioDir.TTYInFifo(), ioDir.TTYOutFifo(), ioDir.ResizeFifo()}
+	if bcArgs.NoTTY {
+		fifoPaths = []string{ioDir.StdinFifo(), ioDir.StdoutFifo(), ioDir.StderrFifo()}
+	}
+	for _, path := range fifoPaths {
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return fmt.Errorf("failed to create client fifo %s: %w", path, err)
+		}
+	}
+	if !bcArgs.NoTTY {
+		// hold the resize fifo open so resizes sent before the daemon opens
+		// it aren't lost
+		resizeFifo, err := os.OpenFile(ioDir.ResizeFifo(), os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open resize fifo: %w", err)
+		}
+		defer resizeFifo.Close()
+	}
+
+	clientsLock := flock.New(cfg.clientsLockPath())
+	locked, err := clientsLock.TryRLock()
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", clientsLock.Path(), err)
+	}
+	if !locked {
+		return fmt.Errorf("the system is stopping, try again once it has exited")
+	}
+	defer clientsLock.Unlock()
+
+	bcArgs.ClientIODir = filepath.Join(ctrVarDir, clientsDir, id)
+	bcArgs.BincastleSockPath = cfg.sockPath()
+
+	ctx, cancel := context.WithCancel(
+		namespaces.WithNamespace(context.Background(), "buildkit"))
+	defer cancel()
+	ioctx, iocancel := context.WithCancel(context.Background())
+	defer iocancel()
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigchan)
+	go func() {
+		select {
+		case <-sigchan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	attachCh := make(chan error, 1)
+	go func() {
+		var attachErr error
+		if bcArgs.NoTTY {
+			attachErr = ioDir.AttachStreams(ioctx, os.Stdin, os.Stdout, os.Stderr)
+		} else {
+			attachErr = ctr.AttachSelfConsole(ioctx, ioDir)
+		}
+		if attachErr == context.Canceled {
+			attachErr = nil
+		}
+		if attachErr != nil {
+			attachErr = fmt.Errorf("error during console attach: %w", attachErr)
+		}
+		attachCh <- attachErr
+	}()
+
+	buildErr := buildkit.BincastleBuild(ctx, bcArgs)
+
+	// the daemon closes its end of the fifos once the system exits, give the
+	// attach a moment to copy whatever output is left
+	select {
+	case attachErr := <-attachCh:
+		return multierror.Append(buildErr, attachErr).ErrorOrNil()
+	case <-time.After(time.Second):
+	}
+	iocancel()
+	return multierror.Append(buildErr, <-attachCh).ErrorOrNil()
+}
+
+// waitForClients blocks until no clients are connected to the system from
+// outside of it. New clients are refused until clientsLock is unlocked.
+func waitForClients(ctx context.Context, clientsLock *flock.Flock) error {
+	locked, err := clientsLock.TryLock()
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", clientsLock.Path(), err)
+	}
+	if locked {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "waiting for the other execs of the system to exit\n")
+	// TODO don't hardcode
+	if _, err := clientsLock.TryLockContext(ctx, 500*time.Millisecond); err != nil {
+		if err == context.Canceled {
+			return nil
+		}
+		return fmt.Errorf("failed waiting for the other execs of the system: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bincastle-clients")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := &stateConfig{VarDir: dir}
+
+	// no clients
+	lock := flock.New(cfg.clientsLockPath())
+	require.NoError(t, waitForClients(context.Background(), lock))
+	// new clients are refused until it's unlocked
+	locked, err := flock.New(cfg.clientsLockPath()).TryRLock()
+	require.NoError(t, err)
+	require.False(t, locked)
+	require.NoError(t, lock.Unlock())
+
+	// a connected client is waited for
+	client := flock.New(cfg.clientsLockPath())
+	locked, err = client.TryRLock()
+	require.NoError(t, err)
+	require.True(t, locked)
+	lock = flock.New(cfg.clientsLockPath())
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- waitForClients(context.Background(), lock)
+	}()
+	select {
+	case err := <-waitCh:
+		t.Fatalf("returned while a client is connected: %v", err)
+	case <-time.After(time.Second):
+	}
+	require.NoError(t, client.Unlock())
+	select {
+	case err := <-waitCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for clients")
+	}
+	require.NoError(t, lock.Unlock())
+
+	// stopping while waiting isn't an error
+	locked, err = client.TryRLock()
+	require.NoError(t, err)
+	require.True(t, locked)
+	defer client.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	require.NoError(t, waitForClients(ctx, flock.New(cfg.clientsLockPath())))
+}
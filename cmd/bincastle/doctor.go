@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	units "github.com/docker/go-units"
+	"github.com/gofrs/flock"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	minKernelMajor = 4
+	minKernelMinor = 18
+	// minFreeDisk is what the README recommends for building the demo system
+	minFreeDisk = 20e9 // ~20GB
+)
+
+// checkResult is the outcome of checking one of the host's requirements.
+// Hint says how to fix a failed check.
+type checkResult struct {
+	Name   string
+	OK     bool
+	Detail string
+	Hint   string
+}
+
+func pass(name, detail string) checkResult {
+	return checkResult{Name: name, OK: true, Detail: detail}
+}
+
+func fail(name, detail, hint string) checkResult {
+	return checkResult{Name: name, Detail: detail, Hint: hint}
+}
+
+// doctorChecks checks each of the host requirements listed in the README
+// along with state left over from systems that didn't exit cleanly.
+func doctorChecks(cfg *stateConfig) []checkResult {
+	results := []checkResult{
+		checkArch(),
+		checkKernel(),
+		checkUsernsClone(),
+		checkMaxUserns(),
+		checkFuse(),
+		checkCABundle(),
+	}
+	dirs := []string{cfg.Root}
+	if cfg.CacheDir != cfg.Root {
+		dirs = append(dirs, cfg.CacheDir)
+	}
+	for _, dir := range dirs {
+		results = append(results, checkXattrs(dir))
+	}
+	results = append(results,
+		checkFreeDisk(cfg.CacheDir),
+		checkLock(cfg),
+		checkFuseMounts(cfg),
+	)
+	return results
+}
+
+func checkArch() checkResult {
+	const name = "architecture"
+	if runtime.GOARCH != "amd64" {
+		return fail(name, runtime.GOARCH, "bootstrap images are only built for x86_64 right now")
+	}
+	return pass(name, "x86_64")
+}
+
+func checkKernel() checkResult {
+	const name = "kernel version"
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return fail(name, err.Error(), "")
+	}
+	return checkKernelRelease(strings.TrimRight(string(uname.Release[:]), "\x00"))
+}
+
+// checkKernelRelease checks a release as given by uname -r, i.e.
+// 5.4.0-42-generic.
+func checkKernelRelease(release string) checkResult {
+	const name = "kernel version"
+	var major, minor int
+	if _, err := fmt.Sscanf(release, "%d.%d", &major, &minor); err != nil {
+		return fail(name, fmt.Sprintf("can't parse kernel release %q", release), "")
+	}
+	if major < minKernelMajor || (major == minKernelMajor && minor < minKernelMinor) {
+		return fail(name, release, fmt.Sprintf(
+			"upgrade to kernel v%d.%d or greater, which allows fuse in unprivileged user namespaces",
+			minKernelMajor, minKernelMinor))
+	}
+	return pass(name, release)
+}
+
+func checkUsernsClone() checkResult {
+	const name = "unprivileged userns"
+	const sysctl = "kernel.unprivileged_userns_clone"
+	val, err := readSysctl(sysctl)
+	if os.IsNotExist(err) {
+		// only some kernels have this sysctl, the others always allow it
+		return pass(name, "allowed")
+	}
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	if val != "1" {
+		return fail(name, fmt.Sprintf("%s=%s", sysctl, val), fmt.Sprintf("sudo sysctl -w %s=1", sysctl))
+	}
+	return pass(name, fmt.Sprintf("%s=%s", sysctl, val))
+}
+
+func checkMaxUserns() checkResult {
+	const name = "max user namespaces"
+	const sysctl = "user.max_user_namespaces"
+	val, err := readSysctl(sysctl)
+	if os.IsNotExist(err) {
+		return pass(name, "unlimited")
+	}
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	if n, err := strconv.Atoi(val); err != nil || n == 0 {
+		return fail(name, fmt.Sprintf("%s=%s", sysctl, val), fmt.Sprintf("sudo sysctl -w %s=15000", sysctl))
+	}
+	return pass(name, fmt.Sprintf("%s=%s", sysctl, val))
+}
+
+func readSysctl(sysctl string) (string, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join("/proc/sys", strings.ReplaceAll(sysctl, ".", "/")))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bytes)), nil
+}
+
+func checkFuse() checkResult {
+	const name = "/dev/fuse"
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return fail(name, "missing", "sudo modprobe fuse")
+	}
+	if err != nil {
+		return fail(name, err.Error(), "make /dev/fuse readable and writable by your user (i.e. sudo chmod 0666 /dev/fuse)")
+	}
+	f.Close()
+	return pass(name, "accessible")
+}
+
+// checkCABundle checks for the host's CA certificates, which the daemon
+// verifies registries with.
+func checkCABundle() checkResult {
+	const name = "CA certificates"
+	caBundle := hostCABundle()
+	if caBundle == "" {
+		return fail(name, "not found",
+			"install your distro's ca-certificates package or set $SSL_CERT_FILE to a bundle of them")
+	}
+	return pass(name, caBundle)
+}
+
+// checkXattrs checks that user xattrs can be set in dir, which fuse-overlayfs
+// needs to store file ownership and whiteouts.
+func checkXattrs(dir string) checkResult {
+	name := "xattrs in " + dir
+	f, err := ioutil.TempFile(dir, ".doctor")
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := unix.Fsetxattr(int(f.Fd()), "user.bincastle.doctor", []byte("1"), 0); err != nil {
+		return fail(name, err.Error(),
+			"use --root (or varDir/cacheDir in config.json) to keep state on a filesystem with user xattrs (i.e. ext4, xfs or btrfs)")
+	}
+	return pass(name, "supported")
+}
+
+func checkFreeDisk(dir string) checkResult {
+	name := "free disk in " + dir
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return fail(name, err.Error(), "")
+	}
+	free := float64(stat.Bavail) * float64(stat.Bsize)
+	if free < minFreeDisk {
+		return fail(name, units.HumanSize(free), fmt.Sprintf(
+			"free up at least %s (i.e. with bincastle prune) or move cacheDir to a bigger disk in config.json",
+			units.HumanSize(minFreeDisk)))
+	}
+	return pass(name, units.HumanSize(free))
+}
+
+// checkLock checks for a daemon lock that's still around while the system
+// isn't running.
+func checkLock(cfg *stateConfig) checkResult {
+	const name = "daemon lock"
+	lockPath := cfg.lockPath()
+	if _, err := os.Stat(lockPath); os.IsNotExist(err) {
+		return pass(name, "none")
+	} else if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	if ctrState, err := cfg.systemCtrState(); err == nil && ctrState.ContainerExists() {
+		return pass(name, "held by the running system")
+	}
+
+	lock := flock.New(lockPath)
+	locked, err := lock.TryLock()
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	if !locked {
+		return fail(name, lockPath+" is held by a process outside of a running system",
+			fmt.Sprintf("stop the process holding it (see fuser %s)", lockPath))
+	}
+	lock.Unlock()
+	return fail(name, "stale "+lockPath, "rm "+lockPath)
+}
+
+// checkFuseMounts checks for fuse mounts under the state dirs, which are left
+// behind when fuse-overlayfs is killed before it can unmount.
+func checkFuseMounts(cfg *stateConfig) checkResult {
+	const name = "leftover fuse mounts"
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	defer f.Close()
+	mounts, err := fuseMounts(f, cfg.Root, cfg.VarDir, cfg.CacheDir, cfg.CtrsDir)
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	if len(mounts) > 0 {
+		return fail(name, strings.Join(mounts, ", "), "fusermount -u each of them")
+	}
+	return pass(name, "none")
+}
+
+// fuseMounts returns the mountpoints of fuse mounts in mountinfo that are
+// under any of dirs.
+func fuseMounts(mountinfo io.Reader, dirs ...string) ([]string, error) {
+	var mounts []string
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		// the fs type is the first field after the "-" separator
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		var fsType string
+		for i, field := range fields[5:] {
+			if field == "-" && 5+i+1 < len(fields) {
+				fsType = fields[5+i+1]
+				break
+			}
+		}
+		if fsType != "fuse" && !strings.HasPrefix(fsType, "fuse.") {
+			continue
+		}
+		mountpoint, err := strconv.Unquote(`"` + fields[4] + `"`)
+		if err != nil {
+			mountpoint = fields[4]
+		}
+		for _, dir := range dirs {
+			if mountpoint == dir || strings.HasPrefix(mountpoint, dir+"/") {
+				mounts = append(mounts, mountpoint)
+				break
+			}
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// writeChecks writes a line for each result, followed by its hint if it
+// failed.
+func writeChecks(w io.Writer, results []checkResult) error {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, '\t', 0)
+	for _, result := range results {
+		status := "PASS"
+		if !result.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", status, result.Name, result.Detail)
+		if !result.OK && result.Hint != "" {
+			fmt.Fprintf(tw, "\tfix: %s\n", result.Hint)
+		}
+	}
+	return tw.Flush()
+}
+
+func failedChecks(results []checkResult) []checkResult {
+	var failed []checkResult
+	for _, result := range results {
+		if !result.OK {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// reportStartupFailure writes the failed checks to stderr after the system
+// failed to start, since they usually explain otherwise obscure errors.
+func reportStartupFailure(cfg *stateConfig) {
+	failed := failedChecks(doctorChecks(cfg))
+	if len(failed) == 0 {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "the system failed to start, these host requirements aren't met:")
+	writeChecks(os.Stderr, failed)
+}
+
+func doctorCommand() *cli.Command {
+	return &cli.Command{
+		Name:  doctorArg,
+		Usage: "check that the host meets bincastle's requirements",
+		Flags: stateRootFlags,
+		Action: func(c *cli.Context) error {
+			cfg, err := loadStateConfig(c)
+			if err != nil {
+				return err
+			}
+			results := doctorChecks(cfg)
+			if err := writeChecks(os.Stdout, results); err != nil {
+				return err
+			}
+			if failed := failedChecks(results); len(failed) > 0 {
+				return fmt.Errorf("%d of %d checks failed", len(failed), len(results))
+			}
+			return nil
+		},
+	}
+}
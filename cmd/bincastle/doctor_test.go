@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckKernelRelease(t *testing.T) {
+	for _, tc := range []struct {
+		release string
+		ok      bool
+	}{
+		{"5.4.0-42-generic", true},
+		{"4.18.0-193.el8.x86_64", true},
+		{"4.19", true},
+		{"10.1.0", true},
+		{"4.17.19", false},
+		{"3.10.0-1127.el7.x86_64", false},
+		{"4.9.0-rc1", false},
+		{"", false},
+		{"linux", false},
+	} {
+		t.Run(tc.release, func(t *testing.T) {
+			result := checkKernelRelease(tc.release)
+			require.Equal(t, tc.ok, result.OK)
+		})
+	}
+}
+
+func TestFuseMounts(t *testing.T) {
+	// mountpoints in mountinfo escape spaces, tabs, newlines and
+	// backslashes as octal
+	mountinfo := strings.Join([]string{
+		`22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw`,
+		`60 22 0:50 / /home/user/my\040state/var/fuse rw,nosuid - fuse.fuse-overlayfs fuse-overlayfs rw`,
+		`61 22 0:51 / /home/user/my\040state/cache/a\134b rw shared:2 master:1 - fuse fuse rw`,
+		`62 22 0:52 / /home/user/my\040state/tmpfs rw - tmpfs tmpfs rw`,
+		`63 22 0:53 / /home/user/my\040stateful rw - fuse.sshfs host:/ rw`,
+		`64 22 0:54 / /mnt/other rw - fuse.sshfs host:/ rw`,
+		`short line`,
+	}, "\n")
+
+	mounts, err := fuseMounts(strings.NewReader(mountinfo), "/home/user/my state", "/mnt/unused")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"/home/user/my state/var/fuse",
+		`/home/user/my state/cache/a\b`,
+	}, mounts)
+}
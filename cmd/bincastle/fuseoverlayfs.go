@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/sipsma/bincastle/buildkit"
+)
+
+const defaultFuseOverlayfsImage = "docker.io/eriksipsma/bincastle-fuse-overlayfs:latest"
+
+// embeddedFuseOverlayfs is the fuse-overlayfs binary when built with the
+// embed_fuseoverlayfs tag (see make build-embedded), so no registry is
+// needed to start the system.
+var embeddedFuseOverlayfs []byte
+
+// exportFuseOverlayfs builds the fuse-overlayfs binary used by the daemon
+// for inner containers and exports it to the system's var dir.
+func exportFuseOverlayfs(ctx context.Context, cfg *stateConfig, bcArgs buildkit.BincastleArgs) error {
+	if len(embeddedFuseOverlayfs) > 0 {
+		return writeEmbeddedFuseOverlayfs(cfg)
+	}
+
+	fuseoverlayDef, err := llb.Image(cfg.Images.FuseOverlayfs).Marshal(ctx, llb.LinuxAmd64)
+	if err != nil {
+		return err
+	}
+	return buildkit.BincastleBuild(ctx, buildkit.BincastleArgs{
+		LLB:              fuseoverlayDef,
+		ExportLocalDir:   filepath.Dir(cfg.fuseOverlayfsBin()),
+		ImportCacheRef:   bcArgs.ImportCacheRef,
+		SSHAgentSockPath: bcArgs.SSHAgentSockPath,
+		Registries:       cfg.Registries,
+		// TODO don't hardcode
+		BincastleSockPath: bcArgs.BincastleSockPath,
+		Verbose:           bcArgs.Verbose,
+		Progress:          bcArgs.Progress,
+		EventLog:          bcArgs.EventLog,
+	})
+}
+
+func writeEmbeddedFuseOverlayfs(cfg *stateConfig) error {
+	// write then rename so the daemon never sees a partial binary
+	tmpFile, err := ioutil.TempFile(filepath.Dir(cfg.fuseOverlayfsBin()), ".fuse-overlayfs")
+	if err != nil {
+		return fmt.Errorf("failed to create fuse-overlayfs binary: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	if _, err := tmpFile.Write(embeddedFuseOverlayfs); err != nil {
+		return fmt.Errorf("failed to write fuse-overlayfs binary: %w", err)
+	}
+	if err := tmpFile.Chmod(0755); err != nil {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), cfg.fuseOverlayfsBin())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/sipsma/bincastle/buildkit"
+)
+
+// gitPaths are the parts of the sysroot image's /tools that the daemon
+// needs to run git, which buildkit fetches git sources with. Paths ending
+// in / are dirs the matches of the source are copied into.
+var gitPaths = []struct {
+	src  string
+	dest string
+}{
+	{"/tools/bin/git*", "/bin/"},
+	{"/tools/libexec/git-core", "/libexec/git-core"},
+	{"/tools/share/git-core", "/share/git-core"},
+	{"/tools/lib/*.so*", "/lib/"},
+	{"/tools/lib64", "/lib64"},
+	{"/tools/etc/ssl", "/etc/ssl"},
+}
+
+// exportGit exports git and the libraries it links from the sysroot image
+// to the system's var dir.
+func exportGit(ctx context.Context, cfg *stateConfig, bcArgs buildkit.BincastleArgs) error {
+	sysroot := llb.Image(cfg.Images.Sysroot)
+	git := llb.Scratch()
+	for _, p := range gitPaths {
+		git = git.File(llb.Copy(sysroot, p.src, p.dest, &llb.CopyInfo{
+			AllowWildcard:  true,
+			CreateDestPath: true,
+		}))
+	}
+	gitDef, err := git.Marshal(ctx, llb.LinuxAmd64)
+	if err != nil {
+		return err
+	}
+	return buildkit.BincastleBuild(ctx, buildkit.BincastleArgs{
+		LLB:               gitDef,
+		ExportLocalDir:    cfg.gitDir(),
+		ImportCacheRef:    bcArgs.ImportCacheRef,
+		SSHAgentSockPath:  bcArgs.SSHAgentSockPath,
+		Registries:        cfg.Registries,
+		BincastleSockPath: bcArgs.BincastleSockPath,
+		Verbose:           bcArgs.Verbose,
+		Progress:          bcArgs.Progress,
+		EventLog:          bcArgs.EventLog,
+	})
+}
+
+func needsGit(cfg *stateConfig) (bool, error) {
+	if _, err := os.Stat(filepath.Join(cfg.gitDir(), "bin", "git")); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
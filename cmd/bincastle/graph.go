@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/sipsma/bincastle/buildkit"
+	"github.com/sipsma/bincastle/graph"
+	"github.com/urfave/cli/v2"
+)
+
+// describeGraphs evaluates the definition of each source, given as cli args
+// like those of run, and returns the descriptions of their graphs.
+func describeGraphs(c *cli.Context, selfBin string, sources ...[]string) ([]*graph.Description, error) {
+	var descs []*graph.Description
+	err := withEvaluator(c, selfBin, func(ctx context.Context, sourceArgs func([]string) buildkit.BincastleArgs) error {
+		for _, srcArgs := range sources {
+			desc, err := buildkit.DescribeGraph(ctx, sourceArgs(srcArgs))
+			if err != nil {
+				return err
+			}
+			descs = append(descs, desc)
+		}
+		return nil
+	})
+	return descs, err
+}
+
+// withEvaluator calls fn once a system that can evaluate definitions is
+// running. fn gets the args to evaluate the definition of a source, given as
+// cli args like those of run, with.
+func withEvaluator(
+	c *cli.Context, selfBin string, fn func(ctx context.Context, sourceArgs func([]string) buildkit.BincastleArgs) error,
+) error {
+	sshAgent, err := sshAgentFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(
+		namespaces.WithNamespace(context.Background(), "buildkit"))
+	defer cancel()
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigchan)
+	go func() {
+		select {
+		case <-sigchan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	cfg, err := loadStateConfig(c)
+	if err != nil {
+		return err
+	}
+
+	return withSystem(ctx, cfg, selfBin, sshAgent, daemonFlagArgs(c), func(sockPath string) error {
+		if bincastleSock == "" {
+			needBins, err := needsDaemonBins(cfg)
+			if err != nil {
+				return err
+			}
+			if needBins {
+				if err := exportDaemonBins(ctx, cfg, buildkit.BincastleArgs{
+					BincastleSockPath: sockPath,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+
+		return fn(ctx, func(srcArgs []string) buildkit.BincastleArgs {
+			bcArgs := buildkit.BincastleArgs{
+				SSHAgentSockPath:  sshAgent,
+				BincastleSockPath: sockPath,
+				SysrootImage:      cfg.Images.Sysroot,
+				Registries:        cfg.Registries,
+			}
+			setSource(&bcArgs, srcArgs)
+			return bcArgs
+		})
+	})
+}
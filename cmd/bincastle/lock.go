@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sipsma/bincastle/buildkit"
+	"github.com/urfave/cli/v2"
+)
+
+func lockCommand(selfBin string) *cli.Command {
+	return &cli.Command{
+		Name: lockArg,
+		Usage: "pin the images, git refs and downloads used by a system's definition " +
+			"in a lock file next to it",
+		ArgsUsage: "<local dir> [subdir]",
+		Flags:     joinflags(stateRootFlags, sshFlags, lockFlags),
+		Action: func(c *cli.Context) error {
+			if c.NArg() == 0 {
+				return fmt.Errorf("a local dir with the system's definition must be provided")
+			}
+			return withEvaluator(c, selfBin, func(ctx context.Context, sourceArgs func([]string) buildkit.BincastleArgs) error {
+				bcArgs := sourceArgs(c.Args().Slice())
+				path, err := buildkit.LockFilePath(bcArgs)
+				if err != nil {
+					return err
+				}
+				lock, diff, err := buildkit.WriteLock(ctx, bcArgs, c.Bool("update"))
+				if err != nil {
+					return err
+				}
+				if !diff.Empty() {
+					fmt.Println(diff)
+				}
+				fmt.Printf("locked %d images, %d git refs and %d downloads in %s\n",
+					len(lock.Images), len(lock.Git), len(lock.Downloads), path)
+				return nil
+			})
+		},
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/sipsma/bincastle/buildkit"
+)
+
+// networkEnv is set in the system container to the json network config of
+// the daemon.
+const networkEnv = "BINCASTLE_NETWORK"
+
+// networkFromEnv returns the network config the system container was started
+// with.
+func networkFromEnv() (buildkit.NetworkConfig, error) {
+	var network buildkit.NetworkConfig
+	if v := os.Getenv(networkEnv); v != "" {
+		if err := json.Unmarshal([]byte(v), &network); err != nil {
+			return network, fmt.Errorf("invalid %s: %w", networkEnv, err)
+		}
+	}
+	return network, nil
+}
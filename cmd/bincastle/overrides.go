@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sipsma/bincastle/graph"
+	"github.com/urfave/cli/v2"
+)
+
+// storedOverrides are the local source overrides of each named system, kept
+// in the state root.
+type storedOverrides map[string][]graph.NamedOverride
+
+func loadOverrides(cfg *stateConfig) (storedOverrides, error) {
+	overrides := make(storedOverrides)
+	bytes, err := ioutil.ReadFile(cfg.overridesPath())
+	if os.IsNotExist(err) {
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overrides: %w", err)
+	}
+	if err := json.Unmarshal(bytes, &overrides); err != nil {
+		return nil, fmt.Errorf("invalid overrides %s: %w", cfg.overridesPath(), err)
+	}
+	return overrides, nil
+}
+
+func (o storedOverrides) save(cfg *stateConfig) error {
+	bytes, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal overrides: %w", err)
+	}
+	// write then rename so a failed write doesn't lose the existing overrides
+	tmpPath := cfg.overridesPath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, bytes, 0600); err != nil {
+		return fmt.Errorf("failed to write overrides: %w", err)
+	}
+	return os.Rename(tmpPath, cfg.overridesPath())
+}
+
+// set replaces any override of the layer in the named system.
+func (o storedOverrides) set(name string, override graph.NamedOverride) {
+	o.remove(name, override.Layer)
+	o[name] = append(o[name], override)
+	sort.Slice(o[name], func(i, j int) bool {
+		return o[name][i].Layer < o[name][j].Layer
+	})
+}
+
+func (o storedOverrides) remove(name string, layer string) bool {
+	var kept []graph.NamedOverride
+	for _, override := range o[name] {
+		if !graph.LayerNamesMatch(override.Layer, layer) {
+			kept = append(kept, override)
+		}
+	}
+	removed := len(kept) != len(o[name])
+	if len(kept) == 0 {
+		delete(o, name)
+	} else {
+		o[name] = kept
+	}
+	return removed
+}
+
+// envOverrides returns the overrides set with EnvOverridesPrefix env vars,
+// which systems also set for the layers they have overridden so that
+// systems nested in them get the same overrides. They're skipped for
+// definitions that don't have those layers.
+func envOverrides() []graph.NamedOverride {
+	var overrides []graph.NamedOverride
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, graph.EnvOverridesPrefix) {
+			continue
+		}
+		split := strings.SplitN(strings.TrimPrefix(kv, graph.EnvOverridesPrefix), "=", 2)
+		if split[0] == "" || len(split) != 2 {
+			continue
+		}
+		overrides = append(overrides, graph.NamedOverride{
+			Layer:    split[0],
+			Path:     split[1],
+			Optional: true,
+		})
+	}
+	return overrides
+}
+
+func overrideCommand(selfBin string) *cli.Command {
+	return &cli.Command{
+		Name:  overrideArg,
+		Usage: "manage the local source overrides of named systems",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "add",
+				Usage:     "use a local dir in place of a layer when building the system",
+				ArgsUsage: "<layer> <path> -- <source args...>",
+				Flags:     joinflags(stateRootFlags, execNameFlags, sshFlags),
+				Action: func(c *cli.Context) error {
+					args, srcArgs := splitCmdArgs(c.Args())
+					if len(args) != 2 {
+						return fmt.Errorf("a layer name and a path must be provided")
+					}
+					layer := args[0]
+					path, err := filepath.Abs(args[1])
+					if err != nil {
+						return fmt.Errorf("invalid path %q: %w", args[1], err)
+					}
+					if fi, err := os.Stat(path); err != nil {
+						return fmt.Errorf("invalid override path: %w", err)
+					} else if !fi.IsDir() {
+						return fmt.Errorf("override path %s is not a dir", path)
+					}
+
+					// the definition of a system is only known while it's
+					// being run, so it has to be given to check the layer
+					if len(srcArgs) == 0 {
+						return fmt.Errorf("the system's definition must be given after -- "+
+							"to check that it has a layer named %s", layer)
+					}
+					descs, err := describeGraphs(c, selfBin, srcArgs)
+					if err != nil {
+						return err
+					}
+					if !descs[0].HasLayer(layer) {
+						return fmt.Errorf("no layer named %s in the system's definition", layer)
+					}
+
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					overrides, err := loadOverrides(cfg)
+					if err != nil {
+						return err
+					}
+					overrides.set(c.String("name"), graph.NamedOverride{Layer: layer, Path: path})
+					return overrides.save(cfg)
+				},
+			},
+			{
+				Name:      "rm",
+				Usage:     "stop overriding a layer of the system",
+				ArgsUsage: "<layer>",
+				Flags:     joinflags(stateRootFlags, execNameFlags),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("a layer name must be provided")
+					}
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					overrides, err := loadOverrides(cfg)
+					if err != nil {
+						return err
+					}
+					if !overrides.remove(c.String("name"), c.Args().First()) {
+						return fmt.Errorf("system %s has no override of %s", c.String("name"), c.Args().First())
+					}
+					return overrides.save(cfg)
+				},
+			},
+			{
+				Name:  "ls",
+				Usage: "list the overrides of every system",
+				Flags: stateRootFlags,
+				Action: func(c *cli.Context) error {
+					cfg, err := loadStateConfig(c)
+					if err != nil {
+						return err
+					}
+					overrides, err := loadOverrides(cfg)
+					if err != nil {
+						return err
+					}
+
+					var names []string
+					for name := range overrides {
+						names = append(names, name)
+					}
+					sort.Strings(names)
+
+					tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+					fmt.Fprintln(tw, "SYSTEM\tLAYER\tPATH")
+					for _, name := range names {
+						for _, override := range overrides[name] {
+							fmt.Fprintf(tw, "%s\t%s\t%s\n", name, override.Layer, override.Path)
+						}
+					}
+					return tw.Flush()
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/sipsma/bincastle/graph"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoredOverrides(t *testing.T) {
+	root, err := ioutil.TempDir("", "bincastle-overrides")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	cfg := &stateConfig{Root: root}
+
+	loaded, err := loadOverrides(cfg)
+	require.NoError(t, err)
+	require.Empty(t, loaded)
+
+	overrides := make(storedOverrides)
+	overrides.set("home", graph.NamedOverride{Layer: "Some-Lib", Path: "/src/old"})
+	overrides.set("home", graph.NamedOverride{Layer: "git", Path: "/src/git"})
+	// the same layer by its canonical name replaces the existing override
+	overrides.set("home", graph.NamedOverride{Layer: "some_lib", Path: "/src/some:lib"})
+	overrides.set("other", graph.NamedOverride{Layer: "git", Path: "/src/other:git"})
+	require.Equal(t, []graph.NamedOverride{
+		{Layer: "git", Path: "/src/git"},
+		{Layer: "some_lib", Path: "/src/some:lib"},
+	}, overrides["home"])
+
+	require.NoError(t, overrides.save(cfg))
+	loaded, err = loadOverrides(cfg)
+	require.NoError(t, err)
+	require.Equal(t, overrides, loaded)
+
+	require.True(t, loaded.remove("home", "SOME-LIB"))
+	require.False(t, loaded.remove("home", "some_lib"))
+	require.True(t, loaded.remove("other", "git"))
+	require.Equal(t, storedOverrides{"home": {{Layer: "git", Path: "/src/git"}}}, loaded)
+}
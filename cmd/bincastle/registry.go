@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sipsma/bincastle/buildkit"
+	"github.com/sipsma/bincastle/ctr"
+)
+
+const (
+	// registriesEnv is set in the system container to the json registry
+	// configs of the daemon, with paths of files mounted under
+	// ctrRegistryDir
+	registriesEnv  = "BINCASTLE_REGISTRIES"
+	ctrRegistryDir = "/run/bincastle/registry"
+	// ctrCABundle is where the host's CA certificates are mounted, which is
+	// one of the paths go looks for the system's certificates in
+	ctrCABundle = "/etc/ssl/certs/ca-certificates.crt"
+)
+
+// hostCABundles are the paths distros keep their bundle of CA certificates at.
+var hostCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// hostCABundle returns the path of the host's bundle of CA certificates, or
+// "" if it has none.
+func hostCABundle() string {
+	paths := hostCABundles
+	if certFile := os.Getenv("SSL_CERT_FILE"); certFile != "" {
+		paths = append([]string{certFile}, paths...)
+	}
+	for _, path := range paths {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			return resolved
+		}
+	}
+	return ""
+}
+
+// resolveRegistryPaths makes the paths in the registry configs relative to
+// the state root absolute and checks that they exist.
+func (cfg *stateConfig) resolveRegistryPaths() error {
+	abs := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(cfg.Root, path)
+	}
+	for host, rc := range cfg.Registries {
+		for i, ca := range rc.CAs {
+			rc.CAs[i] = abs(ca)
+		}
+		rc.ClientCert = abs(rc.ClientCert)
+		rc.ClientKey = abs(rc.ClientKey)
+		if rc.Auth != nil {
+			rc.Auth.PasswordFile = abs(rc.Auth.PasswordFile)
+		}
+		cfg.Registries[host] = rc
+	}
+	if err := cfg.Registries.Validate(); err != nil {
+		return fmt.Errorf("invalid registry config: %w", err)
+	}
+	return nil
+}
+
+// ctrRegistries returns the registry configs as seen by the daemon in the
+// system container, along with the mounts of the files they refer to.
+// Credentials are left out, they're only read by clients.
+func (cfg *stateConfig) ctrRegistries() (buildkit.RegistryConfigs, []ctr.BindMount) {
+	var mounts []ctr.BindMount
+	ctrPath := func(path string) string {
+		dest := filepath.Join(ctrRegistryDir, strconv.Itoa(len(mounts)), filepath.Base(path))
+		mounts = append(mounts, ctr.BindMount{
+			Dest:   dest,
+			Source: path,
+		})
+		return dest
+	}
+
+	registries := make(buildkit.RegistryConfigs)
+	for host, rc := range cfg.Registries {
+		ctrRC := buildkit.RegistryConfig{
+			Mirrors:   rc.Mirrors,
+			PlainHTTP: rc.PlainHTTP,
+			Insecure:  rc.Insecure,
+		}
+		for _, ca := range rc.CAs {
+			ctrRC.CAs = append(ctrRC.CAs, ctrPath(ca))
+		}
+		if rc.ClientCert != "" {
+			ctrRC.ClientCert = ctrPath(rc.ClientCert)
+			ctrRC.ClientKey = ctrPath(rc.ClientKey)
+		}
+		registries[host] = ctrRC
+	}
+	return registries, mounts
+}
+
+// registriesFromEnv returns the registry configs the system container was
+// started with.
+func registriesFromEnv() (buildkit.RegistryConfigs, error) {
+	registries := make(buildkit.RegistryConfigs)
+	if v := os.Getenv(registriesEnv); v != "" {
+		if err := json.Unmarshal([]byte(v), &registries); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", registriesEnv, err)
+		}
+	}
+	return registries, nil
+}
@@ -14,13 +14,48 @@ import (
 func WriteSystemDef(asSpec graph.AsSpec) {
 	var dumpJsonFlag bool
 	var dumpDotFlag bool
+	var describeFlag bool
+	var lockFlag bool
 
 	flag.BoolVar(&dumpJsonFlag, "json", false, "write formatted json instead of marshalled protobuf (for debugging)")
 	flag.BoolVar(&dumpDotFlag, "dot", false,
 		"write formatted dotviz instead of marshalled protobuf (for debugging)")
+	flag.BoolVar(&describeFlag, "describe", false,
+		"write a json description of the layer graph instead of marshalled protobuf")
+	flag.BoolVar(&lockFlag, "lock", false,
+		"write the json lock of the sources used instead of marshalled protobuf, "+
+			"resolving the ones missing from the lock file")
 	flag.Parse()
 
-	g := graph.Build(asSpec)
+	var lock *graph.Lock
+	if path := os.Getenv(graph.LockFileEnv); path != "" {
+		var err error
+		if lock, err = graph.ReadLock(path); err != nil {
+			panic(err)
+		}
+	}
+
+	if lockFlag {
+		if err := json.NewEncoder(os.Stdout).Encode(graph.UsedLock(asSpec, lock)); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if lock != nil {
+		if err := graph.LockDrift(lock, graph.UsedLock(asSpec, lock)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	g := graph.Build(graph.Locked(lock).ApplyToSpec(asSpec))
+
+	if describeFlag {
+		if err := json.NewEncoder(os.Stdout).Encode(g.Describe()); err != nil {
+			panic(err)
+		}
+		return
+	}
 
 	if dumpDotFlag {
 		if err := g.DumpDot(os.Stdout); err != nil {
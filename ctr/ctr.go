@@ -2,6 +2,8 @@ package ctr
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -152,6 +154,22 @@ func (d IODir) TTYInFifo() string {
 	return filepath.Join(string(d), "in")
 }
 
+func (d IODir) ResizeFifo() string {
+	return filepath.Join(string(d), "resize")
+}
+
+func (d IODir) StdinFifo() string {
+	return filepath.Join(string(d), "stdin")
+}
+
+func (d IODir) StdoutFifo() string {
+	return filepath.Join(string(d), "stdout")
+}
+
+func (d IODir) StderrFifo() string {
+	return filepath.Join(string(d), "stderr")
+}
+
 type ContainerExistsError struct {
 	ID string
 }
@@ -230,111 +248,19 @@ func (d ContainerState) Start(def ContainerDef) (Container, error) {
 	}
 	postkillCleanups = append(mountCleanups, postkillCleanups...)
 
-	inFifoCh := make(chan io.ReadWriteCloser)
-	go func() {
-		defer close(inFifoCh)
-		inFifo, err := fifo.OpenFifo(context.TODO(), d.IODir().TTYInFifo(),
-			syscall.O_CREAT|syscall.O_RDONLY, 0600)
-		if err != nil {
-			panic(fmt.Errorf("failed to create tty in fifo: %w", err))
-		}
-		inFifoCh <- inFifo
-	}()
-
-	outFifoCh := make(chan io.ReadWriteCloser)
-	go func() {
-		defer close(outFifoCh)
-		outFifo, err := fifo.OpenFifo(context.TODO(), d.IODir().TTYOutFifo(),
-			syscall.O_CREAT|syscall.O_WRONLY, 0600)
-		if err != nil {
-			panic(fmt.Errorf("failed to create tty out fifo: %w", err))
-		}
-		outFifoCh <- outFifo
-	}()
-
-	parentConsoleSock, ctrConsoleSock, err := utils.NewSockPair("console")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create tty console sock: %w", err)
+	var ioCleanups CleanupStack
+	var ctrConsoleSock *os.File
+	var consoleResizeCh chan<- console.WinSize
+	var stdio *pipeIO
+	if def.NoTTY {
+		stdio, ioCleanups, err = d.setupPipeIO()
+	} else {
+		ctrConsoleSock, consoleResizeCh, ioCleanups, err = d.setupConsoleIO()
 	}
-	postkillCleanups = postkillCleanups.Push(ctrConsoleSock.Close)
-
-	epoller, err := console.NewEpoller()
+	postkillCleanups = append(ioCleanups, postkillCleanups...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create epoller: %w", err)
+		return nil, err
 	}
-	postkillCleanups = postkillCleanups.Push(epoller.Close)
-
-	consoleResizeCh := make(chan console.WinSize)
-	go func() {
-		// TODO need real logging
-		f, err := utils.RecvFd(parentConsoleSock)
-		parentConsoleSock.Close()
-		if err != nil {
-			fmt.Printf("failed to receive tty fd: %v\n", err)
-			return
-		}
-		ctrConsole, err := console.ConsoleFromFile(f)
-		if err != nil {
-			panic(err)
-		}
-		defer ctrConsole.Close()
-
-		console.ClearONLCR(ctrConsole.Fd())
-		err = ctrConsole.ResizeFrom(console.Current())
-		if err != nil {
-			panic(err)
-		}
-
-		epollConsole, err := epoller.Add(ctrConsole)
-		if err != nil {
-			panic(err)
-		}
-
-		epollerCh := make(chan error)
-		go func() {
-			defer close(epollerCh)
-			epollerCh <- epoller.Wait()
-		}()
-
-		for {
-			select {
-			case inFifo := <-inFifoCh:
-				inFifoCh = nil
-				if inFifo == nil {
-					continue
-				}
-				defer inFifo.Close()
-				go func() {
-					_, err := io.Copy(epollConsole, inFifo)
-					if err != nil {
-						fmt.Printf("in-fifo copy stopped: %v\n", err)
-					}
-				}()
-			case outFifo := <-outFifoCh:
-				outFifoCh = nil
-				if outFifo == nil {
-					continue
-				}
-				defer outFifo.Close()
-				go func() {
-					_, err := io.Copy(outFifo, epollConsole)
-					if err != nil {
-						fmt.Printf("out-fifo copy stopped: %v\n", err)
-					}
-				}()
-			case winSize := <-consoleResizeCh:
-				err := ctrConsole.Resize(winSize)
-				if err != nil {
-					fmt.Printf("console resize failed: %v\n", err)
-				}
-			case err := <-epollerCh:
-				if err != nil {
-					fmt.Printf("console epoller stopped: %v\n", err)
-				}
-				return
-			}
-		}
-	}()
 
 	noNewPrivileges := true
 	var caps *configs.Capabilities
@@ -355,7 +281,26 @@ func (d ContainerState) Start(def ContainerDef) (Container, error) {
 		Cwd:             def.WorkingDir,
 		Capabilities:    caps,
 		NoNewPrivileges: &noNewPrivileges,
-		ConsoleSocket:   ctrConsoleSock,
+	}
+	if stdio != nil {
+		runcProc.Stdin = stdio.ctrStdin
+		runcProc.Stdout = stdio.ctrStdout
+		runcProc.Stderr = stdio.ctrStderr
+	} else {
+		runcProc.ConsoleSocket = ctrConsoleSock
+	}
+
+	namespaces := []oci.LinuxNamespace{
+		{Type: oci.MountNamespace},
+		{Type: oci.PIDNamespace},
+		{Type: oci.UserNamespace},
+		{Type: oci.UTSNamespace},
+		{Type: oci.IPCNamespace},
+		// TODO {Type: configs.NEWCGROUP},
+	}
+	if def.NetworkNamespace {
+		// runc sets up loopback in new network namespaces
+		namespaces = append(namespaces, oci.LinuxNamespace{Type: oci.NetworkNamespace})
 	}
 
 	runcConfig, err := specconv.CreateLibcontainerConfig(&specconv.CreateOpts{
@@ -381,14 +326,7 @@ func (d ContainerState) Start(def ContainerDef) (Container, error) {
 						Size:        1,
 					},
 				},
-				Namespaces: []oci.LinuxNamespace{
-					{Type: oci.MountNamespace},
-					{Type: oci.PIDNamespace},
-					{Type: oci.UserNamespace},
-					{Type: oci.UTSNamespace},
-					{Type: oci.IPCNamespace},
-					// TODO {Type: configs.NEWCGROUP},
-				},
+				Namespaces: namespaces,
 				// TODO haven't investigated why, but without masking this
 				// path, runc can fail at container destroy with EPERM when
 				// trying to unlink something under the cgroup mount. Even
@@ -426,6 +364,10 @@ func (d ContainerState) Start(def ContainerDef) (Container, error) {
 	if err != nil {
 		return nil, err
 	}
+	if stdio != nil {
+		// the container has its own copies now
+		stdio.closeCtrSide()
+	}
 
 	return &container{
 		state:           d,
@@ -435,18 +377,260 @@ func (d ContainerState) Start(def ContainerDef) (Container, error) {
 		postkillCleanup: postkillCleanups,
 		mounts:          mounts,
 		consoleResizeCh: consoleResizeCh,
+		noTTY:           def.NoTTY,
+	}, nil
+}
+
+// setupConsoleIO allocates the socket the container's console is received
+// on and copies between the console and the tty fifos in the IODir. Clients
+// may attach to and detach from the fifos any number of times.
+func (d ContainerState) setupConsoleIO() (*os.File, chan<- console.WinSize, CleanupStack, error) {
+	var cleanups CleanupStack
+
+	// opened read-write so that attachers going away never results in EOF
+	inFifo, err := fifo.OpenFifo(context.TODO(), d.IODir().TTYInFifo(),
+		syscall.O_CREAT|syscall.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, cleanups, fmt.Errorf("failed to create tty in fifo: %w", err)
+	}
+	cleanups = cleanups.Push(inFifo.Close)
+
+	resizeFifo, err := fifo.OpenFifo(context.TODO(), d.IODir().ResizeFifo(),
+		syscall.O_CREAT|syscall.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, cleanups, fmt.Errorf("failed to create tty resize fifo: %w", err)
+	}
+	cleanups = cleanups.Push(resizeFifo.Close)
+
+	// the out fifo is only opened when there's an attacher, see relayConsoleOutput
+	if err := syscall.Mkfifo(d.IODir().TTYOutFifo(), 0600); err != nil && !os.IsExist(err) {
+		return nil, nil, cleanups, fmt.Errorf("failed to create tty out fifo: %w", err)
+	}
+
+	parentConsoleSock, ctrConsoleSock, err := utils.NewSockPair("console")
+	if err != nil {
+		return nil, nil, cleanups, fmt.Errorf("failed to create tty console sock: %w", err)
+	}
+	cleanups = cleanups.Push(ctrConsoleSock.Close)
+
+	epoller, err := console.NewEpoller()
+	if err != nil {
+		return nil, nil, cleanups, fmt.Errorf("failed to create epoller: %w", err)
+	}
+	cleanups = cleanups.Push(epoller.Close)
+
+	consoleResizeCh := make(chan console.WinSize)
+	go func() {
+		// TODO need real logging
+		f, err := utils.RecvFd(parentConsoleSock)
+		parentConsoleSock.Close()
+		if err != nil {
+			fmt.Printf("failed to receive tty fd: %v\n", err)
+			return
+		}
+		ctrConsole, err := console.ConsoleFromFile(f)
+		if err != nil {
+			panic(err)
+		}
+		defer ctrConsole.Close()
+
+		console.ClearONLCR(ctrConsole.Fd())
+		// attaching clients send their own size, the daemon's stdin is only
+		// a starting point when it's a terminal (console.Current panics
+		// otherwise, i.e. when it's a pipe or /dev/null)
+		if StdinIsTerminal() {
+			if err := ctrConsole.ResizeFrom(console.Current()); err != nil {
+				fmt.Printf("console resize failed: %v\n", err)
+			}
+		}
+
+		epollConsole, err := epoller.Add(ctrConsole)
+		if err != nil {
+			panic(err)
+		}
+
+		epollerCh := make(chan error)
+		go func() {
+			defer close(epollerCh)
+			epollerCh <- epoller.Wait()
+		}()
+
+		go func() {
+			// stops once the fifo is closed during cleanup
+			io.Copy(epollConsole, inFifo)
+		}()
+		go func() {
+			if err := d.relayConsoleOutput(epollConsole); err != nil {
+				fmt.Printf("out-fifo copy stopped: %v\n", err)
+			}
+		}()
+		go func() {
+			// resizes from clients that didn't start the container
+			dec := json.NewDecoder(resizeFifo)
+			for {
+				var winSize console.WinSize
+				if err := dec.Decode(&winSize); err != nil {
+					return
+				}
+				if err := ctrConsole.Resize(winSize); err != nil {
+					fmt.Printf("console resize failed: %v\n", err)
+				}
+			}
+		}()
+
+		for {
+			select {
+			case winSize := <-consoleResizeCh:
+				err := ctrConsole.Resize(winSize)
+				if err != nil {
+					fmt.Printf("console resize failed: %v\n", err)
+				}
+			case err := <-epollerCh:
+				if err != nil {
+					fmt.Printf("console epoller stopped: %v\n", err)
+				}
+				return
+			}
+		}
+	}()
+	return ctrConsoleSock, consoleResizeCh, cleanups, nil
+}
+
+// consoleOutputBufferSize is how much of the console's most recent output is
+// kept while nothing is attached, it's written to the next attacher.
+const consoleOutputBufferSize = 64 * 1024
+
+// relayConsoleOutput copies the console's output to the tty out fifo while
+// something is attached to it. Output while detached is buffered (up to
+// consoleOutputBufferSize) instead of blocking the console.
+func (d ContainerState) relayConsoleOutput(ctrConsole io.Reader) error {
+	dataCh := make(chan []byte)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := ctrConsole.Read(buf)
+			if n > 0 {
+				dataCh <- buf[:n]
+			}
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	var out *os.File
+	defer func() {
+		if out != nil {
+			out.Close()
+		}
+	}()
+	var pending []byte
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if out == nil {
+			// fails with ENXIO until an attacher opens the fifo for reading
+			f, err := os.OpenFile(d.IODir().TTYOutFifo(), os.O_WRONLY|syscall.O_NONBLOCK, 0)
+			if err != nil {
+				return
+			}
+			out = f
+		}
+		if _, err := out.Write(pending); err != nil {
+			// the attacher went away, keep buffering until the next one
+			out.Close()
+			out = nil
+			return
+		}
+		pending = pending[:0]
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-dataCh:
+			pending = append(pending, data...)
+			if len(pending) > consoleOutputBufferSize {
+				pending = pending[len(pending)-consoleOutputBufferSize:]
+			}
+		case <-ticker.C:
+		case err := <-errCh:
+			// give an attacher that's on its way a moment to get the last output
+			for i := 0; i < 10 && len(pending) > 0; i++ {
+				if flush(); len(pending) > 0 {
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		flush()
+	}
+}
+
+// Load returns the already running container at this state dir. Cleanups
+// registered by the process that called Start are not known to the returned
+// Container, so it's mostly useful for Exec'ing into the container.
+func (d ContainerState) Load() (Container, error) {
+	factory, err := d.factory()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := factory.Load(d.ContainerID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load container %s: %w", d.ContainerID(), err)
+	}
+
+	_, err = os.Stat(d.IODir().StdoutFifo())
+	return &container{
+		state:   d,
+		runcCtr: c,
+		loaded:  true,
+		noTTY:   err == nil,
 	}, nil
 }
 
+// Remove deletes the state dir, including any stale runc state left behind
+// by a container that wasn't cleanly destroyed. It fails if the container is
+// still running.
+func (d ContainerState) Remove() error {
+	if factory, err := d.factory(); err == nil {
+		if c, err := factory.Load(d.ContainerID()); err == nil {
+			status, err := c.Status()
+			if err != nil {
+				return fmt.Errorf("failed to get status of container %s: %w", d.ContainerID(), err)
+			}
+			if status != libcontainer.Stopped {
+				return fmt.Errorf("container %s is still %s", d.ContainerID(), status)
+			}
+			if err := c.Destroy(); err != nil {
+				return fmt.Errorf("failed to destroy container %s: %w", d.ContainerID(), err)
+			}
+		}
+	}
+	return os.RemoveAll(string(d))
+}
+
 type Attachable interface {
 	Attach(ctx context.Context, in io.Reader, out io.Writer) error
-	Resize(console.WinSize)
+	Resize(console.WinSize) error
 }
 
 type Container interface {
 	Attachable
+	// AttachStreams attaches to the separate stdio streams of a container
+	// started with NoTTY. For containers with a tty, errOut is unused.
+	AttachStreams(ctx context.Context, in io.Reader, out, errOut io.Writer) error
 	Wait(context.Context) WaitResult
 	Destroy(time.Duration) error
+	Exec(ContainerProc) (Process, error)
 }
 
 type ContainerProc struct {
@@ -467,6 +651,12 @@ type ContainerDef struct {
 	WorkDir        string
 	Persist        bool
 	ReadOnlyRootfs bool
+	// NoTTY gives the container plain pipes for stdin, stdout and stderr
+	// instead of allocating a console.
+	NoTTY bool
+	// NetworkNamespace gives the container its own network namespace with
+	// only a loopback interface instead of sharing its parent's network.
+	NetworkNamespace bool
 }
 
 type CleanupStack []func() error
@@ -489,6 +679,8 @@ type container struct {
 	runcCtr         libcontainer.Container
 	mounts          []oci.Mount
 	consoleResizeCh chan<- console.WinSize
+	loaded          bool
+	noTTY           bool
 
 	prekillCleanup  CleanupStack
 	postkillCleanup CleanupStack
@@ -530,14 +722,29 @@ func (c *container) Destroy(waitTimeout time.Duration) (rerr error) {
 }
 
 func (c *container) Attach(ctx context.Context, in io.Reader, out io.Writer) error {
+	if c.noTTY {
+		return c.AttachStreams(ctx, in, out, out)
+	}
+	return c.state.IODir().Attach(ctx, in, out)
+}
+
+func (c *container) AttachStreams(ctx context.Context, in io.Reader, out, errOut io.Writer) error {
+	if !c.noTTY {
+		return c.Attach(ctx, in, out)
+	}
+	return c.state.IODir().AttachStreams(ctx, in, out, errOut)
+}
+
+// Attach copies in to the tty in fifo and the tty out fifo to out.
+func (d IODir) Attach(ctx context.Context, in io.Reader, out io.Writer) error {
 	var inFifoPath string
 	if in != nil {
-		inFifoPath = c.state.IODir().TTYInFifo()
+		inFifoPath = d.TTYInFifo()
 	}
 
 	var outFifoPath string
 	if out != nil {
-		outFifoPath = c.state.IODir().TTYOutFifo()
+		outFifoPath = d.TTYOutFifo()
 	}
 
 	ctrIO, err := cio.NewAttach(cio.WithStreams(
@@ -550,6 +757,48 @@ func (c *container) Attach(ctx context.Context, in io.Reader, out io.Writer) err
 	if err != nil {
 		return fmt.Errorf("failed to attach to tty fifos: %w", err)
 	}
+	return waitIO(ctx, ctrIO)
+}
+
+// AttachStreams copies in to the stdin fifo and the stdout and stderr fifos
+// to out and errOut.
+func (d IODir) AttachStreams(ctx context.Context, in io.Reader, out, errOut io.Writer) error {
+	cfg := cio.Config{}
+	if in != nil {
+		cfg.Stdin = d.StdinFifo()
+	}
+	if out != nil {
+		cfg.Stdout = d.StdoutFifo()
+	}
+	if errOut != nil {
+		cfg.Stderr = d.StderrFifo()
+	}
+
+	ctrIO, err := cio.NewAttach(cio.WithStreams(
+		in, out, errOut,
+	))(cio.NewFIFOSet(cfg, func() error { return nil }))
+	if err != nil {
+		return fmt.Errorf("failed to attach to stdio fifos: %w", err)
+	}
+	return waitIO(ctx, ctrIO)
+}
+
+// Resize sends winSize to the owner of the tty, which reads it from the
+// resize fifo.
+func (d IODir) Resize(winSize console.WinSize) error {
+	f, err := os.OpenFile(d.ResizeFifo(), os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		// nothing is reading resizes
+		return nil
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(winSize); err != nil {
+		return fmt.Errorf("failed to send console resize: %w", err)
+	}
+	return nil
+}
+
+func waitIO(ctx context.Context, ctrIO cio.IO) error {
 	defer ctrIO.Close()
 
 	ctrIOCh := make(chan struct{})
@@ -566,11 +815,26 @@ func (c *container) Attach(ctx context.Context, in io.Reader, out io.Writer) err
 	}
 }
 
-func (c *container) Resize(winSize console.WinSize) {
-	c.consoleResizeCh <- winSize
+func (c *container) Resize(winSize console.WinSize) error {
+	if c.consoleResizeCh != nil {
+		c.consoleResizeCh <- winSize
+		return nil
+	}
+	// the console is owned by whichever process started the container
+	return c.state.IODir().Resize(winSize)
+}
+
+// StdinIsTerminal returns whether this process' stdin is a terminal.
+func StdinIsTerminal() bool {
+	_, err := console.ConsoleFromFile(os.Stdin)
+	return err == nil
 }
 
 func AttachSelfConsole(ctx context.Context, attacher Attachable) error {
+	return attachSelfConsole(ctx, attacher, os.Stdin)
+}
+
+func attachSelfConsole(ctx context.Context, attacher Attachable, in io.Reader) error {
 	resizeCh, cleanup, err := SetupSelfConsole(ctx)
 	if err != nil {
 		return err
@@ -580,15 +844,22 @@ func AttachSelfConsole(ctx context.Context, attacher Attachable) error {
 	attachCh := make(chan error)
 	go func() {
 		defer close(attachCh)
-		attachCh <- attacher.Attach(ctx, os.Stdin, os.Stdout)
+		attachCh <- attacher.Attach(ctx, in, os.Stdout)
 	}()
 
 	for {
 		select {
 		case err := <-attachCh:
 			return err
-		case winSize := <-resizeCh:
-			attacher.Resize(winSize)
+		case winSize, ok := <-resizeCh:
+			if !ok {
+				// closed once ctx is done, don't resize to a zero size
+				resizeCh = nil
+				continue
+			}
+			if err := attacher.Resize(winSize); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
 		}
 	}
 }
@@ -605,6 +876,9 @@ func SetupSelfConsole(ctx context.Context) (<-chan console.WinSize, func(), erro
 
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGWINCH)
+	// send the initial size too, processes that didn't inherit it (like
+	// execs) otherwise start out with a 0x0 tty
+	sigchan <- syscall.SIGWINCH
 
 	resizeCh := make(chan console.WinSize)
 	go func() {
@@ -627,6 +901,12 @@ func SetupSelfConsole(ctx context.Context) (<-chan console.WinSize, func(), erro
 }
 
 func (c *container) Wait(ctx context.Context) WaitResult {
+	if c.loaded {
+		// not the parent of the init process, so the best that can be done
+		// is polling until it's gone
+		return WaitResult{Err: c.pollStopped(ctx)}
+	}
+
 	c.waitOnce.Do(func() {
 		c.waitCh = make(chan struct{})
 		go func() {
@@ -635,7 +915,7 @@ func (c *container) Wait(ctx context.Context) WaitResult {
 			exitCode := state.ExitCode()
 			if exitCode != 0 && exitCode != -1 {
 				err = multierror.Append(err, fmt.Errorf(
-					"container exited with non-zero status %d", exitCode)).ErrorOrNil()
+					"container %w", ExitError{ExitCode: exitCode})).ErrorOrNil()
 			}
 			c.waitResult = WaitResult{State: state, Err: err}
 		}()
@@ -649,6 +929,25 @@ func (c *container) Wait(ctx context.Context) WaitResult {
 	}
 }
 
+func (c *container) pollStopped(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		status, err := c.runcCtr.Status()
+		if err != nil {
+			return err
+		}
+		if status == libcontainer.Stopped {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
 type GenericMountOptions struct {
 	Noexec      bool
 	Nosuid      bool
@@ -860,6 +1159,34 @@ type WaitResult struct {
 	Err   error
 }
 
+// ExitError is returned when a container or exec process exits with a
+// non-zero status.
+type ExitError struct {
+	ExitCode int
+}
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exited with non-zero status %d", e.ExitCode)
+}
+
+// ExitCode returns the exit code of the ExitError in err's chain, if any,
+// including ones appended to a multierror.
+func ExitCode(err error) (int, bool) {
+	var exitErr ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode, true
+	}
+	var merr *multierror.Error
+	if errors.As(err, &merr) {
+		for _, err := range merr.Errors {
+			if code, ok := ExitCode(err); ok {
+				return code, true
+			}
+		}
+	}
+	return 0, false
+}
+
 func HasBind(mountOptions []string) bool {
 	return hasOpt("bind", mountOptions)
 }
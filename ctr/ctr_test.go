@@ -0,0 +1,207 @@
+package ctr
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/opencontainers/runc/libcontainer"
+	_ "github.com/opencontainers/runc/libcontainer/nsenter"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	// the test binary is the init of the containers it starts
+	if len(os.Args) > 1 && os.Args[1] == RuncInitArg {
+		runtime.GOMAXPROCS(1)
+		runtime.LockOSThread()
+		factory, _ := libcontainer.New("", libcontainer.RootlessCgroupfs)
+		err := factory.StartInitialization()
+		panic(err)
+	}
+}
+
+// hostToolsMounts gives a container the host's shell and the libraries it
+// links.
+func hostToolsMounts() Mounts {
+	mounts := DefaultMounts()
+	for _, dir := range []string{"/bin", "/lib", "/lib64", "/usr"} {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		mounts = mounts.With(BindMount{Source: dir, Dest: dir, Recursive: true, Readonly: true})
+	}
+	return mounts
+}
+
+// startContainer starts a container running script with a read-only rootfs
+// made of the host's tools, skipping the test if containers can't be
+// started here. opts can change the container's def before it's started.
+func startContainer(t *testing.T, script string, noTTY bool, opts ...func(*ContainerDef)) Container {
+	if os.Getuid() != 0 {
+		t.Skip("starting containers requires root")
+	}
+	dir, err := ioutil.TempDir("", "bincastle-ctr-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	def := ContainerDef{
+		ContainerProc: ContainerProc{
+			Args:       []string{"/bin/sh", "-c", script},
+			Env:        []string{"PATH=/bin:/usr/bin"},
+			WorkingDir: "/",
+		},
+		MountBackend:   NoOverlayfsBackend{},
+		Mounts:         hostToolsMounts(),
+		ReadOnlyRootfs: true,
+		NoTTY:          noTTY,
+	}
+	for _, opt := range opts {
+		opt(&def)
+	}
+	c, err := ContainerStateRoot(dir).ContainerState("test").Start(def)
+	if err != nil {
+		t.Skipf("can't start containers here: %v", err)
+	}
+	t.Cleanup(func() { c.Destroy(10 * time.Second) })
+	return c
+}
+
+// withPipeStdin replaces the test's stdin with a pipe, like the stdin of a
+// daemon started by CI or in the background.
+func withPipeStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	origStdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = origStdin
+		r.Close()
+		w.Close()
+	})
+}
+
+func TestStartWithPipeStdin(t *testing.T) {
+	withPipeStdin(t)
+	require.False(t, StdinIsTerminal())
+
+	for _, noTTY := range []bool{false, true} {
+		// the console isn't sized from the daemon's stdin, the container
+		// still gets a tty unless it asks for pipes
+		c := startContainer(t, `if [ -t 0 ]; then echo tty; else echo pipe; fi; read line; echo "$line"`, noTTY)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		var out bytes.Buffer
+		attachCh := make(chan error, 1)
+		go func() {
+			attachCh <- c.Attach(ctx, strings.NewReader("hello\n"), &out)
+		}()
+		require.NoError(t, c.Wait(ctx).Err)
+		// the console's output is relayed asynchronously
+		select {
+		case <-attachCh:
+		case <-time.After(time.Second):
+			cancel()
+			<-attachCh
+		}
+
+		expected := "tty"
+		if noTTY {
+			expected = "pipe"
+		}
+		require.Contains(t, out.String(), expected, "noTTY=%v", noTTY)
+		require.Contains(t, out.String(), "hello", "noTTY=%v", noTTY)
+	}
+}
+
+func TestConsoleSizedByAttacher(t *testing.T) {
+	// like the stdin of a system started with run -d
+	devNull, err := os.Open(os.DevNull)
+	require.NoError(t, err)
+	defer devNull.Close()
+	origStdin := os.Stdin
+	os.Stdin = devNull
+	defer func() { os.Stdin = origStdin }()
+
+	c := startContainer(t, `while [ "$(stty size)" = "0 0" ]; do sleep 0.1; done; stty size`, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var out bytes.Buffer
+	attachCh := make(chan error, 1)
+	go func() {
+		attachCh <- c.Attach(ctx, nil, &out)
+	}()
+	// sent through the resize fifo, like a client attaching to a system
+	// it didn't start
+	require.NoError(t, c.(*container).state.IODir().Resize(console.WinSize{Height: 30, Width: 100}))
+	require.NoError(t, c.Wait(ctx).Err)
+	select {
+	case <-attachCh:
+	case <-time.After(time.Second):
+		cancel()
+		<-attachCh
+	}
+	require.Contains(t, out.String(), "30 100")
+}
+
+func TestNetworkNamespace(t *testing.T) {
+	hostNetDev, err := ioutil.ReadFile("/proc/net/dev")
+	require.NoError(t, err)
+	hostIfaces := netDevIfaces(string(hostNetDev))
+	if len(hostIfaces) < 2 {
+		t.Skip("the host only has loopback")
+	}
+
+	for _, tc := range []struct {
+		name             string
+		networkNamespace bool
+		ifaces           []string
+	}{
+		{name: "shared", ifaces: hostIfaces},
+		{name: "own", networkNamespace: true, ifaces: []string{"lo"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := startContainer(t, "cat /proc/net/dev", true, func(def *ContainerDef) {
+				def.NetworkNamespace = tc.networkNamespace
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			var out bytes.Buffer
+			attachCh := make(chan error, 1)
+			go func() {
+				attachCh <- c.Attach(ctx, nil, &out)
+			}()
+			require.NoError(t, c.Wait(ctx).Err)
+			select {
+			case <-attachCh:
+			case <-time.After(time.Second):
+				cancel()
+				<-attachCh
+			}
+			require.ElementsMatch(t, tc.ifaces, netDevIfaces(out.String()))
+		})
+	}
+}
+
+// netDevIfaces returns the names of the interfaces in the contents of
+// /proc/net/dev.
+func netDevIfaces(netDev string) []string {
+	var ifaces []string
+	for _, line := range strings.Split(netDev, "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		ifaces = append(ifaces, strings.TrimSpace(line[:i]))
+	}
+	return ifaces
+}
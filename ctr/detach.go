@@ -0,0 +1,141 @@
+package ctr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// DefaultDetachKeys is the key sequence that detaches from a console unless
+// another one is configured.
+const DefaultDetachKeys = "ctrl-p,ctrl-q"
+
+// ErrDetached is returned by attaches that ended because the client typed
+// the detach key sequence.
+var ErrDetached = errors.New("detached")
+
+// ParseDetachKeys parses a comma separated sequence of keys, each of which is
+// either a single character or ctrl-<key> (i.e. "ctrl-p,ctrl-q").
+func ParseDetachKeys(keys string) ([]byte, error) {
+	var seq []byte
+	for _, key := range strings.Split(keys, ",") {
+		if len(key) == 1 {
+			seq = append(seq, key[0])
+			continue
+		}
+		if !strings.HasPrefix(key, "ctrl-") || len(key) != len("ctrl-")+1 {
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+		switch c := key[len(key)-1]; {
+		case c >= 'a' && c <= 'z':
+			seq = append(seq, c-'a'+1)
+		case c >= '@' && c <= '_':
+			// ctrl-@, ctrl-A...ctrl-Z, ctrl-[, ctrl-\, ctrl-], ctrl-^, ctrl-_
+			seq = append(seq, c-'@')
+		default:
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+	}
+	return seq, nil
+}
+
+// detachReader passes through reads from r until the detach key sequence is
+// read. Input that partially matches the sequence is held back until it's
+// known not to be part of it.
+type detachReader struct {
+	r        io.Reader
+	keys     []byte
+	onDetach func()
+
+	// fallback[i] is the length of the longest proper prefix of keys[:i+1]
+	// that's also a suffix of it, which is how much of a partial match is
+	// still a match after the next byte doesn't continue it
+	fallback []int
+	matched  int
+	pending  []byte
+	err      error
+}
+
+func detachFallback(keys []byte) []int {
+	fallback := make([]int, len(keys))
+	for i, k := 1, 0; i < len(keys); i++ {
+		for k > 0 && keys[i] != keys[k] {
+			k = fallback[k-1]
+		}
+		if keys[i] == keys[k] {
+			k++
+		}
+		fallback[i] = k
+	}
+	return fallback
+}
+
+func (d *detachReader) Read(p []byte) (int, error) {
+	if d.fallback == nil {
+		d.fallback = detachFallback(d.keys)
+	}
+	for len(d.pending) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		buf := make([]byte, len(p))
+		n, err := d.r.Read(buf)
+		for _, b := range buf[:n] {
+			// the held back keys[:d.matched] can only still match by a
+			// suffix of it, the bytes before that are passed through
+			for d.matched > 0 && b != d.keys[d.matched] {
+				k := d.fallback[d.matched-1]
+				d.pending = append(d.pending, d.keys[:d.matched-k]...)
+				d.matched = k
+			}
+			if b != d.keys[d.matched] {
+				d.pending = append(d.pending, b)
+				continue
+			}
+			d.matched++
+			if d.matched == len(d.keys) {
+				d.err = ErrDetached
+				d.onDetach()
+				break
+			}
+		}
+		if err != nil && d.err == nil {
+			d.err = err
+			// the input ended partway through the sequence, so it wasn't one
+			d.pending = append(d.pending, d.keys[:d.matched]...)
+			d.matched = 0
+		}
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// AttachSelfConsoleWithDetachKeys is AttachSelfConsole, except that typing
+// detachKeys ends the attach with ErrDetached.
+func AttachSelfConsoleWithDetachKeys(ctx context.Context, attacher Attachable, detachKeys []byte) error {
+	if len(detachKeys) == 0 {
+		return AttachSelfConsole(ctx, attacher)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	detached := make(chan struct{})
+	err := attachSelfConsole(ctx, attacher, &detachReader{
+		r:    os.Stdin,
+		keys: detachKeys,
+		onDetach: func() {
+			close(detached)
+			cancel()
+		},
+	})
+	select {
+	case <-detached:
+		return ErrDetached
+	default:
+		return err
+	}
+}
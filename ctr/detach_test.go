@@ -0,0 +1,111 @@
+package ctr
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDetachKeys(t *testing.T) {
+	for _, tc := range []struct {
+		keys    string
+		seq     []byte
+		invalid bool
+	}{
+		{keys: DefaultDetachKeys, seq: []byte{0x10, 0x11}},
+		{keys: "a,b", seq: []byte{'a', 'b'}},
+		{keys: "ctrl-a,x", seq: []byte{0x01, 'x'}},
+		{keys: "ctrl-A", seq: []byte{0x01}},
+		{keys: "ctrl-@", seq: []byte{0x00}},
+		{keys: "ctrl-[", seq: []byte{0x1b}},
+		{keys: "ctrl-_", seq: []byte{0x1f}},
+		{keys: "", invalid: true},
+		{keys: "ctrl-", invalid: true},
+		{keys: "ctrl-pq", invalid: true},
+		{keys: "ctrl-1", invalid: true},
+		{keys: "ctrl-~", invalid: true},
+		{keys: "shift-a", invalid: true},
+		{keys: "ab", invalid: true},
+		{keys: "a,,b", invalid: true},
+		{keys: "ctrl-p,", invalid: true},
+	} {
+		t.Run(tc.keys, func(t *testing.T) {
+			seq, err := ParseDetachKeys(tc.keys)
+			if tc.invalid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.seq, seq)
+		})
+	}
+}
+
+// chunkReader returns one chunk per read, like a tty does per keypress.
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if n < len(r.chunks[0]) {
+		r.chunks[0] = r.chunks[0][n:]
+	} else {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestDetachReader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		keys     string
+		chunks   []string
+		out      string
+		detached bool
+	}{
+		{name: "no keys", chunks: []string{"hello"}, out: "hello"},
+		{name: "sequence", chunks: []string{"ab\x10\x11cd"}, out: "ab", detached: true},
+		{name: "sequence split across reads", chunks: []string{"a\x10", "\x11b"}, out: "a", detached: true},
+		{name: "partial match then mismatch", chunks: []string{"a\x10b"}, out: "a\x10b"},
+		{name: "partial match then mismatch across reads", chunks: []string{"\x10", "x", "y"}, out: "\x10xy"},
+		{name: "partial match then first key again", chunks: []string{"\x10\x10\x11"}, out: "\x10", detached: true},
+		{name: "second key alone", chunks: []string{"\x11\x10"}, out: "\x11\x10"},
+		{name: "partial match at end of input", chunks: []string{"a", "\x10"}, out: "a\x10"},
+		// sequences whose prefixes overlap fall back to the longest partial
+		// match that's still possible
+		{name: "overlapping prefix", keys: "aab", chunks: []string{"aaab"}, out: "a", detached: true},
+		{name: "overlapping prefix across reads", keys: "aab", chunks: []string{"a", "a", "a", "b"}, out: "a", detached: true},
+		{name: "overlapping prefix then mismatch", keys: "aab", chunks: []string{"aaac"}, out: "aaac"},
+		{name: "repeated prefix", keys: "abac", chunks: []string{"ab", "abab", "ac!"}, out: "abab", detached: true},
+		{name: "repeated prefix then mismatch", keys: "abac", chunks: []string{"abab", "ax"}, out: "ababax"},
+		{name: "single key", keys: "q", chunks: []string{"abc", "q"}, out: "abc", detached: true},
+		{name: "overlapping prefix at end of input", keys: "aab", chunks: []string{"xaa"}, out: "xaa"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			keys := []byte{0x10, 0x11}
+			if tc.keys != "" {
+				keys = []byte(tc.keys)
+			}
+			detached := false
+			r := &detachReader{
+				r:        &chunkReader{chunks: append([]string{}, tc.chunks...)},
+				keys:     keys,
+				onDetach: func() { detached = true },
+			}
+			out, err := ioutil.ReadAll(r)
+			require.Equal(t, tc.out, string(out))
+			require.Equal(t, tc.detached, detached)
+			if tc.detached {
+				require.Equal(t, ErrDetached, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
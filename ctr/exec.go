@@ -0,0 +1,200 @@
+package ctr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/containerd/console"
+	"github.com/hashicorp/go-multierror"
+	"github.com/opencontainers/runc/libcontainer"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runc/libcontainer/utils"
+)
+
+// Process is a non-init process started in an existing container via Exec.
+type Process interface {
+	Attachable
+	Wait(context.Context) WaitResult
+}
+
+// Exec starts a new process in the container's namespaces with its own tty.
+// If the proc has no Args, Env or WorkingDir, they are inherited from the
+// container's init process.
+func (c *container) Exec(proc ContainerProc) (Process, error) {
+	if len(proc.Args) == 0 || proc.Env == nil || proc.WorkingDir == "" {
+		initProc, err := c.initProcInfo()
+		if err != nil {
+			return nil, err
+		}
+		if len(proc.Args) == 0 {
+			proc.Args = initProc.Args
+		}
+		if proc.Env == nil {
+			proc.Env = initProc.Env
+		}
+		if proc.WorkingDir == "" {
+			proc.WorkingDir = initProc.WorkingDir
+		}
+	}
+
+	parentConsoleSock, ctrConsoleSock, err := utils.NewSockPair("console")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tty console sock: %w", err)
+	}
+	defer parentConsoleSock.Close()
+	defer ctrConsoleSock.Close()
+
+	noNewPrivileges := true
+	var caps *configs.Capabilities
+	if proc.Capabilities != nil {
+		caps = &configs.Capabilities{
+			Bounding:    proc.Capabilities.Bounding,
+			Effective:   proc.Capabilities.Effective,
+			Inheritable: proc.Capabilities.Inheritable,
+			Permitted:   proc.Capabilities.Permitted,
+			Ambient:     proc.Capabilities.Ambient,
+		}
+	}
+	runcProc := &libcontainer.Process{
+		Init:            false,
+		User:            "0:0",
+		Args:            proc.Args,
+		Env:             proc.Env,
+		Cwd:             proc.WorkingDir,
+		Capabilities:    caps,
+		NoNewPrivileges: &noNewPrivileges,
+		ConsoleSocket:   ctrConsoleSock,
+	}
+
+	if err := c.runcCtr.Run(runcProc); err != nil {
+		return nil, fmt.Errorf("failed to exec in container %s: %w", c.state.ContainerID(), err)
+	}
+
+	f, err := utils.RecvFd(parentConsoleSock)
+	if err != nil {
+		runcProc.Signal(os.Kill)
+		return nil, fmt.Errorf("failed to receive exec tty fd: %w", err)
+	}
+	procConsole, err := console.ConsoleFromFile(f)
+	if err != nil {
+		runcProc.Signal(os.Kill)
+		return nil, fmt.Errorf("failed to open exec tty: %w", err)
+	}
+	console.ClearONLCR(procConsole.Fd())
+
+	return &process{
+		runcProc: runcProc,
+		console:  procConsole,
+	}, nil
+}
+
+// initProcInfo reads the args, env and cwd of the container's init process
+// out of /proc so that execs can default to the same environment.
+func (c *container) initProcInfo() (ContainerProc, error) {
+	var proc ContainerProc
+	state, err := c.runcCtr.State()
+	if err != nil {
+		return proc, fmt.Errorf("failed to get container state: %w", err)
+	}
+	procDir := filepath.Join("/proc", strconv.Itoa(state.InitProcessPid))
+
+	cmdline, err := ioutil.ReadFile(filepath.Join(procDir, "cmdline"))
+	if err != nil {
+		return proc, fmt.Errorf("failed to read init process cmdline: %w", err)
+	}
+	proc.Args = splitNulls(cmdline)
+
+	environ, err := ioutil.ReadFile(filepath.Join(procDir, "environ"))
+	if err != nil {
+		return proc, fmt.Errorf("failed to read init process environ: %w", err)
+	}
+	proc.Env = splitNulls(environ)
+
+	proc.WorkingDir = "/"
+	if cwd, err := os.Readlink(filepath.Join(procDir, "cwd")); err == nil {
+		proc.WorkingDir = cwd
+	}
+	return proc, nil
+}
+
+func splitNulls(b []byte) []string {
+	var strs []string
+	for _, s := range bytes.Split(bytes.TrimRight(b, "\x00"), []byte{0}) {
+		if len(s) > 0 {
+			strs = append(strs, string(s))
+		}
+	}
+	return strs
+}
+
+type process struct {
+	runcProc *libcontainer.Process
+	console  console.Console
+
+	waitOnce   sync.Once
+	waitCh     chan struct{}
+	waitResult WaitResult
+}
+
+func (p *process) Attach(ctx context.Context, in io.Reader, out io.Writer) error {
+	if in != nil {
+		go io.Copy(p.console, in)
+	}
+
+	outCh := make(chan error, 1)
+	go func() {
+		defer close(outCh)
+		if out == nil {
+			out = ioutil.Discard
+		}
+		// reads from the console return EIO once the process exits, which
+		// just means there's no more output
+		_, err := io.Copy(out, p.console)
+		p.console.Close()
+		outCh <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-outCh:
+		return nil
+	}
+}
+
+func (p *process) Resize(winSize console.WinSize) error {
+	if err := p.console.Resize(winSize); err != nil {
+		return fmt.Errorf("exec console resize failed: %w", err)
+	}
+	return nil
+}
+
+func (p *process) Wait(ctx context.Context) WaitResult {
+	p.waitOnce.Do(func() {
+		p.waitCh = make(chan struct{})
+		go func() {
+			defer close(p.waitCh)
+			state, err := p.runcProc.Wait()
+			exitCode := state.ExitCode()
+			if exitCode != 0 && exitCode != -1 {
+				err = multierror.Append(err, fmt.Errorf(
+					"exec %w", ExitError{ExitCode: exitCode})).ErrorOrNil()
+			}
+			p.waitResult = WaitResult{State: state, Err: err}
+		}()
+	})
+
+	select {
+	case <-p.waitCh:
+		return p.waitResult
+	case <-ctx.Done():
+		return WaitResult{Err: ctx.Err()}
+	}
+}
@@ -0,0 +1,71 @@
+package ctr
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitNulls(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		strs []string
+	}{
+		{in: "", strs: nil},
+		{in: "\x00", strs: nil},
+		{in: "sh\x00", strs: []string{"sh"}},
+		{in: "sh\x00-c\x00echo hi\x00", strs: []string{"sh", "-c", "echo hi"}},
+		{in: "A=1\x00\x00B=2", strs: []string{"A=1", "B=2"}},
+	} {
+		require.Equal(t, tc.strs, splitNulls([]byte(tc.in)), "%q", tc.in)
+	}
+}
+
+func TestExec(t *testing.T) {
+	// the init's env and cwd are read from /proc, so they're only set once
+	// it's exec'd
+	c := startContainer(t, `export INIT_VAR=init; cd /usr; `+
+		`exec /bin/sh -c "trap 'exit 0' TERM HUP; while :; do sleep 0.1; done"`, true)
+	time.Sleep(500 * time.Millisecond)
+
+	exec := func(proc ContainerProc) (string, error) {
+		p, err := c.(*container).Exec(proc)
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		var out bytes.Buffer
+		attachCh := make(chan error, 1)
+		go func() {
+			attachCh <- p.Attach(ctx, nil, &out)
+		}()
+		err = p.Wait(ctx).Err
+		select {
+		case <-attachCh:
+		case <-time.After(time.Second):
+			cancel()
+			<-attachCh
+		}
+		return out.String(), err
+	}
+
+	// execs without an env or working dir get the init's
+	out, err := exec(ContainerProc{Args: []string{"/bin/sh", "-c", `echo "$INIT_VAR $(pwd)"`}})
+	require.NoError(t, err)
+	require.Contains(t, out, "init /usr")
+
+	out, err = exec(ContainerProc{
+		Args:       []string{"/bin/sh", "-c", `echo "$INIT_VAR $EXEC_VAR $(pwd)"`},
+		Env:        []string{"PATH=/bin:/usr/bin", "EXEC_VAR=exec"},
+		WorkingDir: "/bin",
+	})
+	require.NoError(t, err)
+	require.Contains(t, out, " exec /bin")
+
+	_, err = exec(ContainerProc{Args: []string{"/bin/sh", "-c", "exit 3"}})
+	exitCode, ok := ExitCode(err)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, 3, exitCode)
+}
@@ -0,0 +1,99 @@
+package ctr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/containerd/fifo"
+)
+
+// pipeIO is the stdio of a container started with NoTTY. The container gets
+// one end of plain os pipes while the other ends are copied to/from fifos in
+// the IODir, which is what clients attach to.
+type pipeIO struct {
+	ctrStdin  *os.File
+	ctrStdout *os.File
+	ctrStderr *os.File
+}
+
+func (d ContainerState) setupPipeIO() (*pipeIO, CleanupStack, error) {
+	var cleanups CleanupStack
+	stdio := &pipeIO{}
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, cleanups, fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	stdio.ctrStdin = stdinR
+	cleanups = cleanups.Push(stdinW.Close)
+
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, cleanups, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	stdio.ctrStdout = stdoutW
+	cleanups = cleanups.Push(stdoutR.Close)
+
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		return nil, cleanups, fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+	stdio.ctrStderr = stderrW
+	cleanups = cleanups.Push(stderrR.Close)
+
+	// O_NONBLOCK makes OpenFifo return immediately, reads and writes then
+	// block until the other side of the fifo is opened by an attacher.
+	inFifo, err := fifo.OpenFifo(context.TODO(), d.IODir().StdinFifo(),
+		syscall.O_CREAT|syscall.O_RDONLY|syscall.O_NONBLOCK, 0600)
+	if err != nil {
+		return nil, cleanups, fmt.Errorf("failed to create stdin fifo: %w", err)
+	}
+	cleanups = cleanups.Push(inFifo.Close)
+
+	outFifo, err := fifo.OpenFifo(context.TODO(), d.IODir().StdoutFifo(),
+		syscall.O_CREAT|syscall.O_WRONLY|syscall.O_NONBLOCK, 0600)
+	if err != nil {
+		return nil, cleanups, fmt.Errorf("failed to create stdout fifo: %w", err)
+	}
+	cleanups = cleanups.Push(outFifo.Close)
+
+	errFifo, err := fifo.OpenFifo(context.TODO(), d.IODir().StderrFifo(),
+		syscall.O_CREAT|syscall.O_WRONLY|syscall.O_NONBLOCK, 0600)
+	if err != nil {
+		return nil, cleanups, fmt.Errorf("failed to create stderr fifo: %w", err)
+	}
+	cleanups = cleanups.Push(errFifo.Close)
+
+	// TODO need real logging
+	go func() {
+		if _, err := io.Copy(stdinW, inFifo); err != nil {
+			fmt.Fprintf(os.Stderr, "stdin fifo copy stopped: %v\n", err)
+		}
+		stdinW.Close()
+	}()
+	go func() {
+		if _, err := io.Copy(outFifo, stdoutR); err != nil {
+			fmt.Fprintf(os.Stderr, "stdout fifo copy stopped: %v\n", err)
+		}
+		outFifo.Close()
+	}()
+	go func() {
+		if _, err := io.Copy(errFifo, stderrR); err != nil {
+			fmt.Fprintf(os.Stderr, "stderr fifo copy stopped: %v\n", err)
+		}
+		errFifo.Close()
+	}()
+
+	return stdio, cleanups, nil
+}
+
+// closeCtrSide closes this process's copies of the container's ends of the
+// pipes so that EOF is seen once the container closes them too.
+func (p *pipeIO) closeCtrSide() {
+	p.ctrStdin.Close()
+	p.ctrStdout.Close()
+	p.ctrStderr.Close()
+}
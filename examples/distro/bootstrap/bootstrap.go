@@ -17,7 +17,7 @@ type Spec struct {}
 
 func (Spec) Spec() graph.Spec {
 	return graph.Wrap(
-		graph.Image{Ref: "docker.io/eriksipsma/bincastle-sysroot:latest"},
+		graph.Image{Ref: graph.SysrootImage()},
 		graph.AppendOutputDir("/sysroot")).Spec()
 }
 
@@ -60,8 +60,10 @@ func (patchedBaseSystem) Spec() Spec {
 
 func Distro(opts ...LayerSpecOpt) AsSpec {
 	return LayerSpec(opts...).With(
-		Replaced(patchedBaseSystem{}, baseSystem{}),
-		Replaced(bootstrap.Spec{}, nil),
+		ReplacedAll([]Replacement{
+			{Replacee: patchedBaseSystem{}, Replacer: baseSystem{}},
+			{Replacee: bootstrap.Spec{}},
+		}),
 		EnvOverrides{},
 	)
 }
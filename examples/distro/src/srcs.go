@@ -3,7 +3,10 @@ package src
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
 
+	"github.com/moby/buildkit/client/llb"
+	"github.com/opencontainers/go-digest"
 	"github.com/sipsma/bincastle/examples/distro/bootstrap"
 	. "github.com/sipsma/bincastle/graph"
 )
@@ -20,6 +23,10 @@ func SrcLayer(name string, extras ...LayerSpecOpt) Spec {
 	), MountDir(mountDir)).Spec()
 }
 
+// ViaCurl downloads an archive with curl in a build step without verifying
+// it, prefer ViaHTTP for archives with a known checksum. Once the definition
+// is locked, it's downloaded like a ViaHTTP source with the locked checksum
+// instead.
 type ViaCurl struct {
 	URL             string
 	Name            string
@@ -29,14 +36,12 @@ type ViaCurl struct {
 }
 
 func (s ViaCurl) Spec() Spec {
-	opts := []LayerSpecOpt{s.AlwaysRun, BuildScript(
+	opts := []LayerSpecOpt{s.AlwaysRun, NetworkAccess(true), BuildScript(
 		`mkdir -p /src`,
 		`cd /src`,
 		fmt.Sprintf("curl -L -O %s", s.URL),
 		`DLFILE=$(ls)`,
-		fmt.Sprintf(
-			`tar --strip-components=%d --extract --no-same-owner --file=$DLFILE`,
-			s.StripComponents),
+		extractCmd(`$DLFILE`, s.StripComponents),
 		`rm $DLFILE`,
 	)}
 	if !s.NoOverride {
@@ -45,27 +50,284 @@ func (s ViaCurl) Spec() Spec {
 	return SrcLayer(s.Name, opts...)
 }
 
+func (s ViaCurl) LockKey() (LockKind, string, bool) {
+	return LockDownload, s.URL, true
+}
+
+func (s ViaCurl) Locked(checksum string) AsSpec {
+	return ViaHTTP{
+		URL:             s.URL,
+		Name:            s.Name,
+		Checksum:        digest.Digest(checksum),
+		StripComponents: s.StripComponents,
+		NoOverride:      s.NoOverride,
+	}
+}
+
+// ViaHTTP downloads an archive with the daemon rather than in a build step.
+// The download fails unless its digest matches Checksum, which (rather than
+// URL) is also what its cache key is derived from.
+type ViaHTTP struct {
+	URL             string
+	Name            string
+	Checksum        digest.Digest
+	StripComponents int
+	NoOverride      bool
+}
+
+func (s ViaHTTP) Spec() Spec {
+	if err := s.Checksum.Validate(); err != nil {
+		panic(fmt.Sprintf("invalid checksum of %s: %v", s.Name, err))
+	}
+	// a fixed filename keeps the url out of the download's cache key, tar
+	// detects the compression from the archive's contents
+	download := llb.HTTP(s.URL,
+		llb.Checksum(s.Checksum),
+		llb.Filename(httpArchiveName),
+		llb.WithCustomName(fmt.Sprintf("download %s", s.URL)),
+	)
+	opts := []LayerSpecOpt{
+		LayerSpecOptFunc(func(ls LayerSpecOpts) LayerSpecOpts {
+			ls.BuildExecOpts = append(ls.BuildExecOpts,
+				llb.AddMount(httpDownloadDir, download, llb.Readonly))
+			return ls
+		}),
+		BuildScript(
+			`mkdir -p /src`,
+			`cd /src`,
+			extractCmd(filepath.Join(httpDownloadDir, httpArchiveName), s.StripComponents),
+		),
+	}
+	if !s.NoOverride {
+		opts = append(opts, LocalOverride(false))
+	}
+	return SrcLayer(s.Name, opts...)
+}
+
+const (
+	httpDownloadDir = "/download"
+	httpArchiveName = "archive"
+)
+
+// extractCmd extracts the archive at file into the working dir, dropping
+// the first stripComponents dirs of each path in it.
+func extractCmd(file string, stripComponents int) string {
+	return fmt.Sprintf(`tar --strip-components=%d --extract --no-same-owner --file=%s`,
+		stripComponents, file)
+}
+
+// ViaGit checks out a git repo. Unless the definition's lock pins it, Ref is
+// resolved to the commit it points to when the source is built rather than
+// when the definition is evaluated, as definitions can't reach the network.
+// Resolving runs on every build, but the checkout is cached by the commit it
+// resolves to, so it only runs again once the ref moves.
+//
+// Repos with http(s) and git:// urls are fetched with buildkit's git source.
+// It can't fetch file:// repos, ssh ones (which need the forwarded ssh agent)
+// or skip submodules, so those are cloned in a build step instead. file://
+// repos are shared by the client and mounted at the same path in the steps
+// that read them.
 type ViaGit struct {
-	URL        string
+	URL string
+	// Ref is a branch, tag or full commit sha, master if empty.
 	Ref        string
 	Name       string
 	AlwaysRun  AlwaysRun
 	NoOverride bool
+	// NoGitDir leaves the repo's .git dir out of the source. Sources with a
+	// Subdir never have it.
+	NoGitDir bool
+	// NoSubmodules skips checking out the repo's submodules.
+	NoSubmodules bool
+	// Subdir, if set, is the only dir of the repo in the source.
+	Subdir string
 }
 
 func (s ViaGit) Spec() Spec {
-	opts := []LayerSpecOpt{s.AlwaysRun, BuildScript(
+	ref := s.ref()
+	if s.NoSubmodules || !isGitSourceURL(s.URL) {
+		return s.clone(ref)
+	}
+
+	gitOpts := []llb.GitOption{llb.WithCustomName(fmt.Sprintf("git %s#%s", s.URL, ref))}
+	if !s.NoGitDir {
+		gitOpts = append(gitOpts, llb.KeepGitDir())
+	}
+	if s.AlwaysRun {
+		gitOpts = append(gitOpts, llb.IgnoreCache)
+	}
+	checkout := llb.Git(s.URL, ref, gitOpts...)
+
+	opts := []LayerSpecOpt{
+		LayerSpecOptFunc(func(ls LayerSpecOpts) LayerSpecOpts {
+			ls.BaseState = checkout
+			return ls
+		}),
+		OutputDir(filepath.Join("/", s.Subdir)),
+	}
+	if !s.NoOverride {
+		opts = append(opts, LocalOverride(false))
+	}
+	return Wrap(LayerSpec(
+		Name(s.Name),
+		MergeLayerSpecOpts(opts...),
+		LocalOverride(true),
+	), MountDir(filepath.Join("/src", s.Name))).Spec()
+}
+
+func (s ViaGit) ref() string {
+	if s.Ref == "" {
+		return "master"
+	}
+	return s.Ref
+}
+
+// LockKey is the repo's url and ref, unless the ref is already a commit.
+func (s ViaGit) LockKey() (LockKind, string, bool) {
+	return LockGit, GitLockKey(s.URL, s.ref()), !IsCommitSHA(s.ref())
+}
+
+func (s ViaGit) Locked(commit string) AsSpec {
+	s.Ref = commit
+	return s
+}
+
+// clone checks out the commit ref resolves to in a build step.
+func (s ViaGit) clone(ref string) Spec {
+	opts := []LayerSpecOpt{s.AlwaysRun, localRepo(s.URL), ForwardSSH(isSSHURL(s.URL))}
+	commit := ref
+	if !IsCommitSHA(ref) {
+		// the clone is cached by the contents of the resolved commit, so
+		// it only runs again when the ref moves
+		opts = append(opts, BuildDep(GitCommit{URL: s.URL, Ref: ref}))
+		commit = fmt.Sprintf(`$(cat %s)`, GitCommitFile)
+	}
+
+	checkoutDir := "/src"
+	if s.Subdir != "" {
+		checkoutDir = "/tmp/checkout"
+	}
+	script := []string{
 		`mkdir -p /src`,
-		fmt.Sprintf(`git clone --recurse-submodules %s /src`, s.URL),
-		`cd /src`,
-		fmt.Sprintf(`git checkout -f %s`, s.Ref),
-	)}
+		fmt.Sprintf(`git clone --no-checkout %s %s`, s.URL, checkoutDir),
+		fmt.Sprintf(`cd %s`, checkoutDir),
+		fmt.Sprintf(`git checkout -f %s`, commit),
+	}
+	if !s.NoSubmodules {
+		script = append(script, `git submodule update --init --recursive`)
+	}
+	if s.NoGitDir {
+		script = append(script, `find . -name .git -prune -exec rm -rf {} +`)
+	}
+	if s.Subdir != "" {
+		script = append(script,
+			fmt.Sprintf(`cp -a %s/. /src/`, filepath.Join(checkoutDir, s.Subdir)),
+			`cd /src`,
+			fmt.Sprintf(`rm -rf %s`, checkoutDir),
+		)
+	}
+	opts = append(opts, BuildScript(script...))
 	if !s.NoOverride {
 		opts = append(opts, LocalOverride(false))
 	}
 	return SrcLayer(s.Name, opts...)
 }
 
+// GitCommit resolves Ref (a branch, tag or full commit sha) of the git repo
+// at URL to the commit it points to, writing it to GitCommitFile. It runs
+// every time it's built as the ref may have moved, steps that mount it
+// read-only are cached by the commit it writes rather than by the step.
+type GitCommit struct {
+	URL string
+	Ref string
+}
+
+const (
+	gitCommitDir = "/git-commit"
+	// GitCommitFile is where GitCommit writes the commit in its output and
+	// where it's mounted as a dep.
+	GitCommitFile = gitCommitDir + "/commit"
+)
+
+func (s GitCommit) Spec() Spec {
+	return LayerSpec(
+		BuildDep(bootstrap.Spec{}),
+		bootstrap.BuildOpts(),
+		AlwaysRun(true),
+		localRepo(s.URL),
+		ForwardSSH(isSSHURL(s.URL)),
+		BuildScript(resolveRefScript(s.URL, s.Ref, gitCommitDir)...),
+		OutputDir(gitCommitDir),
+		MountDir(gitCommitDir),
+	)
+}
+
+// resolveRefScript writes the commit ref points to in the repo at url to
+// commit in dir. Branches are preferred over tags of the same name and
+// annotated tags are peeled to the commit they point to.
+func resolveRefScript(url, ref, dir string) []string {
+	return []string{
+		fmt.Sprintf(`mkdir -p %s`, dir),
+		fmt.Sprintf(`cd %s`, dir),
+		fmt.Sprintf(`git ls-remote %s > refs`, url),
+		fmt.Sprintf(`for name in "%[1]s^{}" "%[1]s" "refs/heads/%[1]s" "refs/tags/%[1]s^{}" "refs/tags/%[1]s"; do `+
+			`commit=$(awk -v name="$name" '$2 == name { print $1 }' refs); `+
+			`if [ -n "$commit" ]; then break; fi; done`, ref),
+		`rm refs`,
+		fmt.Sprintf(`if [ -z "$commit" ]; then echo "git repo %s has no branch or tag %s" >&2; exit 1; fi`, url, ref),
+		`printf '%s' "$commit" > commit`,
+	}
+}
+
+// LocalRepoPrefix prefixes the names of the local dirs of repos on the
+// client's host, which are shared by the client when the daemon asks for
+// them.
+const LocalRepoPrefix = "git-repo:"
+
+// localRepoPath returns the path of the repo on the client's host that url
+// refers to, if it's a file:// url or an absolute path.
+func localRepoPath(url string) (string, bool) {
+	path := strings.TrimPrefix(url, "file://")
+	return path, filepath.IsAbs(path)
+}
+
+// localRepo mounts repos on the client's host read-only at the same path in
+// the build step, which otherwise fetches its repo over the network.
+func localRepo(url string) LayerSpecOpt {
+	path, ok := localRepoPath(url)
+	if !ok {
+		return NetworkAccess(true)
+	}
+	repo := llb.Local(LocalRepoPrefix+path, llb.WithCustomName(fmt.Sprintf("git repo %s", path)))
+	return LayerSpecOptFunc(func(ls LayerSpecOpts) LayerSpecOpts {
+		ls.BuildExecOpts = append(ls.BuildExecOpts, llb.AddMount(path, repo, llb.Readonly))
+		return ls
+	})
+}
+
+// isGitSourceURL returns whether buildkit's git source can fetch the url.
+func isGitSourceURL(url string) bool {
+	for _, prefix := range []string{"http://", "https://", "git://"} {
+		if strings.HasPrefix(url, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSSHURL returns whether git will use ssh to fetch the url, which is the
+// case for ssh:// urls and scp-like ones such as git@github.com:org/repo.
+func isSSHURL(url string) bool {
+	if strings.HasPrefix(url, "ssh://") {
+		return true
+	}
+	if strings.Contains(url, "://") {
+		return false
+	}
+	colon := strings.Index(url, ":")
+	return colon > 0 && !strings.Contains(url[:colon], "/")
+}
+
 type Awk struct{}
 
 func (Awk) Spec() Spec {
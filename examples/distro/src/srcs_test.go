@@ -0,0 +1,479 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/runc/libcontainer"
+	_ "github.com/opencontainers/runc/libcontainer/nsenter"
+	"github.com/sipsma/bincastle/ctr"
+	"github.com/sipsma/bincastle/graph"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	// the test binary is the init of the containers build steps run in
+	if len(os.Args) > 1 && os.Args[1] == ctr.RuncInitArg {
+		runtime.GOMAXPROCS(1)
+		runtime.LockOSThread()
+		factory, _ := libcontainer.New("", libcontainer.RootlessCgroupfs)
+		err := factory.StartInitialization()
+		panic(err)
+	}
+}
+
+// layerOps returns the ops of the layer of g with the given mount dir.
+func layerOps(t *testing.T, g *graph.Graph, mountDir string) []pb.Op {
+	layers, err := g.MarshalLayers(context.TODO())
+	require.NoError(t, err)
+	for _, layer := range layers {
+		if layer.MountDir != mountDir {
+			continue
+		}
+		var def pb.Definition
+		require.NoError(t, def.Unmarshal(layer.LLB))
+		var ops []pb.Op
+		for _, dt := range def.Def {
+			var op pb.Op
+			require.NoError(t, op.Unmarshal(dt))
+			ops = append(ops, op)
+		}
+		return ops
+	}
+	t.Fatalf("no layer mounted at %s", mountDir)
+	return nil
+}
+
+func TestExtractCmd(t *testing.T) {
+	require.Equal(t,
+		`tar --strip-components=0 --extract --no-same-owner --file=/download/archive`,
+		extractCmd("/download/archive", 0))
+	require.Equal(t,
+		`tar --strip-components=2 --extract --no-same-owner --file=$DLFILE`,
+		extractCmd("$DLFILE", 2))
+}
+
+func TestViaHTTP(t *testing.T) {
+	const url = "https://example.com/releases/foo-1.0.tar.gz"
+	checksum := digest.FromString("foo-1.0.tar.gz")
+	g := graph.Build(ViaHTTP{
+		URL:             url,
+		Name:            "foo-src",
+		Checksum:        checksum,
+		StripComponents: 1,
+	})
+
+	var download *pb.SourceOp
+	var extract *pb.ExecOp
+	for _, op := range layerOps(t, g, "/src/foo-src") {
+		if src := op.GetSource(); src != nil && src.Identifier == url {
+			download = src
+		}
+		if exec := op.GetExec(); exec != nil {
+			extract = exec
+		}
+	}
+
+	// the daemon fails the download unless its content has the checksum
+	require.NotNil(t, download)
+	require.Equal(t, checksum.String(), download.Attrs[pb.AttrHTTPChecksum])
+	require.Equal(t, httpArchiveName, download.Attrs[pb.AttrHTTPFilename])
+
+	require.NotNil(t, extract)
+	var downloadMount *pb.Mount
+	for _, mnt := range extract.Mounts {
+		if mnt.Dest == httpDownloadDir {
+			downloadMount = mnt
+		}
+	}
+	require.NotNil(t, downloadMount)
+	require.True(t, downloadMount.Readonly)
+	script := extract.Meta.Args[len(extract.Meta.Args)-1]
+	require.True(t, strings.Contains(script,
+		`tar --strip-components=1 --extract --no-same-owner --file=/download/archive`), script)
+}
+
+func TestViaHTTPInvalidChecksum(t *testing.T) {
+	require.Panics(t, func() {
+		ViaHTTP{URL: "https://example.com/foo.tar.gz", Name: "foo-src", Checksum: "sha256:nope"}.Spec()
+	})
+	require.Panics(t, func() {
+		ViaHTTP{URL: "https://example.com/foo.tar.gz", Name: "foo-src"}.Spec()
+	})
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+// testGitRepo creates a bare repo with a "main" branch one commit ahead of
+// an annotated "v1" tag, returning its file:// url and the two commits.
+func testGitRepo(t *testing.T) (url string, tagged string, head string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "bincastle-git-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	bareDir := filepath.Join(dir, "repo.git")
+	workDir := filepath.Join(dir, "work")
+	git(t, dir, "init", "-q", "--bare", bareDir)
+	git(t, dir, "init", "-q", workDir)
+	git(t, workDir, "checkout", "-q", "-b", "main")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(workDir, "file"), []byte("1"), 0644))
+	git(t, workDir, "add", "file")
+	git(t, workDir, "commit", "-q", "-m", "first")
+	git(t, workDir, "tag", "-a", "-m", "v1", "v1")
+	tagged = git(t, workDir, "rev-parse", "HEAD")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(workDir, "file"), []byte("2"), 0644))
+	git(t, workDir, "commit", "-q", "-am", "second")
+	head = git(t, workDir, "rev-parse", "HEAD")
+
+	git(t, workDir, "push", "-q", bareDir, "main", "v1")
+	return "file://" + bareDir, tagged, head
+}
+
+func TestResolveRefScript(t *testing.T) {
+	url, tagged, head := testGitRepo(t)
+	resolve := func(ref string) (string, error) {
+		dir, err := ioutil.TempDir("", "bincastle-resolve-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		script := append([]string{"set -e"}, resolveRefScript(url, ref, dir)...)
+		if out, err := exec.Command("sh", "-c", strings.Join(script, "\n")).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("%w: %s", err, out)
+		}
+		commit, err := ioutil.ReadFile(filepath.Join(dir, "commit"))
+		require.NoError(t, err)
+		return string(commit), nil
+	}
+
+	commit, err := resolve("main")
+	require.NoError(t, err)
+	require.Equal(t, head, commit)
+
+	// annotated tags resolve to the commit, not the tag object
+	commit, err = resolve("v1")
+	require.NoError(t, err)
+	require.Equal(t, tagged, commit)
+
+	commit, err = resolve("refs/tags/v1")
+	require.NoError(t, err)
+	require.Equal(t, tagged, commit)
+
+	_, err = resolve("missing")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has no branch or tag missing")
+}
+
+func TestViaGit(t *testing.T) {
+	const url = "https://example.com/repo.git"
+	gitSource := func(s ViaGit) (*pb.SourceOp, string) {
+		g := graph.Build(s)
+		layers, err := g.MarshalLayers(context.TODO())
+		require.NoError(t, err)
+		outputDir := layers[len(layers)-1].OutputDir
+		for _, op := range layerOps(t, g, "/src/"+s.Name) {
+			if src := op.GetSource(); src != nil {
+				return src, outputDir
+			}
+		}
+		t.Fatalf("%s has no source op", s.Name)
+		return nil, ""
+	}
+
+	src, outputDir := gitSource(ViaGit{URL: url, Ref: "main", Name: "repo-src"})
+	require.Equal(t, "git://example.com/repo.git#main", src.Identifier)
+	// the .git dir is kept unless the source asks for it not to be
+	require.Equal(t, "true", src.Attrs[pb.AttrKeepGitDir])
+	require.Equal(t, "/", outputDir)
+
+	src, outputDir = gitSource(ViaGit{URL: url, Name: "repo-src", NoGitDir: true, Subdir: "sub/dir"})
+	require.Equal(t, "git://example.com/repo.git#master", src.Identifier)
+	require.NotContains(t, src.Attrs, pb.AttrKeepGitDir)
+	require.Equal(t, "/sub/dir", outputDir)
+}
+
+func TestViaGitClone(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	scripts := func(s ViaGit) []string {
+		var scripts []string
+		g := graph.Build(s)
+		layers, err := g.MarshalLayers(context.TODO())
+		require.NoError(t, err)
+		for _, layer := range layers {
+			for _, op := range layerOps(t, g, layer.MountDir) {
+				if exec := op.GetExec(); exec != nil {
+					scripts = append(scripts, exec.Meta.Args[len(exec.Meta.Args)-1])
+				}
+			}
+		}
+		return scripts
+	}
+
+	// refs are resolved in their own step that the clone depends on
+	resolved := scripts(ViaGit{URL: "file:///repo.git", Ref: "main", Name: "repo-src"})
+	require.Len(t, resolved, 2)
+	require.Contains(t, resolved[0], "git ls-remote file:///repo.git > refs")
+	require.Contains(t, resolved[1], "git checkout -f $(cat "+GitCommitFile+")")
+	require.Contains(t, resolved[1], "git submodule update")
+	require.NotContains(t, resolved[1], "rm -rf {}")
+
+	pinned := scripts(ViaGit{URL: "git@example.com:repo.git", Ref: commit, Name: "repo-src", NoGitDir: true})
+	require.Len(t, pinned, 1)
+	require.Contains(t, pinned[0], "git checkout -f "+commit)
+	require.Contains(t, pinned[0], "find . -name .git -prune -exec rm -rf {} +")
+
+	// buildkit's git source always checks out submodules
+	noSubmodules := scripts(ViaGit{URL: "https://example.com/repo.git", Ref: commit, Name: "repo-src", NoSubmodules: true})
+	require.Len(t, noSubmodules, 1)
+	require.NotContains(t, noSubmodules[0], "git submodule update")
+}
+
+// runBuildSteps runs the build steps of g's layers in order, each in a
+// container with the host's tools instead of the layer's deps. Local repos
+// are mounted like buildkit mounts them and each of outputDirs is a dir shared
+// by all of the steps. It skips the test if containers can't be started here.
+func runBuildSteps(t *testing.T, g *graph.Graph, outputDirs ...string) map[string]string {
+	if os.Getuid() != 0 {
+		t.Skip("starting containers requires root")
+	}
+	dir, err := ioutil.TempDir("", "bincastle-build-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	mounts := ctr.DefaultMounts()
+	for _, hostDir := range []string{"/bin", "/lib", "/lib64", "/usr", "/etc/alternatives"} {
+		if _, err := os.Stat(hostDir); err == nil {
+			mounts = mounts.With(ctr.BindMount{Source: hostDir, Dest: hostDir, Recursive: true, Readonly: true})
+		}
+	}
+	outputs := make(map[string]string)
+	for i, outputDir := range outputDirs {
+		outputs[outputDir] = filepath.Join(dir, fmt.Sprintf("output%d", i))
+		require.NoError(t, os.Mkdir(outputs[outputDir], 0755))
+		mounts = mounts.With(ctr.BindMount{Source: outputs[outputDir], Dest: outputDir})
+	}
+
+	layers, err := g.MarshalLayers(context.TODO())
+	require.NoError(t, err)
+	for i, layer := range layers {
+		var def pb.Definition
+		require.NoError(t, def.Unmarshal(layer.LLB))
+		// ops are in the order they're run in
+		var order []*pb.Op
+		ops := make(map[digest.Digest]*pb.Op)
+		for _, dt := range def.Def {
+			op := &pb.Op{}
+			require.NoError(t, op.Unmarshal(dt))
+			order = append(order, op)
+			ops[digest.FromBytes(dt)] = op
+		}
+		for _, op := range order {
+			execOp := op.GetExec()
+			if execOp == nil {
+				continue
+			}
+			stepMounts := mounts
+			for _, m := range execOp.Mounts {
+				if m.Input < 0 {
+					continue
+				}
+				source := ops[op.Inputs[m.Input].Digest].GetSource()
+				if source == nil || !strings.HasPrefix(source.Identifier, "local://"+LocalRepoPrefix) {
+					continue
+				}
+				stepMounts = stepMounts.With(ctr.BindMount{
+					Source:   strings.TrimPrefix(source.Identifier, "local://"+LocalRepoPrefix),
+					Dest:     m.Dest,
+					Readonly: true,
+				})
+			}
+
+			c, err := ctr.ContainerStateRoot(filepath.Join(dir, "state")).ContainerState(fmt.Sprintf("step%d", i)).Start(ctr.ContainerDef{
+				ContainerProc: ctr.ContainerProc{
+					// attaching only gets stdout
+					Args:       append([]string{"/bin/sh", "-c", `exec 2>&1; exec "$@"`, "sh"}, execOp.Meta.Args...),
+					Env:        execOp.Meta.Env,
+					WorkingDir: execOp.Meta.Cwd,
+				},
+				MountBackend:   ctr.NoOverlayfsBackend{},
+				Mounts:         stepMounts,
+				ReadOnlyRootfs: true,
+				NoTTY:          true,
+			})
+			if err != nil {
+				t.Skipf("can't start containers here: %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			var out bytes.Buffer
+			attachCh := make(chan error, 1)
+			go func() {
+				attachCh <- c.Attach(ctx, nil, &out)
+			}()
+			err = c.Wait(ctx).Err
+			select {
+			case <-attachCh:
+			case <-time.After(time.Second):
+				cancel()
+				<-attachCh
+			}
+			cancel()
+			c.Destroy(10 * time.Second)
+			require.NoError(t, err, out.String())
+		}
+	}
+	return outputs
+}
+
+func TestViaGitLocalRepo(t *testing.T) {
+	url, _, head := testGitRepo(t)
+	outputs := runBuildSteps(t, graph.Build(ViaGit{URL: url, Ref: "main", Name: "repo-src"}),
+		gitCommitDir, "/src")
+
+	commit, err := ioutil.ReadFile(filepath.Join(outputs[gitCommitDir], "commit"))
+	require.NoError(t, err)
+	require.Equal(t, head, string(commit))
+	contents, err := ioutil.ReadFile(filepath.Join(outputs["/src"], "file"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(contents))
+	require.Equal(t, head, git(t, outputs["/src"], "rev-parse", "HEAD"))
+}
+
+func TestViaGitCloneCache(t *testing.T) {
+	type step struct {
+		dgst   digest.Digest
+		exec   *pb.ExecOp
+		always bool
+	}
+	steps := func() (resolve step, clone step) {
+		g := graph.Build(ViaGit{URL: "file:///repo.git", Ref: "main", Name: "repo-src"})
+		layers, err := g.MarshalLayers(context.TODO())
+		require.NoError(t, err)
+		var def pb.Definition
+		require.NoError(t, def.Unmarshal(layers[len(layers)-1].LLB))
+		for _, dt := range def.Def {
+			var op pb.Op
+			require.NoError(t, op.Unmarshal(dt))
+			execOp := op.GetExec()
+			if execOp == nil {
+				continue
+			}
+			dgst := digest.FromBytes(dt)
+			s := step{dgst: dgst, exec: execOp, always: def.Metadata[dgst].IgnoreCache}
+			if strings.Contains(execOp.Meta.Args[len(execOp.Meta.Args)-1], "git ls-remote") {
+				resolve = s
+			} else {
+				clone = s
+			}
+		}
+		require.NotNil(t, resolve.exec)
+		require.NotNil(t, clone.exec)
+		return resolve, clone
+	}
+
+	resolve, clone := steps()
+	// the ref may have moved since the last build
+	require.True(t, resolve.always)
+	require.False(t, clone.always)
+
+	// buildkit keys read-only inputs of a step by their contents, so the
+	// clone only runs again when the resolved commit changes
+	var commitMount *pb.Mount
+	for _, m := range clone.exec.Mounts {
+		if strings.HasSuffix(m.Dest, gitCommitDir) {
+			commitMount = m
+		}
+	}
+	require.NotNil(t, commitMount)
+	require.True(t, commitMount.Readonly)
+	require.Equal(t, pb.SkipOutput, commitMount.Output)
+	require.Equal(t, gitCommitDir, commitMount.Selector)
+
+	// the clone step is the same each time the definition is evaluated
+	_, reevaluated := steps()
+	require.Equal(t, clone.dgst, reevaluated.dgst)
+}
+
+func TestViaGitResolvedCommit(t *testing.T) {
+	url, _, head := testGitRepo(t)
+	resolve := func() string {
+		outputs := runBuildSteps(t, graph.Build(GitCommit{URL: url, Ref: "main"}), gitCommitDir)
+		commit, err := ioutil.ReadFile(filepath.Join(outputs[gitCommitDir], "commit"))
+		require.NoError(t, err)
+		return string(commit)
+	}
+
+	// resolving an unchanged ref gives the clone the same input
+	require.Equal(t, head, resolve())
+	require.Equal(t, head, resolve())
+
+	bareDir := strings.TrimPrefix(url, "file://")
+	workDir := filepath.Join(filepath.Dir(bareDir), "work")
+	git(t, workDir, "commit", "-q", "--allow-empty", "-m", "third")
+	git(t, workDir, "push", "-q", bareDir, "main")
+	moved := resolve()
+	require.NotEqual(t, head, moved)
+	require.Equal(t, git(t, workDir, "rev-parse", "HEAD"), moved)
+}
+
+func TestLockedSources(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	const gitURL = "https://example.com/repo.git"
+	const dlURL = "https://example.com/foo-1.0.tar.gz"
+	checksum := digest.FromString("foo-1.0.tar.gz")
+	spec := graph.LayerSpec(
+		graph.Dep(ViaGit{URL: gitURL, Ref: "main", Name: "repo-src"}),
+		graph.Dep(ViaGit{URL: gitURL, Ref: commit, Name: "pinned-src"}),
+		graph.Dep(ViaCurl{URL: dlURL, Name: "foo-src"}),
+	)
+
+	// commits are already pinned
+	used := graph.UsedLock(spec, nil)
+	require.Equal(t, map[string]string{gitURL + "#main": ""}, used.Git)
+	require.Equal(t, map[string]digest.Digest{dlURL: ""}, used.Downloads)
+
+	lock := graph.NewLock()
+	lock.Git[gitURL+"#main"] = commit
+	lock.Downloads[dlURL] = checksum
+	g := graph.Build(graph.Locked(lock).ApplyToSpec(spec))
+
+	var gitSrc, httpSrc *pb.SourceOp
+	for _, op := range append(layerOps(t, g, "/src/repo-src"), layerOps(t, g, "/src/foo-src")...) {
+		src := op.GetSource()
+		switch {
+		case src == nil:
+		case strings.HasPrefix(src.Identifier, "git://"):
+			gitSrc = src
+		case strings.HasPrefix(src.Identifier, "https://"):
+			httpSrc = src
+		}
+	}
+	require.NotNil(t, gitSrc)
+	require.Equal(t, "git://example.com/repo.git#"+commit, gitSrc.Identifier)
+	// locked curl downloads are verified against their checksum
+	require.NotNil(t, httpSrc)
+	require.Equal(t, checksum.String(), httpSrc.Attrs[pb.AttrHTTPChecksum])
+}
@@ -47,10 +47,12 @@ func (Sysroot) Spec() Spec {
 			Curl{},
 			OpenSSH{},
 		).With(
-			Replaced(bootstrap.Spec{}, nil),
-			Replaced(tmpBinutils{}, nil),
-			Replaced(tmpGCC{}, nil),
-			Replaced(libstdcpp{}, nil),
+			ReplacedAll([]Replacement{
+				{Replacee: bootstrap.Spec{}},
+				{Replacee: tmpBinutils{}},
+				{Replacee: tmpGCC{}},
+				{Replacee: libstdcpp{}},
+			}),
 		)),
 		bootstrap.BuildOpts(),
 		BuildScript(
@@ -26,6 +26,8 @@ require (
 	github.com/containerd/fifo v0.0.0-20200410184934-f15a3290365b
 	github.com/creack/pty v1.1.10
 	github.com/cyphar/filepath-securejoin v0.2.2 // indirect
+	github.com/docker/cli v0.0.0-20200227165822-2298e6a3fe24
+	github.com/docker/go-units v0.4.0
 	github.com/gofrs/flock v0.7.1
 	github.com/hashicorp/go-multierror v1.0.0
 	github.com/moby/buildkit v0.7.1-0.20200811165058-be534ae9a702
@@ -0,0 +1,267 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+)
+
+// Description is a summary of a graph meant for humans inspecting it, it
+// includes the layers of both the run graph and the graphs of build deps.
+type Description struct {
+	Roots  []digest.Digest    `json:"roots"`
+	Layers []LayerDescription `json:"layers"`
+}
+
+type LayerDescription struct {
+	Digest     digest.Digest `json:"digest"`
+	OrigDigest digest.Digest `json:"origDigest,omitempty"`
+	Name       string        `json:"name,omitempty"`
+	// OpDigest identifies the op that builds the layer, excluding its inputs,
+	// so it only changes when the layer's own build changes
+	OpDigest   digest.Digest   `json:"opDigest,omitempty"`
+	MountDir   string          `json:"mountDir,omitempty"`
+	OutputDir  string          `json:"outputDir,omitempty"`
+	Args       []string        `json:"args,omitempty"`
+	WorkingDir string          `json:"workingDir,omitempty"`
+	Env        []string        `json:"env,omitempty"`
+	Mounts     []HostMount     `json:"mounts,omitempty"`
+	RunDeps    []digest.Digest `json:"runDeps,omitempty"`
+	BuildDeps  []digest.Digest `json:"buildDeps,omitempty"`
+}
+
+// Describe returns a description of g. Layers are in topological order, each
+// layer comes after all of its run and build deps.
+func (g *Graph) Describe() *Description {
+	desc := &Description{}
+	if g == nil {
+		return desc
+	}
+
+	starts := make([]interface{}, len(g.roots))
+	for i, root := range g.roots {
+		starts[i] = root
+		desc.Roots = append(desc.Roots, root.digest)
+	}
+
+	rootsOf := func(g *Graph) []digest.Digest {
+		if g == nil {
+			return nil
+		}
+		var dgsts []digest.Digest
+		for _, root := range g.roots {
+			dgsts = append(dgsts, root.digest)
+		}
+		return dgsts
+	}
+
+	bottomUpWalk(starts,
+		func(vtx interface{}) interface{} {
+			return vtx.(*Layer).digest
+		},
+		func(vtx interface{}) []interface{} {
+			var deps []interface{}
+			for _, depGraph := range []*Graph{vtx.(*Layer).deps, vtx.(*Layer).buildDeps} {
+				if depGraph != nil {
+					for _, dep := range depGraph.roots {
+						deps = append(deps, dep)
+					}
+				}
+			}
+			return deps
+		},
+		func(vtxs []interface{}) {
+			var layers []*Layer
+			for _, vtx := range vtxs {
+				layers = append(layers, vtx.(*Layer))
+			}
+			sort.Slice(layers, func(i, j int) bool {
+				return layers[i].digest < layers[j].digest
+			})
+			for _, l := range layers {
+				var env []string
+				for k, v := range l.env {
+					env = append(env, k+"="+v)
+				}
+				sort.Strings(env)
+				desc.Layers = append(desc.Layers, LayerDescription{
+					Digest:     l.digest,
+					OrigDigest: l.origDigest,
+					Name:       NameOf(l),
+					OpDigest:   l.opDigest(),
+					MountDir:   l.mountDir,
+					OutputDir:  l.outputDir,
+					Args:       l.args,
+					WorkingDir: l.cwd,
+					Env:        env,
+					Mounts:     l.mounts,
+					RunDeps:    rootsOf(l.deps),
+					BuildDeps:  rootsOf(l.buildDeps),
+				})
+			}
+		},
+	)
+	return desc
+}
+
+// opDigest returns the digest of the op at the top of the layer's state with
+// its inputs cleared, or "" if the layer has no op of its own.
+func (l *Layer) opDigest() digest.Digest {
+	def, err := l.state.Marshal(context.TODO(), llb.LocalUniqueID("bincastle"))
+	if err != nil {
+		panic(err)
+	}
+	pbDef := def.ToPB()
+	if len(pbDef.Def) == 0 {
+		return ""
+	}
+
+	// the last op in a definition just points to the actual output
+	var last pb.Op
+	if err := (&last).Unmarshal(pbDef.Def[len(pbDef.Def)-1]); err != nil {
+		panic(err)
+	}
+	if len(last.Inputs) == 0 {
+		return ""
+	}
+	for _, dt := range pbDef.Def {
+		if digest.FromBytes(dt) != last.Inputs[0].Digest {
+			continue
+		}
+		var op pb.Op
+		if err := (&op).Unmarshal(dt); err != nil {
+			panic(err)
+		}
+		op.Inputs = nil
+		dt, err := op.Marshal()
+		if err != nil {
+			panic(err)
+		}
+		return digest.FromBytes(dt)
+	}
+	return ""
+}
+
+// Layer returns the description of the layer with the given digest, if any.
+func (d *Description) Layer(dgst digest.Digest) (LayerDescription, bool) {
+	for _, l := range d.Layers {
+		if l.Digest == dgst {
+			return l, true
+		}
+	}
+	return LayerDescription{}, false
+}
+
+// HasLayer returns whether a layer has the given name, using the same
+// matching as overrides.
+func (d *Description) HasLayer(name string) bool {
+	for _, l := range d.Layers {
+		if l.Name != "" && LayerNamesMatch(l.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l LayerDescription) label() string {
+	name := l.Name
+	if name == "" {
+		name = "<unnamed>"
+	}
+	return fmt.Sprintf("%s (%s)", name, shortDigest(l.Digest))
+}
+
+func shortDigest(dgst digest.Digest) string {
+	hex := dgst.Hex()
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
+
+// WriteDot writes the description as a graphviz digraph. Build deps are
+// drawn with dashed edges.
+func (d *Description) WriteDot(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "digraph {"); err != nil {
+		return err
+	}
+	for _, l := range d.Layers {
+		label := l.label()
+		if l.MountDir != "" {
+			label += "\n" + l.MountDir
+		}
+		if _, err := fmt.Fprintf(w, "  %q [label=%q shape=%q];\n", l.Digest, label, "box"); err != nil {
+			return err
+		}
+	}
+	for _, l := range d.Layers {
+		for _, dep := range l.RunDeps {
+			if _, err := fmt.Fprintf(w, "  %q -> %q;\n", l.Digest, dep); err != nil {
+				return err
+			}
+		}
+		for _, dep := range l.BuildDeps {
+			if _, err := fmt.Fprintf(w, "  %q -> %q [style=dashed];\n", l.Digest, dep); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// WriteTree writes the description as an indented tree starting from the
+// roots. Layers that were already written are only referred to again, not
+// expanded.
+func (d *Description) WriteTree(w io.Writer) error {
+	written := make(map[digest.Digest]bool)
+	var writeLayer func(dgst digest.Digest, prefix string, depth int) error
+	writeLayer = func(dgst digest.Digest, prefix string, depth int) error {
+		indent := strings.Repeat("  ", depth)
+		l, ok := d.Layer(dgst)
+		if !ok {
+			_, err := fmt.Fprintf(w, "%s%s<missing> (%s)\n", indent, prefix, shortDigest(dgst))
+			return err
+		}
+		if written[dgst] {
+			_, err := fmt.Fprintf(w, "%s%s%s ...\n", indent, prefix, l.label())
+			return err
+		}
+		written[dgst] = true
+
+		line := indent + prefix + l.label()
+		if l.MountDir != "" {
+			line += " mount=" + l.MountDir
+		}
+		if l.OutputDir != "" {
+			line += " output=" + l.OutputDir
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+		for _, dep := range l.RunDeps {
+			if err := writeLayer(dep, "run: ", depth+1); err != nil {
+				return err
+			}
+		}
+		for _, dep := range l.BuildDeps {
+			if err := writeLayer(dep, "build: ", depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, root := range d.Roots {
+		if err := writeLayer(root, "", 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func describedByName(t *testing.T, desc *Description) map[string]LayerDescription {
+	layers := make(map[string]LayerDescription)
+	for _, l := range desc.Layers {
+		layers[l.Name] = l
+	}
+	require.Len(t, layers, len(desc.Layers))
+	return layers
+}
+
+func TestDescribe(t *testing.T) {
+	desc := Build(testSystem("make libc", true)).Describe()
+	layers := describedByName(t, desc)
+	require.Equal(t, []digest.Digest{layers["vim"].Digest}, desc.Roots)
+
+	// each layer comes after its deps
+	seen := make(map[digest.Digest]bool)
+	for _, l := range desc.Layers {
+		for _, dep := range append(l.RunDeps, l.BuildDeps...) {
+			require.True(t, seen[dep], "%s before its dep %s", l.Name, dep)
+		}
+		seen[l.Digest] = true
+	}
+
+	for _, tc := range []struct {
+		name      string
+		mountDir  string
+		runDeps   []string
+		buildDeps []string
+	}{
+		{name: "base", mountDir: "/"},
+		// run deps are also needed to build a layer
+		{name: "libc", mountDir: "/libc", runDeps: []string{"base"}, buildDeps: []string{"base"}},
+		{name: "perl", mountDir: "/perl", runDeps: []string{"libc"}, buildDeps: []string{"libc"}},
+		// the build graph is reduced, so libc is only reached through perl
+		{name: "vim", mountDir: "/vim", runDeps: []string{"libc"}, buildDeps: []string{"perl"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := layers[tc.name]
+			require.Equal(t, tc.mountDir, l.MountDir)
+			names := func(dgsts []digest.Digest) []string {
+				var names []string
+				for _, dgst := range dgsts {
+					dep, ok := desc.Layer(dgst)
+					require.True(t, ok, "missing dep %s", dgst)
+					names = append(names, dep.Name)
+				}
+				return names
+			}
+			require.Equal(t, tc.runDeps, names(l.RunDeps))
+			require.Equal(t, tc.buildDeps, names(l.BuildDeps))
+		})
+	}
+	require.True(t, desc.HasLayer("Vim"))
+	require.False(t, desc.HasLayer("gcc"))
+
+	// descriptions are passed from the definition to the client as json
+	dt, err := json.Marshal(desc)
+	require.NoError(t, err)
+	var decoded Description
+	require.NoError(t, json.Unmarshal(dt, &decoded))
+	require.Equal(t, desc, &decoded)
+}
+
+func TestDescribeOpDigest(t *testing.T) {
+	a := describedByName(t, Build(testSystem("make libc", false)).Describe())
+	b := describedByName(t, Build(testSystem("make libc V=2", false)).Describe())
+
+	// only the changed layer's own op changes, its dependents are rebuilt
+	// with the same op
+	require.NotEqual(t, a["libc"].OpDigest, b["libc"].OpDigest)
+	require.NotEqual(t, a["vim"].Digest, b["vim"].Digest)
+	require.NotEmpty(t, a["vim"].OpDigest)
+	require.Equal(t, a["vim"].OpDigest, b["vim"].OpDigest)
+}
+
+func TestDescribeEnv(t *testing.T) {
+	base := LayerSpec(Name("base"), MountDir("/"))
+	desc := Build(LayerSpec(Name("env"), Dep(base), Env("B", "2"), Env("A", "1"), BuildScript("true"))).Describe()
+	require.Equal(t, []string{"A=1", "B=2"}, describedByName(t, desc)["env"].Env)
+
+	require.Empty(t, (*Graph)(nil).Describe().Layers)
+}
+
+func TestDescriptionOutput(t *testing.T) {
+	dgst := func(name string) digest.Digest {
+		return digest.FromString(name)
+	}
+	short := func(name string) string {
+		return dgst(name).Hex()[:12]
+	}
+	desc := &Description{
+		Roots: []digest.Digest{dgst("vim")},
+		Layers: []LayerDescription{
+			{Digest: dgst("libc"), Name: "libc", MountDir: "/libc"},
+			{Digest: dgst("unnamed"), OutputDir: "/out"},
+			{Digest: dgst("perl"), Name: "perl", RunDeps: []digest.Digest{dgst("libc")}},
+			{
+				Digest:    dgst("vim"),
+				Name:      "vim",
+				RunDeps:   []digest.Digest{dgst("libc"), dgst("unnamed")},
+				BuildDeps: []digest.Digest{dgst("perl"), dgst("missing")},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name  string
+		write func(*Description, *bytes.Buffer) error
+		out   string
+	}{{
+		name: "tree",
+		write: func(d *Description, b *bytes.Buffer) error {
+			return d.WriteTree(b)
+		},
+		out: "vim (" + short("vim") + ")\n" +
+			"  run: libc (" + short("libc") + ") mount=/libc\n" +
+			"  run: <unnamed> (" + short("unnamed") + ") output=/out\n" +
+			"  build: perl (" + short("perl") + ")\n" +
+			"    run: libc (" + short("libc") + ") ...\n" +
+			"  build: <missing> (" + short("missing") + ")\n",
+	}, {
+		name: "dot",
+		write: func(d *Description, b *bytes.Buffer) error {
+			return d.WriteDot(b)
+		},
+		out: "digraph {\n" +
+			`  "` + dgst("libc").String() + `" [label="libc (` + short("libc") + `)\n/libc" shape="box"];` + "\n" +
+			`  "` + dgst("unnamed").String() + `" [label="<unnamed> (` + short("unnamed") + `)" shape="box"];` + "\n" +
+			`  "` + dgst("perl").String() + `" [label="perl (` + short("perl") + `)" shape="box"];` + "\n" +
+			`  "` + dgst("vim").String() + `" [label="vim (` + short("vim") + `)" shape="box"];` + "\n" +
+			`  "` + dgst("perl").String() + `" -> "` + dgst("libc").String() + `";` + "\n" +
+			`  "` + dgst("vim").String() + `" -> "` + dgst("libc").String() + `";` + "\n" +
+			`  "` + dgst("vim").String() + `" -> "` + dgst("unnamed").String() + `";` + "\n" +
+			`  "` + dgst("vim").String() + `" -> "` + dgst("perl").String() + `" [style=dashed];` + "\n" +
+			`  "` + dgst("vim").String() + `" -> "` + dgst("missing").String() + `" [style=dashed];` + "\n" +
+			"}\n",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			require.NoError(t, tc.write(desc, &b))
+			require.Equal(t, tc.out, b.String())
+		})
+	}
+}
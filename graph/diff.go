@@ -0,0 +1,193 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// GraphDiff is the difference between two graphs. Layers are matched by
+// name, or by their original digest when they don't have a unique name.
+type GraphDiff struct {
+	Added   []LayerDescription `json:"added,omitempty"`
+	Removed []LayerDescription `json:"removed,omitempty"`
+	// Changed are the layers that changed themselves
+	Changed []LayerChange `json:"changed,omitempty"`
+	// Invalidated are the layers that didn't change themselves but will be
+	// rebuilt anyways because something they depend on changed
+	Invalidated []LayerChange `json:"invalidated,omitempty"`
+}
+
+// LayerChange is a layer that's in both graphs with a different digest.
+type LayerChange struct {
+	// Key is what the layer was matched by
+	Key string           `json:"key"`
+	Old LayerDescription `json:"old"`
+	New LayerDescription `json:"new"`
+	// Fields are the parts of the layer that changed (op, env, args,
+	// workingDir, mountDir, outputDir, mounts, runDeps, buildDeps)
+	Fields []string `json:"fields,omitempty"`
+	// Causes are the keys of the deps whose changes invalidated the layer
+	Causes []string `json:"causes,omitempty"`
+}
+
+// Diff returns what changed going from graph a to graph b.
+func Diff(a, b *Graph) *GraphDiff {
+	return DiffDescriptions(a.Describe(), b.Describe())
+}
+
+// DiffDescriptions returns what changed going from the graph described by a
+// to the one described by b.
+func DiffDescriptions(a, b *Description) *GraphDiff {
+	aLayers := keyedLayers(a)
+	bLayers := keyedLayers(b)
+	diff := &GraphDiff{}
+
+	for _, l := range a.Layers {
+		key := aLayers.keys[l.Digest]
+		if _, ok := bLayers.byKey[key]; !ok {
+			diff.Removed = append(diff.Removed, l)
+		}
+	}
+
+	// b's layers are in topological order, so each layer's deps are always
+	// handled before it
+	dirty := make(map[digest.Digest]bool)
+	for _, l := range b.Layers {
+		key := bLayers.keys[l.Digest]
+		old, ok := aLayers.byKey[key]
+		if !ok {
+			diff.Added = append(diff.Added, l)
+			dirty[l.Digest] = true
+			continue
+		}
+		if old.Digest == l.Digest {
+			continue
+		}
+		dirty[l.Digest] = true
+
+		change := LayerChange{Key: key, Old: old, New: l}
+		if old.OpDigest != l.OpDigest {
+			change.Fields = append(change.Fields, "op")
+		}
+		for _, field := range []struct {
+			name     string
+			old, new interface{}
+		}{
+			{"env", old.Env, l.Env},
+			{"args", old.Args, l.Args},
+			{"workingDir", old.WorkingDir, l.WorkingDir},
+			{"mountDir", old.MountDir, l.MountDir},
+			{"outputDir", old.OutputDir, l.OutputDir},
+			{"mounts", old.Mounts, l.Mounts},
+			{"runDeps", aLayers.depKeys(old.RunDeps), bLayers.depKeys(l.RunDeps)},
+			{"buildDeps", aLayers.depKeys(old.BuildDeps), bLayers.depKeys(l.BuildDeps)},
+		} {
+			if !reflect.DeepEqual(field.old, field.new) {
+				change.Fields = append(change.Fields, field.name)
+			}
+		}
+
+		for _, dep := range append(append([]digest.Digest{}, l.RunDeps...), l.BuildDeps...) {
+			if dirty[dep] {
+				change.Causes = append(change.Causes, bLayers.keys[dep])
+			}
+		}
+		change.Causes = uniqueSorted(change.Causes)
+
+		if len(change.Fields) == 0 {
+			diff.Invalidated = append(diff.Invalidated, change)
+		} else {
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+	return diff
+}
+
+// Empty returns whether the graphs were the same.
+func (d *GraphDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Invalidated) == 0
+}
+
+// Write writes the diff in a format meant for humans.
+func (d *GraphDiff) Write(w io.Writer) error {
+	var lines []string
+	for _, l := range d.Added {
+		lines = append(lines, fmt.Sprintf("+ %s", l.label()))
+	}
+	for _, l := range d.Removed {
+		lines = append(lines, fmt.Sprintf("- %s", l.label()))
+	}
+	for _, c := range d.Changed {
+		lines = append(lines, fmt.Sprintf("~ %s -> %s changed: %s",
+			c.Old.label(), shortDigest(c.New.Digest), strings.Join(c.Fields, ", ")))
+	}
+	for _, c := range d.Invalidated {
+		lines = append(lines, fmt.Sprintf("! %s -> %s rebuilt because of: %s",
+			c.Old.label(), shortDigest(c.New.Digest), strings.Join(c.Causes, ", ")))
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type layerIndex struct {
+	byKey map[string]LayerDescription
+	keys  map[digest.Digest]string
+}
+
+// keyedLayers indexes the layers of desc by the key they're matched with,
+// which is their name if it's unique in desc and their original digest
+// otherwise.
+func keyedLayers(desc *Description) layerIndex {
+	nameCounts := make(map[string]int)
+	for _, l := range desc.Layers {
+		nameCounts[l.Name]++
+	}
+
+	idx := layerIndex{
+		byKey: make(map[string]LayerDescription),
+		keys:  make(map[digest.Digest]string),
+	}
+	for _, l := range desc.Layers {
+		key := l.Name
+		if key == "" || nameCounts[key] > 1 {
+			key = string(l.OrigDigest)
+			if key == "" {
+				key = string(l.Digest)
+			}
+		}
+		idx.byKey[key] = l
+		idx.keys[l.Digest] = key
+	}
+	return idx
+}
+
+func (idx layerIndex) depKeys(deps []digest.Digest) []string {
+	var keys []string
+	for _, dep := range deps {
+		keys = append(keys, idx.keys[dep])
+	}
+	return uniqueSorted(keys)
+}
+
+func uniqueSorted(strs []string) []string {
+	if len(strs) == 0 {
+		return nil
+	}
+	sort.Strings(strs)
+	unique := strs[:1]
+	for _, s := range strs[1:] {
+		if s != unique[len(unique)-1] {
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,172 @@
+package graph
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testSystem(libcScript string, withPerl bool) AsSpec {
+	base := LayerSpec(Name("base"), MountDir("/"))
+	libc := LayerSpec(Name("libc"), MountDir("/libc"), Dep(base), BuildScript(libcScript))
+	opts := []LayerSpecOpt{Name("vim"), MountDir("/vim"), Dep(libc), BuildScript("make vim")}
+	if withPerl {
+		perl := LayerSpec(Name("perl"), MountDir("/perl"), Dep(libc), BuildScript("make perl"))
+		opts = append(opts, BuildDep(perl))
+	}
+	return LayerSpec(opts...)
+}
+
+func changeKeys(changes []LayerChange) []string {
+	var keys []string
+	for _, c := range changes {
+		keys = append(keys, c.Key)
+	}
+	return keys
+}
+
+func TestDiffSame(t *testing.T) {
+	diff := Diff(Build(testSystem("make libc", false)), Build(testSystem("make libc", false)))
+	require.True(t, diff.Empty())
+}
+
+func TestDiffChangedInvalidates(t *testing.T) {
+	diff := Diff(Build(testSystem("make libc", false)), Build(testSystem("make libc V=2", false)))
+	require.Empty(t, diff.Added)
+	require.Empty(t, diff.Removed)
+
+	require.Equal(t, []string{"libc"}, changeKeys(diff.Changed))
+	require.Equal(t, []string{"op"}, diff.Changed[0].Fields)
+
+	require.Equal(t, []string{"vim"}, changeKeys(diff.Invalidated))
+	require.Empty(t, diff.Invalidated[0].Fields)
+	require.Equal(t, []string{"libc"}, diff.Invalidated[0].Causes)
+}
+
+func TestDiffAddedBuildDep(t *testing.T) {
+	diff := Diff(Build(testSystem("make libc", false)), Build(testSystem("make libc", true)))
+	require.Empty(t, diff.Removed)
+	require.Len(t, diff.Added, 1)
+	require.Equal(t, "perl", diff.Added[0].Name)
+
+	require.Equal(t, []string{"vim"}, changeKeys(diff.Changed))
+	require.Contains(t, diff.Changed[0].Fields, "buildDeps")
+	require.NotContains(t, diff.Changed[0].Fields, "runDeps")
+	require.Equal(t, []string{"perl"}, diff.Changed[0].Causes)
+
+	diff = Diff(Build(testSystem("make libc", true)), Build(testSystem("make libc", false)))
+	require.Empty(t, diff.Added)
+	require.Len(t, diff.Removed, 1)
+	require.Equal(t, "perl", diff.Removed[0].Name)
+}
+
+func TestDiffFields(t *testing.T) {
+	dgst := digest.FromString
+	libc := LayerDescription{Digest: dgst("libc"), Name: "libc", OpDigest: dgst("make libc")}
+	base := LayerDescription{
+		Digest:     dgst("vim"),
+		Name:       "vim",
+		OpDigest:   dgst("make vim"),
+		Env:        []string{"A=1"},
+		Args:       []string{"make"},
+		WorkingDir: "/src",
+		MountDir:   "/vim",
+		RunDeps:    []digest.Digest{libc.Digest},
+	}
+	for _, tc := range []struct {
+		name   string
+		change func(*LayerDescription)
+		fields []string
+	}{
+		{name: "op", change: func(l *LayerDescription) { l.OpDigest = dgst("make vim V=2") }, fields: []string{"op"}},
+		{name: "env", change: func(l *LayerDescription) { l.Env = []string{"A=2"} }, fields: []string{"env"}},
+		{name: "args", change: func(l *LayerDescription) { l.Args = []string{"make", "-j4"} }, fields: []string{"args"}},
+		{name: "working dir", change: func(l *LayerDescription) { l.WorkingDir = "/" }, fields: []string{"workingDir"}},
+		{name: "mount dir", change: func(l *LayerDescription) { l.MountDir = "/usr" }, fields: []string{"mountDir"}},
+		{name: "output dir", change: func(l *LayerDescription) { l.OutputDir = "/out" }, fields: []string{"outputDir"}},
+		{
+			name:   "mounts",
+			change: func(l *LayerDescription) { l.Mounts = []HostMount{{Source: "/a", Dest: "/a"}} },
+			fields: []string{"mounts"},
+		},
+		{
+			name:   "moved dep",
+			change: func(l *LayerDescription) { l.RunDeps, l.BuildDeps = nil, l.RunDeps },
+			fields: []string{"runDeps", "buildDeps"},
+		},
+		{
+			name: "several",
+			change: func(l *LayerDescription) {
+				l.OpDigest = dgst("make vim V=2")
+				l.Env = nil
+			},
+			fields: []string{"op", "env"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			changed := base
+			tc.change(&changed)
+			changed.Digest = dgst("vim changed")
+			diff := DiffDescriptions(
+				&Description{Layers: []LayerDescription{libc, base}},
+				&Description{Layers: []LayerDescription{libc, changed}},
+			)
+			require.Empty(t, diff.Invalidated)
+			require.Equal(t, []string{"vim"}, changeKeys(diff.Changed))
+			require.Equal(t, tc.fields, diff.Changed[0].Fields)
+			require.Empty(t, diff.Changed[0].Causes)
+		})
+	}
+}
+
+func TestDiffMatchesByOrigDigest(t *testing.T) {
+	dgst := digest.FromString
+	// layers without a unique name are matched by their original digest
+	a := &Description{Layers: []LayerDescription{
+		{Digest: dgst("a1"), OrigDigest: dgst("orig1"), Name: "src", OpDigest: dgst("op1")},
+		{Digest: dgst("a2"), OrigDigest: dgst("orig2"), Name: "src", OpDigest: dgst("op2")},
+		{Digest: dgst("a3"), OrigDigest: dgst("orig3"), OpDigest: dgst("op3")},
+	}}
+	b := &Description{Layers: []LayerDescription{
+		{Digest: dgst("a1"), OrigDigest: dgst("orig1"), Name: "src", OpDigest: dgst("op1")},
+		{Digest: dgst("b2"), OrigDigest: dgst("orig2"), Name: "src", OpDigest: dgst("op2 changed")},
+		{Digest: dgst("b4"), OrigDigest: dgst("orig4"), OpDigest: dgst("op4")},
+	}}
+	diff := DiffDescriptions(a, b)
+	require.Equal(t, []string{string(dgst("orig2"))}, changeKeys(diff.Changed))
+	require.Len(t, diff.Removed, 1)
+	require.Equal(t, dgst("a3"), diff.Removed[0].Digest)
+	require.Len(t, diff.Added, 1)
+	require.Equal(t, dgst("b4"), diff.Added[0].Digest)
+}
+
+func TestDiffWrite(t *testing.T) {
+	diff := Diff(Build(testSystem("make libc", true)), Build(testSystem("make libc V=2", false)))
+	var b bytes.Buffer
+	require.NoError(t, diff.Write(&b))
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	require.Len(t, lines, 3)
+	require.Regexp(t, `^- perl \([0-9a-f]{12}\)$`, string(lines[0]))
+	require.Regexp(t, `^~ libc \([0-9a-f]{12}\) -> [0-9a-f]{12} changed: op$`, string(lines[1]))
+	require.Regexp(t, `^~ vim \([0-9a-f]{12}\) -> [0-9a-f]{12} changed: op, buildDeps$`, string(lines[2]))
+
+	b.Reset()
+	diff = Diff(Build(testSystem("make libc", false)), Build(testSystem("make libc V=2", false)))
+	require.NoError(t, diff.Write(&b))
+	require.Regexp(t, `(?m)^! vim \([0-9a-f]{12}\) -> [0-9a-f]{12} rebuilt because of: libc$`, b.String())
+}
+
+func TestUniqueSorted(t *testing.T) {
+	for _, tc := range []struct {
+		in, out []string
+	}{
+		{in: nil, out: nil},
+		{in: []string{"b", "a"}, out: []string{"a", "b"}},
+		{in: []string{"b", "a", "b", "a", "c"}, out: []string{"a", "b", "c"}},
+	} {
+		require.Equal(t, tc.out, uniqueSorted(tc.in), "%v", tc.in)
+	}
+}
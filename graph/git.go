@@ -0,0 +1,12 @@
+package graph
+
+import (
+	"regexp"
+)
+
+var commitSHARegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// IsCommitSHA returns whether ref is a full git commit sha.
+func IsCommitSHA(ref string) bool {
+	return commitSHARegex.MatchString(ref)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -65,6 +66,7 @@ type LayerSpecOpts struct {
 	RunArgs       []string
 	RunEnv        map[string]string
 	RunWorkingDir string
+	RunMounts     []HostMount
 
 	metadata map[interface{}]interface{}
 }
@@ -118,6 +120,7 @@ func (ls *LayerSpecOpts) Build(depGraphs []*Graph) *Graph {
 		execOpts = append(execOpts, llb.WithCustomName(name))
 
 		layer.state = layer.state.Run(execOpts...).Root()
+		layer.buildDeps = mergedGraph
 	}
 
 	layer.deps = mergeGraphs(runDeps...)
@@ -125,6 +128,7 @@ func (ls *LayerSpecOpts) Build(depGraphs []*Graph) *Graph {
 	layer.args = ls.RunArgs
 	layer.env = ls.RunEnv
 	layer.cwd = ls.RunWorkingDir
+	layer.mounts = ls.RunMounts
 	layer.metadata = ls.metadata
 
 	layer.roots = []*Layer{layer}
@@ -192,32 +196,64 @@ func (ws *wrap) Metadata(interface{}) interface{} {
 	return nil
 }
 
-// TODO need to support multiple replacements in a single spec,
-// otherwise you can get unexpected results when chaining replaces.
-// i.e. you start with A->B->C->D and then do a replace of D with nil
-// that results in A'->B'->C', but then you do another replace of B
-// with C, which right now results in A'->C->D instead of the expected
-// A'->C'
+// replace rewrites the graph of spec with every layer of each replacee
+// replaced by its replacer, in a single pass so that the replacements are
+// consistent with each other. i.e. starting with A->B->C->D, replacing D with
+// nil and B with C results in A'->C' rather than A'->C->D. Replacers have
+// the other replacements applied to them too, but not their own, so a
+// replacer can depend on what it replaces.
 type replace struct {
-	spec     AsSpec
-	replacee AsSpec
-	replacer AsSpec
+	spec      AsSpec
+	replacees []AsSpec
+	replacers []AsSpec
 }
 
 func (r *replace) Deps() []AsSpec {
-	return []AsSpec{r.spec, r.replacee, r.replacer}
+	deps := []AsSpec{r.spec}
+	deps = append(deps, r.replacees...)
+	deps = append(deps, r.replacers...)
+	return deps
 }
 
 func (r *replace) Build(depGraphs []*Graph) *Graph {
-	g := depGraphs[0]
-	replacee := depGraphs[1]
-	replacer := depGraphs[2]
+	replaceeGraphs := depGraphs[1 : 1+len(r.replacees)]
+	rw := &replacement{
+		replacees: make(map[digest.Digest]int),
+		replacers: depGraphs[1+len(r.replacees):],
+		rewritten: make(map[string]*Graph),
+		active:    make(map[int]bool),
+	}
+	for i, replacee := range replaceeGraphs {
+		if replacee == nil {
+			continue
+		}
+		rw.replacees[replacee.digest] = i
+	}
+	return rw.rewrite(depGraphs[0])
+}
+
+// replacement holds the state of rewriting a graph for a replace.
+type replacement struct {
+	// replacee digest -> index of its replacer
+	replacees map[digest.Digest]int
+	replacers []*Graph
+	// rewrittenKey -> replacer with the other replacements applied
+	rewritten map[string]*Graph
+	// replacers currently being rewritten, which aren't replaced inside
+	// themselves
+	active map[int]bool
+}
+
+func (rw *replacement) rewrite(g *Graph) *Graph {
+	if g == nil {
+		return nil
+	}
 
 	// old layer digest -> *Graph replacing it
 	oldToNew := make(map[digest.Digest]*Graph)
 	g.bottomUpWalk(func(l *Layer) {
-		if l.digest == replacee.digest || l.origDigest == replacee.digest {
-			oldToNew[l.digest] = replacer
+		if i, ok := rw.replacerOf(l); ok {
+			oldToNew[l.digest] = rw.replacer(i)
 			return
 		}
 
@@ -245,6 +281,40 @@ func (r *replace) Build(depGraphs []*Graph) *Graph {
 	return mergeGraphs(finalGraphs...)
 }
 
+// replacerOf returns the index of the replacer of l, if it's a replacee.
+func (rw *replacement) replacerOf(l *Layer) (int, bool) {
+	for _, dgst := range []digest.Digest{l.digest, l.origDigest} {
+		if i, ok := rw.replacees[dgst]; ok && !rw.active[i] {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (rw *replacement) replacer(i int) *Graph {
+	key := rw.rewrittenKey(i)
+	if g, ok := rw.rewritten[key]; ok {
+		return g
+	}
+	rw.active[i] = true
+	g := rw.rewrite(rw.replacers[i])
+	delete(rw.active, i)
+	rw.rewritten[key] = g
+	return g
+}
+
+// rewrittenKey identifies replacer i rewritten while the currently active
+// replacers are, which aren't replaced inside it, so it's only reused when
+// the same ones are active again.
+func (rw *replacement) rewrittenKey(i int) string {
+	var active []int
+	for j := range rw.active {
+		active = append(active, j)
+	}
+	sort.Ints(active)
+	return fmt.Sprint(i, active)
+}
+
 func (r *replace) Metadata(interface{}) interface{} {
 	return nil
 }
@@ -424,6 +494,10 @@ type Layer struct {
 	args      []string
 	env       map[string]string
 	cwd       string
+	mounts    []HostMount
+	// buildDeps are only recorded for describing the graph, they're already
+	// part of state (and thus the digest) as mounts of its exec
+	buildDeps *Graph
 
 	// metadata is not included in digest
 	metadata map[interface{}]interface{}
@@ -437,6 +511,7 @@ type Layer struct {
 
 func (l Layer) clone() *Layer {
 	l.args = append([]string{}, l.args...)
+	l.mounts = append([]HostMount{}, l.mounts...)
 
 	origEnv := l.env
 	l.env = make(map[string]string)
@@ -526,6 +601,7 @@ func (g *Graph) calcDigest() digest.Digest {
 		Args      []string
 		Env       []kvpair
 		Cwd       string
+		Mounts    []HostMount `json:",omitempty"`
 		LLBDigest string
 		DepDigest string
 	}
@@ -539,6 +615,7 @@ func (g *Graph) calcDigest() digest.Digest {
 			Args:      l.args,
 			Env:       l.mergedEnv(),
 			Cwd:       filepath.Clean(l.cwd),
+			Mounts:    l.mounts,
 		}
 
 		if l.deps != nil {
@@ -0,0 +1,281 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// LockFileName is the name of the lock file kept next to a definition.
+const LockFileName = "bincastle.lock"
+
+// LockFileEnv is set to the path of the definition's lock file when running
+// a definition. The file doesn't exist if the definition has no lock.
+const LockFileEnv = "BINCASTLE_LOCK_FILE"
+
+// Lock pins the sources a definition uses to exact versions, so evaluating
+// it again results in the same system.
+type Lock struct {
+	// Images maps image refs to the digest they resolved to.
+	Images map[string]digest.Digest `json:"images,omitempty"`
+	// Git maps "<url>#<ref>" to the commit the ref resolved to.
+	Git map[string]string `json:"git,omitempty"`
+	// Downloads maps urls to the checksum of what was downloaded from them.
+	Downloads map[string]digest.Digest `json:"downloads,omitempty"`
+}
+
+func NewLock() *Lock {
+	return &Lock{
+		Images:    make(map[string]digest.Digest),
+		Git:       make(map[string]string),
+		Downloads: make(map[string]digest.Digest),
+	}
+}
+
+// ReadLock reads the lock file at path, returning nil if there is none.
+func ReadLock(path string) (*Lock, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock file: %w", err)
+	}
+	lock := NewLock()
+	if err := json.Unmarshal(bytes, lock); err != nil {
+		return nil, fmt.Errorf("invalid lock file %s: %w", path, err)
+	}
+	return lock, nil
+}
+
+// Write writes the lock to path with its entries sorted, so changes to it
+// diff cleanly.
+func (l *Lock) Write(path string) error {
+	bytes, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock: %w", err)
+	}
+	if err := ioutil.WriteFile(path, append(bytes, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+	return nil
+}
+
+// LockKind is the kind of source a Lock entry pins.
+type LockKind string
+
+const (
+	LockImage    LockKind = "image"
+	LockGit      LockKind = "git"
+	LockDownload LockKind = "download"
+)
+
+// Lockable is a source that can change underneath the definition using it
+// unless a Lock pins it.
+type Lockable interface {
+	AsSpec
+	// LockKey returns the kind of the source and its key in a Lock. ok is
+	// false if the definition already pins the source itself.
+	LockKey() (kind LockKind, key string, ok bool)
+	// Locked returns the source pinned to version, its entry in a Lock.
+	Locked(version string) AsSpec
+}
+
+// GitLockKey is the key of ref of the git repo at url in a Lock.
+func GitLockKey(url, ref string) string {
+	return url + "#" + ref
+}
+
+func (l *Lock) get(kind LockKind, key string) (string, bool) {
+	switch kind {
+	case LockImage:
+		dgst, ok := l.Images[key]
+		return string(dgst), ok
+	case LockGit:
+		commit, ok := l.Git[key]
+		return commit, ok
+	case LockDownload:
+		dgst, ok := l.Downloads[key]
+		return string(dgst), ok
+	}
+	return "", false
+}
+
+func (l *Lock) set(kind LockKind, key string, version string) {
+	switch kind {
+	case LockImage:
+		l.Images[key] = digest.Digest(version)
+	case LockGit:
+		l.Git[key] = version
+	case LockDownload:
+		l.Downloads[key] = digest.Digest(version)
+	default:
+		panic(fmt.Sprintf("invalid lock kind %q", kind))
+	}
+}
+
+// entries returns the versions in the lock by "<kind> <key>".
+func (l *Lock) entries() map[string]string {
+	entries := make(map[string]string)
+	for k, v := range l.Images {
+		entries[string(LockImage)+" "+k] = string(v)
+	}
+	for k, v := range l.Git {
+		entries[string(LockGit)+" "+k] = v
+	}
+	for k, v := range l.Downloads {
+		entries[string(LockDownload)+" "+k] = string(v)
+	}
+	return entries
+}
+
+// lockables calls f with each source of asSpec that can be locked. Sources
+// replaced by an override are included, they're still part of the definition
+// once the override is removed.
+func lockables(asSpec AsSpec, f func(l Lockable, kind LockKind, key string)) {
+	cache := make(map[AsSpec]Spec)
+	walk([]interface{}{asSpec},
+		func(vtx interface{}) interface{} {
+			return vtx
+		},
+		func(vtx interface{}) []interface{} {
+			var deps []interface{}
+			if vtx == nil {
+				return deps
+			}
+			asSpec := vtx.(AsSpec)
+			spec := cache[asSpec]
+			if spec == nil {
+				spec = asSpec.Spec()
+				cache[asSpec] = spec
+			}
+			if bs, ok := spec.(BuildableSpec); ok {
+				if o, ok := bs.Buildable.(*override); ok {
+					deps = append(deps, o.spec)
+				}
+			}
+			for _, dep := range spec.Deps() {
+				deps = append(deps, dep)
+			}
+			return deps
+		},
+		func(vtx interface{}) error {
+			l, ok := vtx.(Lockable)
+			if !ok {
+				return nil
+			}
+			if kind, key, ok := l.LockKey(); ok {
+				f(l, kind, key)
+			}
+			return nil
+		},
+	)
+}
+
+// UsedLock returns the lock of the sources asSpec uses, pinned to their
+// versions in lock (which may be nil). Sources lock doesn't pin have empty
+// versions, resolving them is left to the daemon.
+func UsedLock(asSpec AsSpec, lock *Lock) *Lock {
+	used := NewLock()
+	lockables(asSpec, func(_ Lockable, kind LockKind, key string) {
+		var version string
+		if lock != nil {
+			version, _ = lock.get(kind, key)
+		}
+		used.set(kind, key, version)
+	})
+	return used
+}
+
+// Locked pins the sources of the spec to their versions in lock, which may
+// be nil. Sources lock doesn't pin are left as they are.
+func Locked(lock *Lock) SpecOpt {
+	cache := make(map[AsSpec]Spec)
+	return SpecOptFunc(func(s AsSpec) AsSpec {
+		if lock == nil {
+			return s
+		}
+		var opts []SpecOpt
+		lockables(s, func(l Lockable, kind LockKind, key string) {
+			if version, ok := lock.get(kind, key); ok && version != "" {
+				opts = append(opts, overridden(l, l.Locked(version), cache))
+			}
+		})
+		return s.Spec().With(opts...)
+	})
+}
+
+// LockDiff lists the entries that differ between two locks as
+// "<kind> <key>".
+type LockDiff struct {
+	Added   []string
+	Changed []string
+	Removed []string
+}
+
+// DiffLocks returns how newer differs from older, which may be nil.
+func DiffLocks(older, newer *Lock) LockDiff {
+	if older == nil {
+		older = NewLock()
+	}
+	oldEntries := older.entries()
+	newEntries := newer.entries()
+	var diff LockDiff
+	for k, v := range newEntries {
+		oldV, ok := oldEntries[k]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, k)
+		case oldV != v:
+			diff.Changed = append(diff.Changed, fmt.Sprintf("%s: %s -> %s", k, oldV, v))
+		}
+	}
+	for k := range oldEntries {
+		if _, ok := newEntries[k]; !ok {
+			diff.Removed = append(diff.Removed, k)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Changed)
+	sort.Strings(diff.Removed)
+	return diff
+}
+
+func (d LockDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+func (d LockDiff) String() string {
+	var lines []string
+	for _, section := range []struct {
+		name    string
+		entries []string
+	}{
+		{"added", d.Added},
+		{"changed", d.Changed},
+		{"removed", d.Removed},
+	} {
+		for _, entry := range section.entries {
+			lines = append(lines, section.name+" "+entry)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// LockDrift returns an error if the sources used by the definition, as
+// returned by UsedLock, don't match its lock. Sources missing from the
+// lock, ones pinned to another version and stale entries of sources the
+// definition no longer uses are all reported.
+func LockDrift(lock *Lock, used *Lock) error {
+	diff := DiffLocks(lock, used)
+	if diff.Empty() {
+		return nil
+	}
+	return fmt.Errorf("%s is out of date, run bincastle lock (or pass --update) to fix:\n  %s",
+		LockFileName, strings.ReplaceAll(diff.String(), "\n", "\n  "))
+}
@@ -0,0 +1,125 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockReadWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bincastle-lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, LockFileName)
+
+	lock, err := ReadLock(path)
+	require.NoError(t, err)
+	require.Nil(t, lock)
+
+	lock = NewLock()
+	lock.Images["docker.io/library/busybox:latest"] = digest.FromString("busybox")
+	lock.Git["https://example.com/repo.git#master"] = "0123456789abcdef0123456789abcdef01234567"
+	lock.Downloads["https://example.com/src.tar.gz"] = digest.FromString("src")
+	require.NoError(t, lock.Write(path))
+
+	read, err := ReadLock(path)
+	require.NoError(t, err)
+	require.Equal(t, lock, read)
+}
+
+// lockedImages returns a spec using the images with the given refs.
+func lockedImages(refs ...string) AsSpec {
+	var opts []LayerSpecOpt
+	for _, ref := range refs {
+		opts = append(opts, Dep(Wrap(Image{Ref: ref}, MountDir("/"+ref))))
+	}
+	return LayerSpec(opts...)
+}
+
+func TestUsedLock(t *testing.T) {
+	busybox := digest.FromString("busybox")
+	lock := NewLock()
+	lock.Images["busybox"] = busybox
+	pinned := "alpine@" + digest.FromString("alpine").String()
+	spec := lockedImages("busybox", "ubuntu", pinned)
+
+	// images with a digest are already pinned
+	require.Equal(t, map[string]digest.Digest{
+		"busybox": busybox,
+		"ubuntu":  "",
+	}, UsedLock(spec, lock).Images)
+	require.Equal(t, map[string]digest.Digest{
+		"busybox": "",
+		"ubuntu":  "",
+	}, UsedLock(spec, nil).Images)
+}
+
+func TestUsedLockOverridden(t *testing.T) {
+	spec := LayerSpec(Dep(Wrap(LayerSpec(
+		Name("busybox-layer"),
+		Dep(Image{Ref: "busybox"}),
+	), MountDir("/busybox"))))
+
+	// overriding a layer doesn't make the lock entries of its sources stale
+	overridden := LocalOverrides(map[string]string{"busybox-layer": "/src/busybox"}).ApplyToSpec(spec)
+	require.Equal(t, []string{"/src/busybox"}, localSources(t, Build(overridden)))
+	require.Equal(t, UsedLock(spec, nil), UsedLock(overridden, nil))
+}
+
+func TestLocked(t *testing.T) {
+	busybox := digest.FromString("busybox")
+	lock := NewLock()
+	lock.Images["busybox"] = busybox
+	spec := lockedImages("busybox", "ubuntu")
+
+	g := Build(Locked(lock).ApplyToSpec(spec))
+	require.Equal(t, []string{
+		"docker.io/library/busybox@" + busybox.String(),
+		"docker.io/library/ubuntu:latest",
+	}, sources(t, g, "docker-image://"))
+	// the locked image keeps the options it was wrapped with
+	var mountDirs []string
+	require.NoError(t, g.walk(func(l *Layer) error {
+		if l.mountDir != "" {
+			mountDirs = append(mountDirs, l.mountDir)
+		}
+		return nil
+	}))
+	require.ElementsMatch(t, []string{"/busybox", "/ubuntu"}, mountDirs)
+
+	require.Equal(t, Build(spec).digest, Build(Locked(nil).ApplyToSpec(spec)).digest)
+}
+
+func TestLockDrift(t *testing.T) {
+	lock := NewLock()
+	lock.Images["busybox"] = digest.FromString("busybox")
+	lock.Images["stale"] = digest.FromString("stale")
+	lock.Git["https://example.com/repo.git#main"] = ""
+
+	used := NewLock()
+	used.Images["busybox"] = lock.Images["busybox"]
+	used.Images["ubuntu"] = ""
+	used.Git["https://example.com/repo.git#main"] = "0123456789abcdef0123456789abcdef01234567"
+
+	err := LockDrift(lock, used)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "added image ubuntu")
+	require.Contains(t, err.Error(), "changed git https://example.com/repo.git#main:  -> 0123456789abcdef0123456789abcdef01234567")
+	require.Contains(t, err.Error(), "removed image stale")
+	require.NotContains(t, err.Error(), "busybox")
+
+	require.NoError(t, LockDrift(lock, lock))
+}
+
+func TestDiffLocks(t *testing.T) {
+	newer := NewLock()
+	newer.Downloads["https://example.com/src.tar.gz"] = digest.FromString("src")
+	require.Equal(t, LockDiff{
+		Added: []string{"download https://example.com/src.tar.gz"},
+	}, DiffLocks(nil, newer))
+	require.True(t, DiffLocks(newer, newer).Empty())
+}
@@ -19,6 +19,8 @@ type MarshalLayer struct {
 	Env        []string `json:"Env"`
 	Args       []string `json:"Args"`
 	WorkingDir string   `json:"WorkingDir"`
+	// Mounts are bind mounts from the host the layer needs when run
+	Mounts []HostMount `json:"Mounts,omitempty"`
 
 	layerDigest digest.Digest `json:"-"`
 }
@@ -51,6 +53,7 @@ func (g *Graph) MarshalLayers(ctx context.Context, co ...llb.ConstraintsOpt) ([]
 			LLB:         bytes,
 			MountDir:    layer.mountDir,
 			OutputDir:   layer.outputDir,
+			Mounts:      layer.mounts,
 			layerDigest: layer.digest,
 		}
 		// TODO a lil silly...
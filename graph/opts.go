@@ -1,6 +1,7 @@
 package graph
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,6 +13,35 @@ import (
 
 const EnvOverridesPrefix = "BINCASTLE_OVERRIDE_"
 
+// OverridesEnv is set to a json list of NamedOverrides when running a
+// definition. Unlike with the EnvOverridesPrefix env vars, every layer named
+// there must exist.
+const OverridesEnv = "BINCASTLE_OVERRIDES"
+
+// NamedOverride replaces the layer named Layer with the local dir at Path.
+type NamedOverride struct {
+	Layer string `json:"layer"`
+	Path  string `json:"path"`
+	// Optional overrides are skipped when there's no layer named Layer
+	Optional bool `json:"optional,omitempty"`
+}
+
+// DefaultSysrootImage is the image definitions are bootstrapped from unless
+// SysrootImageEnv says otherwise.
+const DefaultSysrootImage = "docker.io/eriksipsma/bincastle-sysroot:latest"
+
+// SysrootImageEnv is set to the ref of the sysroot image when running a
+// definition.
+const SysrootImageEnv = "BINCASTLE_SYSROOT_IMAGE"
+
+// SysrootImage returns the ref of the image definitions are bootstrapped from.
+func SysrootImage() string {
+	if ref := os.Getenv(SysrootImageEnv); ref != "" {
+		return ref
+	}
+	return DefaultSysrootImage
+}
+
 type SpecOptFunc func(AsSpec) AsSpec
 
 func (f SpecOptFunc) ApplyToSpec(s AsSpec) AsSpec {
@@ -42,11 +72,36 @@ func Replace(asSpec AsSpec, replacee AsSpec, replacer AsSpec) AsSpec {
 }
 
 func Replaced(replacee AsSpec, replacer AsSpec) SpecOpt {
+	return ReplacedAll([]Replacement{{Replacee: replacee, Replacer: replacer}})
+}
+
+// Replacement replaces Replacee with Replacer, which may be nil to remove
+// the replacee.
+type Replacement struct {
+	Replacee AsSpec
+	Replacer AsSpec
+}
+
+// ReplaceAll is like Replace for each of replacements.
+func ReplaceAll(asSpec AsSpec, replacements []Replacement) AsSpec {
+	return ReplacedAll(replacements).ApplyToSpec(asSpec)
+}
+
+// ReplacedAll applies replacements in a single pass, unlike chaining
+// Replaced, so the replacers have the other replacements applied too. The
+// result doesn't depend on their order, except that a later replacement of
+// the same replacee wins.
+func ReplacedAll(replacements []Replacement) SpecOpt {
+	var replacees, replacers []AsSpec
+	for _, r := range replacements {
+		replacees = append(replacees, r.Replacee)
+		replacers = append(replacers, r.Replacer)
+	}
 	return SpecOptFunc(func(s AsSpec) AsSpec {
 		return BuildableSpec{&replace{
-			spec:     s,
-			replacee: replacee,
-			replacer: replacer,
+			spec:      s,
+			replacees: replacees,
+			replacers: replacers,
 		}}
 	})
 }
@@ -74,6 +129,12 @@ func canonName(name string) string {
 	return strings.ReplaceAll(strings.ToLower(name), "-", "_")
 }
 
+// LayerNamesMatch returns whether two names refer to the same layer, which
+// is how overrides find the layer they replace.
+func LayerNamesMatch(a, b string) bool {
+	return canonName(a) == canonName(b)
+}
+
 func findByName(s AsSpec, name string, cache map[AsSpec]Spec) AsSpec {
 	var found AsSpec
 	walkSpecs(s, cache, func(asSpec AsSpec) error {
@@ -125,7 +186,24 @@ func (EnvOverrides) ApplyToSpec(s AsSpec) AsSpec {
 		}
 		name := strings.SplitN(k, EnvOverridesPrefix, 2)[1]
 		if name != "" {
-			overrides[name] = v
+			overrides[canonName(name)] = v
+		}
+	}
+
+	if v := os.Getenv(OverridesEnv); v != "" {
+		var structured []NamedOverride
+		if err := json.Unmarshal([]byte(v), &structured); err != nil {
+			panic(fmt.Sprintf("invalid %s: %v", OverridesEnv, err))
+		}
+		cache := make(map[AsSpec]Spec)
+		for _, o := range structured {
+			if findByName(s, o.Layer, cache) == nil {
+				if o.Optional {
+					continue
+				}
+				panic(fmt.Sprintf("cannot override %s, no layer has that name", o.Layer))
+			}
+			overrides[canonName(o.Layer)] = o.Path
 		}
 	}
 	return LocalOverrides(overrides).ApplyToSpec(s)
@@ -227,6 +305,15 @@ func (i Image) Spec() Spec {
 	}}
 }
 
+// LockKey is the image's ref, unless it already has a digest.
+func (i Image) LockKey() (LockKind, string, bool) {
+	return LockImage, i.Ref, !strings.Contains(i.Ref, "@")
+}
+
+func (i Image) Locked(dgst string) AsSpec {
+	return Image{Ref: i.Ref + "@" + dgst}
+}
+
 type Local struct {
 	Path string
 	IsOverride bool
@@ -324,6 +411,61 @@ func (alwaysRun AlwaysRun) ApplyToLayerSpecOpts(ls LayerSpecOpts) LayerSpecOpts
 	return ls
 }
 
+const (
+	// SSHForwardID is the id of the ssh agent a client must forward for
+	// layers that use ForwardSSH.
+	SSHForwardID = "default"
+
+	sshAgentSockPath = "/run/ssh-agent.sock"
+)
+
+// ForwardSSH gives the layer's build access to the ssh agent forwarded by
+// the client. Layers without it never have access to an agent.
+type ForwardSSH bool
+
+func (forwardSSH ForwardSSH) ApplyToLayerSpecOpts(ls LayerSpecOpts) LayerSpecOpts {
+	if forwardSSH {
+		ls.BuildExecOpts = append(ls.BuildExecOpts,
+			llb.AddSSHSocket(llb.SSHID(SSHForwardID), llb.SSHSocketTarget(sshAgentSockPath)),
+			llb.AddEnv("SSH_AUTH_SOCK", sshAgentSockPath),
+		)
+	}
+	return ls
+}
+
+// NetworkAccess gives the layer's build access to the host's network even
+// when the daemon is hermetic, i.e. for layers that fetch sources. In hermetic
+// mode, the builds of other layers only have loopback.
+type NetworkAccess bool
+
+func (networkAccess NetworkAccess) ApplyToLayerSpecOpts(ls LayerSpecOpts) LayerSpecOpts {
+	if networkAccess {
+		ls.BuildExecOpts = append(ls.BuildExecOpts, llb.Network(llb.NetModeHost))
+	}
+	return ls
+}
+
+// HostMount is a path from the host that's bind mounted into the system when
+// it's run. Build steps never have access to it.
+type HostMount struct {
+	Source   string `json:"source"`
+	Dest     string `json:"dest"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+// RunMount bind mounts source, an absolute path on the host, at dest when the
+// system is run.
+func RunMount(source, dest string, readonly bool) LayerSpecOpt {
+	return LayerSpecOptFunc(func(ls LayerSpecOpts) LayerSpecOpts {
+		ls.RunMounts = append(ls.RunMounts, HostMount{
+			Source:   source,
+			Dest:     dest,
+			Readonly: readonly,
+		})
+		return ls
+	})
+}
+
 // GraphOpt for updating layer state that is not deps
 func simpleTransform(f func(Layer) Layer) GraphOpt {
 	return GraphOptFunc(func(g *Graph) *Graph {
@@ -0,0 +1,54 @@
+package graph
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/stretchr/testify/require"
+)
+
+// execNetModes returns the network mode of each exec op in the layers of
+// spec, keyed by the exec's args.
+func execNetModes(t *testing.T, spec AsSpec) map[string]pb.NetMode {
+	layers, err := Build(spec).MarshalLayers(context.TODO(), llb.LinuxAmd64)
+	require.NoError(t, err)
+	netModes := make(map[string]pb.NetMode)
+	for _, layer := range layers {
+		def := &pb.Definition{}
+		require.NoError(t, def.Unmarshal(layer.LLB))
+		for _, dt := range def.Def {
+			op := &pb.Op{}
+			require.NoError(t, op.Unmarshal(dt))
+			if exec := op.GetExec(); exec != nil {
+				netModes[strings.Join(exec.Meta.Args, " ")] = exec.Network
+			}
+		}
+	}
+	return netModes
+}
+
+func TestNetworkAccess(t *testing.T) {
+	base := LayerSpec(Name("base"), MountDir("/"))
+	src := LayerSpec(Name("src"), Dep(base), NetworkAccess(true), BuildScript("git clone"))
+	spec := LayerSpec(Name("app"), Dep(base), BuildDep(src), NetworkAccess(false), BuildScript("make"))
+
+	netModes := execNetModes(t, spec)
+	// only the layer that opts in has access to the host's network, the
+	// daemon decides what the others get
+	var sawSrc, sawApp bool
+	for args, netMode := range netModes {
+		switch {
+		case strings.Contains(args, "git clone"):
+			require.Equal(t, pb.NetMode_HOST, netMode)
+			sawSrc = true
+		case strings.Contains(args, "make"):
+			require.Equal(t, pb.NetMode_UNSET, netMode)
+			sawApp = true
+		}
+	}
+	require.True(t, sawSrc)
+	require.True(t, sawApp)
+}
@@ -0,0 +1,71 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/stretchr/testify/require"
+)
+
+// localSources returns the paths of the local sources used by g's layers.
+func localSources(t *testing.T, g *Graph) []string {
+	return sources(t, g, "local://")
+}
+
+// sources returns the identifiers of g's source ops with the given prefix,
+// without it.
+func sources(t *testing.T, g *Graph, prefix string) []string {
+	paths := make(map[string]struct{})
+	require.NoError(t, g.walk(func(l *Layer) error {
+		def, err := l.state.Marshal(context.TODO(), llb.LocalUniqueID("bincastle"))
+		require.NoError(t, err)
+		for _, dt := range def.Def {
+			var op pb.Op
+			require.NoError(t, (&op).Unmarshal(dt))
+			if src := op.GetSource(); src != nil && strings.HasPrefix(src.Identifier, prefix) {
+				paths[strings.TrimPrefix(src.Identifier, prefix)] = struct{}{}
+			}
+		}
+		return nil
+	}))
+	var sorted []string
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func TestEnvOverrides(t *testing.T) {
+	specs := chainSpecs("A", "Some-Lib", "C")
+
+	// paths with ":" can't be given in the colon separated form, which is
+	// what the structured list is for
+	overrides, err := json.Marshal([]NamedOverride{
+		{Layer: "some_lib", Path: "/src/some:lib"},
+		{Layer: "missing", Path: "/src/missing", Optional: true},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.Setenv(OverridesEnv, string(overrides)))
+	defer os.Unsetenv(OverridesEnv)
+
+	g := Build(EnvOverrides{}.ApplyToSpec(specs["A"]))
+	require.Equal(t, []string{"/src/some:lib"}, localSources(t, g))
+
+	overrides, err = json.Marshal([]NamedOverride{{Layer: "missing", Path: "/src/missing"}})
+	require.NoError(t, err)
+	require.NoError(t, os.Setenv(OverridesEnv, string(overrides)))
+	require.Panics(t, func() { EnvOverrides{}.ApplyToSpec(specs["A"]) })
+}
+
+func TestLayerNamesMatch(t *testing.T) {
+	require.True(t, LayerNamesMatch("Some-Lib", "some_lib"))
+	require.True(t, LayerNamesMatch("some_lib", "some_lib"))
+	require.False(t, LayerNamesMatch("some-lib", "somelib"))
+}
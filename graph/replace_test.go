@@ -0,0 +1,133 @@
+package graph
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+// chainSpecs returns layers named after names where each one has the next as
+// its only dep, i.e. A->B->C->D.
+func chainSpecs(names ...string) map[string]AsSpec {
+	specs := make(map[string]AsSpec)
+	var dep AsSpec
+	for i := len(names) - 1; i >= 0; i-- {
+		opts := []LayerSpecOpt{Name(names[i]), MountDir("/" + names[i])}
+		if dep != nil {
+			opts = append(opts, Dep(dep))
+		}
+		dep = LayerSpec(opts...)
+		specs[names[i]] = dep
+	}
+	return specs
+}
+
+// depChain follows the run deps of g's only root, returning the names of
+// the layers along the way.
+func depChain(t *testing.T, g *Graph) []string {
+	desc := g.Describe()
+	require.Len(t, desc.Roots, 1)
+	var names []string
+	for dgst := desc.Roots[0]; ; {
+		l, ok := desc.Layer(dgst)
+		require.True(t, ok)
+		names = append(names, l.Name)
+		if len(l.RunDeps) == 0 {
+			return names
+		}
+		require.Len(t, l.RunDeps, 1)
+		dgst = l.RunDeps[0]
+	}
+}
+
+// depTree returns the names of the layers of g as a tree of their run deps,
+// i.e. A(B(D),C).
+func depTree(t *testing.T, g *Graph) string {
+	desc := g.Describe()
+	var tree func(dgsts []digest.Digest) string
+	tree = func(dgsts []digest.Digest) string {
+		var names []string
+		for _, dgst := range dgsts {
+			l, ok := desc.Layer(dgst)
+			require.True(t, ok)
+			name := l.Name
+			if len(l.RunDeps) > 0 {
+				name += "(" + tree(l.RunDeps) + ")"
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	return tree(desc.Roots)
+}
+
+func TestReplaced(t *testing.T) {
+	specs := chainSpecs("A", "B", "C", "D")
+
+	g := Build(Replace(specs["A"], specs["D"], nil))
+	require.Equal(t, []string{"A", "B", "C"}, depChain(t, g))
+
+	g = Build(Replace(specs["A"], specs["C"], LayerSpec(Name("E"), MountDir("/E"))))
+	require.Equal(t, []string{"A", "B", "E"}, depChain(t, g))
+}
+
+func TestReplacedAll(t *testing.T) {
+	specs := chainSpecs("A", "B", "C", "D")
+
+	// chaining gives A'->C->D, as the second replace doesn't know D was
+	// removed from C by the first one
+	chained := Build(specs["A"].Spec().With(
+		Replaced(specs["D"], nil),
+		Replaced(specs["B"], specs["C"]),
+	))
+	require.Equal(t, []string{"A", "C", "D"}, depChain(t, chained))
+
+	g := Build(ReplaceAll(specs["A"], []Replacement{
+		{Replacee: specs["D"]},
+		{Replacee: specs["B"], Replacer: specs["C"]},
+	}))
+	require.Equal(t, []string{"A", "C"}, depChain(t, g))
+	require.Equal(t, Build(Replace(specs["A"], specs["B"], Replace(specs["C"], specs["D"], nil))).digest, g.digest)
+}
+
+func TestReplacedAllReplacerDependsOnReplacee(t *testing.T) {
+	specs := chainSpecs("A", "B", "C")
+	wrapper := LayerSpec(Name("W"), MountDir("/W"), Dep(specs["B"]))
+
+	// the replacer keeps its dep on what it replaces, which still has the
+	// other replacements applied
+	g := Build(ReplaceAll(specs["A"], []Replacement{
+		{Replacee: specs["B"], Replacer: wrapper},
+		{Replacee: specs["C"]},
+	}))
+	require.Equal(t, []string{"A", "W", "B"}, depChain(t, g))
+}
+
+func TestReplacedAllOrder(t *testing.T) {
+	layer := func(name string, deps ...AsSpec) AsSpec {
+		opts := []LayerSpecOpt{Name(name), MountDir("/" + name)}
+		for _, dep := range deps {
+			opts = append(opts, Dep(dep))
+		}
+		return LayerSpec(opts...)
+	}
+	x, z := layer("X"), layer("Z")
+	y, w := layer("Y", z), layer("W", x)
+	a := layer("A", x, z)
+
+	// each replacer is the other's replacee, which isn't replaced inside
+	// the replacer it's being replaced with
+	replacements := []Replacement{
+		{Replacee: x, Replacer: y},
+		{Replacee: z, Replacer: w},
+	}
+	g := Build(ReplaceAll(a, replacements))
+	require.Equal(t, "A(W(Y(Z)),Y(W(X)))", depTree(t, g))
+
+	reversed := []Replacement{replacements[1], replacements[0]}
+	require.Equal(t, g.digest, Build(ReplaceAll(a, reversed)).digest)
+}
@@ -0,0 +1,200 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// PathStep is a layer in a dependency path along with how the next layer in
+// the path is a dep of it.
+type PathStep struct {
+	Layer LayerDescription `json:"layer"`
+	Run   bool             `json:"run,omitempty"`
+	Build bool             `json:"build,omitempty"`
+}
+
+// DepPath is a chain of deps, each layer depends on the one after it.
+type DepPath []PathStep
+
+func (p DepPath) String() string {
+	var b strings.Builder
+	for i, step := range p {
+		b.WriteString(step.Layer.label())
+		if i == len(p)-1 {
+			break
+		}
+		var kinds []string
+		if step.Run {
+			kinds = append(kinds, "run")
+		}
+		if step.Build {
+			kinds = append(kinds, "build")
+		}
+		fmt.Fprintf(&b, " -(%s)-> ", strings.Join(kinds, ","))
+	}
+	return b.String()
+}
+
+// DepPaths returns every path of run and build deps from the layers matching
+// from to the layers matching to. Layers are matched by name or digest.
+func (g *Graph) DepPaths(from, to string) ([]DepPath, error) {
+	return g.Describe().DepPaths(from, to)
+}
+
+// Dependents returns every layer that depends on the layers matching name,
+// directly or transitively through run or build deps.
+func (g *Graph) Dependents(name string) ([]LayerDescription, error) {
+	return g.Describe().Dependents(name)
+}
+
+// DepPaths returns every path of run and build deps from the layers matching
+// from to the layers matching to. Layers are matched by name or digest.
+func (d *Description) DepPaths(from, to string) ([]DepPath, error) {
+	froms, err := d.match(from)
+	if err != nil {
+		return nil, err
+	}
+	tos, err := d.match(to)
+	if err != nil {
+		return nil, err
+	}
+	isTo := make(map[digest.Digest]bool)
+	for _, l := range tos {
+		isTo[l.Digest] = true
+	}
+
+	// layers are in topological order, so the layers that can reach a target
+	// are all known by the time a layer is checked
+	reaches := make(map[digest.Digest]bool)
+	for _, l := range d.Layers {
+		if isTo[l.Digest] {
+			reaches[l.Digest] = true
+			continue
+		}
+		for _, dep := range append(append([]digest.Digest{}, l.RunDeps...), l.BuildDeps...) {
+			if reaches[dep] {
+				reaches[l.Digest] = true
+			}
+		}
+	}
+
+	var paths []DepPath
+	var visit func(l LayerDescription, path DepPath)
+	visit = func(l LayerDescription, path DepPath) {
+		if isTo[l.Digest] && len(path) > 0 {
+			paths = append(paths, append(append(DepPath{}, path...), PathStep{Layer: l}))
+			return
+		}
+		for _, dep := range d.directDeps(l) {
+			if !reaches[dep.Layer.Digest] {
+				continue
+			}
+			step := dep
+			step.Layer = l
+			visit(dep.Layer, append(path, step))
+		}
+	}
+	for _, l := range froms {
+		visit(l, nil)
+	}
+	return paths, nil
+}
+
+// Dependents returns every layer that depends on the layers matching name,
+// directly or transitively through run or build deps.
+func (d *Description) Dependents(name string) ([]LayerDescription, error) {
+	targets, err := d.match(name)
+	if err != nil {
+		return nil, err
+	}
+	dirty := make(map[digest.Digest]bool)
+	for _, l := range targets {
+		dirty[l.Digest] = true
+	}
+
+	var dependents []LayerDescription
+	for _, l := range d.Layers {
+		if dirty[l.Digest] {
+			continue
+		}
+		for _, dep := range append(append([]digest.Digest{}, l.RunDeps...), l.BuildDeps...) {
+			if dirty[dep] {
+				dirty[l.Digest] = true
+				dependents = append(dependents, l)
+				break
+			}
+		}
+	}
+	return dependents, nil
+}
+
+// directDeps returns the direct deps of l, each with its layer set to the
+// dep and how it's a dep of l.
+func (d *Description) directDeps(l LayerDescription) []PathStep {
+	var deps []PathStep
+	index := make(map[digest.Digest]int)
+	add := func(dgst digest.Digest, run bool) {
+		i, ok := index[dgst]
+		if !ok {
+			dep, ok := d.Layer(dgst)
+			if !ok {
+				return
+			}
+			i = len(deps)
+			index[dgst] = i
+			deps = append(deps, PathStep{Layer: dep})
+		}
+		if run {
+			deps[i].Run = true
+		} else {
+			deps[i].Build = true
+		}
+	}
+	for _, dep := range l.RunDeps {
+		add(dep, true)
+	}
+	for _, dep := range l.BuildDeps {
+		add(dep, false)
+	}
+	return deps
+}
+
+// match returns the layers with the given name, or else the layer whose
+// digest (or a prefix of its hex) is the given name.
+func (d *Description) match(name string) ([]LayerDescription, error) {
+	var matches []LayerDescription
+	for _, l := range d.Layers {
+		if l.Name == name {
+			matches = append(matches, l)
+		}
+	}
+	if len(matches) > 0 {
+		return matches, nil
+	}
+	for _, l := range d.Layers {
+		if string(l.Digest) == name || (name != "" && strings.HasPrefix(l.Digest.Hex(), name)) {
+			matches = append(matches, l)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no layer named %s", name)
+	case 1:
+		return matches, nil
+	default:
+		return nil, fmt.Errorf("ambiguous digest prefix %s", name)
+	}
+}
+
+// WriteLayers writes the label of each layer on its own line.
+func WriteLayers(w io.Writer, layers []LayerDescription) error {
+	for _, l := range layers {
+		if _, err := fmt.Fprintln(w, l.label()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package graph
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func pathNames(path DepPath) []string {
+	var names []string
+	for _, step := range path {
+		names = append(names, step.Layer.Name)
+	}
+	return names
+}
+
+func TestDepPaths(t *testing.T) {
+	g := Build(testSystem("make libc", true))
+
+	paths, err := g.DepPaths("vim", "libc")
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+
+	var sawRun, sawBuild bool
+	for _, path := range paths {
+		switch names := pathNames(path); len(names) {
+		case 2:
+			// libc is also a build dep of vim, but build deps are merged
+			// and reduced so it's only reached through perl there
+			require.Equal(t, []string{"vim", "libc"}, names)
+			require.True(t, path[0].Run)
+			require.False(t, path[0].Build)
+			sawRun = true
+		case 3:
+			require.Equal(t, []string{"vim", "perl", "libc"}, names)
+			require.False(t, path[0].Run)
+			require.True(t, path[0].Build)
+			require.True(t, path[1].Run)
+			sawBuild = true
+		default:
+			t.Fatalf("unexpected path %s", path)
+		}
+	}
+	require.True(t, sawRun)
+	require.True(t, sawBuild)
+
+	paths, err = g.DepPaths("libc", "vim")
+	require.NoError(t, err)
+	require.Empty(t, paths)
+
+	_, err = g.DepPaths("vim", "python")
+	require.Error(t, err)
+}
+
+func TestDependents(t *testing.T) {
+	g := Build(testSystem("make libc", true))
+
+	dependents, err := g.Dependents("libc")
+	require.NoError(t, err)
+	var names []string
+	for _, l := range dependents {
+		names = append(names, l.Name)
+	}
+	require.ElementsMatch(t, []string{"perl", "vim"}, names)
+
+	dependents, err = g.Dependents("vim")
+	require.NoError(t, err)
+	require.Empty(t, dependents)
+}
+
+// testDescription has a layer that's both a run and a build dep of another,
+// and two layers with the same name.
+func testDescription() *Description {
+	dgst := digest.FromString
+	return &Description{
+		Roots: []digest.Digest{dgst("app")},
+		Layers: []LayerDescription{
+			{Digest: dgst("libc"), Name: "libc"},
+			{Digest: dgst("src 1"), Name: "src"},
+			{Digest: dgst("src 2"), Name: "src"},
+			{Digest: dgst("lib"), Name: "lib", RunDeps: []digest.Digest{dgst("libc")}, BuildDeps: []digest.Digest{dgst("src 1")}},
+			{
+				Digest:    dgst("app"),
+				Name:      "app",
+				RunDeps:   []digest.Digest{dgst("lib")},
+				BuildDeps: []digest.Digest{dgst("lib"), dgst("src 2")},
+			},
+		},
+	}
+}
+
+func TestMatchLayers(t *testing.T) {
+	desc := testDescription()
+	for _, tc := range []struct {
+		name    string
+		digests []digest.Digest
+		err     bool
+	}{
+		{name: "lib", digests: []digest.Digest{digest.FromString("lib")}},
+		{name: "src", digests: []digest.Digest{digest.FromString("src 1"), digest.FromString("src 2")}},
+		{name: digest.FromString("libc").String(), digests: []digest.Digest{digest.FromString("libc")}},
+		{name: digest.FromString("libc").Hex()[:12], digests: []digest.Digest{digest.FromString("libc")}},
+		{name: "python", err: true},
+		{name: "", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			matches, err := desc.match(tc.name)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var digests []digest.Digest
+			for _, l := range matches {
+				digests = append(digests, l.Digest)
+			}
+			require.Equal(t, tc.digests, digests)
+		})
+	}
+
+	// a prefix matching several digests is ambiguous
+	ambiguous := &Description{Layers: []LayerDescription{
+		{Digest: digest.Digest("sha256:abc1")},
+		{Digest: digest.Digest("sha256:abc2")},
+	}}
+	_, err := ambiguous.match("abc")
+	require.Error(t, err)
+}
+
+func TestDepPathStrings(t *testing.T) {
+	desc := testDescription()
+	label := func(name string) string {
+		l, ok := desc.Layer(digest.FromString(name))
+		require.True(t, ok)
+		return l.label()
+	}
+	for _, tc := range []struct {
+		from, to string
+		paths    []string
+	}{{
+		from:  "app",
+		to:    "libc",
+		paths: []string{label("app") + " -(run,build)-> " + label("lib") + " -(run)-> " + label("libc")},
+	}, {
+		// every layer matching a name is a target
+		from: "app",
+		to:   "src",
+		paths: []string{
+			label("app") + " -(run,build)-> " + label("lib") + " -(build)-> " + label("src 1"),
+			label("app") + " -(build)-> " + label("src 2"),
+		},
+	}, {
+		from: "libc",
+		to:   "app",
+	}} {
+		t.Run(tc.from+" to "+tc.to, func(t *testing.T) {
+			paths, err := desc.DepPaths(tc.from, tc.to)
+			require.NoError(t, err)
+			var strs []string
+			for _, path := range paths {
+				strs = append(strs, path.String())
+			}
+			require.Equal(t, tc.paths, strs)
+		})
+	}
+}
+
+func TestWriteDependents(t *testing.T) {
+	desc := testDescription()
+	for _, tc := range []struct {
+		name       string
+		dependents []string
+	}{
+		{name: "libc", dependents: []string{"lib", "app"}},
+		{name: "src", dependents: []string{"lib", "app"}},
+		{name: digest.FromString("src 2").Hex()[:12], dependents: []string{"app"}},
+		{name: "app"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dependents, err := desc.Dependents(tc.name)
+			require.NoError(t, err)
+			var b, expected bytes.Buffer
+			require.NoError(t, WriteLayers(&b, dependents))
+			for _, name := range tc.dependents {
+				l, ok := desc.Layer(digest.FromString(name))
+				require.True(t, ok)
+				expected.WriteString(l.label() + "\n")
+			}
+			require.Equal(t, expected.String(), b.String())
+		})
+	}
+}
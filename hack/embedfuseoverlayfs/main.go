@@ -0,0 +1,43 @@
+// embedfuseoverlayfs generates the go file that embeds a fuse-overlayfs
+// binary in bincastle when it's built with the embed_fuseoverlayfs tag.
+//
+//	go run ./hack/embedfuseoverlayfs <fuse-overlayfs binary> <output go file>
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+const header = `// Code generated by hack/embedfuseoverlayfs. DO NOT EDIT.
+
+// +build embed_fuseoverlayfs
+
+package main
+
+func init() {
+	embeddedFuseOverlayfs = []byte(`
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "usage: %s <fuse-overlayfs binary> <output go file>\n", os.Args[0])
+		os.Exit(1)
+	}
+	bin, err := ioutil.ReadFile(os.Args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read fuse-overlayfs binary: %v\n", err)
+		os.Exit(1)
+	}
+
+	var out bytes.Buffer
+	out.WriteString(header)
+	out.WriteString(strconv.Quote(string(bin)))
+	out.WriteString(")\n}\n")
+	if err := ioutil.WriteFile(os.Args[2], out.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write %s: %v\n", os.Args[2], err)
+		os.Exit(1)
+	}
+}
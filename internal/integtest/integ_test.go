@@ -68,10 +68,10 @@ func getpty() (p cmdPty, err error) {
 	return cmdPty{parent: parent, child: child}, nil
 }
 
-func withHomeDir(path string) cmdOpt {
+func withStateRoot(path string) cmdOpt {
 	return cmdOptFunc(func(cmd *exec.Cmd) error {
 		cmd.Dir = path
-		cmd.Env = append(cmd.Env, "HOME="+path)
+		cmd.Env = append(cmd.Env, "BINCASTLE_ROOT="+path)
 		return nil
 	})
 }
@@ -146,12 +146,11 @@ func TestDirectoriesRemoved(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// TODO root dir should be configurable
 	testDir := filepath.Join(os.Getenv("HOME"), ".bincastle/test")
 	require.NoError(t, os.MkdirAll(testDir, 0700))
-	homeDir, err := ioutil.TempDir(testDir, "")
+	stateRoot, err := ioutil.TempDir(testDir, "")
 	require.NoError(t, err)
-	defer os.RemoveAll(homeDir)
+	defer os.RemoveAll(stateRoot)
 
 	pty, err := getpty()
 	require.NoError(t, err)
@@ -161,7 +160,7 @@ func TestDirectoriesRemoved(t *testing.T) {
 	require.NoError(t, err)
 	bcCmd, err := newBincastleCmd(ctx,
 		bincastleArgs("run", filepath.Join(cwd, "../.."), "internal/integtest/stubsystem"),
-		withHomeDir(homeDir),
+		withStateRoot(stateRoot),
 		pty,
 		withDebugStderr(os.Stdout),
 	)
@@ -203,12 +202,12 @@ func TestDirectoriesRemoved(t *testing.T) {
 		require.True(t, foundSentinel)
 	}
 
-	innerRuncRootDir := filepath.Join(homeDir,
-		".bincastle/var/lib/buildkitd/runc-overlayfs/execs/testctr/testctr")
+	innerRuncRootDir := filepath.Join(stateRoot,
+		"var/lib/buildkitd/runc-overlayfs/execs/testctr/testctr")
 	_, err = os.Stat(innerRuncRootDir)
 	require.NoError(t, err)
 
-	outerRuncRootDir := filepath.Join(homeDir, ".bincastle/ctrs/system/system")
+	outerRuncRootDir := filepath.Join(stateRoot, "ctrs/system/system")
 	_, err = os.Stat(outerRuncRootDir)
 	require.NoError(t, err)
 